@@ -0,0 +1,514 @@
+package main
+
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "sort"
+import "strconv"
+import "strings"
+import "time"
+
+import "defs"
+import "fs"
+import "stat"
+import "ufs"
+import "ustr"
+
+// biscuit-img inspects and modifies the file system in a disk image that
+// mkfs made, without booting biscuit.
+
+// the results of commands go to out; the file system's messages go to stderr
+var out = os.Stdout
+
+// the path of the image
+var image string
+
+type cmd_t struct {
+	name  string
+	args  string
+	nargs int
+	f     func(*ufs.Ufs_t, []string) bool
+}
+
+var cmds = []cmd_t{
+	{"ls", "[path]", 0, ls},
+	{"cat", "<path>", 1, cat},
+	{"stat", "<path>", 1, dostat},
+	{"mkdir", "<path>", 1, mkdir},
+	{"rm", "[-r] <path>", 1, rm},
+	{"cp-in", "<host path> <path>", 2, cpin},
+	{"cp-out", "<path> <host path>", 2, cpout},
+	{"du", "[path]", 0, du},
+	{"df", "", 0, df},
+	{"grow", "<size>[K|M|G]", 1, grow},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: biscuit-img <command> <image> [args]\n")
+	for _, c := range cmds {
+		fmt.Fprintf(os.Stderr, "  %-7v <image> %v\n", c.name, c.args)
+	}
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 3 {
+		usage()
+	}
+	name, args := os.Args[1], os.Args[3:]
+	image = os.Args[2]
+	os.Stdout = os.Stderr
+	for _, c := range cmds {
+		if c.name != name {
+			continue
+		}
+		if len(args) < c.nargs {
+			usage()
+		}
+		if _, err := os.Stat(image); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		tfs := ufs.BootFS(image)
+		ok := c.f(tfs, args)
+		ufs.ShutdownFS(tfs)
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+	usage()
+}
+
+func fail(p string, err defs.Err_t) bool {
+	fmt.Fprintf(os.Stderr, "%v: error %v\n", p, err)
+	return false
+}
+
+func itype(st *stat.Stat_t) int {
+	switch t := int(st.Mode() >> 16); t {
+	case fs.I_FILE, fs.I_DIR, fs.I_SYMLINK:
+		return t
+	}
+	return fs.I_DEV
+}
+
+func perm(st *stat.Stat_t) uint {
+	return st.Mode() & 0777
+}
+
+var typechars = map[int]string{fs.I_FILE: "-", fs.I_DIR: "d", fs.I_SYMLINK: "l",
+	fs.I_DEV: "c"}
+
+// the names in directory p, sorted, and their types from the directory
+// entries
+func readdir(tfs *ufs.Ufs_t, p string) ([]ufs.Dirent_t, defs.Err_t) {
+	f, err := tfs.Opendir(ustr.Ustr(p))
+	if err != 0 {
+		return nil, err
+	}
+	defer f.Fops.Close()
+	var res []ufs.Dirent_t
+	for {
+		des, err := tfs.Getdents(f, fs.BSIZE)
+		if err != 0 {
+			return nil, err
+		}
+		if len(des) == 0 {
+			break
+		}
+		for _, de := range des {
+			if de.Name != "." && de.Name != ".." {
+				res = append(res, de)
+			}
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res, 0
+}
+
+func join(dir, name string) string {
+	return strings.TrimSuffix(dir, "/") + "/" + name
+}
+
+func arg(args []string, i int, def string) string {
+	if i < len(args) {
+		return args[i]
+	}
+	return def
+}
+
+func ls(tfs *ufs.Ufs_t, args []string) bool {
+	p := arg(args, 0, "/")
+	st, err := tfs.Stat(ustr.Ustr(p))
+	if err != 0 {
+		return fail(p, err)
+	}
+	if itype(st) != fs.I_DIR {
+		lsone(p, st)
+		return true
+	}
+	des, err := readdir(tfs, p)
+	if err != 0 {
+		return fail(p, err)
+	}
+	ok := true
+	for _, de := range des {
+		c := join(p, de.Name)
+		if de.Type == defs.DT_LNK {
+			target, err := tfs.Readlink(ustr.Ustr(c))
+			if err != 0 {
+				ok = fail(c, err)
+				continue
+			}
+			fmt.Fprintf(out, "l %4v %5v %8v %v -> %v\n", "", "",
+				len(target), de.Name, target)
+			continue
+		}
+		st, err := tfs.Stat(ustr.Ustr(c))
+		if err != 0 {
+			ok = fail(c, err)
+			continue
+		}
+		lsone(de.Name, st)
+	}
+	return ok
+}
+
+func lsone(name string, st *stat.Stat_t) {
+	fmt.Fprintf(out, "%v %04o %5v %8v %v\n", typechars[itype(st)], perm(st),
+		st.Uid(), st.Size(), name)
+}
+
+func cat(tfs *ufs.Ufs_t, args []string) bool {
+	d, err := tfs.Read(ustr.Ustr(args[0]))
+	if err != 0 {
+		return fail(args[0], err)
+	}
+	out.Write(d)
+	return true
+}
+
+func dostat(tfs *ufs.Ufs_t, args []string) bool {
+	p := args[0]
+	st, err := tfs.Stat(ustr.Ustr(p))
+	if err != 0 {
+		return fail(p, err)
+	}
+	types := map[int]string{fs.I_FILE: "file", fs.I_DIR: "directory",
+		fs.I_SYMLINK: "symlink", fs.I_DEV: "device"}
+	fmt.Fprintf(out, "  File: %v\n", p)
+	fmt.Fprintf(out, "  Type: %v\n", types[itype(st)])
+	fmt.Fprintf(out, " Inode: %v\n", st.Rino())
+	fmt.Fprintf(out, "  Size: %v\n", st.Size())
+	fmt.Fprintf(out, "  Mode: %04o\n", perm(st))
+	fmt.Fprintf(out, "   Uid: %v\n", st.Uid())
+	if itype(st) == fs.I_DEV {
+		maj, min := defs.Unmkdev(st.Mode())
+		fmt.Fprintf(out, "Device: %v, %v\n", maj, min)
+	}
+	mt := time.Unix(0, int64(st.Mtime()))
+	fmt.Fprintf(out, "Modify: %v\n", mt.Format(time.RFC3339Nano))
+	return true
+}
+
+func mkdir(tfs *ufs.Ufs_t, args []string) bool {
+	if err := tfs.MkDir(ustr.Ustr(args[0])); err != 0 {
+		return fail(args[0], err)
+	}
+	return true
+}
+
+func rm(tfs *ufs.Ufs_t, args []string) bool {
+	if args[0] == "-r" {
+		if len(args) < 2 {
+			fmt.Fprintf(os.Stderr, "rm: missing path\n")
+			return false
+		}
+		return rmtree(tfs, args[1])
+	}
+	p := args[0]
+	st, err := tfs.Stat(ustr.Ustr(p))
+	if err == 0 && itype(st) == fs.I_DIR {
+		err = tfs.UnlinkDir(ustr.Ustr(p))
+	} else {
+		err = tfs.Unlink(ustr.Ustr(p))
+	}
+	if err != 0 {
+		return fail(p, err)
+	}
+	return true
+}
+
+func rmtree(tfs *ufs.Ufs_t, p string) bool {
+	// don't follow symlinks
+	if _, err := tfs.Readlink(ustr.Ustr(p)); err == 0 {
+		if err := tfs.Unlink(ustr.Ustr(p)); err != 0 {
+			return fail(p, err)
+		}
+		return true
+	}
+	des, err := readdir(tfs, p)
+	if err == -defs.ENOTDIR {
+		if err := tfs.Unlink(ustr.Ustr(p)); err != 0 {
+			return fail(p, err)
+		}
+		return true
+	}
+	if err != 0 {
+		return fail(p, err)
+	}
+	for _, de := range des {
+		c := join(p, de.Name)
+		if de.Type == defs.DT_DIR {
+			if !rmtree(tfs, c) {
+				return false
+			}
+		} else if err := tfs.Unlink(ustr.Ustr(c)); err != 0 {
+			return fail(c, err)
+		}
+	}
+	if err := tfs.UnlinkDir(ustr.Ustr(p)); err != 0 {
+		return fail(p, err)
+	}
+	return true
+}
+
+// copies the host file or directory tree src to dst in the image
+func cpin(tfs *ufs.Ufs_t, args []string) bool {
+	src, dst := args[0], args[1]
+	info, err := os.Lstat(src)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return false
+	}
+	// copying into an existing directory puts src in it
+	if st, err := tfs.Stat(ustr.Ustr(dst)); err == 0 && itype(st) == fs.I_DIR {
+		dst = join(dst, filepath.Base(src))
+	}
+	if !info.IsDir() {
+		return cpfilein(tfs, src, dst, info)
+	}
+	ok := true
+	err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, path)
+		d := dst
+		if rel != "." {
+			d = join(dst, filepath.ToSlash(rel))
+		}
+		if info.IsDir() {
+			e := tfs.MkDir(ustr.Ustr(d))
+			if e != 0 && e != -defs.EEXIST {
+				ok = fail(d, e)
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		ok = cpfilein(tfs, path, d, info) && ok
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return false
+	}
+	return ok
+}
+
+func cpfilein(tfs *ufs.Ufs_t, src, dst string, info os.FileInfo) bool {
+	p := ustr.Ustr(dst)
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(src)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return false
+		}
+		if e := tfs.Symlink(ustr.Ustr(target), p); e != 0 {
+			return fail(dst, e)
+		}
+		return true
+	}
+	if !info.Mode().IsRegular() {
+		fmt.Fprintf(os.Stderr, "%v: not a regular file; skipped\n", src)
+		return true
+	}
+	d, err := ioutil.ReadFile(src)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return false
+	}
+	if e := tfs.MkFile(p, nil); e != 0 {
+		return fail(dst, e)
+	}
+	// replace the contents of an existing file
+	if e := tfs.Truncate(p, 0); e != 0 {
+		return fail(dst, e)
+	}
+	for len(d) > 0 {
+		n := len(d)
+		if n > fs.BSIZE {
+			n = fs.BSIZE
+		}
+		if e := tfs.Append(p, ufs.MkBuf(d[:n])); e != 0 {
+			return fail(dst, e)
+		}
+		d = d[n:]
+	}
+	if e := tfs.Chmod(p, int(info.Mode().Perm())); e != 0 {
+		return fail(dst, e)
+	}
+	mtime := int(info.ModTime().UnixNano())
+	if e := tfs.Utimens(p, mtime, mtime); e != 0 {
+		return fail(dst, e)
+	}
+	return true
+}
+
+// copies the file or directory tree src in the image to dst on the host
+func cpout(tfs *ufs.Ufs_t, args []string) bool {
+	src, dst := args[0], args[1]
+	if info, err := os.Stat(dst); err == nil && info.IsDir() {
+		dst = filepath.Join(dst, filepath.Base(src))
+	}
+	return cpoutpath(tfs, src, dst)
+}
+
+func cpoutpath(tfs *ufs.Ufs_t, src, dst string) bool {
+	if target, err := tfs.Readlink(ustr.Ustr(src)); err == 0 {
+		if err := os.Symlink(target.String(), dst); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return false
+		}
+		return true
+	}
+	st, err := tfs.Stat(ustr.Ustr(src))
+	if err != 0 {
+		return fail(src, err)
+	}
+	mode := os.FileMode(perm(st))
+	switch itype(st) {
+	case fs.I_DIR:
+		if err := os.MkdirAll(dst, 0755); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return false
+		}
+		des, err := readdir(tfs, src)
+		if err != 0 {
+			return fail(src, err)
+		}
+		ok := true
+		for _, de := range des {
+			ok = cpoutpath(tfs, join(src, de.Name),
+				filepath.Join(dst, de.Name)) && ok
+		}
+		os.Chmod(dst, mode)
+		return ok
+	case fs.I_FILE:
+		d, err := tfs.Read(ustr.Ustr(src))
+		if err != 0 {
+			return fail(src, err)
+		}
+		if err := ioutil.WriteFile(dst, d, mode); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return false
+		}
+		mt := time.Unix(0, int64(st.Mtime()))
+		os.Chtimes(dst, mt, mt)
+		return true
+	default:
+		fmt.Fprintf(os.Stderr, "%v: device; skipped\n", src)
+		return true
+	}
+}
+
+// prints the number of blocks of the files in the tree at p, counting a
+// file's size rounded up to blocks
+func du(tfs *ufs.Ufs_t, args []string) bool {
+	p := arg(args, 0, "/")
+	n, ok := dutree(tfs, p)
+	fmt.Fprintf(out, "%v\t%v\n", n*fs.BSIZE/1024, p)
+	return ok
+}
+
+func dutree(tfs *ufs.Ufs_t, p string) (int, bool) {
+	st, err := tfs.Stat(ustr.Ustr(p))
+	if err != 0 {
+		return 0, fail(p, err)
+	}
+	n := (int(st.Size()) + fs.BSIZE - 1) / fs.BSIZE
+	if itype(st) != fs.I_DIR {
+		return n, true
+	}
+	des, err := readdir(tfs, p)
+	if err != 0 {
+		return n, fail(p, err)
+	}
+	ok := true
+	for _, de := range des {
+		if de.Type == defs.DT_LNK {
+			continue
+		}
+		m, ok1 := dutree(tfs, join(p, de.Name))
+		n += m
+		ok = ok && ok1
+	}
+	return n, ok
+}
+
+// prints the inodes and data blocks in use and free, which the allocation
+// bitmaps record
+func df(tfs *ufs.Ufs_t, args []string) bool {
+	ni, nifree, nb, nbfree := tfs.Df()
+	fmt.Fprintf(out, "%-7v %10v %10v %10v %5v\n", "", "total", "used", "free", "use%")
+	pr := func(what string, n, free int) {
+		pct := 0
+		if n != 0 {
+			pct = (100*(n-free) + n - 1) / n
+		}
+		fmt.Fprintf(out, "%-7v %10v %10v %10v %4v%%\n", what, n, n-free, free, pct)
+	}
+	pr("inodes", ni, nifree)
+	pr("blocks", nb, nbfree)
+	return true
+}
+
+// enlarges the image to size bytes, or KB, MB or GB with a suffix, and grows
+// the file system onto the new blocks
+func grow(tfs *ufs.Ufs_t, args []string) bool {
+	n := args[0]
+	mult := int64(1)
+	switch n[len(n)-1] {
+	case 'K':
+		mult = 1 << 10
+	case 'M':
+		mult = 1 << 20
+	case 'G':
+		mult = 1 << 30
+	}
+	if mult != 1 {
+		n = n[:len(n)-1]
+	}
+	size, err := strconv.ParseInt(n, 10, 64)
+	if err != nil || size <= 0 {
+		fmt.Fprintf(os.Stderr, "%v: bad size\n", args[0])
+		return false
+	}
+	size = size * mult / fs.BSIZE * fs.BSIZE
+	info, err := os.Stat(image)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return false
+	}
+	if size <= info.Size() {
+		fmt.Fprintf(os.Stderr, "%v: image is %v bytes already\n", image, info.Size())
+		return false
+	}
+	if err := tfs.Resize(int(size / fs.BSIZE)); err != 0 {
+		os.Truncate(image, info.Size())
+		return fail(image, err)
+	}
+	return df(tfs, nil)
+}
@@ -13,6 +13,7 @@ import "bounds"
 import "circbuf"
 import "defs"
 import "fdops"
+import "flock"
 import "limits"
 import "mem"
 import "proc"
@@ -3005,6 +3006,18 @@ func (tf *Tcpfops_t) Truncate(newlen uint) defs.Err_t {
 	return -defs.EINVAL
 }
 
+func (tf *Tcpfops_t) Fallocate(int, int, int) defs.Err_t {
+	return -defs.ENODEV
+}
+
+func (tf *Tcpfops_t) Fsync(bool) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (tf *Tcpfops_t) Locks() (*flock.Locks_t, defs.Err_t) {
+	return nil, -defs.EINVAL
+}
+
 func (tf *Tcpfops_t) Pread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
 	return 0, -defs.ESPIPE
 }
@@ -3013,6 +3026,10 @@ func (tf *Tcpfops_t) Pwrite(src fdops.Userio_i, offset int) (int, defs.Err_t) {
 	return 0, -defs.ESPIPE
 }
 
+func (tf *Tcpfops_t) Getdents(fdops.Userio_i) (int, defs.Err_t) {
+	return 0, -defs.ENOTDIR
+}
+
 func (tf *Tcpfops_t) Accept(fdops.Userio_i) (fdops.Fdops_i, int, defs.Err_t) {
 	panic("no imp")
 }
@@ -3339,8 +3356,10 @@ func (tl *tcplfops_t) Close() defs.Err_t {
 	return 0
 }
 
-func (tl *tcplfops_t) Fstat(*stat.Stat_t) defs.Err_t {
-	panic("no imp")
+func (tl *tcplfops_t) Fstat(st *stat.Stat_t) defs.Err_t {
+	sockmode := defs.Mkdev(2, 0)
+	st.Wmode(sockmode)
+	return 0
 }
 
 func (tl *tcplfops_t) Lseek(int, int) (int, defs.Err_t) {
@@ -3374,6 +3393,18 @@ func (tl *tcplfops_t) Truncate(newlen uint) defs.Err_t {
 	return -defs.EINVAL
 }
 
+func (tl *tcplfops_t) Fallocate(int, int, int) defs.Err_t {
+	return -defs.ENODEV
+}
+
+func (tl *tcplfops_t) Fsync(bool) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (tl *tcplfops_t) Locks() (*flock.Locks_t, defs.Err_t) {
+	return nil, -defs.EINVAL
+}
+
 func (tl *tcplfops_t) Pread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
 	return 0, -defs.ESPIPE
 }
@@ -3382,6 +3413,10 @@ func (tl *tcplfops_t) Pwrite(src fdops.Userio_i, offset int) (int, defs.Err_t) {
 	return 0, -defs.ESPIPE
 }
 
+func (tl *tcplfops_t) Getdents(fdops.Userio_i) (int, defs.Err_t) {
+	return 0, -defs.ENOTDIR
+}
+
 func (tl *tcplfops_t) Accept(saddr fdops.Userio_i) (fdops.Fdops_i,
 	int, defs.Err_t) {
 	tl.tcl.l.Lock()
@@ -6,11 +6,14 @@ import "ustr"
 type Pathparts_t struct {
 	path ustr.Ustr
 	loc  int
+	// offset of the component last returned by Next
+	cur int
 }
 
 func (pp *Pathparts_t) Pp_init(path ustr.Ustr) {
 	pp.path = path
 	pp.loc = 0
+	pp.cur = 0
 }
 
 func (pp *Pathparts_t) Next() (ustr.Ustr, bool) {
@@ -19,6 +22,7 @@ func (pp *Pathparts_t) Next() (ustr.Ustr, bool) {
 		if pp.loc == len(pp.path) {
 			return ustr.MkUstr(), false
 		}
+		pp.cur = pp.loc
 		ret = pp.path[pp.loc:]
 		nloc := ustr.Ustr.IndexByte(ret, '/')
 		if nloc != -1 {
@@ -31,6 +35,16 @@ func (pp *Pathparts_t) Next() (ustr.Ustr, bool) {
 	return ret, true
 }
 
+// returns the path preceding the component last returned by Next and the path
+// following it.
+func (pp *Pathparts_t) Split() (ustr.Ustr, ustr.Ustr) {
+	end := pp.cur
+	for end < len(pp.path) && pp.path[end] != '/' {
+		end++
+	}
+	return pp.path[:pp.cur], pp.path[end:]
+}
+
 func Sdirname(path ustr.Ustr) (ustr.Ustr, ustr.Ustr) {
 	fn := path
 	l := len(fn)
@@ -0,0 +1,472 @@
+// Package crash checks that ufs recovers from crashes, in the style of
+// CrashMonkey and ALICE. Explore runs a workload on a fresh image while
+// tracing the blocks written to the disk and the flushes of the disk's write
+// cache. Writes between two flushes form an epoch: a crash may persist any
+// subset of an epoch's writes, in any order, on top of all earlier epochs.
+// Explore enumerates these crash states, boots each one, and checks it with
+// fsck and the workload's checker. A failing state is minimized to the fewest
+// in-flight writes that still fail and can be saved as an image.
+package crash
+
+import "bytes"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "sort"
+import "sync"
+
+import "fs"
+import "ufs"
+
+// Workload_t describes a crash test. Setup's writes are durable before the
+// trace starts; Run is traced. Check is called on the file system recovered
+// from each crash state and returns a description of what is wrong, if
+// anything. Every state must also pass fsck, so a nil Check still checks that
+// the file system is consistent. Feat holds the superblock feature flags of
+// the image, such as fs.FEAT_JOURNAL.
+type Workload_t struct {
+	Name       string
+	Nlogblks   int
+	Ninodeblks int
+	Ndatablks  int
+	Feat       int
+	Setup      func(*ufs.Ufs_t)
+	Run        func(*ufs.Ufs_t) (string, bool)
+	Check      func(*ufs.Ufs_t) (string, bool)
+}
+
+type Opts_t struct {
+	// the maximum number of crash states checked per epoch, or 0 for no
+	// limit. an epoch with more states is explored partially: states
+	// that persist few or almost all of the epoch's writes first.
+	Maxstates int
+	// stop after this many failing states
+	Maxfail int
+	// the number of states checked concurrently
+	Nproc int
+	// save an image of each minimized failing state in this directory,
+	// unless it is empty
+	Dir string
+}
+
+var Defopts = Opts_t{Maxstates: 1000, Maxfail: 1, Nproc: 4}
+
+type Failure_t struct {
+	// the epoch the crash happened in and the blocks written in that
+	// epoch which reached the disk, in the minimized state
+	Epoch  int
+	Blocks []int
+	Msg    string
+	// the saved image of the minimized state, if any
+	Image string
+}
+
+func (f *Failure_t) String() string {
+	s := fmt.Sprintf("epoch %v blocks %v: %v", f.Epoch, f.Blocks, f.Msg)
+	if f.Image != "" {
+		s += " (" + f.Image + ")"
+	}
+	return s
+}
+
+type Result_t struct {
+	Nwrites int
+	Nepochs int
+	// crash states checked, states skipped because they are the same as
+	// another state, and epochs explored partially
+	Nstates int
+	Npruned int
+	Ntrunc  int
+	// the failures, ordered by epoch
+	Failures []*Failure_t
+}
+
+// a crash state: all writes of the epochs before epoch plus the blocks of
+// epoch in blks
+type state_t struct {
+	epoch  int
+	prefix map[int][]byte
+	blks   map[int][]byte
+}
+
+type explorer_t struct {
+	w    *Workload_t
+	o    Opts_t
+	dir  string
+	base string
+	res  *Result_t
+	// the size of the disk after the workload, which may have grown it
+	size int64
+
+	sync.Mutex
+	nimg  int
+	fails []*state_t
+	msgs  []string
+}
+
+// Explore runs the workload w and checks the states a crash during w may leave
+// the disk in.
+func Explore(w *Workload_t, o Opts_t) *Result_t {
+	dir, err := ioutil.TempDir("", "crash")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	if o.Nproc < 1 {
+		o.Nproc = 1
+	}
+	x := &explorer_t{w: w, o: o, dir: dir, res: &Result_t{}}
+	x.base = filepath.Join(dir, "base.img")
+	trace := x.record()
+	epochs := split(trace)
+	x.res.Nepochs = len(epochs)
+	x.explore(epochs)
+	x.minimize()
+	return x.res
+}
+
+// runs the workload on a new image and returns the writes of w.Run. the image
+// as it was before w.Run is left in x.base.
+func (x *explorer_t) record() []ufs.Record_t {
+	ufs.MkDiskFeatures(x.base, nil, x.w.Nlogblks, x.w.Ninodeblks,
+		x.w.Ndatablks, x.w.Feat)
+	tfs := ufs.BootFS(x.base)
+	if x.w.Setup != nil {
+		x.w.Setup(tfs)
+	}
+	ufs.ShutdownFS(tfs)
+	// install the log
+	ufs.ShutdownFS(ufs.BootFS(x.base))
+
+	img := filepath.Join(x.dir, "run.img")
+	copyfile(x.base, img)
+	p := filepath.Join(x.dir, "trace.json")
+	tfs = ufs.BootFS(img)
+	tfs.StartTrace(p)
+	if s, ok := x.w.Run(tfs); !ok {
+		panic("crash: workload failed: " + s)
+	}
+	ufs.ShutdownFS(tfs)
+	fi, err := os.Stat(img)
+	if err != nil {
+		panic(err)
+	}
+	x.size = fi.Size()
+	os.Remove(img)
+	trace := ufs.ReadTrace(p)
+	os.Remove(p)
+	return trace
+}
+
+// splits the trace into epochs; the writes after the last flush are an epoch
+// too.
+func split(trace []ufs.Record_t) [][]ufs.Record_t {
+	var epochs [][]ufs.Record_t
+	var cur []ufs.Record_t
+	for _, r := range trace {
+		if r.Cmd == "sync" {
+			if len(cur) != 0 {
+				epochs = append(epochs, cur)
+			}
+			cur = nil
+			continue
+		}
+		cur = append(cur, r)
+	}
+	if len(cur) != 0 {
+		epochs = append(epochs, cur)
+	}
+	return epochs
+}
+
+// the distinct contents of each block written in epoch, leaving out contents
+// the block already has in prefix. the blocks are in order of their first
+// write.
+func versions(epoch []ufs.Record_t, prefix map[int][]byte, base *os.File) ([]int, map[int][][]byte, int) {
+	var blks []int
+	vers := make(map[int][][]byte)
+	pruned := 0
+	for _, r := range epoch {
+		old, ok := prefix[r.BlkNo]
+		if !ok {
+			old = readblk(base, r.BlkNo)
+		}
+		dup := bytes.Equal(old, r.BlkData)
+		for _, v := range vers[r.BlkNo] {
+			dup = dup || bytes.Equal(v, r.BlkData)
+		}
+		if dup {
+			pruned++
+			continue
+		}
+		if _, ok := vers[r.BlkNo]; !ok {
+			blks = append(blks, r.BlkNo)
+		}
+		vers[r.BlkNo] = append(vers[r.BlkNo], r.BlkData)
+	}
+	return blks, vers, pruned
+}
+
+func (x *explorer_t) explore(epochs [][]ufs.Record_t) {
+	base, err := os.Open(x.base)
+	if err != nil {
+		panic(err)
+	}
+	defer base.Close()
+
+	states := make(chan *state_t)
+	var wg sync.WaitGroup
+	for i := 0; i < x.o.Nproc; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for st := range states {
+				x.checkstate(st)
+			}
+		}()
+	}
+
+	prefix := make(map[int][]byte)
+	full := false
+	for e, epoch := range epochs {
+		x.res.Nwrites += len(epoch)
+		blks, vers, pruned := versions(epoch, prefix, base)
+		x.res.Npruned += pruned
+		n := 0
+		emit := func(chosen map[int][]byte) bool {
+			if n == x.o.Maxstates && n > 0 || x.failed() {
+				return false
+			}
+			// the state that persists nothing of this epoch is
+			// the complete previous epoch, which was checked
+			if len(chosen) == 0 && full {
+				x.res.Npruned++
+				return true
+			}
+			n++
+			x.res.Nstates++
+			states <- &state_t{epoch: e, prefix: prefix, blks: chosen}
+			return true
+		}
+		full = enumerate(blks, vers, emit)
+		if !full {
+			x.res.Ntrunc++
+		}
+		if x.failed() {
+			break
+		}
+		// the next epoch starts with all of this one on the disk
+		next := make(map[int][]byte, len(prefix))
+		for b, d := range prefix {
+			next[b] = d
+		}
+		for _, r := range epoch {
+			next[r.BlkNo] = r.BlkData
+		}
+		prefix = next
+	}
+	close(states)
+	wg.Wait()
+}
+
+// calls emit with each choice of blocks and their contents, persisting k
+// blocks for k = 0, n, 1, n-1, ..., so that the states which persist few or
+// almost all writes come first. returns false if emit stopped the
+// enumeration.
+func enumerate(blks []int, vers map[int][][]byte, emit func(map[int][]byte) bool) bool {
+	n := len(blks)
+	var ks []int
+	for lo, hi := 0, n; lo <= hi; lo, hi = lo+1, hi-1 {
+		ks = append(ks, lo)
+		if hi != lo {
+			ks = append(ks, hi)
+		}
+	}
+	for _, k := range ks {
+		if !choose(blks, k, nil, vers, emit) {
+			return false
+		}
+	}
+	return true
+}
+
+// emits the states that persist k of blks in addition to the blocks chosen
+func choose(blks []int, k int, chosen []int, vers map[int][][]byte, emit func(map[int][]byte) bool) bool {
+	if k == 0 {
+		return assign(chosen, 0, make(map[int][]byte), vers, emit)
+	}
+	for i := 0; i+k <= len(blks); i++ {
+		if !choose(blks[i+1:], k-1, append(chosen, blks[i]), vers, emit) {
+			return false
+		}
+	}
+	return true
+}
+
+// emits the states with each content of the chosen blocks from i on
+func assign(chosen []int, i int, st map[int][]byte, vers map[int][][]byte, emit func(map[int][]byte) bool) bool {
+	if i == len(chosen) {
+		c := make(map[int][]byte, len(st))
+		for b, d := range st {
+			c[b] = d
+		}
+		return emit(c)
+	}
+	b := chosen[i]
+	for _, d := range vers[b] {
+		st[b] = d
+		if !assign(chosen, i+1, st, vers, emit) {
+			return false
+		}
+	}
+	delete(st, b)
+	return true
+}
+
+func (x *explorer_t) failed() bool {
+	x.Lock()
+	defer x.Unlock()
+	return x.o.Maxfail > 0 && len(x.fails) >= x.o.Maxfail
+}
+
+func (x *explorer_t) checkstate(st *state_t) {
+	if x.failed() {
+		return
+	}
+	img := x.mkimage(st, "")
+	s, ok := x.check(img)
+	os.Remove(img)
+	if ok {
+		return
+	}
+	x.Lock()
+	defer x.Unlock()
+	if x.o.Maxfail <= 0 || len(x.fails) < x.o.Maxfail {
+		x.fails = append(x.fails, st)
+		x.msgs = append(x.msgs, s)
+	}
+}
+
+// writes the image of st to p or, if p is empty, to a new file in x.dir
+func (x *explorer_t) mkimage(st *state_t, p string) string {
+	if p == "" {
+		x.Lock()
+		x.nimg++
+		p = filepath.Join(x.dir, fmt.Sprintf("s%d.img", x.nimg))
+		x.Unlock()
+	}
+	copyfile(x.base, p)
+	f, err := os.OpenFile(p, os.O_RDWR, 0644)
+	if err != nil {
+		panic(err)
+	}
+	for _, m := range []map[int][]byte{st.prefix, st.blks} {
+		for b, d := range m {
+			if _, err := f.WriteAt(d, int64(b*fs.BSIZE)); err != nil {
+				panic(err)
+			}
+		}
+	}
+	if err := f.Truncate(x.size); err != nil {
+		panic(err)
+	}
+	if err := f.Close(); err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// boots img, which recovers the file system, and checks it. a panic while
+// recovering or checking fails the state too.
+func (x *explorer_t) check(img string) (s string, ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			s, ok = fmt.Sprintf("panic: %v", r), false
+		}
+	}()
+	tfs := ufs.BootFS(img)
+	s, ok = "", true
+	if x.w.Check != nil {
+		s, ok = x.w.Check(tfs)
+	}
+	ufs.ShutdownFS(tfs)
+	if !ok {
+		return s, ok
+	}
+	r := ufs.Fsck(img, false)
+	if r.Logdirty {
+		return "fsck: log not installed", false
+	}
+	if len(r.Problems) != 0 {
+		return "fsck: " + r.Problems[0], false
+	}
+	return "", true
+}
+
+// shrinks each failing state to a minimal set of in-flight blocks which still
+// fails, by leaving out one block at a time.
+func (x *explorer_t) minimize() {
+	for i, st := range x.fails {
+		msg := x.msgs[i]
+		blks := make([]int, 0, len(st.blks))
+		for b := range st.blks {
+			blks = append(blks, b)
+		}
+		sort.Ints(blks)
+		for _, b := range blks {
+			d := st.blks[b]
+			delete(st.blks, b)
+			img := x.mkimage(st, "")
+			s, ok := x.check(img)
+			os.Remove(img)
+			if ok {
+				st.blks[b] = d
+			} else {
+				msg = s
+			}
+		}
+		f := &Failure_t{Epoch: st.epoch, Msg: msg}
+		for b := range st.blks {
+			f.Blocks = append(f.Blocks, b)
+		}
+		sort.Ints(f.Blocks)
+		if x.o.Dir != "" {
+			f.Image = filepath.Join(x.o.Dir,
+				fmt.Sprintf("%s-%d.img", x.w.Name, i))
+			x.mkimage(st, f.Image)
+		}
+		x.res.Failures = append(x.res.Failures, f)
+	}
+	sort.Slice(x.res.Failures, func(i, j int) bool {
+		return x.res.Failures[i].Epoch < x.res.Failures[j].Epoch
+	})
+}
+
+// blocks past the end of f, which a grown file system may use, read as zeros
+func readblk(f *os.File, b int) []byte {
+	d := make([]byte, fs.BSIZE)
+	if _, err := f.ReadAt(d, int64(b*fs.BSIZE)); err != nil && err != io.EOF {
+		panic(err)
+	}
+	return d
+}
+
+func copyfile(src, dst string) {
+	in, err := os.Open(src)
+	if err != nil {
+		panic(err)
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		panic(err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		panic(err)
+	}
+	if err := out.Close(); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,279 @@
+package crash
+
+import "fmt"
+import "io/ioutil"
+import "os"
+import "testing"
+
+import "fs"
+import "ufs"
+import "ustr"
+import "vm"
+
+func mkData(v uint8, n int) *vm.Fakeubuf_t {
+	hdata := make([]uint8, n)
+	for i := range hdata {
+		hdata[i] = v
+	}
+	ub := &vm.Fakeubuf_t{}
+	ub.Fake_init(hdata)
+	return ub
+}
+
+// replacing f by renaming a new file over it is atomic: f has either the old
+// or the new contents
+var rename = &Workload_t{
+	Name:       "rename",
+	Nlogblks:   32,
+	Ninodeblks: 1,
+	Ndatablks:  20,
+	Setup: func(tfs *ufs.Ufs_t) {
+		if e := tfs.MkFile(ustr.Ustr("f"), mkData(1, 2*fs.BSIZE)); e != 0 {
+			panic("mkFile failed")
+		}
+	},
+	Run: func(tfs *ufs.Ufs_t) (string, bool) {
+		if e := tfs.MkFile(ustr.Ustr("tmp"), mkData(2, 2*fs.BSIZE)); e != 0 {
+			return "mkFile failed", false
+		}
+		tfs.Sync()
+		if e := tfs.Rename(ustr.Ustr("tmp"), ustr.Ustr("f")); e != 0 {
+			return "rename failed", false
+		}
+		tfs.Sync()
+		return "", true
+	},
+	Check: func(tfs *ufs.Ufs_t) (string, bool) {
+		d, e := tfs.Read(ustr.Ustr("f"))
+		if e != 0 || len(d) != 2*fs.BSIZE {
+			return fmt.Sprintf("read f: %v %v", len(d), e), false
+		}
+		for i := range d {
+			if d[i] != d[0] {
+				return fmt.Sprintf("mixed data in f %v %v", d[0], d[i]), false
+			}
+		}
+		return "", true
+	},
+}
+
+func TestRename(t *testing.T) {
+	r := Explore(rename, Defopts)
+	if r.Nepochs == 0 || r.Nstates == 0 {
+		t.Fatalf("nothing explored %+v", r)
+	}
+	for _, f := range r.Failures {
+		t.Errorf("%v", f)
+	}
+	fmt.Printf("rename: %v writes %v epochs %v states %v pruned %v truncated\n",
+		r.Nwrites, r.Nepochs, r.Nstates, r.Npruned, r.Ntrunc)
+}
+
+// growing the file system is atomic: it has either its old size or the new
+// one, and keeps f either way
+var resize = &Workload_t{
+	Name:       "resize",
+	Nlogblks:   32,
+	Ninodeblks: 1,
+	Ndatablks:  20,
+	Setup: func(tfs *ufs.Ufs_t) {
+		if e := tfs.MkFile(ustr.Ustr("f"), mkData(1, 2*fs.BSIZE)); e != 0 {
+			panic("mkFile failed")
+		}
+	},
+	Run: func(tfs *ufs.Ufs_t) (string, bool) {
+		if e := tfs.Resize(100); e != 0 {
+			return "resize failed", false
+		}
+		if e := tfs.MkFile(ustr.Ustr("g"), mkData(2, 4*fs.BSIZE)); e != 0 {
+			return "mkFile failed", false
+		}
+		tfs.Sync()
+		return "", true
+	},
+	Check: func(tfs *ufs.Ufs_t) (string, bool) {
+		if _, _, nb, _ := tfs.Df(); nb != 20 && nb < 60 {
+			return fmt.Sprintf("%v data blocks", nb), false
+		}
+		d, e := tfs.Read(ustr.Ustr("f"))
+		if e != 0 || len(d) != 2*fs.BSIZE {
+			return fmt.Sprintf("read f: %v %v", len(d), e), false
+		}
+		return "", true
+	},
+}
+
+func TestResize(t *testing.T) {
+	r := Explore(resize, Defopts)
+	if r.Nepochs == 0 || r.Nstates == 0 {
+		t.Fatalf("nothing explored %+v", r)
+	}
+	for _, f := range r.Failures {
+		t.Errorf("%v", f)
+	}
+	fmt.Printf("resize: %v writes %v epochs %v states %v pruned %v truncated\n",
+		r.Nwrites, r.Nepochs, r.Nstates, r.Npruned, r.Ntrunc)
+}
+
+// shrinking f frees its blocks past the new end, in several operations,
+// before the new size is committed: f has either its old size or the new one,
+// and growing it again never exposes the freed data
+var truncate = &Workload_t{
+	Name:       "truncate",
+	Nlogblks:   32,
+	Ninodeblks: 1,
+	Ndatablks:  80,
+	Setup: func(tfs *ufs.Ufs_t) {
+		if e := tfs.MkFile(ustr.Ustr("f"), mkData(1, 60*fs.BSIZE)); e != 0 {
+			panic("mkFile failed")
+		}
+	},
+	Run: func(tfs *ufs.Ufs_t) (string, bool) {
+		if e := tfs.Truncate(ustr.Ustr("f"), fs.BSIZE/2); e != 0 {
+			return "truncate failed", false
+		}
+		tfs.Sync()
+		return "", true
+	},
+	Check: func(tfs *ufs.Ufs_t) (string, bool) {
+		f := ustr.Ustr("f")
+		st, e := tfs.Stat(f)
+		if e != 0 {
+			return fmt.Sprintf("stat f: %v", e), false
+		}
+		sz := int(st.Size())
+		if sz != fs.BSIZE/2 && sz != 60*fs.BSIZE {
+			return fmt.Sprintf("f has size %v", sz), false
+		}
+		if e := tfs.Truncate(f, 60*fs.BSIZE); e != 0 {
+			return fmt.Sprintf("grow f: %v", e), false
+		}
+		d, e := tfs.Read(f)
+		if e != 0 || len(d) != 60*fs.BSIZE {
+			return fmt.Sprintf("read f: %v %v", len(d), e), false
+		}
+		for i := sz; i < len(d); i++ {
+			if d[i] != 0 {
+				return fmt.Sprintf("stale data at %v past %v", i, sz), false
+			}
+		}
+		return "", true
+	},
+}
+
+func TestTruncate(t *testing.T) {
+	r := Explore(truncate, Defopts)
+	if r.Nepochs == 0 || r.Nstates == 0 {
+		t.Fatalf("nothing explored %+v", r)
+	}
+	for _, f := range r.Failures {
+		t.Errorf("%v", f)
+	}
+	fmt.Printf("truncate: %v writes %v epochs %v states %v pruned %v truncated\n",
+		r.Nwrites, r.Nepochs, r.Nstates, r.Npruned, r.Ntrunc)
+}
+
+// overwriting f in one write is atomic if the file system journals data: f
+// has either the old or the new contents. without journaling, the data blocks
+// reach the disk before the transaction commits, and the overwrite may be torn.
+func mkOverwrite(feat int) *Workload_t {
+	return &Workload_t{
+		Name:       "overwrite",
+		Nlogblks:   64,
+		Ninodeblks: 1,
+		Ndatablks:  20,
+		Feat:       feat,
+		Setup: func(tfs *ufs.Ufs_t) {
+			if e := tfs.MkFile(ustr.Ustr("f"), mkData(1, 4*fs.BSIZE)); e != 0 {
+				panic("mkFile failed")
+			}
+		},
+		Run: func(tfs *ufs.Ufs_t) (string, bool) {
+			if e := tfs.Update(ustr.Ustr("f"), mkData(2, 4*fs.BSIZE)); e != 0 {
+				return "update failed", false
+			}
+			tfs.Sync()
+			return "", true
+		},
+		Check: func(tfs *ufs.Ufs_t) (string, bool) {
+			d, e := tfs.Read(ustr.Ustr("f"))
+			if e != 0 || len(d) != 4*fs.BSIZE {
+				return fmt.Sprintf("read f: %v %v", len(d), e), false
+			}
+			for i := range d {
+				if d[i] != d[0] {
+					return fmt.Sprintf("torn f %v %v", d[0], d[i]), false
+				}
+			}
+			return "", true
+		},
+	}
+}
+
+func TestJournal(t *testing.T) {
+	r := Explore(mkOverwrite(fs.FEAT_JOURNAL), Defopts)
+	if r.Nepochs == 0 || r.Nstates == 0 {
+		t.Fatalf("nothing explored %+v", r)
+	}
+	for _, f := range r.Failures {
+		t.Errorf("%v", f)
+	}
+	fmt.Printf("overwrite: %v writes %v epochs %v states %v pruned %v truncated\n",
+		r.Nwrites, r.Nepochs, r.Nstates, r.Npruned, r.Ntrunc)
+
+	r = Explore(mkOverwrite(0), Defopts)
+	if len(r.Failures) != 1 || r.Failures[0].Msg != "torn f 1 2" &&
+		r.Failures[0].Msg != "torn f 2 1" {
+		t.Fatalf("ordered overwrite: %v", r.Failures)
+	}
+}
+
+// a checker that expects the effects of a workload before they are durable
+// finds a failure, which reproduces on the saved image
+func TestFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crashtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w := &Workload_t{
+		Name:       "create",
+		Nlogblks:   32,
+		Ninodeblks: 1,
+		Ndatablks:  20,
+		Run: func(tfs *ufs.Ufs_t) (string, bool) {
+			if e := tfs.MkFile(ustr.Ustr("x"), mkData(1, fs.BSIZE)); e != 0 {
+				return "mkFile failed", false
+			}
+			tfs.Sync()
+			return "", true
+		},
+		Check: func(tfs *ufs.Ufs_t) (string, bool) {
+			if _, e := tfs.Stat(ustr.Ustr("x")); e != 0 {
+				return "x missing", false
+			}
+			return "", true
+		},
+	}
+	o := Defopts
+	o.Dir = dir
+	r := Explore(w, o)
+	if len(r.Failures) != 1 {
+		t.Fatalf("%v failures", len(r.Failures))
+	}
+	f := r.Failures[0]
+	if f.Msg != "x missing" || f.Image == "" {
+		t.Fatalf("failure %v", f)
+	}
+	// the failure is minimal: none of the blocks in flight is needed
+	if len(f.Blocks) != 0 {
+		t.Fatalf("not minimized %v", f)
+	}
+	tfs := ufs.BootFS(f.Image)
+	s, ok := w.Check(tfs)
+	ufs.ShutdownFS(tfs)
+	if ok || s != f.Msg {
+		t.Fatalf("image doesn't reproduce %v: %v", f, s)
+	}
+}
@@ -15,8 +15,13 @@ const (
 	O_TRUNC     Fdopt_t = 0x200
 	O_APPEND    Fdopt_t = 0x400
 	O_NONBLOCK  Fdopt_t = 0x800
+	O_DIRECT    Fdopt_t = 0x4000
 	O_DIRECTORY Fdopt_t = 0x10000
+	O_NOFOLLOW  Fdopt_t = 0x20000
 	O_CLOEXEC   Fdopt_t = 0x80000
+	// for the kernel only: opens a file to execute it, which requires
+	// execute instead of read permission
+	O_EXEC      Fdopt_t = 0x20
 	SYS_CLOSE           = 3
 	SYS_STAT            = 4
 	SYS_FSTAT           = 5
@@ -35,6 +40,8 @@ const (
 	SEEK_SET            = 0x1
 	SEEK_CUR            = 0x2
 	SEEK_END            = 0x4
+	SEEK_DATA           = 0x8
+	SEEK_HOLE           = 0x10
 	SYS_MMAP            = 9
 	MAP_SHARED          = uint(0x1)
 	MAP_PRIVATE         = uint(0x2)
@@ -50,6 +57,9 @@ const (
 	SYS_READV           = 19
 	SYS_WRITEV          = 20
 	SYS_ACCESS          = 21
+	R_OK                = 1 << 0
+	W_OK                = 1 << 1
+	X_OK                = 1 << 2
 	SYS_DUP2            = 33
 	SYS_PAUSE           = 34
 	SYS_GETPID          = 39
@@ -112,6 +122,19 @@ const (
 	F_SETFL          = 2
 	F_GETFD          = 3
 	F_SETFD          = 4
+	F_SETLK          = 5
+	F_SETLKW         = 6
+	F_GETLK          = 8
+	F_WRLCK          = 1
+	F_UNLCK          = 2
+	F_RDLCK          = 3
+	SYS_FLOCK        = 73
+	LOCK_SH          = 1
+	LOCK_EX          = 2
+	LOCK_NB          = 4
+	LOCK_UN          = 8
+	SYS_FSYNC        = 74
+	SYS_FDATASYNC    = 75
 	SYS_TRUNC        = 76
 	SYS_FTRUNC       = 77
 	SYS_GETCWD       = 79
@@ -120,6 +143,10 @@ const (
 	SYS_MKDIR        = 83
 	SYS_LINK         = 86
 	SYS_UNLINK       = 87
+	SYS_SYMLINK      = 88
+	SYS_READLINK     = 89
+	SYS_CHMOD        = 90
+	SYS_CHOWN        = 92
 	SYS_GETTOD       = 96
 	SYS_GETRLMT      = 97
 	RLIMIT_NOFILE    = 1
@@ -127,11 +154,30 @@ const (
 	SYS_GETRUSG      = 98
 	RUSAGE_SELF      = 1
 	RUSAGE_CHILDREN  = 2
+	SYS_GETUID       = 102
+	SYS_GETGID       = 104
+	SYS_SETUID       = 105
+	SYS_SETGID       = 106
+	SYS_GETEUID      = 107
+	SYS_GETEGID      = 108
+	SYS_GETGROUPS    = 115
+	SYS_SETGROUPS    = 116
 	SYS_MKNOD        = 133
 	SYS_SETRLMT      = 160
 	SYS_SYNC         = 162
+	SYS_MOUNT        = 165
+	SYS_UMOUNT2      = 166
 	SYS_REBOOT       = 169
+	SYS_GETDENTS64   = 217
+	DT_UNKNOWN       = 0
+	DT_CHR           = 2
+	DT_DIR           = 4
+	DT_REG           = 8
+	DT_LNK           = 10
+	DT_SOCK          = 12
 	SYS_NANOSLEEP    = 230
+	SYS_UTIMENSAT    = 280
+	SYS_FALLOCATE    = 285
 	SYS_PIPE2        = 293
 	SYS_PROF         = 31337
 	PROF_DISABLE     = 1 << 0
@@ -164,6 +210,62 @@ const (
 	FUTEX_WAKE       = 2
 	FUTEX_CNDGIVE    = 3
 	SYS_GETTID       = 31343
+	SYS_REFLINK      = 31344
+	SYS_RESIZEFS     = 31345
+)
+
+// utimensat arguments
+const (
+	AT_FDCWD            = -100
+	AT_SYMLINK_NOFOLLOW = 0x100
+	// special timespec nanoseconds
+	UTIME_NOW  = (1 << 30) - 1
+	UTIME_OMIT = (1 << 30) - 2
+)
+
+// fallocate modes
+const (
+	FALLOC_FL_KEEP_SIZE  = 0x1
+	FALLOC_FL_PUNCH_HOLE = 0x2
+	FALLOC_FL_ZERO_RANGE = 0x10
+)
+
+// extended attribute system calls and flags
+const (
+	SYS_SETXATTR    = 188
+	SYS_GETXATTR    = 191
+	SYS_LISTXATTR   = 194
+	SYS_REMOVEXATTR = 197
+	XATTR_CREATE    = 0x1
+	XATTR_REPLACE   = 0x2
+)
+
+// inotify system calls, flags and events
+const (
+	SYS_INOTIFY_ADD_WATCH = 254
+	SYS_INOTIFY_RM_WATCH  = 255
+	SYS_INOTIFY_INIT1     = 294
+	IN_NONBLOCK           = O_NONBLOCK
+	IN_CLOEXEC            = O_CLOEXEC
+	IN_MODIFY             = 0x2
+	IN_ATTRIB             = 0x4
+	IN_MOVED_FROM         = 0x40
+	IN_MOVED_TO           = 0x80
+	IN_CREATE             = 0x100
+	IN_DELETE             = 0x200
+	IN_DELETE_SELF        = 0x400
+	IN_MOVE_SELF          = 0x800
+	IN_ALL_EVENTS         = 0xfc6
+	IN_Q_OVERFLOW         = 0x4000
+	IN_IGNORED            = 0x8000
+	IN_ONLYDIR            = 0x1000000
+	IN_MASK_ADD           = 0x20000000
+	IN_ISDIR              = 0x40000000
+)
+
+// mount flags
+const (
+	MS_BIND = 0x1000
 )
 
 const (
@@ -0,0 +1,406 @@
+package devfs
+
+import "sync"
+import "sync/atomic"
+
+import "bpath"
+import "defs"
+import "device"
+import "fd"
+import "fdops"
+import "flock"
+import "fs"
+import "mem"
+import "proc"
+import "stat"
+import "ustr"
+import "util"
+import "vfs"
+
+// devfs is a flat directory with one node per device in the device registry,
+// owned by root. nodes appear and disappear as drivers register and unregister
+// their devices; they cannot be created, removed or changed through devfs.
+
+type Devfs_t struct {
+	dev uint
+	// the number of open directories, including cwds; updated atomically
+	nopen int64
+}
+
+func MkDevfs() *Devfs_t {
+	return &Devfs_t{dev: vfs.Newdev()}
+}
+
+// resolves paths to the device it names, or to the root directory if isroot is
+// true
+func (dfs *Devfs_t) namei(paths ustr.Ustr) (d device.Dev_t, isroot bool, err defs.Err_t) {
+	isroot = true
+	var pp bpath.Pathparts_t
+	pp.Pp_init(paths)
+	for cp, ok := pp.Next(); ok; cp, ok = pp.Next() {
+		if !isroot {
+			return d, false, -defs.ENOTDIR
+		}
+		if cp.Isdot() || cp.Isdotdot() {
+			continue
+		}
+		if d, ok = device.Lookup(cp.String()); !ok {
+			return d, false, -defs.ENOENT
+		}
+		isroot = false
+	}
+	return d, isroot, 0
+}
+
+// the permission bits of the root directory. the root directory and the devices
+// are owned by root.
+const rootperm = 0755
+
+func (dfs *Devfs_t) Fs_open(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.Cwd_t, cred *proc.Cred_t, major, minor int) (*fd.Fd_t, defs.Err_t) {
+	d, isroot, err := dfs.namei(paths)
+	if err == -defs.ENOENT && flags&defs.O_CREAT != 0 {
+		return nil, -defs.EPERM
+	}
+	if err != 0 {
+		return nil, err
+	}
+	if flags&defs.O_CREAT != 0 && flags&defs.O_EXCL != 0 {
+		return nil, -defs.EEXIST
+	}
+	want := defs.R_OK
+	switch flags & (defs.O_RDONLY | defs.O_WRONLY | defs.O_RDWR) {
+	case defs.O_WRONLY:
+		want = defs.W_OK
+	case defs.O_RDWR:
+		want = defs.R_OK | defs.W_OK
+	}
+	if flags&defs.O_EXEC != 0 {
+		want = defs.X_OK
+	}
+	if isroot {
+		if want&defs.W_OK != 0 || flags&defs.O_CREAT != 0 {
+			return nil, -defs.EISDIR
+		}
+		atomic.AddInt64(&dfs.nopen, 1)
+		return &fd.Fd_t{Fops: &dfops_t{dfs: dfs, count: 1}}, 0
+	}
+	if flags&defs.O_DIRECTORY != 0 {
+		return nil, -defs.ENOTDIR
+	}
+	if err := cred.Access(d.Perm, 0, 0, false, want); err != 0 {
+		return nil, err
+	}
+	fops, err := device.Open(d.Major, d.Minor)
+	if err != 0 {
+		return nil, err
+	}
+	return &fd.Fd_t{Fops: fops}, 0
+}
+
+func (dfs *Devfs_t) Fs_mknod(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.Cwd_t, cred *proc.Cred_t, major, minor int) (defs.Inum_t, defs.Err_t) {
+	if _, _, err := dfs.namei(paths); err == 0 {
+		return 0, -defs.EEXIST
+	}
+	return 0, -defs.EPERM
+}
+
+// device nodes are numbered after their device numbers; 1 is the root
+func inum(d device.Dev_t) uint {
+	return defs.Mkdev(d.Major, d.Minor)>>32 | 1<<16
+}
+
+func (dfs *Devfs_t) stat(d device.Dev_t, isroot bool, st *stat.Stat_t) {
+	st.Wdev(dfs.dev)
+	if isroot {
+		st.Wino(1)
+		st.Wmode(uint(fs.I_DIR<<16 | rootperm))
+		return
+	}
+	st.Wino(inum(d))
+	st.Wmode(defs.Mkdev(d.Major, d.Minor) | uint(d.Perm))
+	st.Wrdev(defs.Mkdev(d.Major, d.Minor))
+}
+
+func (dfs *Devfs_t) Fs_stat(paths ustr.Ustr, st *stat.Stat_t, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	d, isroot, err := dfs.namei(paths)
+	if err != 0 {
+		return err
+	}
+	dfs.stat(d, isroot, st)
+	return 0
+}
+
+func (dfs *Devfs_t) Fs_access(paths ustr.Ustr, amode int, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	d, isroot, err := dfs.namei(paths)
+	if err != 0 {
+		return err
+	}
+	if isroot {
+		return cred.Access(rootperm, 0, 0, true, amode)
+	}
+	return cred.Access(d.Perm, 0, 0, false, amode)
+}
+
+func (dfs *Devfs_t) Fs_mkdir(paths ustr.Ustr, mode int, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	return -defs.EPERM
+}
+
+func (dfs *Devfs_t) Fs_link(old, new ustr.Ustr, cwd, ncwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	return -defs.EPERM
+}
+
+func (dfs *Devfs_t) Fs_reflink(src, dst ustr.Ustr, cwd, ncwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	return -defs.EPERM
+}
+
+func (dfs *Devfs_t) Fs_unlink(paths ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t, wantdir bool) defs.Err_t {
+	return -defs.EPERM
+}
+
+func (dfs *Devfs_t) Fs_rename(oldp, newp ustr.Ustr, cwd, ncwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	return -defs.EPERM
+}
+
+func (dfs *Devfs_t) Fs_symlink(target, paths ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	return -defs.EPERM
+}
+
+func (dfs *Devfs_t) Fs_readlink(paths ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t) (ustr.Ustr, defs.Err_t) {
+	if _, _, err := dfs.namei(paths); err != 0 {
+		return nil, err
+	}
+	return nil, -defs.EINVAL
+}
+
+func (dfs *Devfs_t) Fs_chmod(paths ustr.Ustr, mode int, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	return -defs.EPERM
+}
+
+func (dfs *Devfs_t) Fs_chown(paths ustr.Ustr, uid, gid int, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	return -defs.EPERM
+}
+
+func (dfs *Devfs_t) Fs_utimens(paths ustr.Ustr, atime, mtime int, follow bool, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	return -defs.EPERM
+}
+
+func (dfs *Devfs_t) Fs_setxattr(paths, name ustr.Ustr, value []uint8, flags int, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	return -defs.EOPNOTSUPP
+}
+
+func (dfs *Devfs_t) Fs_getxattr(paths, name ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t) ([]uint8, defs.Err_t) {
+	return nil, -defs.EOPNOTSUPP
+}
+
+func (dfs *Devfs_t) Fs_listxattr(paths ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t) ([]uint8, defs.Err_t) {
+	return nil, -defs.EOPNOTSUPP
+}
+
+func (dfs *Devfs_t) Fs_removexattr(paths, name ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	return -defs.EOPNOTSUPP
+}
+
+func (dfs *Devfs_t) Fs_sync() defs.Err_t {
+	return 0
+}
+
+func (dfs *Devfs_t) Fs_resize(nblocks int) defs.Err_t {
+	return -defs.EOPNOTSUPP
+}
+
+func (dfs *Devfs_t) MkRootCwd() *fd.Cwd_t {
+	return fd.MkRootCwd(&fd.Fd_t{Fops: &dfops_t{dfs: dfs}})
+}
+
+// fails if the root directory is open or is the cwd of a process. open devices
+// do not keep devfs busy.
+func (dfs *Devfs_t) Fs_umount() defs.Err_t {
+	if atomic.LoadInt64(&dfs.nopen) != 0 {
+		return -defs.EBUSY
+	}
+	return 0
+}
+
+// the fops of the root directory
+type dfops_t struct {
+	dfs *Devfs_t
+	sync.Mutex
+	offset int
+	count  int
+}
+
+// "." and ".." are at offsets 0 and 1, followed by the devices sorted by name
+func (fo *dfops_t) Getdents(dst fdops.Userio_i) (int, defs.Err_t) {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return 0, -defs.EBADF
+	}
+	if fo.offset < 0 {
+		return 0, -defs.EINVAL
+	}
+	devs := device.Devices()
+	did := 0
+	for ; fo.offset < len(devs)+2; fo.offset++ {
+		name, ino, dtype := ustr.MkUstrDot(), uint(1), defs.DT_DIR
+		switch fo.offset {
+		case 0:
+		case 1:
+			name = ustr.DotDot
+		default:
+			d := devs[fo.offset-2]
+			name, ino, dtype = ustr.Ustr(d.Name), inum(d), defs.DT_CHR
+		}
+		if util.Direntlen(name) > dst.Remain() {
+			if did == 0 {
+				return 0, -defs.EINVAL
+			}
+			break
+		}
+		rec := util.Dirent(int(ino), fo.offset+1, uint8(dtype), name)
+		if _, err := dst.Uiowrite(rec); err != 0 {
+			return did, err
+		}
+		did += len(rec)
+	}
+	return did, 0
+}
+
+func (fo *dfops_t) Fstat(st *stat.Stat_t) defs.Err_t {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return -defs.EBADF
+	}
+	fo.dfs.stat(device.Dev_t{}, true, st)
+	return 0
+}
+
+func (fo *dfops_t) Close() defs.Err_t {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return -defs.EBADF
+	}
+	fo.count--
+	atomic.AddInt64(&fo.dfs.nopen, -1)
+	return 0
+}
+
+func (fo *dfops_t) Reopen() defs.Err_t {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return -defs.EBADF
+	}
+	fo.count++
+	atomic.AddInt64(&fo.dfs.nopen, 1)
+	return 0
+}
+
+func (fo *dfops_t) Pathi() defs.Inum_t {
+	return 1
+}
+
+func (fo *dfops_t) Lseek(off, whence int) (int, defs.Err_t) {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return 0, -defs.EBADF
+	}
+	switch whence {
+	case defs.SEEK_SET:
+		fo.offset = off
+	case defs.SEEK_CUR:
+		fo.offset += off
+	default:
+		return 0, -defs.EINVAL
+	}
+	if fo.offset < 0 {
+		fo.offset = 0
+	}
+	return fo.offset, 0
+}
+
+func (fo *dfops_t) Read(fdops.Userio_i) (int, defs.Err_t) {
+	return 0, -defs.EISDIR
+}
+
+func (fo *dfops_t) Pread(fdops.Userio_i, int) (int, defs.Err_t) {
+	return 0, -defs.EISDIR
+}
+
+func (fo *dfops_t) Write(fdops.Userio_i) (int, defs.Err_t) {
+	return 0, -defs.EBADF
+}
+
+func (fo *dfops_t) Pwrite(fdops.Userio_i, int) (int, defs.Err_t) {
+	return 0, -defs.EBADF
+}
+
+func (fo *dfops_t) Truncate(newlen uint) defs.Err_t {
+	return -defs.EISDIR
+}
+
+func (fo *dfops_t) Fallocate(mode, offset, len int) defs.Err_t {
+	return -defs.EISDIR
+}
+
+func (fo *dfops_t) Fsync(datasync bool) defs.Err_t {
+	return 0
+}
+
+func (fo *dfops_t) Locks() (*flock.Locks_t, defs.Err_t) {
+	return nil, -defs.EINVAL
+}
+
+func (fo *dfops_t) Mmapi(offset, len int, inc bool) ([]mem.Mmapinfo_t, defs.Err_t) {
+	return nil, -defs.ENODEV
+}
+
+func (fo *dfops_t) Accept(fdops.Userio_i) (fdops.Fdops_i, int, defs.Err_t) {
+	return nil, 0, -defs.ENOTSOCK
+}
+
+func (fo *dfops_t) Bind([]uint8) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (fo *dfops_t) Connect(sabuf []uint8) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (fo *dfops_t) Listen(int) (fdops.Fdops_i, defs.Err_t) {
+	return nil, -defs.ENOTSOCK
+}
+
+func (fo *dfops_t) Sendmsg(fdops.Userio_i, []uint8, []uint8,
+	int) (int, defs.Err_t) {
+	return 0, -defs.ENOTSOCK
+}
+
+func (fo *dfops_t) Recvmsg(fdops.Userio_i,
+	fdops.Userio_i, fdops.Userio_i, int) (int, int, int, defs.Msgfl_t, defs.Err_t) {
+	return 0, 0, 0, 0, -defs.ENOTSOCK
+}
+
+func (fo *dfops_t) Pollone(pm fdops.Pollmsg_t) (fdops.Ready_t, defs.Err_t) {
+	return pm.Events & fdops.R_READ, 0
+}
+
+func (fo *dfops_t) Fcntl(cmd, opt int) int {
+	return int(-defs.ENOSYS)
+}
+
+func (fo *dfops_t) Getsockopt(opt int, bufarg fdops.Userio_i,
+	intarg int) (int, defs.Err_t) {
+	return 0, -defs.ENOTSOCK
+}
+
+func (fo *dfops_t) Setsockopt(int, int, fdops.Userio_i, int) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (fo *dfops_t) Shutdown(read, write bool) defs.Err_t {
+	return -defs.ENOTSOCK
+}
@@ -0,0 +1,110 @@
+package device
+
+import "sort"
+import "sync"
+
+import "defs"
+import "fdops"
+
+// drivers register their devices here when they attach; opening a device
+// special file, in any file system, looks the device up by its major and minor
+// numbers. devfs lists the registered devices in /dev.
+
+// Open_t returns the fops of a new open of the device with the given minor
+// number
+type Open_t func(minor int) (fdops.Fdops_i, defs.Err_t)
+
+type Dev_t struct {
+	// the name of the device's node in /dev
+	Name  string
+	Major int
+	Minor int
+	// the permission bits of the device's node
+	Perm int
+	open Open_t
+}
+
+var devs = struct {
+	sync.Mutex
+	byname map[string]*Dev_t
+	// keyed by defs.Mkdev()
+	bynum map[uint]*Dev_t
+	// the last major handed out by Majalloc
+	lastmaj int
+}{byname: map[string]*Dev_t{}, bynum: map[uint]*Dev_t{}, lastmaj: 63}
+
+// returns a major number that is not used by the devices in defs/device.go
+// nor by another driver
+func Majalloc() int {
+	devs.Lock()
+	defer devs.Unlock()
+	devs.lastmaj++
+	return devs.lastmaj
+}
+
+// adds a device named name. a driver may register many minors of the same
+// major.
+func Register(name string, major, minor, perm int, open Open_t) {
+	devs.Lock()
+	defer devs.Unlock()
+	n := defs.Mkdev(major, minor)
+	if _, ok := devs.byname[name]; ok {
+		panic("device name registered twice")
+	}
+	if _, ok := devs.bynum[n]; ok {
+		panic("device number registered twice")
+	}
+	d := &Dev_t{Name: name, Major: major, Minor: minor, Perm: perm & 0777,
+		open: open}
+	devs.byname[name] = d
+	devs.bynum[n] = d
+}
+
+// removes the device named name, for instance when its driver detaches.
+// already open files of the device are not affected.
+func Unregister(name string) {
+	devs.Lock()
+	defer devs.Unlock()
+	d, ok := devs.byname[name]
+	if !ok {
+		panic("no such device")
+	}
+	delete(devs.byname, name)
+	delete(devs.bynum, defs.Mkdev(d.Major, d.Minor))
+}
+
+// opens the device with the given numbers. fails with ENXIO if no such device
+// is registered.
+func Open(major, minor int) (fdops.Fdops_i, defs.Err_t) {
+	devs.Lock()
+	d, ok := devs.bynum[defs.Mkdev(major, minor)]
+	devs.Unlock()
+	if !ok {
+		return nil, -defs.ENXIO
+	}
+	return d.open(minor)
+}
+
+func Lookup(name string) (Dev_t, bool) {
+	devs.Lock()
+	defer devs.Unlock()
+	d, ok := devs.byname[name]
+	if !ok {
+		return Dev_t{}, false
+	}
+	return *d, true
+}
+
+// returns the registered devices sorted by name
+func Devices() []Dev_t {
+	devs.Lock()
+	ret := make([]Dev_t, 0, len(devs.byname))
+	for _, d := range devs.byname {
+		ret = append(ret, *d)
+	}
+	devs.Unlock()
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
@@ -40,6 +40,9 @@ type Cwd_t struct {
 	sync.Mutex // to serialize chdirs
 	Fd         *Fd_t
 	Path       ustr.Ustr
+	// the mount on which Fd lives; only the VFS interprets it. nil
+	// means the root file system.
+	Mnt interface{}
 }
 
 func (cwd *Cwd_t) Fullpath(p ustr.Ustr) ustr.Ustr {
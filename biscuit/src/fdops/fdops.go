@@ -3,6 +3,7 @@ package fdops
 import "time"
 
 import "defs"
+import "flock"
 import "mem"
 import "stat"
 import "tinfo"
@@ -29,6 +30,16 @@ type Userio_i interface {
 	Totalsz() int
 }
 
+// a Userio_i whose user pages the disk can transfer to and from directly, as
+// O_DIRECT I/O does
+type Userpages_i interface {
+	Userio_i
+	// returns the page at the current offset, which must be page aligned,
+	// and its kernel mapping, and advances past the page. the page is
+	// referenced until the caller releases it.
+	Userpage(k2u bool) (mem.Pa_t, *mem.Bytepg_t, defs.Err_t)
+}
+
 type Fdops_i interface {
 	// fd ops
 	Close() defs.Err_t
@@ -41,9 +52,19 @@ type Fdops_i interface {
 	Reopen() defs.Err_t
 	Write(Userio_i) (int, defs.Err_t)
 	Truncate(uint) defs.Err_t
+	// mode, offset, length
+	Fallocate(int, int, int) defs.Err_t
+	// waits for the file's updates to be durable; if the argument is
+	// true, except for updates of only timestamps
+	Fsync(bool) defs.Err_t
+	// the advisory locks of the fd's file
+	Locks() (*flock.Locks_t, defs.Err_t)
 
 	Pread(Userio_i, int) (int, defs.Err_t)
 	Pwrite(Userio_i, int) (int, defs.Err_t)
+	// copies directory entries as linux_dirent64 records, resuming at the
+	// fd's offset
+	Getdents(Userio_i) (int, defs.Err_t)
 
 	// socket ops
 	// returns fops of new fd, size of connector's address written to user
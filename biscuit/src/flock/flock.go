@@ -0,0 +1,336 @@
+package flock
+
+import "sync"
+
+import "defs"
+import "res"
+import "tinfo"
+
+// advisory file locks. each in-memory inode has a Locks_t with the file's
+// flock(2) locks, which belong to an open file and cover the whole file, and
+// its fcntl(2) record locks, which belong to a process and cover a byte range.
+// the two kinds do not interact.
+//
+// one lock protects the locks of all files: lock operations are rare and
+// deadlock detection follows waiting processes across files.
+var biglock sync.Mutex
+
+// the end of a range that extends to the end of the file, however far the
+// file grows
+const EOF = int(^uint(0) >> 1)
+
+type lock_t struct {
+	// the open file of a flock(2) lock or the pid of a record lock
+	owner interface{}
+	excl  bool
+	// the locked bytes are [start, end)
+	start int
+	end   int
+}
+
+func (l *lock_t) conflicts(o *lock_t) bool {
+	return l.owner != o.owner && (l.excl || o.excl) &&
+		l.start < o.end && o.start < l.end
+}
+
+type Locks_t struct {
+	flocks []lock_t
+	// sorted by start; the locks of one process never overlap
+	recs []lock_t
+	// closed and replaced whenever a lock is released or downgraded
+	wake chan bool
+}
+
+// a process sleeping in F_SETLKW
+type waiter_t struct {
+	ls *Locks_t
+	lk lock_t
+}
+
+// the F_SETLKW requests the threads of each process are sleeping on
+var waiting = map[int][]*waiter_t{}
+
+// the files on which each process holds record locks
+var held = map[int]map[*Locks_t]bool{}
+
+func conflict(locks []lock_t, lk *lock_t) (*lock_t, bool) {
+	for i := range locks {
+		if lk.conflicts(&locks[i]) {
+			return &locks[i], true
+		}
+	}
+	return nil, false
+}
+
+// sleeps until a lock of the file is released. the caller holds biglock,
+// which is dropped while sleeping. returns non-zero if the process was
+// killed.
+func (ls *Locks_t) sleep() defs.Err_t {
+	if ls.wake == nil {
+		ls.wake = make(chan bool)
+	}
+	wake := ls.wake
+	biglock.Unlock()
+	defer biglock.Lock()
+	if !res.Kernel {
+		<-wake
+		return 0
+	}
+	kn := &tinfo.Current().Killnaps
+	select {
+	case <-wake:
+		return 0
+	case <-kn.Killch:
+		if kn.Kerr == 0 {
+			panic("no")
+		}
+		return kn.Kerr
+	}
+}
+
+func (ls *Locks_t) wakeup() {
+	if ls.wake != nil {
+		close(ls.wake)
+		ls.wake = nil
+	}
+}
+
+// implements flock(2) for the open file fo. op is LOCK_SH, LOCK_EX or
+// LOCK_UN, possibly with LOCK_NB. like linux, converting a lock releases it
+// first.
+func (ls *Locks_t) Flock(fo interface{}, op int) defs.Err_t {
+	biglock.Lock()
+	defer biglock.Unlock()
+
+	ls.funlock(fo)
+	if op&defs.LOCK_UN != 0 {
+		return 0
+	}
+	lk := lock_t{owner: fo, excl: op&defs.LOCK_EX != 0, start: 0, end: EOF}
+	for {
+		if _, ok := conflict(ls.flocks, &lk); !ok {
+			break
+		}
+		if op&defs.LOCK_NB != 0 {
+			return -defs.EWOULDBLOCK
+		}
+		if err := ls.sleep(); err != 0 {
+			return err
+		}
+	}
+	ls.flocks = append(ls.flocks, lk)
+	return 0
+}
+
+// releases the flock(2) lock of the open file fo, if any. called when the last
+// fd of the open file is closed.
+func (ls *Locks_t) Fclose(fo interface{}) {
+	biglock.Lock()
+	ls.funlock(fo)
+	biglock.Unlock()
+}
+
+func (ls *Locks_t) funlock(fo interface{}) {
+	for i := range ls.flocks {
+		if ls.flocks[i].owner == fo {
+			last := len(ls.flocks) - 1
+			ls.flocks[i] = ls.flocks[last]
+			ls.flocks = ls.flocks[:last]
+			ls.wakeup()
+			return
+		}
+	}
+}
+
+// reports whether sleeping for pid's request lk would make a cycle of
+// processes that wait for each other's record locks.
+func deadlock(pid int, ls *Locks_t, lk *lock_t) bool {
+	seen := map[int]bool{}
+	var blocked func(*Locks_t, *lock_t) bool
+	blocked = func(ls *Locks_t, lk *lock_t) bool {
+		for i := range ls.recs {
+			o := &ls.recs[i]
+			if !lk.conflicts(o) {
+				continue
+			}
+			opid := o.owner.(int)
+			if opid == pid {
+				return true
+			}
+			if seen[opid] {
+				continue
+			}
+			seen[opid] = true
+			for _, w := range waiting[opid] {
+				if blocked(w.ls, &w.lk) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return blocked(ls, lk)
+}
+
+func unwait(pid int, w *waiter_t) {
+	ws := waiting[pid]
+	for i := range ws {
+		if ws[i] == w {
+			ws = append(ws[:i], ws[i+1:]...)
+			break
+		}
+	}
+	if len(ws) == 0 {
+		delete(waiting, pid)
+	} else {
+		waiting[pid] = ws
+	}
+}
+
+// implements F_SETLK and F_SETLKW for process pid: sets the lock of
+// type typ, which is F_RDLCK, F_WRLCK or F_UNLCK, on [start, end), replacing
+// pid's locks on those bytes.
+func (ls *Locks_t) Setlk(pid, typ, start, end int, wait bool) defs.Err_t {
+	biglock.Lock()
+	defer biglock.Unlock()
+
+	lk := lock_t{owner: pid, excl: typ == defs.F_WRLCK, start: start,
+		end: end}
+	for typ != defs.F_UNLCK {
+		if _, ok := conflict(ls.recs, &lk); !ok {
+			break
+		}
+		if !wait {
+			return -defs.EAGAIN
+		}
+		if deadlock(pid, ls, &lk) {
+			return -defs.EDEADLK
+		}
+		w := &waiter_t{ls: ls, lk: lk}
+		waiting[pid] = append(waiting[pid], w)
+		err := ls.sleep()
+		unwait(pid, w)
+		if err != 0 {
+			return err
+		}
+	}
+
+	ls.punlock(pid, start, end)
+	if typ != defs.F_UNLCK {
+		ls.pinsert(lk)
+	}
+	ls.track(pid)
+	return 0
+}
+
+// records in held whether pid has record locks on the file
+func (ls *Locks_t) track(pid int) {
+	for i := range ls.recs {
+		if ls.recs[i].owner == pid {
+			if held[pid] == nil {
+				held[pid] = map[*Locks_t]bool{}
+			}
+			held[pid][ls] = true
+			return
+		}
+	}
+	if held[pid] != nil {
+		delete(held[pid], ls)
+		if len(held[pid]) == 0 {
+			delete(held, pid)
+		}
+	}
+}
+
+// removes pid's locks on [start, end), splitting those that cover more
+func (ls *Locks_t) punlock(pid, start, end int) {
+	var nrecs []lock_t
+	changed := false
+	for _, l := range ls.recs {
+		if l.owner != pid || l.end <= start || end <= l.start {
+			nrecs = append(nrecs, l)
+			continue
+		}
+		changed = true
+		if l.start < start {
+			left := l
+			left.end = start
+			nrecs = append(nrecs, left)
+		}
+		if end < l.end {
+			right := l
+			right.start = end
+			nrecs = append(nrecs, right)
+		}
+	}
+	if changed {
+		ls.wakeup()
+	}
+	ls.recs = nrecs
+}
+
+// adds lk, which overlaps none of its owner's locks, merging it with the
+// owner's adjacent locks of the same type
+func (ls *Locks_t) pinsert(lk lock_t) {
+	var nrecs []lock_t
+	for _, l := range ls.recs {
+		if l.owner == lk.owner && l.excl == lk.excl &&
+			(l.end == lk.start || lk.end == l.start) {
+			if l.start < lk.start {
+				lk.start = l.start
+			}
+			if l.end > lk.end {
+				lk.end = l.end
+			}
+			continue
+		}
+		nrecs = append(nrecs, l)
+	}
+	i := 0
+	for i < len(nrecs) && nrecs[i].start <= lk.start {
+		i++
+	}
+	nrecs = append(nrecs, lock_t{})
+	copy(nrecs[i+1:], nrecs[i:])
+	nrecs[i] = lk
+	ls.recs = nrecs
+}
+
+// implements F_GETLK: returns the type, range and pid of a lock that would
+// prevent pid from setting a lock of type typ on [start, end), or F_UNLCK if
+// there is none.
+func (ls *Locks_t) Getlk(pid, typ, start, end int) (int, int, int, int) {
+	biglock.Lock()
+	defer biglock.Unlock()
+
+	lk := lock_t{owner: pid, excl: typ == defs.F_WRLCK, start: start,
+		end: end}
+	o, ok := conflict(ls.recs, &lk)
+	if !ok {
+		return defs.F_UNLCK, start, end, 0
+	}
+	otyp := defs.F_RDLCK
+	if o.excl {
+		otyp = defs.F_WRLCK
+	}
+	return otyp, o.start, o.end, o.owner.(int)
+}
+
+// releases pid's record locks on the file. closing any fd of a file releases
+// the locks of the closing process, even if other fds refer to the file.
+func (ls *Locks_t) Close(pid int) {
+	biglock.Lock()
+	defer biglock.Unlock()
+	ls.punlock(pid, 0, EOF)
+	ls.track(pid)
+}
+
+// releases all record locks of the exiting process pid
+func Exit(pid int) {
+	biglock.Lock()
+	defer biglock.Unlock()
+	for ls := range held[pid] {
+		ls.punlock(pid, 0, EOF)
+	}
+	delete(held, pid)
+}
@@ -2,12 +2,14 @@ package fs
 
 import "fmt"
 import "sync"
+import "sync/atomic"
 
 import "runtime"
 
 import "defs"
 import "limits"
 import "mem"
+import "stats"
 
 const bdev_debug = false
 
@@ -41,6 +43,19 @@ type bcache_t struct {
 	disk  Disk_i
 	sync.Mutex
 	pins map[mem.Pa_t]*Bdev_block_t
+	// the number of pages of shared mappings that map each block
+	mapped  map[int]int
+	rastats rastats_t
+	// blocks whose checksum didn't match when read
+	ncsumerr int64
+}
+
+type rastats_t struct {
+	// blocks read ahead, the requests that read them, and reads that
+	// found a block read ahead
+	Nreadahead stats.Counter_t
+	Nrarequest stats.Counter_t
+	Nrahit     stats.Counter_t
 }
 
 func mkBcache(m Blockmem_i, disk Disk_i) *bcache_t {
@@ -49,12 +64,42 @@ func mkBcache(m Blockmem_i, disk Disk_i) *bcache_t {
 	bcache.disk = disk
 	bcache.cache = mkCache(limits.Syslimit.Blocks)
 	bcache.pins = make(map[mem.Pa_t]*Bdev_block_t)
+	bcache.mapped = make(map[int]int)
 	return bcache
 }
 
 // returns locked buf with refcnt on page bumped up by 1. caller must call
 // bdev_relse when done with buf.
 func (bcache *bcache_t) Get_fill(blkn int, s string, lock bool) *Bdev_block_t {
+	b, _ := bcache.get_fill(blkn, s)
+	if !lock {
+		b.Unlock()
+	}
+	return b
+}
+
+// Get_fill_csum is Get_fill for a block that ends in a checksum (see
+// csum.go). if the block is read from the disk and its checksum doesn't match,
+// Get_fill_csum reports and counts it.
+func (bcache *bcache_t) Get_fill_csum(blkn int, s string, lock bool) *Bdev_block_t {
+	b, fresh := bcache.get_fill(blkn, s)
+	if fresh && !Csumok(b.Data) {
+		atomic.AddInt64(&bcache.ncsumerr, 1)
+		fmt.Printf("block %v: bad checksum\n", blkn)
+	}
+	if !lock {
+		b.Unlock()
+	}
+	return b
+}
+
+// returns the number of blocks Get_fill_csum read whose checksums didn't match
+func (bcache *bcache_t) Ncsumerr() int {
+	return int(atomic.LoadInt64(&bcache.ncsumerr))
+}
+
+// returns the locked buf and whether it was read from the disk
+func (bcache *bcache_t) get_fill(blkn int, s string) (*Bdev_block_t, bool) {
 	b, created := bcache.bref(blkn, s)
 	if b.Evictnow() {
 		runtime.Cacheaccount()
@@ -64,14 +109,71 @@ func (bcache *bcache_t) Get_fill(blkn int, s string, lock bool) *Bdev_block_t {
 		fmt.Printf("bcache_get_fill: %v %v created? %v refcnt %v\n", blkn, s, created, b.Ref.Refcnt())
 	}
 
+	fresh := created
 	if created {
 		b.New_page()
 		b.Read() // fill in new bdev_cache entry
+	} else if b._readahead {
+		b._readahead = false
+		bcache.rastats.Nrahit.Inc()
+		fresh = true
 	}
-	if !lock {
-		b.Unlock()
+	return b, fresh
+}
+
+// starts reading the blocks blkns that aren't cached into the cache, without
+// waiting for the reads. blocks that are contiguous on disk are read with one
+// request. a new block stays locked until it is filled, thus Get_fill() of the
+// block waits for the read.
+func (bcache *bcache_t) Readahead(blkns []int) {
+	var l *BlkList_t
+	for _, blkn := range blkns {
+		// skip cached blocks without waiting for their locks
+		if _, ok := bcache.cache.cache.Get(blkn); ok {
+			continue
+		}
+		b, created := bcache.bref(blkn, "readahead")
+		if !created {
+			b.Unlock()
+			bcache.Relse(b, "readahead")
+			continue
+		}
+		b.New_page()
+		b._readahead = true
+		bcache.rastats.Nreadahead.Inc()
+		if l != nil && l.Back().Block+1 != blkn {
+			bcache.readahead(l)
+			l = nil
+		}
+		if l == nil {
+			l = MkBlkList()
+		}
+		l.PushBack(b)
+	}
+	if l != nil {
+		bcache.readahead(l)
+	}
+}
+
+// reads the new, locked blocks of l, which are contiguous on disk, and then
+// unlocks and releases them
+func (bcache *bcache_t) readahead(l *BlkList_t) {
+	bcache.rastats.Nrarequest.Inc()
+	done := func() {
+		l.Apply(func(b *Bdev_block_t) {
+			b.Unlock()
+			bcache.Relse(b, "readahead")
+		})
+	}
+	req := MkRequest(l, BDEV_READ, true)
+	if bcache.disk.Start(req) {
+		go func() {
+			<-req.AckCh
+			done()
+		}()
+	} else {
+		done()
 	}
-	return b
 }
 
 // returns locked buf with refcnt on page bumped up by 1. caller must call
@@ -106,6 +208,36 @@ func (bcache *bcache_t) Get_nofill(blkn int, s string, lock bool) *Bdev_block_t
 	return b
 }
 
+// returns the locked buf of blkn with refcnt on page bumped up by 1, or nil if
+// blkn isn't cached. caller must call bcache_relse when done with buf.
+func (bcache *bcache_t) Get_cached(blkn int, s string) *Bdev_block_t {
+	ref, ok := bcache.cache.lookupinc(blkn)
+	if !ok {
+		return nil
+	}
+	// the lock waits for the thread that is filling a new buf
+	b := ref.Obj.(*Bdev_block_t)
+	b.Lock()
+	return b
+}
+
+// transfers block blkn between the disk and the page pa, whose kernel mapping
+// is data, bypassing the cache. waits for the transfer to finish.
+func (bcache *bcache_t) Direct(cmd Bdevcmd_t, blkn int, pa mem.Pa_t, data *mem.Bytepg_t) {
+	if bdev_debug {
+		fmt.Printf("bcache_direct: %v %v\n", cmd, blkn)
+	}
+	b := MkBlock(blkn, "direct", bcache.mem, bcache.disk, &_nop_relse)
+	b.Pa = pa
+	b.Data = data
+	l := MkBlkList()
+	l.PushBack(b)
+	req := MkRequest(l, cmd, true)
+	if bcache.disk.Start(req) {
+		<-req.AckCh
+	}
+}
+
 func (bcache *bcache_t) Write(b *Bdev_block_t) {
 	bcache.Refup(b, "write")
 	b.Write()
@@ -200,7 +332,8 @@ func (bcache *bcache_t) Relse(b *Bdev_block_t, s string) {
 }
 
 func (bcache *bcache_t) Stats() string {
-	return "bcache" + bcache.cache.Stats()
+	return "bcache" + bcache.cache.Stats() + "readahead" +
+		stats.Stats2String(bcache.rastats)
 }
 
 //
@@ -244,6 +377,7 @@ func (bcache *bcache_t) pin(b *Bdev_block_t) {
 		panic("uh oh")
 	}
 	bcache.pins[b.Pa] = b
+	bcache.mapped[b.Block]++
 	bcache.Unlock()
 }
 
@@ -255,9 +389,39 @@ func (bcache *bcache_t) unpin(pa mem.Pa_t) {
 	if !ok {
 		panic("block no pinned")
 	}
+	// a forked child unpins pages its parent pinned
+	if n := bcache.mapped[b.Block]; n > 1 {
+		bcache.mapped[b.Block] = n - 1
+	} else {
+		delete(bcache.mapped, b.Block)
+	}
 	bcache.Relse(b, "unpin")
 }
 
+// reports whether a shared mapping maps block blkn
+func (bcache *bcache_t) ismapped(blkn int) bool {
+	bcache.Lock()
+	defer bcache.Unlock()
+	return bcache.mapped[blkn] != 0
+}
+
+// zeros the page of block blkn if a shared mapping maps it, such that the
+// mapping reads zeros once blkn is freed. the zeros aren't logged, like writes
+// through the mapping.
+func (bcache *bcache_t) zeromapped(blkn int) {
+	if !bcache.ismapped(blkn) {
+		return
+	}
+	b := bcache.Get_cached(blkn, "zeromapped")
+	if b == nil {
+		panic("mapped block not cached")
+	}
+	var zdata [BSIZE]uint8
+	copy(b.Data[:], zdata[:])
+	b.Unlock()
+	bcache.Relse(b, "zeromapped")
+}
+
 func bdev_test(mem Blockmem_i, disk Disk_i, bcache *bcache_t) {
 	return
 
@@ -307,11 +471,19 @@ type bbitmap_t struct {
 	start int
 	len   int
 	first int
+	// protects the reference count table; see reflink.go
+	rc sync.Mutex
 }
 
 func mkBallocater(fs *Fs_t, start, len, first int) *bbitmap_t {
 	balloc := &bbitmap_t{}
-	balloc.alloc = mkAllocater(fs, start, len, fs.fslog)
+	balloc.alloc = mkAllocater(fs, start, len, fs.superb.Bmapblk, fs.fslog)
+	// a freed block whose page a shared mapping still maps isn't reused
+	// until the mapping goes away, lest the mapping expose the new owner's
+	// data
+	balloc.alloc.busy = func(bit int) bool {
+		return fs.bcache.ismapped(bit + first)
+	}
 	if bdev_debug {
 		fmt.Printf("bmap start %v bmaplen %v first datablock %v free %d\n", start, len, first,
 			balloc.alloc.nfreebits)
@@ -324,7 +496,13 @@ func mkBallocater(fs *Fs_t, start, len, first int) *bbitmap_t {
 }
 
 func (balloc *bbitmap_t) Balloc(opid opid_t) (int, defs.Err_t) {
-	ret, err := balloc.balloc1(opid)
+	return balloc.Balloc_near(opid, 0)
+}
+
+// Balloc_near is Balloc, but allocates block goal if it is free, which keeps
+// the blocks of a growing file contiguous.
+func (balloc *bbitmap_t) Balloc_near(opid opid_t, goal int) (int, defs.Err_t) {
+	ret, err := balloc.balloc1(opid, goal)
 	if err != 0 {
 		return 0, err
 	}
@@ -348,7 +526,9 @@ func (balloc *bbitmap_t) Balloc(opid opid_t) (int, defs.Err_t) {
 	return ret, 0
 }
 
-func (balloc *bbitmap_t) Bfree(opid opid_t, blkno int) {
+// frees block blkno, or only removes an owner if other files share it. returns
+// the block of the bitmap or of the reference count table that was written.
+func (balloc *bbitmap_t) Bfree(opid opid_t, blkno int) int {
 	blkno -= balloc.first
 	if bdev_debug {
 		fmt.Printf("bfree: %v free before %d\n", blkno, balloc.alloc.nfreebits)
@@ -359,7 +539,13 @@ func (balloc *bbitmap_t) Bfree(opid opid_t, blkno int) {
 	if blkno >= balloc.len*BSIZE*8 {
 		panic("bfree too large")
 	}
+	balloc.rc.Lock()
+	defer balloc.rc.Unlock()
+	if leaf, ok := balloc.rcdec(opid, blkno); ok {
+		return leaf
+	}
 	balloc.alloc.Unmark(opid, blkno)
+	return balloc.alloc.bitmapblkno(blkno)
 }
 
 func (balloc *bbitmap_t) Stats() string {
@@ -371,8 +557,8 @@ func (balloc *bbitmap_t) Stats() string {
 // allocates a block, marking it used in the free block bitmap. free blocks and
 // log blocks are not accounted for in the free bitmap; all others are. balloc
 // should only ever acquire fblock.
-func (balloc *bbitmap_t) balloc1(opid opid_t) (int, defs.Err_t) {
-	blkn, err := balloc.alloc.FindAndMark(opid)
+func (balloc *bbitmap_t) balloc1(opid opid_t, goal int) (int, defs.Err_t) {
+	blkn, err := balloc.alloc.FindAndMarkNear(opid, goal-balloc.first)
 	if err != 0 {
 		fmt.Printf("balloc1: %v\n", err)
 		return 0, err
@@ -11,11 +11,12 @@ import "stats"
 
 // Bitmap allocater/marker. Used for inodes, blocks, and orphan inodes.
 
-const bitsperblk = BSIZE * 8
+// the last CSUMSIZE bytes of a bitmap block hold its checksum
+const bitsperblk = (BSIZE - CSUMSIZE) * 8
 
 type storage_i interface {
 	Write(opid_t, *Bdev_block_t)
-	Get_fill(int, string, bool) *Bdev_block_t
+	Get_fill_csum(int, string, bool) *Bdev_block_t
 	Relse(*Bdev_block_t, string)
 }
 
@@ -36,15 +37,21 @@ type bitmap_t struct {
 	stats     bitmapstats_t
 	freemap   []uint8
 	last      int
+	// maps a block of the bitmap to its disk block if the bitmap is not
+	// contiguous
+	blkmap func(int) int
+	// reports whether a free bit must not be allocated yet, or nil
+	busy func(int) bool
 }
 
 const NFREE = 1000
 
-func mkAllocater(fs *Fs_t, start, len int, s storage_i) *bitmap_t {
+func mkAllocater(fs *Fs_t, start, len int, blkmap func(int) int, s storage_i) *bitmap_t {
 	a := &bitmap_t{}
 	a.fs = fs
 	a.freestart = start
 	a.freelen = len
+	a.blkmap = blkmap
 	a.storage = s
 	a.apply(0, func(b, v int) bool {
 		if v == 0 {
@@ -53,12 +60,17 @@ func mkAllocater(fs *Fs_t, start, len int, s storage_i) *bitmap_t {
 		return true
 	})
 	if !fs.diskfs {
-		a.freemap = make([]uint8, (a.freelen * BSIZE))
+		a.freemap = make([]uint8, (a.freelen * bitsperblk / 8))
 		a.populateFreeMap()
 	}
 	return a
 }
 
+// reports whether the free bit may not be allocated
+func (alloc *bitmap_t) isbusy(bit int) bool {
+	return alloc.busy != nil && alloc.busy(bit)
+}
+
 func blkno(bit int) int {
 	return bit / bitsperblk
 }
@@ -75,15 +87,23 @@ func byteoffset(bit int) int {
 	return blkoffset(bit) % 8
 }
 
+// returns the disk block holding block n of the bitmap
+func (alloc *bitmap_t) diskblk(n int) int {
+	if alloc.blkmap != nil {
+		return alloc.blkmap(n)
+	}
+	return alloc.freestart + n
+}
+
 func (alloc *bitmap_t) bitmapblkno(bit int) int {
-	return alloc.freestart + blkno(bit)
+	return alloc.diskblk(blkno(bit))
 }
 
 func (alloc *bitmap_t) Fbread(blockno int) *Bdev_block_t {
 	if blockno < 0 || blockno >= alloc.freelen {
 		panic("naughty blockno")
 	}
-	return alloc.storage.Get_fill(alloc.freestart+blockno, "fbread", true)
+	return alloc.storage.Get_fill_csum(alloc.diskblk(blockno), "fbread", true)
 }
 
 // apply f to every bit starting from start, until f is false.  return true if
@@ -134,9 +154,10 @@ func (alloc *bitmap_t) CheckAndMark(opid opid_t) (int, defs.Err_t) {
 	bit := byteoffset(alloc.lastbit)
 
 	blk := alloc.Fbread(blkno)
-	if blk.Data[byte]&(1<<uint(bit)) == 0 {
+	if blk.Data[byte]&(1<<uint(bit)) == 0 && !alloc.isbusy(bitno) {
 		alloc.lastbit++
 		blk.Data[byte] |= (1 << uint(bit))
+		Csumw(blk.Data)
 		blk.Unlock()
 		alloc.storage.Write(opid, blk)
 		alloc.storage.Relse(blk, "CheckAndMark")
@@ -150,8 +171,8 @@ func (alloc *bitmap_t) CheckAndMark(opid opid_t) (int, defs.Err_t) {
 func (alloc *bitmap_t) populateFreeMap() {
 	for bn := 0; bn < alloc.freelen; bn++ {
 		blk := alloc.Fbread(bn)
-		for i := 0; i < len(blk.Data); i++ {
-			alloc.freemap[bn*4096+i] = blk.Data[i]
+		for i := 0; i < bitsperblk/8; i++ {
+			alloc.freemap[bn*bitsperblk/8+i] = blk.Data[i]
 		}
 		blk.Unlock()
 		alloc.storage.Relse(blk, "alloc apply")
@@ -168,14 +189,13 @@ func (alloc *bitmap_t) FindFreeMap(opid opid_t) (int, defs.Err_t) {
 			alloc.last = i
 			for j := 0; j < 8; j++ {
 				v := alloc.freemap[i] & (1 << uint(j))
-				if v == 0 {
+				if v == 0 && !alloc.isbusy(i*8+j) {
 					alloc.freemap[i] |= (1 << uint(j))
 					alloc.nfreebits--
 					alloc.Unlock()
 					return (i*8 + j), 0
 				}
 			}
-			panic("FindFreeMap")
 		}
 		if i+1 >= len(alloc.freemap) {
 			i = 0
@@ -199,7 +219,7 @@ func (alloc *bitmap_t) FindDiskMap(opid opid_t) (int, defs.Err_t) {
 		alloc.stats.Nhit.Inc()
 	} else {
 		alloc.apply(0, func(b, v int) bool {
-			if v == 0 {
+			if v == 0 && !alloc.isbusy(b) {
 				alloc.lastbit = b
 				return false
 			}
@@ -224,6 +244,34 @@ func (alloc *bitmap_t) FindAndMark(opid opid_t) (int, defs.Err_t) {
 	}
 }
 
+// FindAndMarkNear is FindAndMark, but allocates bit goal if it is free.
+func (alloc *bitmap_t) FindAndMarkNear(opid opid_t, goal int) (int, defs.Err_t) {
+	if goal < 0 || goal >= alloc.freelen*bitsperblk {
+		return alloc.FindAndMark(opid)
+	}
+	alloc.Lock()
+	if alloc.fs.diskfs {
+		last := alloc.lastbit
+		alloc.lastbit = goal
+		if bit, err := alloc.CheckAndMark(opid); err == 0 {
+			alloc.stats.Nhit.Inc()
+			alloc.stats.Nalloc.Inc()
+			alloc.nfreebits--
+			alloc.Unlock()
+			return bit, 0
+		}
+		alloc.lastbit = last
+	} else if alloc.freemap[goal/8]&(1<<uint(goal%8)) == 0 &&
+		!alloc.isbusy(goal) {
+		alloc.freemap[goal/8] |= 1 << uint(goal%8)
+		alloc.nfreebits--
+		alloc.Unlock()
+		return goal, 0
+	}
+	alloc.Unlock()
+	return alloc.FindAndMark(opid)
+}
+
 func (alloc *bitmap_t) Unmark(opid opid_t, bit int) {
 	alloc.Lock()
 
@@ -249,6 +297,7 @@ func (alloc *bitmap_t) Unmark(opid opid_t, bit int) {
 	fbitoff := byteoffset(bit)
 	fblk := alloc.Fbread(fblkno)
 	fblk.Data[fbyteoff] &= ^(1 << uint(fbitoff))
+	Csumw(fblk.Data)
 	fblk.Unlock()
 	alloc.storage.Write(opid, fblk)
 	alloc.storage.Relse(fblk, "Unmark")
@@ -274,6 +323,7 @@ func (alloc *bitmap_t) Mark(opid opid_t, bit int) {
 	fbitoff := byteoffset(bit)
 	fblk := alloc.Fbread(fblkno)
 	fblk.Data[fbyteoff] |= 1 << uint(fbitoff)
+	Csumw(fblk.Data)
 	fblk.Unlock()
 	alloc.storage.Write(opid, fblk)
 	alloc.storage.Relse(fblk, "Mark")
@@ -329,6 +379,7 @@ func (alloc *bitmap_t) MarkUnmark(opid opid_t, mark, unmark []int) {
 
 		// done with this block
 		if blk != nil && blk.Block != fblkno {
+			Csumw(blk.Data)
 			blk.Unlock()
 			alloc.storage.Write(opid, blk)
 			alloc.storage.Relse(blk, "MarkUnmark")
@@ -346,6 +397,7 @@ func (alloc *bitmap_t) MarkUnmark(opid opid_t, mark, unmark []int) {
 		}
 	}
 	if blk != nil {
+		Csumw(blk.Data)
 		blk.Unlock()
 		alloc.storage.Write(opid, blk)
 		alloc.storage.Relse(blk, "MarkUnmark")
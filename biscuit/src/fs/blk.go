@@ -33,6 +33,8 @@ type Bdev_block_t struct {
 	Block      int
 	Type       blktype_t
 	_try_evict bool
+	// read ahead and not yet read by Get_fill()
+	_readahead bool
 	Pa         mem.Pa_t
 	Data       *mem.Bytepg_t
 	Ref        *Objref_t
@@ -1,8 +1,7 @@
 package fs
 
 //import "fmt"
-import "runtime"
-import "sort"
+import "container/list"
 import "sync"
 import "sync/atomic"
 
@@ -20,13 +19,23 @@ import "stats"
 // refcache_t that an object isn't in use anymore.  Refcache itself would use a
 // weak reference to an object, so that the GC could collect the object, if it
 // is low on memory.
+//
+// The cache evicts objects using 2Q (Johnson and Shasha, VLDB '94), so that a
+// scan, which uses each object once, doesn't evict the objects that are used
+// repeatedly. A new object enters the a1in FIFO; an object evicted from a1in
+// leaves its key in the a1out ghost FIFO. An object that is looked up while
+// its key is in a1out has been used again after a while and enters am, which
+// holds the frequently used objects. Instead of LRU, am is a CLOCK: a lookup
+// only sets the object's used bit, so that hits don't serialize on a lock, and
+// the evictor gives a used object a second chance.
 
 const REMOVE = uint32(0xF0000000)
 
 type cstats_t struct {
-	Nevict stats.Counter_t
-	Nhit   stats.Counter_t
-	Nadd   stats.Counter_t
+	Nevict    stats.Counter_t
+	Nhit      stats.Counter_t
+	Nmiss     stats.Counter_t
+	Nghosthit stats.Counter_t
 }
 
 type Obj_t interface {
@@ -38,7 +47,12 @@ type Objref_t struct {
 	Key    int
 	Obj    Obj_t
 	refcnt uint32
-	tstamp uint64
+	// set by a lookup and cleared by the evictor
+	used uint32
+	// the queue the object is on and its neighbors, which cache_t.qlock
+	// protects
+	q          *queue_t
+	prev, next *Objref_t
 }
 
 func MkObjref(obj Obj_t, key int) *Objref_t {
@@ -46,7 +60,6 @@ func MkObjref(obj Obj_t, key int) *Objref_t {
 	e.Obj = obj
 	e.Key = key
 	e.refcnt = uint32(1)
-	e.tstamp = runtime.Rdtsc()
 	return e
 }
 
@@ -90,15 +103,75 @@ func (ref *Objref_t) Down() uint32 {
 	return v
 }
 
+// A FIFO of objects, linked through the objects themselves
+type queue_t struct {
+	head, tail *Objref_t
+	len        int
+}
+
+func (q *queue_t) push(e *Objref_t) {
+	if e.q != nil {
+		panic("push: on a queue")
+	}
+	e.q = q
+	e.prev = q.tail
+	e.next = nil
+	if q.tail != nil {
+		q.tail.next = e
+	} else {
+		q.head = e
+	}
+	q.tail = e
+	q.len++
+}
+
+func (q *queue_t) unlink(e *Objref_t) {
+	if e.q != q {
+		panic("unlink: not on queue")
+	}
+	if e.prev != nil {
+		e.prev.next = e.next
+	} else {
+		q.head = e.next
+	}
+	if e.next != nil {
+		e.next.prev = e.prev
+	} else {
+		q.tail = e.prev
+	}
+	e.q, e.prev, e.next = nil, nil, nil
+	q.len--
+}
+
+// moves e to the tail
+func (q *queue_t) rotate(e *Objref_t) {
+	q.unlink(e)
+	q.push(e)
+}
+
 type cache_t struct {
+	// serializes evictors
 	sync.Mutex
 	cache *hashtable.Hashtable_t
 	stats cstats_t
+	// qlock protects the queues. it is separate from the evictor's lock,
+	// because evicting an object may remove other objects from the cache.
+	qlock sync.Mutex
+	a1in  queue_t
+	am    queue_t
+	// the keys of the objects evicted from a1in, oldest first
+	a1out  *list.List
+	ghosts map[int]*list.Element
+	// the number of objects the cache is sized for
+	size int
 }
 
 func mkCache(size int) *cache_t {
 	c := &cache_t{}
 	c.cache = hashtable.MkHash(size)
+	c.a1out = list.New()
+	c.ghosts = make(map[int]*list.Element)
+	c.size = size
 	return c
 }
 
@@ -136,19 +209,41 @@ func (c *cache_t) Lookup(key int, mkobj func(int) Obj_t) (*Objref_t, bool) {
 		e, ok := c.lookupinc(key)
 		if ok {
 			c.stats.Nhit.Inc()
-			atomic.StoreUint64(&e.tstamp, runtime.Rdtsc())
+			if atomic.LoadUint32(&e.used) == 0 {
+				atomic.StoreUint32(&e.used, 1)
+			}
 			return e, false
 		}
 		e = MkObjref(mkobj(key), key)
 		_, ok = c.cache.Set(key, e)
 		if ok {
-			c.stats.Nadd.Inc()
+			c.stats.Nmiss.Inc()
+			c.insert(e)
 			return e, true
 		}
 		// someone else created it, try lookup again
 	}
 }
 
+// puts a new object on am if its key is a ghost and on a1in otherwise
+func (c *cache_t) insert(e *Objref_t) {
+	c.qlock.Lock()
+	defer c.qlock.Unlock()
+
+	if atomic.LoadUint32(&e.refcnt)&REMOVE != 0 {
+		// removed before we got here
+		return
+	}
+	if g, ok := c.ghosts[e.Key]; ok {
+		c.stats.Nghosthit.Inc()
+		c.a1out.Remove(g)
+		delete(c.ghosts, e.Key)
+		c.am.push(e)
+	} else {
+		c.a1in.push(e)
+	}
+}
+
 // Note remove can fail, because a concurrent lookup resurrects the refcnt (or
 // the refcnt is already larger than 0).
 func (c *cache_t) Remove(key int) bool {
@@ -167,7 +262,8 @@ func (c *cache_t) _remove(key int, mustexist bool) bool {
 		e := v.(*Objref_t)
 		cnt := e.Refcnt()
 		if cnt == 0 && atomic.CompareAndSwapUint32(&e.refcnt, cnt, cnt|REMOVE) {
-			c.delete(e)
+			// only eviction remembers the key
+			c.delete(e, !mustexist)
 			return true
 		}
 		return false
@@ -185,30 +281,58 @@ func (c *cache_t) Stats() string {
 	return s
 }
 
-type ByStamp []hashtable.Pair_t
+// the evictor keeps a1in at about a quarter of the cached objects. the cache
+// remembers the keys of half as many objects as it is sized for, independent
+// of how many are cached, so that objects evicted under memory pressure can
+// still be recognized when they are used again.
+func (c *cache_t) kin() int {
+	return (c.a1in.len + c.am.len) / 4
+}
 
-func (a ByStamp) Len() int      { return len(a) }
-func (a ByStamp) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
-func (a ByStamp) Less(i, j int) bool {
-	e1 := a[i].Value.(*Objref_t)
-	e2 := a[j].Value.(*Objref_t)
-	v1 := atomic.LoadUint64(&e1.tstamp)
-	v2 := atomic.LoadUint64(&e2.tstamp)
-	return v1 < v2
+func (c *cache_t) kout() int {
+	return c.size / 2
 }
 
-// Evicts up-to half of the objects in the cache. returns the number of cache
-// entries remaining and the number evicted.
-func (c *cache_t) Evict_half() (int, int) {
+// returns the next object to try to evict, which it moves to the tail of its
+// queue so that the evictor makes progress if the object cannot be evicted.
+func (c *cache_t) victim() *Objref_t {
+	c.qlock.Lock()
+	defer c.qlock.Unlock()
+
+	if c.a1in.len > c.kin() || c.am.len == 0 {
+		e := c.a1in.head
+		if e != nil {
+			c.a1in.rotate(e)
+		}
+		return e
+	}
+	// skip over the objects used since the clock hand last passed them,
+	// but not forever
+	for i := 0; i < c.am.len; i++ {
+		e := c.am.head
+		c.am.rotate(e)
+		if atomic.LoadUint32(&e.used) == 0 {
+			return e
+		}
+		atomic.StoreUint32(&e.used, 0)
+	}
+	e := c.am.head
+	c.am.rotate(e)
+	return e
+}
+
+// Evicts up to n of the objects in the cache that no thread references.
+// returns the number of cache entries remaining and the number evicted.
+func (c *cache_t) Evict(n int) (int, int) {
 	c.Lock()
 	defer c.Unlock()
 
-	upto := c.cache.Size()
 	did := 0
-	elems := c.cache.Elems()
-	sort.Sort(ByStamp(elems))
-	for _, p := range elems { // XXX only need the keys, not complete elems
-		e := p.Value.(*Objref_t)
+	for tries := c.Len(); did < n && tries > 0; tries-- {
+		e := c.victim()
+		if e == nil {
+			break
+		}
 		// evict each inode's dcache before setting REMOVE to ensure
 		// that a concurrent lock-free namei can't succeed on an
 		// evicted inode
@@ -219,10 +343,32 @@ func (c *cache_t) Evict_half() (int, int) {
 		e.Obj.EvictDone()
 		did++
 	}
-	return upto - did, did
+	return c.Len(), did
 }
 
-func (c *cache_t) delete(o *Objref_t) {
+func (c *cache_t) delete(o *Objref_t, ghost bool) {
+	c.dequeue(o, ghost)
 	c.cache.Del(o.Key)
 	c.stats.Nevict.Inc()
 }
+
+// takes o off its queue and, if o is evicted from a1in, remembers its key
+func (c *cache_t) dequeue(o *Objref_t, ghost bool) {
+	c.qlock.Lock()
+	defer c.qlock.Unlock()
+
+	q := o.q
+	if q == nil {
+		// not inserted yet
+		return
+	}
+	q.unlink(o)
+	if ghost && q == &c.a1in {
+		c.ghosts[o.Key] = c.a1out.PushBack(o.Key)
+		for c.a1out.Len() > c.kout() {
+			f := c.a1out.Front()
+			delete(c.ghosts, f.Value.(int))
+			c.a1out.Remove(f)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package fs
+
+import "hash/crc32"
+
+import "mem"
+import "util"
+
+// Metadata checksums.
+//
+// The last CSUMSIZE bytes of bitmap blocks, directory blocks, and the inode
+// blocks of a file system with FEAT_XATTR hold a CRC-32C of the rest of the
+// block. The layouts of those blocks leave these bytes unused; ISIZE inodes
+// use the whole block, thus their blocks have no checksum. The file system stamps the checksum while it holds
+// the lock of the block, right before it writes the block, so every copy the
+// log or the disk gets carries a checksum that matches. Get_fill_csum()
+// verifies the checksum of a block that it reads from the disk; a block that
+// doesn't match is reported and counted (see Fs_statistics()), but used
+// anyway, since it may be only partly damaged.
+//
+// The log checksums its transactions separately; see log_t.chktrans().
+
+const CSUMSIZE = 4
+
+var crctab = crc32.MakeTable(crc32.Castagnoli)
+
+func csum(d *mem.Bytepg_t) int {
+	return int(crc32.Checksum(d[:BSIZE-CSUMSIZE], crctab))
+}
+
+// Csumw stamps the checksum of block d.
+func Csumw(d *mem.Bytepg_t) {
+	util.Writen(d[:], CSUMSIZE, BSIZE-CSUMSIZE, csum(d))
+}
+
+// Csumok returns true if the checksum of block d matches its contents.
+func Csumok(d *mem.Bytepg_t) bool {
+	return util.Readn(d[:], CSUMSIZE, BSIZE-CSUMSIZE) == csum(d)
+}
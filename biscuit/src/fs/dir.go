@@ -6,6 +6,7 @@ import "unsafe"
 
 import "bounds"
 import "defs"
+import "fdops"
 import "hashtable"
 import "mem"
 import "res"
@@ -160,6 +161,13 @@ func (idm *imemnode_t) _denextempty(opid opid_t) (int, defs.Err_t) {
 	// from the free list.
 	idm.dentc.scanned = true
 
+	// a directory outgrowing its first block gets an index
+	if idm.size == BSIZE {
+		if err := idm._dxbuild(opid); err != 0 {
+			return 0, err
+		}
+	}
+
 	// current dir blocks are full -- allocate new dirdata block. because
 	// the offset of the new block is larger than idm.size, off2buf will
 	// zero-fill the block.
@@ -175,6 +183,7 @@ func (idm *imemnode_t) _denextempty(opid opid_t) (int, defs.Err_t) {
 		idm._deaddempty(noff)
 	}
 
+	Csumw(b.Data)
 	b.Unlock()
 	idm.fs.fslog.Write(opid, b) // log empty dir block, later writes absorpt it hopefully
 	idm.fs.fslog.Relse(b, "_denextempty")
@@ -192,6 +201,14 @@ func (idm *imemnode_t) _deinsert(opid opid_t, name ustr.Ustr, inum defs.Inum_t)
 	if err != 0 {
 		return err
 	}
+	dx, err := idm._dxindexed(opid)
+	if err == 0 && dx {
+		err = idm._dxinsert(opid, name, noff)
+	}
+	if err != 0 {
+		idm._deaddempty(noff)
+		return err
+	}
 	// dennextempty() made the slot so we won't fill
 	b, err := idm.off2buf(opid, noff, NDBYTES, true, true, "_deinsert")
 	if err != 0 {
@@ -202,6 +219,7 @@ func (idm *imemnode_t) _deinsert(opid opid_t, name ustr.Ustr, inum defs.Inum_t)
 	ddata.W_filename(0, name)
 	ddata.W_inodenext(0, inum)
 
+	Csumw(b.Data)
 	b.Unlock()
 	idm.fs.fslog.Write(opid, b)
 	idm.fs.fslog.Relse(b, "_deinsert")
@@ -229,6 +247,11 @@ func (idm *imemnode_t) _descan(opid opid_t, f func(fn ustr.Ustr, de *icdent_t) b
 		if err != 0 {
 			return false, err
 		}
+		if isdxblk(b.Data) {
+			b.Unlock()
+			idm.fs.fslog.Relse(b, "_descan")
+			continue
+		}
 		dd := Dirdata_t{b.Data[:]}
 		for j := 0; j < NDIRENTS; j++ {
 			tfn := dd.Filename(j)
@@ -263,6 +286,16 @@ func (idm *imemnode_t) _delookup(opid opid_t, fn ustr.Ustr) (*icdent_t, defs.Err
 		// cache negative entries?
 		return zi, -defs.ENOENT
 	}
+	if dx, err := idm._dxindexed(opid); err != 0 {
+		return zi, err
+	} else if dx {
+		de, err := idm._dxlookup(opid, fn)
+		if err != 0 {
+			return zi, err
+		}
+		idm._dceadd(fn, de)
+		return de, 0
+	}
 
 	// not in cached dirents
 	found := false
@@ -298,9 +331,9 @@ func (idm *imemnode_t) _deremove(opid opid_t, fn ustr.Ustr) (*icdent_t, defs.Err
 		return zi, err
 	}
 	// it's good for the memory FS performance to skip updating the data
-	// blocks, but our implementation of readdir(3) requires it (because it
-	// reads the directory's contents from the data blocks). therefore,
-	// make the data block update unconditional.
+	// blocks, but getdents requires it (because it reads the directory's
+	// contents from the data blocks). therefore, make the data block
+	// update unconditional.
 	if true || idm.fs.diskfs {
 		b, err := idm.off2buf(opid, de.offset, NDBYTES, true, true, "_deremove")
 		if err != 0 {
@@ -309,10 +342,15 @@ func (idm *imemnode_t) _deremove(opid opid_t, fn ustr.Ustr) (*icdent_t, defs.Err
 		dirdata := Dirdata_t{b.Data[de.offset%mem.PGSIZE:]}
 		dirdata.W_filename(0, ustr.MkUstr())
 		dirdata.W_inodenext(0, defs.Inum_t(0))
+		Csumw(b.Data)
 		b.Unlock()
 		idm.fs.fslog.Write(opid, b)
 		idm.fs.fslog.Relse(b, "_deremove")
 	}
+	// a failure leaves a stale index entry behind, which is harmless
+	if dx, err := idm._dxindexed(opid); err == 0 && dx {
+		idm._dxremove(opid, fn, de.offset)
+	}
 	idm._deremove_dent(de)
 	idm._deaddempty(de.offset)
 	return de, 0
@@ -397,14 +435,22 @@ func (idm *imemnode_t) _deaddempty(off int) {
 }
 
 // guarantee that there is enough memory to insert at least one directory
-// entry.
-func (idm *imemnode_t) probe_insert(opid opid_t) (*Bdev_block_t, defs.Err_t) {
+// entry, and room in the index for name.
+func (idm *imemnode_t) probe_insert(opid opid_t, name ustr.Ustr) (*Bdev_block_t, defs.Err_t) {
 	// insert and remove a fake directory entry, forcing a page allocation
 	// if necessary.
 	b, err := idm._deprobe(opid, ustr.MkUstr())
 	if err != 0 {
 		return nil, err
 	}
+	dx, err := idm._dxindexed(opid)
+	if err == 0 && dx {
+		err = idm._dxroom(opid, name)
+	}
+	if err != 0 {
+		idm.fs.fslog.Relse(b, "probe_insert")
+		return nil, err
+	}
 	return b, 0
 }
 
@@ -530,6 +576,9 @@ func (idm *imemnode_t) iinsert(opid opid_t, name ustr.Ustr, inum defs.Inum_t) de
 		panic("iinsert")
 	}
 	err := idm._deinsert(opid, name, inum)
+	if err == 0 {
+		idm.touch()
+	}
 	return err
 }
 
@@ -542,6 +591,7 @@ func (idm *imemnode_t) iunlink(opid opid_t, name ustr.Ustr) (defs.Inum_t, defs.E
 	if err != 0 {
 		return 0, err
 	}
+	idm.touch()
 	return de.inum, 0
 }
 
@@ -552,3 +602,97 @@ func (idm *imemnode_t) idirempty(opid opid_t) (bool, defs.Err_t) {
 	}
 	return idm._deempty(opid)
 }
+
+// returns the linux_dirent64 file type of the inode named by de
+func (idm *imemnode_t) _detype(de *icdent_t) uint8 {
+	if de.name.Isdotdot() {
+		return defs.DT_DIR
+	}
+	child := idm.fs.icache.Iref(de.inum, "_detype")
+	itype, maj := child.itype, child.major
+	child.Refdown("_detype")
+	switch itype {
+	case I_FILE:
+		return defs.DT_REG
+	case I_DIR:
+		return defs.DT_DIR
+	case I_SYMLINK:
+		return defs.DT_LNK
+	case I_DEV:
+		if maj == defs.D_SUD || maj == defs.D_SUS {
+			return defs.DT_SOCK
+		}
+		return defs.DT_CHR
+	}
+	return defs.DT_UNKNOWN
+}
+
+// copies the entries of idm, starting with the entry at offset off, to dst as
+// linux_dirent64 records until dst is full. an entry's offset is the offset of
+// its slot in the directory data, which never changes, and thus an offset
+// returned by do_getdents remains valid across concurrent insertions and
+// removals. returns the number of bytes written and the offset from which to
+// continue, which reflects the records written even if an error is returned.
+// idm must be locked.
+func (idm *imemnode_t) do_getdents(dst fdops.Userio_i, off int) (int, int, defs.Err_t) {
+	if !idm._amlocked {
+		panic("getdents")
+	}
+	if idm.itype != I_DIR {
+		return 0, off, -defs.ENOTDIR
+	}
+	if boff := off % BSIZE; boff%NDBYTES != 0 || boff >= NDIRENTS*NDBYTES {
+		return 0, off, -defs.EINVAL
+	}
+	idm.atime = inodetime()
+
+	did := 0
+	for blk := util.Rounddown(off, BSIZE); blk < idm.size; blk += BSIZE {
+		if !res.Resadd_noblock(bounds.Bounds(bounds.B_IMEMNODE_T__DESCAN)) {
+			return did, off, -defs.ENOHEAP
+		}
+		// collect the block's entries before looking up their inodes
+		// so that the directory block isn't locked while the inodes
+		// are filled
+		b, err := idm.off2buf(opid_t(0), blk, BSIZE, false, true, "getdents")
+		if err != 0 {
+			return did, off, err
+		}
+		var dents []icdent_t
+		dd := Dirdata_t{b.Data[:]}
+		// index blocks hold no entries
+		nents := NDIRENTS
+		if isdxblk(b.Data) {
+			nents = 0
+		}
+		for j := (off - blk) / NDBYTES; j < nents; j++ {
+			if fn := dd.Filename(j); len(fn) != 0 {
+				dents = append(dents, icdent_t{offset: blk + j*NDBYTES,
+					inum: dd.inodenext(j), name: fn})
+			}
+		}
+		b.Unlock()
+		idm.fs.fslog.Relse(b, "getdents")
+
+		for i := range dents {
+			de := &dents[i]
+			next := de.offset + NDBYTES
+			if next-blk >= NDIRENTS*NDBYTES {
+				next = blk + BSIZE
+			}
+			if util.Direntlen(de.name) > dst.Remain() {
+				if did == 0 {
+					return 0, off, -defs.EINVAL
+				}
+				return did, de.offset, 0
+			}
+			rec := util.Dirent(int(de.inum), next, idm._detype(de), de.name)
+			if _, err := dst.Uiowrite(rec); err != 0 {
+				return did, de.offset, err
+			}
+			did += len(rec)
+		}
+		off = blk + BSIZE
+	}
+	return did, off, 0
+}
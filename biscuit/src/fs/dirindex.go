@@ -0,0 +1,344 @@
+package fs
+
+import "defs"
+import "mem"
+import "ustr"
+import "util"
+
+// Hashed directory index.
+//
+// A directory that outgrows its first block gets an index, similar in spirit
+// to ext4's htree, so that looking up a name when the dirent cache is cold
+// reads a couple of blocks instead of every block of the directory. The index
+// lives in the directory's own blocks: when the directory grows beyond its
+// first block, the second block becomes the index root, and index leaves are
+// appended to the directory as needed, interleaved with blocks of directory
+// entries. Index blocks start with a magic whose first byte is zero, which a
+// block of directory entries never does (the first byte of an empty entry's
+// name is zero, but so are the rest), and everything that scans directory
+// entries skips index blocks. Directory entries never move; the index maps
+// the hash of a name to the offset of its directory entry.
+//
+// The index uses extendible hashing. The root holds the global depth and
+// 2^depth pointers to leaves. A leaf holds its local depth and up to DXNPAIRS
+// (hash, offset) pairs. A full leaf is split in two, doubling the pointers in
+// the root first if the leaf's local depth equals the global depth. The index
+// is written through the log in the same operation as the directory entries
+// it describes, thus it is always consistent with them after a crash. A pair
+// whose entry was cleared or reused is harmless since lookups compare names.
+//
+// root format
+// 0-3,   magic
+// 4-7,   global depth
+// 8-15,  unused
+// 16-,   leaf file block numbers, 4 bytes each
+//
+// leaf format
+// 0-3,   magic
+// 4-7,   local depth
+// 8-11,  number of pairs
+// 12-15, unused
+// 16-,   (name hash, directory entry offset) pairs, 4 bytes each
+
+const (
+	DXHDR      = 16
+	DXNPAIRS   = (BSIZE - DXHDR - CSUMSIZE) / 8
+	DXMAXDEPTH = 9
+	// the offset of the root in an indexed directory
+	DXROOTOFF = BSIZE
+)
+
+var dxrootmagic = [4]uint8{0, 'd', 'x', 'r'}
+var dxleafmagic = [4]uint8{0, 'd', 'x', 'l'}
+
+// returns true if d is a block of a directory index
+func isdxblk(d *mem.Bytepg_t) bool {
+	return d[0] == 0 && d[1] == 'd' && d[2] == 'x'
+}
+
+// FNV-1a
+func dxhash(name ustr.Ustr) int {
+	h := uint32(2166136261)
+	for _, c := range name {
+		h ^= uint32(c)
+		h *= 16777619
+	}
+	return int(h)
+}
+
+func dxpair(d *mem.Bytepg_t, i int) (int, int) {
+	off := DXHDR + 8*i
+	return util.Readn(d[:], 4, off), util.Readn(d[:], 4, off+4)
+}
+
+func dxwpair(d *mem.Bytepg_t, i int, h, doff int) {
+	off := DXHDR + 8*i
+	util.Writen(d[:], 4, off, h)
+	util.Writen(d[:], 4, off+4, doff)
+}
+
+func dxptr(root *mem.Bytepg_t, h int) int {
+	depth := util.Readn(root[:], 4, 4)
+	return util.Readn(root[:], 4, DXHDR+4*(h&(1<<uint(depth)-1)))
+}
+
+// returns true if idm, a directory, has an index. idm must be locked.
+func (idm *imemnode_t) _dxindexed(opid opid_t) (bool, defs.Err_t) {
+	dc := &idm.dentc
+	if idm.size < DXROOTOFF+BSIZE {
+		return false, 0
+	}
+	if !dc.dxknown {
+		b, err := idm.off2buf(opid, DXROOTOFF, BSIZE, false, true, "_dxindexed")
+		if err != 0 {
+			return false, err
+		}
+		// directories created before indexing existed have
+		// directory entries in their second block
+		dc.indexed = isdxblk(b.Data) && b.Data[3] == dxrootmagic[3]
+		dc.dxknown = true
+		b.Unlock()
+		idm.fs.fslog.Relse(b, "_dxindexed")
+	}
+	return dc.indexed, 0
+}
+
+// appends a zeroed block to the directory for the index. returns the block
+// locked and its file block number.
+func (idm *imemnode_t) _dxnewblk(opid opid_t) (*Bdev_block_t, int, defs.Err_t) {
+	b, err := idm.off2buf(opid, idm.size, BSIZE, true, true, "_dxnewblk")
+	if err != 0 {
+		return nil, 0, err
+	}
+	*b.Data = mem.Bytepg_t{}
+	fbn := idm.size / BSIZE
+	idm.size += BSIZE
+	return b, fbn, 0
+}
+
+// builds the index of idm, which must consist of exactly one block of
+// directory entries.
+func (idm *imemnode_t) _dxbuild(opid opid_t) defs.Err_t {
+	if idm.size != BSIZE {
+		panic("dxbuild")
+	}
+	var dents []*icdent_t
+	_, err := idm._descan(opid, func(fn ustr.Ustr, de *icdent_t) bool {
+		if len(fn) != 0 {
+			dents = append(dents, de)
+		}
+		return false
+	})
+	if err != 0 {
+		return err
+	}
+	root, _, err := idm._dxnewblk(opid)
+	if err != 0 {
+		return err
+	}
+	leaf, lfbn, err := idm._dxnewblk(opid)
+	if err != 0 {
+		root.Unlock()
+		idm.fs.fslog.Relse(root, "_dxbuild")
+		return err
+	}
+	copy(root.Data[:], dxrootmagic[:])
+	util.Writen(root.Data[:], 4, DXHDR, lfbn)
+	copy(leaf.Data[:], dxleafmagic[:])
+	util.Writen(leaf.Data[:], 4, 8, len(dents))
+	for i, de := range dents {
+		dxwpair(leaf.Data, i, dxhash(de.name), de.offset)
+	}
+	for _, b := range []*Bdev_block_t{root, leaf} {
+		Csumw(b.Data)
+		b.Unlock()
+		idm.fs.fslog.Write(opid, b)
+		idm.fs.fslog.Relse(b, "_dxbuild")
+	}
+	idm.dentc.dxknown = true
+	idm.dentc.indexed = true
+	return 0
+}
+
+// returns the locked leaf which may hold hash h.
+func (idm *imemnode_t) _dxleaf(opid opid_t, h int) (*Bdev_block_t, defs.Err_t) {
+	root, err := idm.off2buf(opid, DXROOTOFF, BSIZE, false, true, "_dxleaf")
+	if err != 0 {
+		return nil, err
+	}
+	lfbn := dxptr(root.Data, h)
+	root.Unlock()
+	idm.fs.fslog.Relse(root, "_dxleaf")
+	return idm.off2buf(opid, lfbn*BSIZE, BSIZE, false, true, "_dxleaf")
+}
+
+func (idm *imemnode_t) _dxlookup(opid opid_t, name ustr.Ustr) (*icdent_t, defs.Err_t) {
+	h := dxhash(name)
+	leaf, err := idm._dxleaf(opid, h)
+	if err != 0 {
+		return nil, err
+	}
+	var offs []int
+	n := util.Readn(leaf.Data[:], 4, 8)
+	for i := 0; i < n; i++ {
+		if ph, doff := dxpair(leaf.Data, i); ph == h {
+			offs = append(offs, doff)
+		}
+	}
+	leaf.Unlock()
+	idm.fs.fslog.Relse(leaf, "_dxlookup")
+
+	for _, doff := range offs {
+		b, err := idm.off2buf(opid, doff, NDBYTES, false, true, "_dxlookup")
+		if err != 0 {
+			return nil, err
+		}
+		dd := Dirdata_t{b.Data[doff%mem.PGSIZE:]}
+		fn := dd.Filename(0)
+		inum := dd.inodenext(0)
+		b.Unlock()
+		idm.fs.fslog.Relse(b, "_dxlookup")
+		if fn.Eq(name) {
+			return &icdent_t{offset: doff, inum: inum, name: fn}, 0
+		}
+	}
+	return nil, -defs.ENOENT
+}
+
+// splits the leaf holding hash h. returns ENOSPC if the index cannot grow.
+func (idm *imemnode_t) _dxsplit(opid opid_t, h int) defs.Err_t {
+	root, err := idm.off2buf(opid, DXROOTOFF, BSIZE, false, true, "_dxsplit")
+	if err != 0 {
+		return err
+	}
+	depth := util.Readn(root.Data[:], 4, 4)
+	lfbn := dxptr(root.Data, h)
+	root.Unlock()
+	leaf, err := idm.off2buf(opid, lfbn*BSIZE, BSIZE, false, true, "_dxsplit")
+	if err != 0 {
+		idm.fs.fslog.Relse(root, "_dxsplit")
+		return err
+	}
+	local := util.Readn(leaf.Data[:], 4, 4)
+	leaf.Unlock()
+	if local == depth && depth == DXMAXDEPTH {
+		idm.fs.fslog.Relse(root, "_dxsplit")
+		idm.fs.fslog.Relse(leaf, "_dxsplit")
+		return -defs.ENOSPC
+	}
+	nleaf, nfbn, err := idm._dxnewblk(opid)
+	if err != 0 {
+		idm.fs.fslog.Relse(root, "_dxsplit")
+		idm.fs.fslog.Relse(leaf, "_dxsplit")
+		return err
+	}
+
+	root.Lock()
+	if local == depth {
+		n := 1 << uint(depth)
+		for i := 0; i < n; i++ {
+			p := util.Readn(root.Data[:], 4, DXHDR+4*i)
+			util.Writen(root.Data[:], 4, DXHDR+4*(n+i), p)
+		}
+		depth++
+		util.Writen(root.Data[:], 4, 4, depth)
+	}
+	bit := 1 << uint(local)
+	for i := 0; i < 1<<uint(depth); i++ {
+		if i&bit != 0 && util.Readn(root.Data[:], 4, DXHDR+4*i) == lfbn {
+			util.Writen(root.Data[:], 4, DXHDR+4*i, nfbn)
+		}
+	}
+
+	leaf.Lock()
+	copy(nleaf.Data[:], dxleafmagic[:])
+	util.Writen(leaf.Data[:], 4, 4, local+1)
+	util.Writen(nleaf.Data[:], 4, 4, local+1)
+	n := util.Readn(leaf.Data[:], 4, 8)
+	kept, moved := 0, 0
+	for i := 0; i < n; i++ {
+		ph, doff := dxpair(leaf.Data, i)
+		if ph&bit != 0 {
+			dxwpair(nleaf.Data, moved, ph, doff)
+			moved++
+		} else {
+			dxwpair(leaf.Data, kept, ph, doff)
+			kept++
+		}
+	}
+	util.Writen(leaf.Data[:], 4, 8, kept)
+	util.Writen(nleaf.Data[:], 4, 8, moved)
+
+	for _, b := range []*Bdev_block_t{root, leaf, nleaf} {
+		Csumw(b.Data)
+		b.Unlock()
+		idm.fs.fslog.Write(opid, b)
+		idm.fs.fslog.Relse(b, "_dxsplit")
+	}
+	return 0
+}
+
+// splits leaves until the leaf for name has room for another pair.
+func (idm *imemnode_t) _dxroom(opid opid_t, name ustr.Ustr) defs.Err_t {
+	h := dxhash(name)
+	for {
+		leaf, err := idm._dxleaf(opid, h)
+		if err != 0 {
+			return err
+		}
+		full := util.Readn(leaf.Data[:], 4, 8) == DXNPAIRS
+		leaf.Unlock()
+		idm.fs.fslog.Relse(leaf, "_dxroom")
+		if !full {
+			return 0
+		}
+		if err := idm._dxsplit(opid, h); err != 0 {
+			return err
+		}
+	}
+}
+
+// adds the directory entry for name at offset doff to the index.
+func (idm *imemnode_t) _dxinsert(opid opid_t, name ustr.Ustr, doff int) defs.Err_t {
+	if err := idm._dxroom(opid, name); err != 0 {
+		return err
+	}
+	h := dxhash(name)
+	leaf, err := idm._dxleaf(opid, h)
+	if err != 0 {
+		return err
+	}
+	n := util.Readn(leaf.Data[:], 4, 8)
+	dxwpair(leaf.Data, n, h, doff)
+	util.Writen(leaf.Data[:], 4, 8, n+1)
+	Csumw(leaf.Data)
+	leaf.Unlock()
+	idm.fs.fslog.Write(opid, leaf)
+	idm.fs.fslog.Relse(leaf, "_dxinsert")
+	return 0
+}
+
+// removes the directory entry for name at offset doff from the index.
+func (idm *imemnode_t) _dxremove(opid opid_t, name ustr.Ustr, doff int) defs.Err_t {
+	h := dxhash(name)
+	leaf, err := idm._dxleaf(opid, h)
+	if err != 0 {
+		return err
+	}
+	n := util.Readn(leaf.Data[:], 4, 8)
+	for i := 0; i < n; i++ {
+		if ph, poff := dxpair(leaf.Data, i); ph == h && poff == doff {
+			lh, loff := dxpair(leaf.Data, n-1)
+			dxwpair(leaf.Data, i, lh, loff)
+			util.Writen(leaf.Data[:], 4, 8, n-1)
+			Csumw(leaf.Data)
+			leaf.Unlock()
+			idm.fs.fslog.Write(opid, leaf)
+			idm.fs.fslog.Relse(leaf, "_dxremove")
+			return 0
+		}
+	}
+	leaf.Unlock()
+	idm.fs.fslog.Relse(leaf, "_dxremove")
+	return 0
+}
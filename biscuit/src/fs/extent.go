@@ -0,0 +1,409 @@
+package fs
+
+import "defs"
+import "mem"
+import "util"
+
+// Extent-mapped inodes.
+//
+// On a file system made with the FEAT_EXTENTS feature, new inodes map their
+// data with a tree of extents instead of direct and indirect block pointers,
+// and are marked with IF_EXTENTS. An extent maps a run of consecutive file
+// blocks to consecutive disk blocks, thus a large file that was written
+// sequentially needs few extents, and looking up a random block reads at most
+// a block per level of the tree (usually one, and usually cached).
+//
+// The root of the tree replaces the block pointers of the inode (words 3-4 and
+// 9-15); the other nodes are blocks. A node is a header word followed by
+// two-word entries sorted by file block. An entry of a leaf (height 0) maps
+// the extent's length blocks starting at file block fbn to the blocks starting
+// at blk. An entry of an interior node points to the child node at blk, all
+// of whose extents start at or after fbn, except that the first child also
+// holds any extents before its fbn. Unmapping a block trims or splits the
+// extent mapping it, which may leave a leaf empty; tree blocks are only freed
+// by ifree() when the file is.
+//
+// header word
+// 0-15,  number of entries
+// 16-31, height of the node
+// 32-63, EXTMAGIC
+//
+// entry words
+// 0,     fbn (bits 0-31), length (bits 32-63)
+// 1,     blk
+
+const (
+	// number of words in the root
+	EXTROOTW = NIADDRS + 2
+	// maximum number of entries in the root and in a tree block
+	EXTROOTN = (EXTROOTW - 1) / 2
+	EXTNODEN = (BSIZE/8 - 1) / 2
+	EXTMAGIC = 0xe47e
+	// file block numbers and extent lengths are stored in 32 bits
+	EXTMAXFBN = 1 << 32
+	EXTMAXLEN = 1<<32 - 1
+)
+
+type extent_t struct {
+	fbn int
+	len int
+	blk int
+}
+
+// a node of an extent tree; either root is the root, copied out of the inode,
+// or d is the data of a tree block.
+type enode_t struct {
+	root *[EXTROOTW]int
+	d    *mem.Bytepg_t
+}
+
+func (n *enode_t) word(i int) int {
+	if n.root != nil {
+		return n.root[i]
+	}
+	return util.Readn(n.d[:], 8, i*8)
+}
+
+func (n *enode_t) wword(i, v int) {
+	if n.root != nil {
+		n.root[i] = v
+		return
+	}
+	util.Writen(n.d[:], 8, i*8, v)
+}
+
+func (n *enode_t) nents() int {
+	return int(uint(n.word(0)) & 0xffff)
+}
+
+func (n *enode_t) height() int {
+	return int(uint(n.word(0)) >> 16 & 0xffff)
+}
+
+func (n *enode_t) magicok() bool {
+	return uint(n.word(0))>>32 == EXTMAGIC
+}
+
+func (n *enode_t) whdr(nents, height int) {
+	n.wword(0, EXTMAGIC<<32|height<<16|nents)
+}
+
+func (n *enode_t) max() int {
+	if n.root != nil {
+		return EXTROOTN
+	}
+	return EXTNODEN
+}
+
+func (n *enode_t) ent(i int) extent_t {
+	w := uint(n.word(1 + 2*i))
+	return extent_t{fbn: int(w & 0xffffffff), len: int(w >> 32),
+		blk: n.word(2 + 2*i)}
+}
+
+func (n *enode_t) went(i int, e extent_t) {
+	n.wword(1+2*i, e.len<<32|e.fbn)
+	n.wword(2+2*i, e.blk)
+}
+
+// returns the index of the last entry starting at or before fbn, or -1.
+func (n *enode_t) search(fbn int) int {
+	lo, hi := 0, n.nents()
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if n.ent(mid).fbn <= fbn {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo - 1
+}
+
+// removes entry i
+func (n *enode_t) remove(i int) {
+	nents := n.nents()
+	for j := i; j < nents-1; j++ {
+		n.went(j, n.ent(j+1))
+	}
+	n.whdr(nents-1, n.height())
+}
+
+// the root of an empty tree
+func mkeroot() [EXTROOTW]int {
+	var r [EXTROOTW]int
+	n := &enode_t{root: &r}
+	n.whdr(0, 0)
+	return r
+}
+
+// the root is stored in indir, dindir, and addrs
+func (idm *imemnode_t) _eroot() [EXTROOTW]int {
+	var r [EXTROOTW]int
+	r[0] = idm.indir
+	r[1] = idm.dindir
+	copy(r[2:], idm.addrs[:])
+	return r
+}
+
+func (idm *imemnode_t) _weroot(r *[EXTROOTW]int) {
+	idm.indir = r[0]
+	idm.dindir = r[1]
+	copy(idm.addrs[:], r[2:])
+}
+
+func (idm *imemnode_t) extents() bool {
+	return idm.iflags&IF_EXTENTS != 0
+}
+
+// returns the first extent which maps a file block at or after fbn.
+func (idm *imemnode_t) _extnext(fbn int) (extent_t, bool) {
+	root := idm._eroot()
+	return idm._extnext1(&enode_t{root: &root}, fbn)
+}
+
+func (idm *imemnode_t) _extnext1(n *enode_t, fbn int) (extent_t, bool) {
+	i := n.search(fbn)
+	if i < 0 {
+		i = 0
+	}
+	if n.height() == 0 {
+		for ; i < n.nents(); i++ {
+			if e := n.ent(i); e.fbn+e.len > fbn {
+				return e, true
+			}
+		}
+		return extent_t{}, false
+	}
+	for ; i < n.nents(); i++ {
+		blk := idm.mbread(n.ent(i).blk)
+		e, ok := idm._extnext1(&enode_t{d: blk.Data}, fbn)
+		idm.fs.fslog.Relse(blk, "extnext")
+		if ok {
+			return e, true
+		}
+	}
+	return extent_t{}, false
+}
+
+// returns the disk block holding file block fbn, or 0 if fbn isn't mapped.
+func (idm *imemnode_t) _extlookup(fbn int) int {
+	e, ok := idm._extnext(fbn)
+	if !ok || e.fbn > fbn {
+		return 0
+	}
+	return e.blk + fbn - e.fbn
+}
+
+// fbn2block() for extent-mapped inodes. a new block is allocated after the
+// block of the previous file block, if possible, so that the extent mapping
+// the previous block grows instead of a new extent being added.
+func (idm *imemnode_t) _extfbn2block(opid opid_t, fbn int, writing bool) (int, bool, defs.Err_t) {
+	if fbn >= EXTMAXFBN {
+		return 0, false, -defs.EFBIG
+	}
+	if blkn := idm._extlookup(fbn); blkn != 0 || !writing {
+		return blkn, false, 0
+	}
+	goal := 0
+	if fbn > 0 {
+		if prev := idm._extlookup(fbn - 1); prev != 0 {
+			goal = prev + 1
+		}
+	}
+	blkn, err := idm.fs.balloc.Balloc_near(opid, goal)
+	if err != 0 {
+		return 0, false, err
+	}
+	root := idm._eroot()
+	_, err = idm._extins(opid, &enode_t{root: &root}, extent_t{fbn, 1, blkn})
+	if err != 0 {
+		idm.fs.balloc.Bfree(opid, blkn)
+		return 0, false, err
+	}
+	// imemnode_t.iupdate() will make sure the root is updated on disk
+	idm._weroot(&root)
+	return blkn, true, 0
+}
+
+// inserts e into the subtree rooted at n. if n is a tree block and is split,
+// returns the entry for the new sibling, which the caller must add to n's
+// parent. the caller logs n.
+func (idm *imemnode_t) _extins(opid opid_t, n *enode_t, e extent_t) (*extent_t, defs.Err_t) {
+	i := n.search(e.fbn)
+	if n.height() == 0 {
+		if i >= 0 {
+			p := n.ent(i)
+			if p.fbn+p.len == e.fbn && p.blk+p.len == e.blk &&
+				p.len+e.len <= EXTMAXLEN {
+				p.len += e.len
+				n.went(i, p)
+				return nil, 0
+			}
+		}
+		return idm._extadd(opid, n, i+1, e)
+	}
+	if i < 0 {
+		i = 0
+	}
+	cblk := idm.mbread(n.ent(i).blk)
+	sib, err := idm._extins(opid, &enode_t{d: cblk.Data}, e)
+	if err == 0 {
+		idm.fs.fslog.Write(opid, cblk)
+	}
+	idm.fs.fslog.Relse(cblk, "extins")
+	if err != 0 || sib == nil {
+		return nil, err
+	}
+	return idm._extadd(opid, n, i+1, *sib)
+}
+
+// adds entry e at index i of n. a full root moves its entries to a new child,
+// making the tree one level taller, while a full tree block is split and the
+// entry for the new sibling is returned.
+func (idm *imemnode_t) _extadd(opid opid_t, n *enode_t, i int, e extent_t) (*extent_t, defs.Err_t) {
+	nents := n.nents()
+	if nents < n.max() {
+		for j := nents; j > i; j-- {
+			n.went(j, n.ent(j-1))
+		}
+		n.went(i, e)
+		n.whdr(nents+1, n.height())
+		return nil, 0
+	}
+
+	newb, err := idm.fs.balloc.Balloc(opid)
+	if err != 0 {
+		return nil, err
+	}
+	blk := idm.mbread(newb)
+	defer idm.fs.fslog.Relse(blk, "extadd")
+	nn := &enode_t{d: blk.Data}
+	if n.root != nil {
+		for j := 0; j < nents; j++ {
+			nn.went(j, n.ent(j))
+		}
+		nn.whdr(nents, n.height())
+		if _, err := idm._extadd(opid, nn, i, e); err != 0 {
+			panic("must fit")
+		}
+		idm.fs.fslog.Write(opid, blk)
+		n.whdr(1, n.height()+1)
+		n.went(0, extent_t{fbn: nn.ent(0).fbn, blk: newb})
+		return nil, 0
+	}
+
+	// a file usually grows at its end; leave the full node full then.
+	half := nents / 2
+	if i == nents {
+		half = nents
+	}
+	for j := half; j < nents; j++ {
+		nn.went(j-half, n.ent(j))
+	}
+	nn.whdr(nents-half, n.height())
+	n.whdr(half, n.height())
+	if i < half {
+		idm._extadd(opid, n, i, e)
+	} else {
+		idm._extadd(opid, nn, i-half, e)
+	}
+	idm.fs.fslog.Write(opid, blk)
+	return &extent_t{fbn: nn.ent(0).fbn, blk: newb}, 0
+}
+
+// _bunmap() for extent-mapped inodes.
+func (idm *imemnode_t) _extunmap(opid opid_t, fbn int) (int, defs.Err_t) {
+	root := idm._eroot()
+	blkn, _, err := idm._extrm(opid, &enode_t{root: &root}, fbn)
+	if err != 0 {
+		return 0, err
+	}
+	idm._weroot(&root)
+	return blkn, 0
+}
+
+// removes file block fbn from the extent mapping it in the subtree rooted at
+// n and returns the block fbn was mapped to. removing a block from the middle
+// of an extent splits it, thus like _extins(), returns the entry for a new
+// sibling of n, if any. the caller logs n.
+func (idm *imemnode_t) _extrm(opid opid_t, n *enode_t, fbn int) (int, *extent_t, defs.Err_t) {
+	i := n.search(fbn)
+	if n.height() != 0 {
+		if i < 0 {
+			i = 0
+		}
+		cblk := idm.mbread(n.ent(i).blk)
+		blkn, sib, err := idm._extrm(opid, &enode_t{d: cblk.Data}, fbn)
+		if err == 0 {
+			idm.fs.fslog.Write(opid, cblk)
+		}
+		idm.fs.fslog.Relse(cblk, "extrm")
+		if err != 0 || sib == nil {
+			return blkn, nil, err
+		}
+		sib, err = idm._extadd(opid, n, i+1, *sib)
+		return blkn, sib, err
+	}
+	if i < 0 || fbn >= n.ent(i).fbn+n.ent(i).len {
+		panic("not mapped")
+	}
+	e := n.ent(i)
+	blkn := e.blk + fbn - e.fbn
+	switch {
+	case e.len == 1:
+		n.remove(i)
+	case fbn == e.fbn:
+		n.went(i, extent_t{fbn: e.fbn + 1, len: e.len - 1, blk: e.blk + 1})
+	case fbn == e.fbn+e.len-1:
+		n.went(i, extent_t{fbn: e.fbn, len: e.len - 1, blk: e.blk})
+	default:
+		tail := extent_t{fbn: fbn + 1, len: e.fbn + e.len - fbn - 1,
+			blk: blkn + 1}
+		n.went(i, extent_t{fbn: e.fbn, len: fbn - e.fbn, blk: e.blk})
+		sib, err := idm._extadd(opid, n, i+1, tail)
+		if err != 0 {
+			n.went(i, e)
+			return 0, nil, err
+		}
+		return blkn, sib, 0
+	}
+	return blkn, nil, 0
+}
+
+// removes the last tree block from the extent tree and returns it, or -1 if
+// the tree has no blocks. the extents the block maps are forgotten, thus
+// ifree() only calls it once the data blocks have been freed.
+func (idm *imemnode_t) _extpop(opid opid_t) int {
+	root := idm._eroot()
+	n := &enode_t{root: &root}
+	if n.height() == 0 {
+		return -1
+	}
+	// an emptied interior block is removed like a leaf
+	var nblk *Bdev_block_t
+	for {
+		c := n.ent(n.nents() - 1).blk
+		cblk := idm.mbread(c)
+		cn := &enode_t{d: cblk.Data}
+		if cn.height() != 0 && cn.nents() != 0 {
+			if nblk != nil {
+				idm.fs.fslog.Relse(nblk, "extpop")
+			}
+			nblk, n = cblk, cn
+			continue
+		}
+		idm.fs.fslog.Relse(cblk, "extpop")
+		n.whdr(n.nents()-1, n.height())
+		if nblk != nil {
+			idm.fs.fslog.Write(opid, nblk)
+			idm.fs.fslog.Relse(nblk, "extpop")
+		} else {
+			if n.nents() == 0 {
+				n.whdr(0, 0)
+			}
+			idm._weroot(&root)
+		}
+		return c
+	}
+}
@@ -6,8 +6,11 @@ import "sync"
 import "bounds"
 import "bpath"
 import "defs"
+import "device"
 import "fd"
 import "fdops"
+import "flock"
+import "inotify"
 import "limits"
 import "mem"
 import "proc"
@@ -16,6 +19,7 @@ import "stat"
 import "stats"
 import "ustr"
 import "util"
+import "vfs"
 
 const fs_debug = false
 const FSOFF = 506
@@ -35,6 +39,8 @@ type Fs_t struct {
 	istats       *inode_stats_t
 	root         *imemnode_t
 	diskfs       bool // disk or in-mem file system?
+	resizel      sync.Mutex
+	dev          uint // device number, see vfs.Newdev()
 }
 
 func StartFS(mem Blockmem_i, disk Disk_i, console proc.Cons_i, diskfs bool) (*fd.Fd_t, *Fs_t) {
@@ -50,6 +56,7 @@ func StartFS(mem Blockmem_i, disk Disk_i, console proc.Cons_i, diskfs bool) (*fd
 	fs := &Fs_t{}
 	fs.diskfs = diskfs
 	fs.ahci = disk
+	fs.dev = vfs.Newdev()
 	fs.istats = &inode_stats_t{}
 	if !fs.diskfs {
 		fmt.Printf("Using MEMORY FS\n")
@@ -67,10 +74,14 @@ func StartFS(mem Blockmem_i, disk Disk_i, console proc.Cons_i, diskfs bool) (*fd
 	}
 	fs.bcache.Relse(b, "fs_init")
 
-	// superblock is never changed, so reading before recovery is fine
+	// reading the superblock before recovery is fine, since recovery
+	// installs the logged changes to it (see resize.go) in the cached copy
 	b = fs.bcache.Get_fill(fs.superb_start, "super", false) // don't relse b, because superb is global
 
 	fs.superb = Superblock_t{b.Data}
+	if fs.superb.Features()&^FEAT_ALL != 0 {
+		panic("unknown file system features")
+	}
 
 	logstart := fs.superb_start + 1
 	loglen := fs.superb.Loglen()
@@ -94,10 +105,10 @@ func StartFS(mem Blockmem_i, disk Disk_i, console proc.Cons_i, diskfs bool) (*fd
 	//fmt.Printf("bmapstart %v bmaplen %v\n", bmapstart, bmaplen)
 
 	inodelen := fs.superb.Inodelen()
-	//fmt.Printf("inodestart %v inodelen %v\n", bmapstart+bmaplen, inodelen)
+	//fmt.Printf("inodestart %v inodelen %v\n", fs.superb.Inodeblk(0), inodelen)
 
-	fs.ialloc = mkIalloc(fs, imapstart, imaplen, bmapstart+bmaplen, inodelen)
-	fs.balloc = mkBallocater(fs, bmapstart, bmaplen, bmapstart+bmaplen+inodelen)
+	fs.ialloc = mkIalloc(fs, imapstart, imaplen, inodelen)
+	fs.balloc = mkBallocater(fs, bmapstart, bmaplen, fs.superb.Datastart())
 
 	fs.icache = mkIcache(fs, iorphanstart, iorphanlen)
 	fs.icache.RecoverOrphans()
@@ -121,6 +132,12 @@ func (fs *Fs_t) Fs_size() (uint, uint) {
 	return fs.ialloc.alloc.nfreebits, fs.balloc.alloc.nfreebits
 }
 
+// returns the number of inodes and data blocks the file system has room for
+func (fs *Fs_t) Fs_capacity() (uint, uint) {
+	sb := fs.superb
+	return uint(sb.Inodelen() * (BSIZE / sb.Isize())), uint(sb.Lastblock() - sb.Datastart())
+}
+
 func (fs *Fs_t) IrefRoot() *imemnode_t {
 	r := fs.root
 	r.Refup("IrefRoot")
@@ -137,25 +154,46 @@ func (fs *Fs_t) Unpin(pa mem.Pa_t) {
 	fs.bcache.unpin(pa)
 }
 
-func (fs *Fs_t) Fs_op_link(old ustr.Ustr, new ustr.Ustr, cwd *fd.Cwd_t) ([]*imemnode_t, defs.Err_t) {
+// fails if any inode is referenced besides fs.root's reference on the root,
+// i.e. if a file is open, a process has its cwd in the file system, or an
+// operation is in progress. otherwise commits all changes and stops the log.
+func (fs *Fs_t) Fs_umount() defs.Err_t {
+	if fs.fslog.Busy() {
+		return -defs.EBUSY
+	}
+	for _, p := range fs.icache.cache.cache.Elems() {
+		e := p.Value.(*Objref_t)
+		n := e.Refcnt() &^ REMOVE
+		if e.Key == int(iroot) {
+			n--
+		}
+		if n != 0 {
+			return -defs.EBUSY
+		}
+	}
+	fs.StopFS()
+	return 0
+}
+
+func (fs *Fs_t) Fs_op_link(old ustr.Ustr, new ustr.Ustr, cwd, ncwd *fd.Cwd_t, cred *proc.Cred_t) ([]*imemnode_t, defs.Err_t) {
 	opid := fs.fslog.Op_begin("Fs_link")
 	defer fs.fslog.Op_end(opid)
 
 	if fs_debug {
-		fmt.Printf("Fs_link: %v %v %v\n", old, new, cwd)
+		fmt.Printf("Fs_link: %v %v %v %v\n", old, new, cwd, ncwd)
 	}
 
 	fs.istats.Nilink.Inc()
 
 	var deads []*imemnode_t
-	orig, dead, err := fs.fs_namei_locked(opid, old, cwd, "Fs_link_org")
+	orig, dead, err := fs.fs_lnamei_locked(opid, old, cwd, cred, "Fs_link_org")
 	if err != 0 {
 		if dead != nil {
 			deads = append(deads, dead)
 		}
 		return deads, err
 	}
-	if orig.itype != I_FILE {
+	if orig.itype != I_FILE && orig.itype != I_SYMLINK {
 		if orig.iunlock_refdown("fs_link") {
 			deads = append(deads, dead)
 		}
@@ -166,18 +204,25 @@ func (fs *Fs_t) Fs_op_link(old ustr.Ustr, new ustr.Ustr, cwd *fd.Cwd_t) ([]*imem
 	orig.iunlock("fs_link_orig")
 
 	dirs, fn := bpath.Sdirname(new)
-	newd, dead, err := fs.fs_namei_locked(opid, dirs, cwd, "fs_link_newd")
+	newd, dead, err := fs.fs_namei_locked(opid, dirs, ncwd, cred, "fs_link_newd")
 	if err != 0 {
 		if dead != nil {
 			deads = append(deads, dead)
 		}
 		goto undo
 	}
-	err = newd.do_insert(opid, fn, inum)
+	err = newd.dirmodchk(cred, nil)
+	if err == 0 {
+		err = newd.do_insert(opid, fn, inum)
+	}
+	if err == 0 {
+		newd.notify(defs.IN_CREATE, 0, fn)
+	}
 	newd.iunlock_refdown("fs_link_newd")
 	if err != 0 {
 		goto undo
 	}
+	orig.notify(defs.IN_ATTRIB, 0, nil)
 	// XXX check for dead and return orig?
 	orig.Refdown("fs_link_orig")
 	return deads, 0
@@ -191,15 +236,58 @@ undo:
 	return deads, err
 }
 
-func (fs *Fs_t) Fs_link(old ustr.Ustr, new ustr.Ustr, cwd *fd.Cwd_t) defs.Err_t {
-	deads, err := fs.Fs_op_link(old, new, cwd)
+func (fs *Fs_t) Fs_link(old ustr.Ustr, new ustr.Ustr, cwd, ncwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	deads, err := fs.Fs_op_link(old, new, cwd, ncwd, cred)
 	for _, dead := range deads {
 		dead.Free()
 	}
 	return err
 }
 
-func (fs *Fs_t) Fs_op_unlink(paths ustr.Ustr, cwd *fd.Cwd_t, wantdir bool) (*imemnode_t, defs.Err_t) {
+// creates the regular file dst as a clone of the regular file src, which shares
+// src's blocks until either file writes them. like a file created by open(2),
+// the clone has src's mode and is owned by cred.
+func (fs *Fs_t) Fs_reflink(src, dst ustr.Ustr, cwd, ncwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	if !fs.diskfs {
+		return -defs.EOPNOTSUPP
+	}
+	fs.istats.Nreflink.Inc()
+	sidm, dead, err := fs.fs_namei_locked(opid_t(0), src, cwd, cred, "Fs_reflink")
+	if err != 0 {
+		if dead != nil {
+			dead.Free()
+		}
+		return err
+	}
+	switch {
+	case sidm.itype == I_DIR:
+		err = -defs.EISDIR
+	case sidm.itype != I_FILE:
+		err = -defs.EINVAL
+	default:
+		err = sidm.iaccess(cred, defs.R_OK)
+	}
+	mode := sidm.mode
+	sidm.iunlock("Fs_reflink")
+	if err == 0 {
+		var fsf Fsfile_t
+		flags := defs.O_CREAT | defs.O_EXCL | defs.O_WRONLY
+		fsf, err = fs.Fs_open_inner(dst, flags, mode, ncwd, cred, 0, 0)
+		if err == 0 {
+			didm := fs.icache.Iref(fsf.Inum, "Fs_reflink")
+			err = didm.do_clone(sidm)
+			didm.Refdown("Fs_reflink")
+			fs.Fs_close(fsf.Inum)
+		}
+	}
+	sidm.ilock("Fs_reflink")
+	if sidm.iunlock_refdown("Fs_reflink") {
+		sidm.Free()
+	}
+	return err
+}
+
+func (fs *Fs_t) Fs_op_unlink(paths ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t, wantdir bool) (*imemnode_t, defs.Err_t) {
 	opid := fs.fslog.Op_begin("fs_unlink")
 	defer fs.fslog.Op_end(opid)
 
@@ -218,7 +306,7 @@ func (fs *Fs_t) Fs_op_unlink(paths ustr.Ustr, cwd *fd.Cwd_t, wantdir bool) (*ime
 	var par *imemnode_t
 	var err defs.Err_t
 
-	par, dead, err := fs.fs_namei_locked(opid, dirs, cwd, "fs_unlink_par")
+	par, dead, err := fs.fs_namei_locked(opid, dirs, cwd, cred, "fs_unlink_par")
 	if err != 0 {
 		return dead, err
 	}
@@ -252,7 +340,10 @@ func (fs *Fs_t) Fs_op_unlink(paths ustr.Ustr, cwd *fd.Cwd_t, wantdir bool) (*ime
 
 	}
 
-	err = child.do_dirchk(opid, wantdir)
+	err = par.dirmodchk(cred, child)
+	if err == 0 {
+		err = child.do_dirchk(opid, wantdir)
+	}
 	if err != 0 {
 		del := child.iunlock_refdown("fs_unlink_child")
 		if del {
@@ -272,6 +363,8 @@ func (fs *Fs_t) Fs_op_unlink(paths ustr.Ustr, cwd *fd.Cwd_t, wantdir bool) (*ime
 		return dead, err
 	}
 	child._linkdown(opid)
+	par.notify(defs.IN_DELETE|child.inisdir(), 0, fn)
+	child.notify_linkdown()
 	del := child.iunlock_refdown("fs_unlink_child")
 	if del {
 		dead = child
@@ -279,8 +372,8 @@ func (fs *Fs_t) Fs_op_unlink(paths ustr.Ustr, cwd *fd.Cwd_t, wantdir bool) (*ime
 	return dead, 0
 }
 
-func (fs *Fs_t) Fs_unlink(paths ustr.Ustr, cwd *fd.Cwd_t, wantdir bool) defs.Err_t {
-	dead, err := fs.Fs_op_unlink(paths, cwd, wantdir)
+func (fs *Fs_t) Fs_unlink(paths ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t, wantdir bool) defs.Err_t {
+	dead, err := fs.Fs_op_unlink(paths, cwd, cred, wantdir)
 	if dead != nil {
 		dead.Free()
 	}
@@ -292,7 +385,7 @@ var _renamelock = sync.Mutex{}
 
 // first return value is inodes to refdown, second return is inode which needs
 // to be freed...
-func (fs *Fs_t) Fs_op_rename(oldp, newp ustr.Ustr, cwd *fd.Cwd_t) ([]*imemnode_t, *imemnode_t, defs.Err_t) {
+func (fs *Fs_t) Fs_op_rename(oldp, newp ustr.Ustr, cwd, ncwd *fd.Cwd_t, cred *proc.Cred_t) ([]*imemnode_t, *imemnode_t, defs.Err_t) {
 	odirs, ofn := bpath.Sdirname(oldp)
 	ndirs, nfn := bpath.Sdirname(newp)
 	var refs []*imemnode_t
@@ -314,13 +407,13 @@ func (fs *Fs_t) Fs_op_rename(oldp, newp ustr.Ustr, cwd *fd.Cwd_t) ([]*imemnode_t
 	defer _renamelock.Unlock()
 
 	if fs_debug {
-		fmt.Printf("fs_rename: src %v dst %v %v\n", oldp, newp, cwd)
+		fmt.Printf("fs_rename: src %v dst %v %v %v\n", oldp, newp, cwd, ncwd)
 	}
 
 	// lookup all inode references, but we will release locks and lock them
 	// together when we know all references.  the references to the inodes
 	// cannot disppear, so unlocking temporarily is fine.
-	opar, dead, err := fs.fs_namei_locked(opid, odirs, cwd, "fs_rename_opar")
+	opar, dead, err := fs.fs_namei_locked(opid, odirs, cwd, cred, "fs_rename_opar")
 	if err != 0 {
 		return refs, dead, err
 	}
@@ -334,7 +427,7 @@ func (fs *Fs_t) Fs_op_rename(oldp, newp ustr.Ustr, cwd *fd.Cwd_t) ([]*imemnode_t
 	// unlock par after we have ref to child
 	opar.iunlock("fs_rename_par")
 
-	npar, dead, err := fs.fs_namei_locked(opid, ndirs, cwd, "")
+	npar, dead, err := fs.fs_namei_locked(opid, ndirs, ncwd, cred, "")
 	if err != 0 {
 		return []*imemnode_t{opar, ochild}, dead, err
 	}
@@ -434,6 +527,19 @@ func (fs *Fs_t) Fs_op_rename(oldp, newp ustr.Ustr, cwd *fd.Cwd_t) ([]*imemnode_t
 		}
 	}
 
+	if err := opar.dirmodchk(cred, ochild); err != 0 {
+		return refs, nil, err
+	}
+	if err := npar.dirmodchk(cred, nchild); err != 0 {
+		return refs, nil, err
+	}
+	// moving a directory rewrites its ".."
+	if ochild.itype == I_DIR && opar != npar {
+		if err := ochild.iaccess(cred, defs.W_OK); err != 0 {
+			return refs, nil, err
+		}
+	}
+
 	// if src and dst are the same file, we are done
 	if nchild != nil && ochild.inum == nchild.inum {
 		return refs, nil, 0
@@ -441,7 +547,7 @@ func (fs *Fs_t) Fs_op_rename(oldp, newp ustr.Ustr, cwd *fd.Cwd_t) ([]*imemnode_t
 
 	// guarantee that any page allocations will succeed before starting the
 	// operation, which will be messy to piece-wise undo.
-	b1, err := npar.probe_insert(opid)
+	b1, err := npar.probe_insert(opid, nfn)
 	if err != 0 {
 		return refs, nil, err
 	}
@@ -474,7 +580,7 @@ func (fs *Fs_t) Fs_op_rename(oldp, newp ustr.Ustr, cwd *fd.Cwd_t) ([]*imemnode_t
 			return refs, nil, err
 		}
 		nchild._linkdown(opid)
-
+		nchild.notify_linkdown()
 	}
 
 	// finally, do the move
@@ -495,11 +601,15 @@ func (fs *Fs_t) Fs_op_rename(oldp, newp ustr.Ustr, cwd *fd.Cwd_t) ([]*imemnode_t
 			panic("insert after unlink must succeed")
 		}
 	}
+	cookie := inotify.Cookie()
+	opar.notify(defs.IN_MOVED_FROM|ochild.inisdir(), cookie, ofn)
+	npar.notify(defs.IN_MOVED_TO|ochild.inisdir(), cookie, nfn)
+	ochild.notify(defs.IN_MOVE_SELF, 0, nil)
 	return refs, nil, 0
 }
 
-func (fs *Fs_t) Fs_rename(oldp, newp ustr.Ustr, cwd *fd.Cwd_t) defs.Err_t {
-	refs, dead, err := fs.Fs_op_rename(oldp, newp, cwd)
+func (fs *Fs_t) Fs_rename(oldp, newp ustr.Ustr, cwd, ncwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	refs, dead, err := fs.Fs_op_rename(oldp, newp, cwd, ncwd, cred)
 	for _, r := range refs {
 		del := r.Refdown("Fs_rename")
 		if del {
@@ -579,6 +689,8 @@ type fsfops_t struct {
 	sync.Mutex
 	offset int
 	append bool
+	// O_DIRECT
+	direct bool
 	count  int
 	//hack	*imemnode_t
 }
@@ -603,7 +715,7 @@ func (fo *fsfops_t) _read(dst fdops.Userio_i, toff int) (int, defs.Err_t) {
 		offset = toff
 	}
 	idm := fo.fs.icache.Iref_locked(fo.priv, "_read")
-	did, err := idm.do_read(dst, offset)
+	did, err := idm.do_read(dst, offset, fo.direct)
 	if !useoffset && err == 0 {
 		fo.offset += did
 	}
@@ -641,7 +753,7 @@ func (fo *fsfops_t) _write(src fdops.Userio_i, toff int) (int, defs.Err_t) {
 		append = false
 	}
 	idm := fo.fs.icache.Iref(fo.priv, "_write")
-	did, err := idm.do_write(src, offset, append)
+	did, err := idm.do_write(src, offset, append, fo.direct)
 	if !useoffset && err == 0 {
 		fo.offset += did
 	}
@@ -656,7 +768,6 @@ func (fo *fsfops_t) Write(src fdops.Userio_i) (int, defs.Err_t) {
 	return r, e
 }
 
-// XXX doesn't free blocks when shrinking file
 func (fo *fsfops_t) Truncate(newlen uint) defs.Err_t {
 	fo.Lock()
 	defer fo.Unlock()
@@ -664,23 +775,94 @@ func (fo *fsfops_t) Truncate(newlen uint) defs.Err_t {
 		return -defs.EBADF
 	}
 
-	opid := fo.fs.fslog.Op_begin("truncate")
-	defer fo.fs.fslog.Op_end(opid)
-
 	if fs_debug {
 		fmt.Printf("truncate: %v %v\n", fo.priv, newlen)
 	}
 
-	idm := fo.fs.icache.Iref_locked(fo.priv, "truncate")
-	err := idm.do_trunc(opid, newlen)
-	idm.iunlock_refdown("truncate")
+	idm := fo.fs.icache.Iref(fo.priv, "truncate")
+	err := idm.do_trunc(newlen)
+	idm.Refdown("truncate")
+	return err
+}
+
+func (fo *fsfops_t) Fallocate(mode, offset, len int) defs.Err_t {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return -defs.EBADF
+	}
+
+	idm := fo.fs.icache.Iref(fo.priv, "fallocate")
+	err := idm.do_fallocate(mode, offset, len)
+	idm.Refdown("fallocate")
 	return err
 }
 
+// waits only for the transaction with the file's last update, instead of
+// forcing the whole log like Fs_sync()
+func (fo *fsfops_t) Fsync(datasync bool) defs.Err_t {
+	fo.Lock()
+	if fo.count <= 0 {
+		fo.Unlock()
+		return -defs.EBADF
+	}
+	if !fo.fs.diskfs {
+		fo.Unlock()
+		return 0
+	}
+
+	fo.fs.istats.Nfsync.Inc()
+	idm := fo.fs.icache.Iref_locked(fo.priv, "fsync")
+	seq := idm.do_syncseq(datasync)
+	idm.iunlock_refdown("fsync")
+	// other operations on the file needn't wait for the commit
+	fo.Unlock()
+	if seq == -1 {
+		fo.fs.fslog.Force(false)
+	} else {
+		fo.fs.fslog.Force_seq(seq)
+	}
+	return 0
+}
+
+// the locks live in the in-memory inode, which stays cached while the file is
+// open
+func (fo *fsfops_t) Locks() (*flock.Locks_t, defs.Err_t) {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return nil, -defs.EBADF
+	}
+	idm := fo.fs.icache.Iref_locked(fo.priv, "locks")
+	ret := &idm.locks
+	idm.iunlock_refdown("locks")
+	return ret, 0
+}
+
 func (fo *fsfops_t) Pwrite(src fdops.Userio_i, offset int) (int, defs.Err_t) {
 	return fo._write(src, offset)
 }
 
+// the fd offset of a directory is the offset of the next directory entry to
+// return. entries never move, thus the offset remains valid while other
+// threads add and remove entries.
+func (fo *fsfops_t) Getdents(dst fdops.Userio_i) (int, defs.Err_t) {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return 0, -defs.EBADF
+	}
+
+	idm := fo.fs.icache.Iref_locked(fo.priv, "getdents")
+	did, next, err := idm.do_getdents(dst, fo.offset)
+	idm.iunlock_refdown("getdents")
+	fo.offset = next
+	if did > 0 {
+		return did, 0
+	}
+	return did, err
+}
+
 // caller holds fo lock
 func (fo *fsfops_t) fstat(st *stat.Stat_t) defs.Err_t {
 	if fs_debug {
@@ -713,7 +895,13 @@ func (fo *fsfops_t) Close() defs.Err_t {
 		fmt.Printf("Close: %d cnt %d\n", fo.priv, fo.count)
 
 	}
+	last := fo.count == 0
 	fo.Unlock()
+	if last {
+		idm := fo.fs.icache.Iref_locked(fo.priv, "close")
+		idm.locks.Fclose(fo)
+		idm.iunlock_refdown("close")
+	}
 	return fo.fs.Fs_close(fo.priv)
 }
 
@@ -726,6 +914,11 @@ func (fo *fsfops_t) Pathi() defs.Inum_t {
 	return fo.priv
 }
 
+// shared mappings of the file unpin their pages through the fops
+func (fo *fsfops_t) Unpin(pa mem.Pa_t) {
+	fo.fs.Unpin(pa)
+}
+
 func (fo *fsfops_t) Reopen() defs.Err_t {
 	fo.Lock()
 	//defer fo.Unlock()
@@ -762,6 +955,14 @@ func (fo *fsfops_t) Lseek(off, whence int) (int, defs.Err_t) {
 		st := &stat.Stat_t{}
 		fo.fstat(st)
 		fo.offset = int(st.Size()) + off
+	case defs.SEEK_DATA, defs.SEEK_HOLE:
+		idm := fo.fs.icache.Iref_locked(fo.priv, "lseek")
+		n, err := idm.do_seekdata(off, whence == defs.SEEK_HOLE)
+		idm.iunlock_refdown("lseek")
+		if err != 0 {
+			return 0, err
+		}
+		fo.offset = n
 	default:
 		return 0, -defs.EINVAL
 	}
@@ -782,6 +983,19 @@ func (fo *fsfops_t) Mmapi(offset, len int, inc bool) ([]mem.Mmapinfo_t, defs.Err
 	}
 
 	idm := fo.fs.icache.Iref_locked(fo.priv, "mmapi")
+	// mapping a hole allocates its blocks, and a shared mapping copies
+	// the blocks other files share, which may take many operations; do
+	// so first, until the range has neither.
+	for idm.mmaphole(offset, len) || (inc && idm.mmapshared(offset, len)) {
+		idm.iunlock("mmapi")
+		err := idm.do_mmapfill(offset, len, inc)
+		idm.ilock("mmapi")
+		if err != 0 {
+			idm.iunlock_refdown("mmapi")
+			fo.Unlock()
+			return nil, err
+		}
+	}
 	mmi, err := idm.do_mmapi(offset, len, inc)
 	idm.iunlock_refdown("mmapi")
 
@@ -841,10 +1055,30 @@ type Devfops_t struct {
 	Min int
 }
 
+// returns an Open_t for the device registry that opens one of the simple
+// devices implemented by Devfops_t. other drivers register their own fops.
+func Devopen(maj int) device.Open_t {
+	return func(min int) (fdops.Fdops_i, defs.Err_t) {
+		df := &Devfops_t{Maj: maj, Min: min}
+		df._sane()
+		return df, 0
+	}
+}
+
+// opens the statistics device, which reads the statistics of fs as of the open
+func (fs *Fs_t) Statopen(min int) (fdops.Fdops_i, defs.Err_t) {
+	stats_string = fs.Fs_statistics()
+	return &Devfops_t{Maj: defs.D_STAT, Min: min}, 0
+}
+
+// opens the raw disk device, whose blocks are read and written through the
+// buffer cache of fs
+func (fs *Fs_t) Rawopen(min int) (fdops.Fdops_i, defs.Err_t) {
+	return &rawdfops_t{minor: min, fs: fs}, 0
+}
+
 func (df *Devfops_t) _sane() {
-	// make sure this maj/min pair is handled by Devfops_t. to handle more
-	// devices, we can either do dispatch in Devfops_t or we can return
-	// device-specific fdops.Fdops_i in fs_open()
+	// make sure this maj/min pair is handled by Devfops_t
 	if df.Maj != defs.D_CONSOLE && df.Maj != defs.D_DEVNULL &&
 		df.Maj != defs.D_STAT && df.Maj != defs.D_PROF {
 		panic("bad dev")
@@ -974,6 +1208,18 @@ func (df *Devfops_t) Truncate(newlen uint) defs.Err_t {
 	return -defs.EINVAL
 }
 
+func (df *Devfops_t) Fallocate(int, int, int) defs.Err_t {
+	return -defs.ENODEV
+}
+
+func (df *Devfops_t) Fsync(bool) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (df *Devfops_t) Locks() (*flock.Locks_t, defs.Err_t) {
+	return nil, -defs.EINVAL
+}
+
 func (df *Devfops_t) Pread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
 	df._sane()
 	return 0, -defs.ESPIPE
@@ -984,6 +1230,10 @@ func (df *Devfops_t) Pwrite(src fdops.Userio_i, offset int) (int, defs.Err_t) {
 	return 0, -defs.ESPIPE
 }
 
+func (df *Devfops_t) Getdents(fdops.Userio_i) (int, defs.Err_t) {
+	return 0, -defs.ENOTDIR
+}
+
 func (df *Devfops_t) Fstat(st *stat.Stat_t) defs.Err_t {
 	df._sane()
 	st.Wmode(defs.Mkdev(df.Maj, df.Min))
@@ -1130,6 +1380,18 @@ func (raw *rawdfops_t) Truncate(newlen uint) defs.Err_t {
 	return -defs.EINVAL
 }
 
+func (raw *rawdfops_t) Fallocate(int, int, int) defs.Err_t {
+	return -defs.ENODEV
+}
+
+func (raw *rawdfops_t) Fsync(bool) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (raw *rawdfops_t) Locks() (*flock.Locks_t, defs.Err_t) {
+	return nil, -defs.EINVAL
+}
+
 func (raw *rawdfops_t) Pread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
 	return 0, -defs.ESPIPE
 }
@@ -1138,6 +1400,10 @@ func (raw *rawdfops_t) Pwrite(src fdops.Userio_i, offset int) (int, defs.Err_t)
 	return 0, -defs.ESPIPE
 }
 
+func (raw *rawdfops_t) Getdents(fdops.Userio_i) (int, defs.Err_t) {
+	return 0, -defs.ENOTDIR
+}
+
 func (raw *rawdfops_t) Fstat(st *stat.Stat_t) defs.Err_t {
 	raw.Lock()
 	defer raw.Unlock()
@@ -1227,8 +1493,8 @@ func (raw *rawdfops_t) Shutdown(read, write bool) defs.Err_t {
 	return -defs.ENOTSOCK
 }
 
-func (fs *Fs_t) Fs_mkdir(paths ustr.Ustr, mode int, cwd *fd.Cwd_t) defs.Err_t {
-	refs, dead, err := fs.Fs_op_mkdir(paths, mode, cwd)
+func (fs *Fs_t) Fs_mkdir(paths ustr.Ustr, mode int, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	refs, dead, err := fs.Fs_op_mkdir(paths, mode, cwd, cred)
 	for _, ref := range refs {
 		if ref.Refdown("") {
 			ref.Free()
@@ -1241,7 +1507,7 @@ func (fs *Fs_t) Fs_mkdir(paths ustr.Ustr, mode int, cwd *fd.Cwd_t) defs.Err_t {
 }
 
 // returns refs, dead, and error...
-func (fs *Fs_t) Fs_op_mkdir(paths ustr.Ustr, mode int, cwd *fd.Cwd_t) ([]*imemnode_t, *imemnode_t, defs.Err_t) {
+func (fs *Fs_t) Fs_op_mkdir(paths ustr.Ustr, mode int, cwd *fd.Cwd_t, cred *proc.Cred_t) ([]*imemnode_t, *imemnode_t, defs.Err_t) {
 	opid := fs.fslog.Op_begin("fs_mkdir")
 	defer fs.fslog.Op_end(opid)
 
@@ -1259,12 +1525,17 @@ func (fs *Fs_t) Fs_op_mkdir(paths ustr.Ustr, mode int, cwd *fd.Cwd_t) ([]*imemno
 		return nil, nil, -defs.ENAMETOOLONG
 	}
 
-	par, dead, err := fs.fs_namei_locked(opid, dirs, cwd, "mkdir")
+	par, dead, err := fs.fs_namei_locked(opid, dirs, cwd, cred, "mkdir")
 	if err != 0 {
 		return nil, dead, err
 	}
 
-	child, err := par.do_createdir(opid, fn)
+	err = par.dirmodchk(cred, nil)
+	if err != 0 {
+		par.iunlock("fs_mkdir_par")
+		return []*imemnode_t{par}, nil, err
+	}
+	child, err := par.do_createdir(opid, fn, mode, cred)
 	if err != 0 {
 		par.iunlock("fs_mkdir_par")
 		return []*imemnode_t{par}, nil, err
@@ -1293,39 +1564,399 @@ outunlink:
 	return []*imemnode_t{par, child}, nil, err
 }
 
+func (fs *Fs_t) Fs_symlink(target, paths ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	refs, dead, err := fs.Fs_op_symlink(target, paths, cwd, cred)
+	for _, ref := range refs {
+		if ref.Refdown("") {
+			ref.Free()
+		}
+	}
+	if dead != nil {
+		dead.Free()
+	}
+	return err
+}
+
+// creates a symlink named paths which refers to target. returns refs, dead,
+// and error.
+func (fs *Fs_t) Fs_op_symlink(target, paths ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t) ([]*imemnode_t, *imemnode_t, defs.Err_t) {
+	if len(target) == 0 {
+		return nil, nil, -defs.ENOENT
+	}
+	if len(target) > NAME_MAX {
+		return nil, nil, -defs.ENAMETOOLONG
+	}
+
+	opid := fs.fslog.Op_begin("fs_symlink")
+	defer fs.fslog.Op_end(opid)
+
+	if fs_debug {
+		fmt.Printf("symlink: %v %v %v\n", target, paths, cwd)
+	}
+
+	dirs, fn := bpath.Sdirname(paths)
+	if err, ok := crname(fn, -defs.ENOENT); !ok {
+		return nil, nil, err
+	}
+	if len(fn) > DNAMELEN {
+		return nil, nil, -defs.ENAMETOOLONG
+	}
+
+	par, dead, err := fs.fs_namei_locked(opid, dirs, cwd, cred, "symlink")
+	if err != 0 {
+		return nil, dead, err
+	}
+
+	err = par.dirmodchk(cred, nil)
+	if err != 0 {
+		par.iunlock("fs_symlink_par")
+		return []*imemnode_t{par}, nil, err
+	}
+	child, err := par.do_createsymlink(opid, fn, cred)
+	if err != 0 {
+		par.iunlock("fs_symlink_par")
+		if child != nil {
+			// icreate returns the existing inode on EEXIST
+			return []*imemnode_t{par, child}, nil, err
+		}
+		return []*imemnode_t{par}, nil, err
+	}
+	defer par.iunlock("fs_symlink_par")
+	// cannot deadlock since par is locked and concurrent lookup must lock
+	// par to get a handle to child
+	child.ilock("")
+	defer child.iunlock("")
+
+	if err = child.do_writelink(opid, target); err != 0 {
+		_, nerr := par.iunlink(opid, fn)
+		if nerr != 0 {
+			panic("must succeed")
+		}
+		child._linkdown(opid)
+	}
+	return []*imemnode_t{par, child}, nil, err
+}
+
+// returns the target of the symlink named by paths
+func (fs *Fs_t) Fs_readlink(paths ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t) (ustr.Ustr, defs.Err_t) {
+	opid := opid_t(0)
+
+	if fs_debug {
+		fmt.Printf("readlink: %v %v\n", paths, cwd)
+	}
+	idm, dead, err := fs.fs_lnamei_locked(opid, paths, cwd, cred, "Fs_readlink")
+	if err != 0 {
+		if dead != nil {
+			dead.Free()
+		}
+		return nil, err
+	}
+	target, err := idm.do_readlink()
+	if idm.iunlock_refdown("Fs_readlink") {
+		idm.Free()
+	}
+	return target, err
+}
+
+func (fs *Fs_t) Fs_chmod(paths ustr.Ustr, mode int, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	return fs._fs_setattr(paths, cwd, cred, true, "Fs_chmod", func(opid opid_t, idm *imemnode_t) defs.Err_t {
+		if err := idm.ownerchk(cred); err != 0 {
+			return err
+		}
+		if !cred.Isroot() && !cred.Ingroup(idm.gid) {
+			mode &^= S_ISGID
+		}
+		idm.mode = mode & 07777
+		return 0
+	})
+}
+
+// a uid or gid of -1 is left unchanged. only the superuser may change the
+// owner; the owner may change the group to one of its groups.
+func (fs *Fs_t) Fs_chown(paths ustr.Ustr, uid, gid int, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	return fs._fs_setattr(paths, cwd, cred, true, "Fs_chown", func(opid opid_t, idm *imemnode_t) defs.Err_t {
+		if !cred.Isroot() {
+			if uid != -1 && uid != idm.uid {
+				return -defs.EPERM
+			}
+			if err := idm.ownerchk(cred); err != 0 {
+				return err
+			}
+			if gid != -1 && !cred.Ingroup(gid) {
+				return -defs.EPERM
+			}
+		}
+		if uid != -1 {
+			idm.uid = uid
+		}
+		if gid != -1 {
+			idm.gid = gid
+		}
+		if idm.itype != I_DIR {
+			idm.mode &^= S_ISUID | S_ISGID
+		}
+		return 0
+	})
+}
+
+// atime and mtime are in nanoseconds since the epoch; a negative time is left
+// unchanged. if follow is false, a symlink in the last component is updated
+// instead of its target.
+func (fs *Fs_t) Fs_utimens(paths ustr.Ustr, atime, mtime int, follow bool, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	return fs._fs_setattr(paths, cwd, cred, follow, "Fs_utimens", func(opid opid_t, idm *imemnode_t) defs.Err_t {
+		// XXX setting both times to the current time should also be
+		// allowed with write permission
+		if err := idm.ownerchk(cred); err != 0 {
+			return err
+		}
+		if atime >= 0 {
+			idm.atime = atime
+		}
+		if mtime >= 0 {
+			idm.mtime = mtime
+		}
+		return 0
+	})
+}
+
+// reports whether the files have extended attributes; see xattr.go
+func (fs *Fs_t) hasxattr() bool {
+	return fs.diskfs && fs.superb.Features()&FEAT_XATTR != 0
+}
+
+// sets extended attribute name of the file named by paths to value. flags is
+// defs.XATTR_CREATE or defs.XATTR_REPLACE to require that the attribute
+// doesn't or does exist.
+func (fs *Fs_t) Fs_setxattr(paths, name ustr.Ustr, value []uint8, flags int, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	if err := xnamechk(name); err != 0 {
+		return err
+	}
+	if len(value) > XATTR_SIZE_MAX {
+		return -defs.E2BIG
+	}
+	if flags&^(defs.XATTR_CREATE|defs.XATTR_REPLACE) != 0 {
+		return -defs.EINVAL
+	}
+	if !fs.hasxattr() {
+		return -defs.EOPNOTSUPP
+	}
+	if value == nil {
+		value = []uint8{}
+	}
+	return fs._fs_setattr(paths, cwd, cred, true, "Fs_setxattr", func(opid opid_t, idm *imemnode_t) defs.Err_t {
+		if err := idm.xaccess(cred, name, defs.W_OK); err != 0 {
+			return err
+		}
+		return idm.do_setxattr(opid, name, value, flags)
+	})
+}
+
+func (fs *Fs_t) Fs_removexattr(paths, name ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	if err := xnamechk(name); err != 0 {
+		return err
+	}
+	if !fs.hasxattr() {
+		return -defs.EOPNOTSUPP
+	}
+	return fs._fs_setattr(paths, cwd, cred, true, "Fs_removexattr", func(opid opid_t, idm *imemnode_t) defs.Err_t {
+		if err := idm.xaccess(cred, name, defs.W_OK); err != 0 {
+			return err
+		}
+		return idm.do_setxattr(opid, name, nil, 0)
+	})
+}
+
+func (fs *Fs_t) Fs_getxattr(paths, name ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t) ([]uint8, defs.Err_t) {
+	if err := xnamechk(name); err != 0 {
+		return nil, err
+	}
+	if !fs.hasxattr() {
+		return nil, -defs.EOPNOTSUPP
+	}
+	var value []uint8
+	err := fs._fs_getxattr(paths, cwd, cred, "Fs_getxattr", func(idm *imemnode_t) defs.Err_t {
+		err := idm.xaccess(cred, name, defs.R_OK)
+		if err == 0 {
+			value, err = idm.do_getxattr(name)
+		}
+		return err
+	})
+	return value, err
+}
+
+// returns the NUL-terminated names of the extended attributes of the file
+// named by paths
+func (fs *Fs_t) Fs_listxattr(paths ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t) ([]uint8, defs.Err_t) {
+	if !fs.hasxattr() {
+		return nil, -defs.EOPNOTSUPP
+	}
+	var names []uint8
+	err := fs._fs_getxattr(paths, cwd, cred, "Fs_listxattr", func(idm *imemnode_t) defs.Err_t {
+		names = idm.do_listxattr(cred)
+		return 0
+	})
+	return names, err
+}
+
+// applies get to the locked inode named by paths
+func (fs *Fs_t) _fs_getxattr(paths ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t, s string, get func(*imemnode_t) defs.Err_t) defs.Err_t {
+	opid := opid_t(0)
+
+	if fs_debug {
+		fmt.Printf("%v: %v %v\n", s, paths, cwd)
+	}
+	idm, dead, err := fs.fs_namei_locked(opid, paths, cwd, cred, s)
+	if err != 0 {
+		if dead != nil {
+			dead.Free()
+		}
+		return err
+	}
+	err = get(idm)
+	if idm.iunlock_refdown(s) {
+		idm.Free()
+	}
+	return err
+}
+
+func (fs *Fs_t) _fs_setattr(paths ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t, follow bool, s string, setattr func(opid_t, *imemnode_t) defs.Err_t) defs.Err_t {
+	idm, dead, err := fs._fs_op_setattr(paths, cwd, cred, follow, s, setattr)
+	if idm != nil && idm.Refdown(s) {
+		idm.Free()
+	}
+	if dead != nil {
+		dead.Free()
+	}
+	return err
+}
+
+// applies setattr to the inode named by paths and logs the updated inode if
+// setattr succeeds. returns the referenced inode, dead, and error.
+func (fs *Fs_t) _fs_op_setattr(paths ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t, follow bool, s string, setattr func(opid_t, *imemnode_t) defs.Err_t) (*imemnode_t, *imemnode_t, defs.Err_t) {
+	opid := fs.fslog.Op_begin(s)
+	defer fs.fslog.Op_end(opid)
+
+	if fs_debug {
+		fmt.Printf("%v: %v %v\n", s, paths, cwd)
+	}
+	idm, dead, err := fs._fs_namei_locked(opid, paths, cwd, cred, follow)
+	if err != 0 {
+		return nil, dead, err
+	}
+	err = setattr(opid, idm)
+	if err == 0 {
+		idm.ctime = inodetime()
+		idm._iupdate(opid)
+		idm.notify(defs.IN_ATTRIB|idm.inisdir(), 0, nil)
+	}
+	idm.iunlock(s)
+	return idm, nil, err
+}
+
+// checks whether cred may access paths in the ways described by amode, a mask
+// of defs.R_OK, defs.W_OK and defs.X_OK.
+func (fs *Fs_t) Fs_access(paths ustr.Ustr, amode int, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	opid := opid_t(0)
+
+	if fs_debug {
+		fmt.Printf("access: %v %v %v\n", paths, amode, cwd)
+	}
+	idm, dead, err := fs.fs_namei_locked(opid, paths, cwd, cred, "Fs_access")
+	if err != 0 {
+		if dead != nil {
+			dead.Free()
+		}
+		return err
+	}
+	err = idm.iaccess(cred, amode)
+	if idm.iunlock_refdown("Fs_access") {
+		idm.Free()
+	}
+	return err
+}
+
+// checks whether cred may execute the open file. returns the uid and gid which
+// a set-user-ID or set-group-ID file executes with, or -1.
+func (fo *fsfops_t) Execperm(cred *proc.Cred_t) (int, int, defs.Err_t) {
+	idm := fo.fs.icache.Iref_locked(fo.priv, "Execperm")
+	defer idm.iunlock_refdown("Execperm")
+	if idm.itype != I_FILE {
+		return -1, -1, -defs.EACCES
+	}
+	if err := idm.iaccess(cred, defs.X_OK); err != 0 {
+		return -1, -1, err
+	}
+	uid, gid := -1, -1
+	if idm.mode&S_ISUID != 0 {
+		uid = idm.uid
+	}
+	// set-group-ID without group execute permission means mandatory
+	// locking, not set-group-ID
+	if idm.mode&S_ISGID != 0 && idm.mode&0010 != 0 {
+		gid = idm.gid
+	}
+	return uid, gid, 0
+}
+
 // a type to represent on-disk files
 type Fsfile_t struct {
 	Inum  defs.Inum_t
 	Major int
 	Minor int
+	// the file is truncated once opened
+	trunc bool
 }
 
-func (fs *Fs_t) Fs_open_inner(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.Cwd_t, major, minor int) (Fsfile_t, defs.Err_t) {
-	ret, dead, err := fs._fs_open_inner(paths, flags, mode, cwd, major, minor)
+func (fs *Fs_t) Fs_open_inner(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.Cwd_t, cred *proc.Cred_t, major, minor int) (Fsfile_t, defs.Err_t) {
+	ret, dead, err := fs._fs_open_inner(paths, flags, mode, cwd, cred, major, minor)
 	if dead != nil {
 		dead.Free()
 	}
+	if err == 0 && ret.trunc {
+		// truncating may take many operations, thus is not part of the
+		// open's
+		idm := fs.icache.Iref(ret.Inum, "Fs_open_inner")
+		err = idm.do_trunc(0)
+		idm.Refdown("Fs_open_inner")
+		if err != 0 {
+			fs.Fs_close(ret.Inum)
+		}
+	}
 	return ret, err
 }
 
+// creates the special file paths and returns its inode number
+func (fs *Fs_t) Fs_mknod(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.Cwd_t, cred *proc.Cred_t, major, minor int) (defs.Inum_t, defs.Err_t) {
+	fsf, err := fs.Fs_open_inner(paths, flags|defs.O_CREAT, mode, cwd, cred, major, minor)
+	if err != 0 {
+		return 0, err
+	}
+	if fs.Fs_close(fsf.Inum) != 0 {
+		panic("must succeed")
+	}
+	return fsf.Inum, 0
+}
+
 // returns the file, a dead inode (non-nil only on error) and error
-func (fs *Fs_t) _fs_open_inner(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.Cwd_t, major, minor int) (Fsfile_t, *imemnode_t, defs.Err_t) {
+func (fs *Fs_t) _fs_open_inner(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.Cwd_t, cred *proc.Cred_t, major, minor int) (Fsfile_t, *imemnode_t, defs.Err_t) {
 	trunc := flags&defs.O_TRUNC != 0
 	creat := flags&defs.O_CREAT != 0
+	nofollow := flags&defs.O_NOFOLLOW != 0
 	nodir := false
 
 	if fs_debug {
 		fmt.Printf("fs_open: %v %v %v\n", paths, cwd, creat)
 	}
 
-	// open with O_TRUNC is not read-only
 	var opid opid_t
-	if trunc || creat {
+	if creat {
 		opid = fs.fslog.Op_begin("fs_open")
 		defer fs.fslog.Op_end(opid)
 	}
 	var ret Fsfile_t
 	var idm *imemnode_t
+	// true if this open created the file
+	created := false
 	if creat {
 		nodir = true
 		// creat w/execl; must atomically create and open the new file.
@@ -1342,14 +1973,23 @@ func (fs *Fs_t) _fs_open_inner(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cw
 		}
 
 		// with O_CREAT, the file may exist.
-		par, dead, err := fs.fs_namei_locked(opid, dirs, cwd, "Fs_open_inner")
+		par, dead, err := fs.fs_namei_locked(opid, dirs, cwd, cred, "Fs_open_inner")
 		if err != 0 {
 			return ret, dead, err
 		}
-		if isdev {
-			idm, err = par.do_createnod(opid, fn, major, minor)
+		if perr := par.dirmodchk(cred, nil); perr != 0 {
+			// cred cannot create files in par, but may open an
+			// existing one
+			idm, err = par.ilookup(opid, fn)
+			if err == 0 {
+				err = -defs.EEXIST
+			} else if err == -defs.ENOENT {
+				err = perr
+			}
+		} else if isdev {
+			idm, err = par.do_createnod(opid, fn, major, minor, mode, cred)
 		} else {
-			idm, err = par.do_createfile(opid, fn)
+			idm, err = par.do_createfile(opid, fn, mode, cred)
 		}
 		if err != 0 && err != -defs.EEXIST {
 			// XXX must check dead
@@ -1357,6 +1997,7 @@ func (fs *Fs_t) _fs_open_inner(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cw
 			return ret, nil, err
 		}
 		exists := err == -defs.EEXIST
+		created = !exists
 		par.iunlock_refdown("Fs_open_inner_par")
 		idm.ilock("child")
 
@@ -1366,12 +2007,24 @@ func (fs *Fs_t) _fs_open_inner(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cw
 				idm.iunlock_refdown("Fs_open_inner2")
 				return ret, nil, -defs.EEXIST
 			}
+			if idm.itype == I_SYMLINK && !nofollow {
+				// XXX O_CREAT through a dangling symlink
+				// fails instead of creating the target
+				if idm.iunlock_refdown("Fs_open_inner_link") {
+					return ret, idm, -defs.ENOENT
+				}
+				var dead *imemnode_t
+				idm, dead, err = fs.fs_namei_locked(opid, paths, cwd, cred, "Fs_open_inner_link")
+				if err != 0 {
+					return ret, dead, err
+				}
+			}
 		}
 	} else {
 		// open existing file
 		var err defs.Err_t
 		var dead *imemnode_t
-		idm, dead, err = fs.fs_namei_locked(opid, paths, cwd, "Fs_open_inner_existing")
+		idm, dead, err = fs._fs_namei_locked(opid, paths, cwd, cred, !nofollow)
 		if err != 0 {
 			return ret, dead, err
 		}
@@ -1381,6 +2034,11 @@ func (fs *Fs_t) _fs_open_inner(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cw
 
 	itype := idm.itype
 
+	// a symlink can only be found here if O_NOFOLLOW was given
+	if itype == I_SYMLINK {
+		return ret, nil, -defs.ELOOP
+	}
+
 	o_dir := flags&defs.O_DIRECTORY != 0
 	wantwrite := flags&(defs.O_WRONLY|defs.O_RDWR) != 0
 	if wantwrite {
@@ -1398,10 +2056,28 @@ func (fs *Fs_t) _fs_open_inner(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cw
 		}
 	}
 
-	if nodir && trunc {
-		idm.do_trunc(opid, 0)
+	// the creator may open a new file regardless of the mode
+	if !created {
+		want := defs.R_OK
+		switch flags & (defs.O_RDONLY | defs.O_WRONLY | defs.O_RDWR) {
+		case defs.O_WRONLY:
+			want = defs.W_OK
+		case defs.O_RDWR:
+			want = defs.R_OK | defs.W_OK
+		}
+		if trunc {
+			want |= defs.W_OK
+		}
+		if flags&defs.O_EXEC != 0 {
+			want = defs.X_OK
+		}
+		if err := idm.iaccess(cred, want); err != 0 {
+			return ret, nil, err
+		}
 	}
 
+	ret.trunc = nodir && trunc
+
 	idm.Refup("Fs_open_inner")
 
 	ret.Inum = idm.inum
@@ -1431,9 +2107,9 @@ func (fs *Fs_t) Makefake() *fd.Fd_t {
 // socket files cannot be open(2)'ed (must use connect(2)/sendto(2) etc.)
 var _denyopen = map[int]bool{defs.D_SUD: true, defs.D_SUS: true}
 
-func (fs *Fs_t) Fs_open(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.Cwd_t, major, minor int) (*fd.Fd_t, defs.Err_t) {
+func (fs *Fs_t) Fs_open(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.Cwd_t, cred *proc.Cred_t, major, minor int) (*fd.Fd_t, defs.Err_t) {
 	fs.istats.Nopen.Inc()
-	fsf, err := fs.Fs_open_inner(paths, flags, mode, cwd, major, minor)
+	fsf, err := fs.Fs_open_inner(paths, flags, mode, cwd, cred, major, minor)
 	if err != 0 {
 		return nil, err
 	}
@@ -1456,20 +2132,14 @@ func (fs *Fs_t) Fs_open(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.C
 		if fs.Fs_close(fsf.Inum) != 0 {
 			panic("must succeed")
 		}
-		switch maj {
-		case defs.D_CONSOLE, defs.D_DEVNULL, defs.D_STAT, defs.D_PROF:
-			if maj == defs.D_STAT {
-				stats_string = fs.Fs_statistics()
-			}
-			ret.Fops = &Devfops_t{Maj: maj, Min: min}
-		case defs.D_RAWDISK:
-			ret.Fops = &rawdfops_t{minor: min, fs: fs}
-		default:
-			panic("bad dev")
+		if ret.Fops, err = device.Open(maj, min); err != 0 {
+			return nil, err
 		}
 	} else {
 		apnd := flags&defs.O_APPEND != 0
-		ret.Fops = &fsfops_t{priv: priv, fs: fs, append: apnd, count: 1}
+		direct := flags&defs.O_DIRECT != 0
+		ret.Fops = &fsfops_t{priv: priv, fs: fs, append: apnd,
+			direct: direct, count: 1}
 	}
 	return ret, 0
 }
@@ -1496,13 +2166,13 @@ func (fs *Fs_t) Fs_close(priv defs.Inum_t) defs.Err_t {
 	return 0
 }
 
-func (fs *Fs_t) Fs_stat(path ustr.Ustr, st *stat.Stat_t, cwd *fd.Cwd_t) defs.Err_t {
+func (fs *Fs_t) Fs_stat(path ustr.Ustr, st *stat.Stat_t, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
 	opid := opid_t(0)
 
 	if fs_debug {
 		fmt.Printf("fstat: %v %v\n", path, cwd)
 	}
-	idm, dead, err := fs.fs_namei_locked(opid, path, cwd, "Fs_stat")
+	idm, dead, err := fs.fs_namei_locked(opid, path, cwd, cred, "Fs_stat")
 	if err != 0 {
 		if dead != nil {
 			dead.Free()
@@ -1517,8 +2187,7 @@ func (fs *Fs_t) Fs_stat(path ustr.Ustr, st *stat.Stat_t, cwd *fd.Cwd_t) defs.Err
 	return err
 }
 
-// Sync the file system to disk. XXX If Biscuit supported fsync, we could be
-// smarter and flush only the dirty blocks of particular inode.
+// Sync the file system to disk. fsfops_t.Fsync() syncs a single file.
 func (fs *Fs_t) Fs_sync() defs.Err_t {
 	if !fs.diskfs {
 		return 0
@@ -1537,13 +2206,36 @@ func (fs *Fs_t) Fs_syncapply() defs.Err_t {
 	return 0
 }
 
+// maximum number of symlinks followed while resolving a single path
+const MAXSYMLINKS = 8
+
 // if the path resolves successfully, returns target inode with incremented
 // refcount and locked. the caller must always be prepared to free the returned
 // imemnode after calling Refdown. if the lookup fails, the second returned
 // inode may be non-nil and must be freed by the caller. since the slow path
 // acquires locks on inodes, the caller must not have any other inode locked,
-// otherwise namei may deadlock.
-func (fs *Fs_t) _fs_namei_locked(opid opid_t, paths ustr.Ustr, cwd *fd.Cwd_t) (*imemnode_t, *imemnode_t, defs.Err_t) {
+// otherwise namei may deadlock. symlinks in the middle of the path are always
+// followed; a symlink in the last component is followed only if follow is
+// true.
+func (fs *Fs_t) _fs_namei_locked(opid opid_t, paths ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t, follow bool) (*imemnode_t, *imemnode_t, defs.Err_t) {
+	for nlinks := 0; ; nlinks++ {
+		idm, dead, link, err := fs._fs_namei1(opid, paths, cwd, cred, follow)
+		if err != 0 || link == nil {
+			return idm, dead, err
+		}
+		if nlinks == MAXSYMLINKS {
+			return nil, nil, -defs.ELOOP
+		}
+		// resolve the path with the symlink substituted
+		paths = link
+	}
+}
+
+// resolves paths without following symlinks. if a symlink must be followed,
+// returns the path with the symlink replaced by its target instead of an
+// inode. cred must have search permission on every directory the walk goes
+// through.
+func (fs *Fs_t) _fs_namei1(opid opid_t, paths ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t, follow bool) (*imemnode_t, *imemnode_t, ustr.Ustr, defs.Err_t) {
 	var start *imemnode_t
 	fs.istats.Nnamei.Inc()
 	// ref lookup directory
@@ -1563,40 +2255,60 @@ func (fs *Fs_t) _fs_namei_locked(opid opid_t, paths ustr.Ustr, cwd *fd.Cwd_t) (*
 		// lock-free lookup fails
 		next, nextok = pp.Next()
 		lastc := !nextok
+		// the slow path reports the error. idm isn't locked, thus its
+		// mode may change under us, as it may right after the check.
+		if idm.searchchk(cred) != 0 {
+			break
+		}
 		n, found := idm.ilookup_lockfree(cp, lastc)
 		if !found {
 			break
 		}
 		idm = n
 		if lastc {
-			// ilookup_lockfree already locked n
-			return n, nil, 0
+			if follow && n.itype == I_SYMLINK {
+				// let the slow path follow the link. n's
+				// link count is non-zero, thus it cannot be
+				// freed by dropping our reference.
+				n.iunlock_refdown("")
+				break
+			}
+			// ilookup_lockfree already locked n. like the slow
+			// path, drop the reference on start; the cwd (or the
+			// root) keeps it alive.
+			start.Refdown("")
+			return n, nil, nil, 0
 		}
 		// "start" is the only imemnode whose refcount is incremented
 		if !res.Resadd_noblock(bounds.Bounds(bounds.B_FS_T_FS_NAMEI)) {
 			err := -defs.ENOHEAP
 			if start.Refdown("") {
-				return nil, start, err
+				return nil, start, nil, err
 			}
-			return nil, nil, err
+			return nil, nil, nil, err
 		}
 	}
 	// couldn't ref idm; restart completely
 	idm = start
 	pp.Pp_init(paths)
 
+	// the parts of the path before and after the component which resolved
+	// to idm
+	var pre, rest ustr.Ustr
 	// lock-full slow path
-	for cp, ok := pp.Next(); ok; cp, ok = next, nextok {
-		next, nextok = pp.Next()
-
+	for cp, ok := pp.Next(); ok; cp, ok = pp.Next() {
 		idm.ilock("fs_namei")
+		if idm.itype == I_SYMLINK {
+			link, dead, err := idm._followlink(pre, rest)
+			return nil, dead, link, err
+		}
 		// for simplicity, conservatively fail the lookup if links==0
 		// so that namei can return at most one dead inode.
 		var n *imemnode_t
-		var err defs.Err_t
-		if idm.links != 0 {
+		err := idm.searchchk(cred)
+		if err == 0 && idm.links != 0 {
 			n, err = idm.ilookup(opid, cp)
-		} else {
+		} else if err == 0 {
 			err = -defs.ENOENT
 		}
 		var dead *imemnode_t
@@ -1613,31 +2325,62 @@ func (fs *Fs_t) _fs_namei_locked(opid opid_t, paths ustr.Ustr, cwd *fd.Cwd_t) (*
 			}
 		}
 		if err != 0 {
-			return nil, dead, err
+			return nil, dead, nil, err
 		}
 		idm = n
+		pre, rest = pp.Split()
 		if !res.Resadd_noblock(bounds.Bounds(bounds.B_FS_T_FS_NAMEI)) {
 			err := -defs.ENOHEAP
 			if idm.Refdown("") {
-				return nil, idm, err
+				return nil, idm, nil, err
 			}
-			return nil, nil, err
+			return nil, nil, nil, err
 		}
 	}
 	idm.ilock("")
-	return idm, nil, 0
+	if follow && idm.itype == I_SYMLINK {
+		link, dead, err := idm._followlink(pre, rest)
+		return nil, dead, link, err
+	}
+	return idm, nil, nil, 0
 }
 
-func (fs *Fs_t) fs_namei_locked(opid opid_t, paths ustr.Ustr, cwd *fd.Cwd_t, s string) (*imemnode_t, *imemnode_t, defs.Err_t) {
-	return fs._fs_namei_locked(opid, paths, cwd)
+// follows the locked and referenced symlink idm, whose name is preceded by pre
+// and followed by rest in the path being resolved. returns the path which
+// must be resolved instead, and a dead inode if idm was unlinked.
+func (idm *imemnode_t) _followlink(pre, rest ustr.Ustr) (ustr.Ustr, *imemnode_t, defs.Err_t) {
+	target, err := idm.do_readlink()
+	if idm.iunlock_refdown("_followlink") {
+		return nil, idm, -defs.ENOENT
+	}
+	if err != 0 {
+		return nil, nil, err
+	}
+	var ret ustr.Ustr
+	if !target.IsAbsolute() {
+		ret = append(ret, pre...)
+	}
+	ret = append(ret, target...)
+	return append(ret, rest...), nil, 0
+}
+
+func (fs *Fs_t) fs_namei_locked(opid opid_t, paths ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t, s string) (*imemnode_t, *imemnode_t, defs.Err_t) {
+	return fs._fs_namei_locked(opid, paths, cwd, cred, true)
+}
+
+// like fs_namei_locked, but does not follow a symlink in the last component
+func (fs *Fs_t) fs_lnamei_locked(opid opid_t, paths ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t, s string) (*imemnode_t, *imemnode_t, defs.Err_t) {
+	return fs._fs_namei_locked(opid, paths, cwd, cred, false)
 }
 
+// Evicts an eighth of the cached blocks and inodes, picking the ones least
+// likely to be used again; callers that need more memory call Fs_evict again.
 func (fs *Fs_t) Fs_evict() (int, int) {
 	if !fs.diskfs {
 		panic("no evict")
 	}
-	_, a := fs.bcache.cache.Evict_half()
-	_, b := fs.icache.cache.Evict_half()
+	_, a := fs.bcache.cache.Evict(fs.bcache.cache.Len()/8 + 1)
+	_, b := fs.icache.cache.Evict(fs.icache.cache.Len()/8 + 1)
 	fmt.Printf("FS EVICT blk %v imem %v\n", a, b)
 	return fs.Sizes()
 }
@@ -1652,5 +2395,15 @@ func (fs *Fs_t) Fs_statistics() string {
 	s += fs.bcache.Stats()
 	s += fs.icache.Stats()
 	s += fs.ahci.Stats()
+	// unlike the statistics above, the corruption counts are always kept
+	nlog, nblk := fs.Fs_csumerrs()
+	s += fmt.Sprintf("checksum errors: log %v blocks %v\n", nlog, nblk)
 	return s
 }
+
+// Fs_csumerrs returns the number of log transactions that recovery dropped
+// because their checksums didn't match, and the number of metadata blocks read
+// from the disk whose checksums didn't match; see csum.go.
+func (fs *Fs_t) Fs_csumerrs() (int, int) {
+	return fs.fslog.Ncsumerr(), fs.bcache.Ncsumerr()
+}
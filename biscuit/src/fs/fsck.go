@@ -0,0 +1,697 @@
+package fs
+
+import "fmt"
+
+import "defs"
+import "mem"
+import "ustr"
+import "util"
+
+// Offline consistency checker. Fsck reads the image directly from a disk,
+// without the log, block cache, or inode cache, and therefore must not run
+// while the file system is mounted.
+
+type Fsckres_t struct {
+	// descriptions of the inconsistencies found
+	Problems []string
+	// true if the log holds transactions which have not been installed;
+	// nothing else is checked since the image is inconsistent until the
+	// log is replayed by mounting the file system.
+	Logdirty bool
+	// true if the image was modified
+	Repaired bool
+}
+
+type fsck_t struct {
+	disk   Disk_i
+	repair bool
+	res    *Fsckres_t
+
+	superb    Superblock_t
+	imapstart int
+	ninode    int
+	datastart int
+	ndata     int
+
+	blks  map[int]*mem.Bytepg_t
+	dirty map[int]bool
+
+	// number of directory entries, excluding "." and "..", naming each
+	// inode
+	nlinks map[defs.Inum_t]int
+	// inodes reachable from the root
+	reach map[defs.Inum_t]bool
+	// referenced blocks and the inode referencing them
+	bref map[int]defs.Inum_t
+	// blocks of orphans, some of which may have been freed already
+	oblks map[int]bool
+	// blocks of the reference count table, its leaves by index, the
+	// counts which are not zero, and the references found besides the
+	// first
+	rcblks   map[int]bool
+	rcleaves map[int]int
+	rcnt     map[int]int
+	nshare   map[int]int
+	// the block map and inode blocks which grows added
+	gblks map[int]bool
+	// the blocks ending in a checksum that have been read
+	csumblks map[int]bool
+}
+
+// Fsck checks the file system on disk. if repair is true, Fsck also fixes the
+// problems it can.
+func Fsck(disk Disk_i, repair bool) *Fsckres_t {
+	fk := &fsck_t{disk: disk, repair: repair, res: &Fsckres_t{}}
+	fk.blks = make(map[int]*mem.Bytepg_t)
+	fk.dirty = make(map[int]bool)
+	fk.nlinks = make(map[defs.Inum_t]int)
+	fk.reach = make(map[defs.Inum_t]bool)
+	fk.bref = make(map[int]defs.Inum_t)
+	fk.oblks = make(map[int]bool)
+	fk.rcblks = make(map[int]bool)
+	fk.rcleaves = make(map[int]int)
+	fk.rcnt = make(map[int]int)
+	fk.nshare = make(map[int]int)
+	fk.gblks = make(map[int]bool)
+	fk.csumblks = make(map[int]bool)
+
+	if !fk.chkgeometry() {
+		return fk.res
+	}
+	if fk.chklog() {
+		fk.res.Logdirty = true
+		return fk.res
+	}
+	fk.rctable()
+	fk.walk(iroot, iroot)
+	fk.chkinodes()
+	fk.chkblocks()
+	fk.flush()
+	return fk.res
+}
+
+func (fk *fsck_t) problem(f string, args ...interface{}) {
+	fk.res.Problems = append(fk.res.Problems, fmt.Sprintf(f, args...))
+}
+
+// fsck_t reads blocks without the block cache; Relse is called by the disk
+// once a write completes.
+func (fk *fsck_t) Relse(blk *Bdev_block_t, s string) {
+}
+
+func (fk *fsck_t) bread(blkn int) *mem.Bytepg_t {
+	if d, ok := fk.blks[blkn]; ok {
+		return d
+	}
+	b := MkBlock(blkn, "fsck", nil, fk.disk, fk)
+	b.Data = &mem.Bytepg_t{}
+	b.Read()
+	fk.blks[blkn] = b.Data
+	return b.Data
+}
+
+// reads block blkn, which ends in a checksum, and checks the checksum when the
+// block is first read. a repair restamps the checksum.
+func (fk *fsck_t) breadcsum(blkn int) *mem.Bytepg_t {
+	d := fk.bread(blkn)
+	if !fk.csumblks[blkn] {
+		fk.csumblks[blkn] = true
+		if !Csumok(d) {
+			fk.problem("block %v: bad checksum", blkn)
+			if fk.repair {
+				fk.bdirty(blkn)
+			}
+		}
+	}
+	return d
+}
+
+func (fk *fsck_t) bdirty(blkn int) {
+	fk.dirty[blkn] = true
+	fk.res.Repaired = true
+}
+
+func (fk *fsck_t) flush() {
+	if len(fk.dirty) == 0 {
+		return
+	}
+	for blkn := range fk.dirty {
+		if fk.csumblks[blkn] {
+			Csumw(fk.blks[blkn])
+		}
+		b := MkBlock(blkn, "fsck", nil, fk.disk, fk)
+		b.Data = fk.blks[blkn]
+		b.Write()
+	}
+	req := MkRequest(nil, BDEV_FLUSH, true)
+	if fk.disk.Start(req) {
+		<-req.AckCh
+	}
+}
+
+func (fk *fsck_t) chkgeometry() bool {
+	b := fk.bread(0)
+	start := util.Readn(b[:], 4, FSOFF)
+	if start <= 0 {
+		fk.problem("bad superblock address %v", start)
+		return false
+	}
+	fk.superb = Superblock_t{fk.bread(start)}
+	sb := &fk.superb
+	fk.ninode = sb.Inodelen() * (BSIZE / sb.Isize())
+	fk.imapstart = sb.Iorphanblock() + sb.Iorphanlen()
+	fk.datastart = sb.Datastart()
+	fk.ndata = sb.Lastblock() - fk.datastart
+	ok := true
+	chk := func(c bool, f string, args ...interface{}) {
+		if !c {
+			fk.problem("superblock: "+f, args...)
+			ok = false
+		}
+	}
+	chk(sb.Loglen() > 0, "bad log length %v", sb.Loglen())
+	chk(sb.Iorphanblock() == start+1+sb.Loglen(),
+		"orphan map at %v, not after the log", sb.Iorphanblock())
+	chk(sb.Iorphanlen() == sb.Imaplen(), "orphan map length %v != inode map length %v",
+		sb.Iorphanlen(), sb.Imaplen())
+	chk(sb.Freeblock() == fk.imapstart+sb.Imaplen(),
+		"block map at %v, not after the inode map", sb.Freeblock())
+	chk(sb.Inodelen() > 0, "bad inode length %v", sb.Inodelen())
+	chk(sb.Imaplen()*bitsperblk >= fk.ninode,
+		"inode map too small for %v inodes", fk.ninode)
+	chk(fk.ndata > 0, "no data blocks")
+	chk(sb.Freeblocklen()*bitsperblk >= fk.ndata,
+		"block map too small for %v blocks", fk.ndata)
+	if !ok {
+		return false
+	}
+	chk(sb.Ngrow() <= GROWMAX, "bad number of grows %v", sb.Ngrow())
+	for i := 0; ok && i < sb.Ngrow(); i++ {
+		bmap, bfirst, inodes, ifirst := sb.Grow(i)
+		bend, iend := sb.Freeblocklen(), sb.Inodelen()
+		if i+1 < sb.Ngrow() {
+			_, bend, _, iend = sb.Grow(i + 1)
+		}
+		chk(bfirst <= bend && ifirst <= iend, "grow %v: bad block map or inode table index", i)
+		for b := bmap; ok && b < bmap+bend-bfirst; b++ {
+			chk(fk.validblk(b) && !fk.gblks[b], "grow %v: bad block map block %v", i, b)
+			fk.gblks[b] = true
+		}
+		for b := inodes; ok && b < inodes+iend-ifirst; b++ {
+			chk(fk.validblk(b) && !fk.gblks[b], "grow %v: bad inode block %v", i, b)
+			fk.gblks[b] = true
+		}
+	}
+	return ok
+}
+
+// returns true if the log must be replayed
+func (fk *fsck_t) chklog() bool {
+	lh := &logheader_t{fk.bread(fk.superb.Iorphanblock() - fk.superb.Loglen())}
+	return lh.r_tail() != lh.r_head()
+}
+
+// returns the block holding bit of the bitmap which starts at start. the block
+// map continues in the blocks grows added.
+func (fk *fsck_t) bitblk(start int, bit int) int {
+	if start == fk.superb.Freeblock() {
+		return fk.superb.Bmapblk(blkno(bit))
+	}
+	return start + blkno(bit)
+}
+
+// start is the first block of the bitmap
+func (fk *fsck_t) bitr(start int, bit int) bool {
+	d := fk.breadcsum(fk.bitblk(start, bit))
+	return d[byteno(bit)]&(1<<uint(byteoffset(bit))) != 0
+}
+
+func (fk *fsck_t) bitw(start int, bit int, v bool) {
+	d := fk.breadcsum(fk.bitblk(start, bit))
+	if v {
+		d[byteno(bit)] |= 1 << uint(byteoffset(bit))
+	} else {
+		d[byteno(bit)] &^= 1 << uint(byteoffset(bit))
+	}
+	fk.bdirty(fk.bitblk(start, bit))
+}
+
+func (fk *fsck_t) iblkno(inum defs.Inum_t) int {
+	return fk.superb.Inodeblk(int(inum) / (BSIZE / fk.superb.Isize()))
+}
+
+func (fk *fsck_t) inode(inum defs.Inum_t) *Inode_t {
+	blkn := fk.iblkno(inum)
+	isize := fk.superb.Isize()
+	var d *mem.Bytepg_t
+	if isize == ISIZE {
+		// ISIZE inodes leave no room for a checksum
+		d = fk.bread(blkn)
+	} else {
+		d = fk.breadcsum(blkn)
+	}
+	return mkInode(&Bdev_block_t{Block: blkn, Data: d}, inum, isize)
+}
+
+// returns the inode's type without panicking on garbage
+func itype_raw(ind *Inode_t) int {
+	return ind.bitsr(0, 0, 8)
+}
+
+func (fk *fsck_t) isorphan(inum defs.Inum_t) bool {
+	return fk.bitr(fk.superb.Iorphanblock(), int(inum))
+}
+
+func (fk *fsck_t) isalloc(inum defs.Inum_t) bool {
+	return fk.bitr(fk.imapstart, int(inum))
+}
+
+func (fk *fsck_t) validblk(blkn int) bool {
+	return blkn >= fk.datastart && blkn < fk.superb.Lastblock()
+}
+
+// returns the block holding file block fbn of the inode, or 0 for a hole
+func (fk *fsck_t) fbn2block(ind *Inode_t, fbn int) int {
+	if ind.iflags()&IF_EXTENTS != 0 {
+		root := ind.eroot()
+		n := &enode_t{root: &root}
+		for n.magicok() && n.nents() > 0 {
+			i := n.search(fbn)
+			if i < 0 {
+				i = 0
+			}
+			e := n.ent(i)
+			if n.height() == 0 {
+				if fbn < e.fbn || fbn >= e.fbn+e.len {
+					return 0
+				}
+				return e.blk + fbn - e.fbn
+			}
+			if !fk.validblk(e.blk) {
+				return 0
+			}
+			n = &enode_t{d: fk.bread(e.blk)}
+		}
+		return 0
+	}
+	if fbn < NIADDRS {
+		return ind.addr(fbn)
+	}
+	fbn -= NIADDRS
+	var indno int
+	if fbn < INDADDR {
+		indno = ind.indirect()
+	} else {
+		fbn -= INDADDR
+		dindno := ind.dindirect()
+		if dindno == 0 || !fk.validblk(dindno) {
+			return 0
+		}
+		indno = util.Readn(fk.bread(dindno)[:], 8, (fbn/INDADDR)*8)
+		fbn %= INDADDR
+	}
+	if indno == 0 || !fk.validblk(indno) {
+		return 0
+	}
+	return util.Readn(fk.bread(indno)[:], 8, fbn*8)
+}
+
+// records the blocks of the reference count table and the counts it holds
+func (fk *fsck_t) rctable() {
+	var visit func(blkn, span, base int)
+	visit = func(blkn, span, base int) {
+		if !fk.validblk(blkn) || fk.rcblks[blkn] || fk.gblks[blkn] {
+			fk.problem("reference count table: bad block %v", blkn)
+			return
+		}
+		fk.rcblks[blkn] = true
+		d := fk.bread(blkn)
+		if span < rccnts {
+			fk.rcleaves[base/rccnts] = blkn
+			for i := 0; i < rccnts; i++ {
+				if n := util.Readn(d[:], 2, i*2); n != 0 {
+					fk.rcnt[fk.datastart+base+i] = n
+				}
+			}
+			return
+		}
+		for i := 0; i < rcptrs; i++ {
+			if c := util.Readn(d[:], 8, i*8); c != 0 {
+				visit(c, span/rcptrs, base+i*span)
+			}
+		}
+	}
+	if root := fk.superb.Refcnt(); root != 0 {
+		visit(root, rcspan/rcptrs, 0)
+	}
+}
+
+// visits the directory inum, whose parent is par, and its descendants
+func (fk *fsck_t) walk(inum, par defs.Inum_t) {
+	fk.reach[inum] = true
+	ind := fk.inode(inum)
+	if itype_raw(ind) != I_DIR {
+		fk.problem("root inode is not a directory")
+		return
+	}
+	if ind.size()%BSIZE != 0 {
+		fk.problem("directory %v: size %v is not a multiple of the block size",
+			inum, ind.size())
+	}
+	var sawdot, sawdotdot bool
+	var subdirs []defs.Inum_t
+	for fbn := 0; fbn < ind.size()/BSIZE; fbn++ {
+		blkn := fk.fbn2block(ind, fbn)
+		if blkn == 0 || !fk.validblk(blkn) {
+			fk.problem("directory %v: missing block %v", inum, fbn)
+			continue
+		}
+		d := fk.breadcsum(blkn)
+		if isdxblk(d) {
+			continue
+		}
+		dd := &Dirdata_t{d[:]}
+		for i := 0; i < NDIRENTS; i++ {
+			fn := dd.Filename(i)
+			if len(fn) == 0 {
+				continue
+			}
+			child := dd.inodenext(i)
+			clear := func() {
+				if fk.repair {
+					dd.W_filename(i, ustr.MkUstr())
+					dd.W_inodenext(i, 0)
+					fk.bdirty(blkn)
+				}
+			}
+			switch {
+			case fn.Isdot():
+				sawdot = true
+				if child != inum {
+					fk.problem("directory %v: \".\" names %v", inum, child)
+					if fk.repair {
+						dd.W_inodenext(i, inum)
+						fk.bdirty(blkn)
+					}
+				}
+				continue
+			case fn.Isdotdot():
+				sawdotdot = true
+				if child != par {
+					fk.problem("directory %v: \"..\" names %v, not parent %v",
+						inum, child, par)
+					if fk.repair {
+						dd.W_inodenext(i, par)
+						fk.bdirty(blkn)
+					}
+				}
+				continue
+			}
+			if int(child) < 0 || int(child) >= fk.ninode {
+				fk.problem("directory %v: %q names bad inode %v", inum, fn, child)
+				clear()
+				continue
+			}
+			ct := itype_raw(fk.inode(child))
+			if ct <= I_INVALID || ct > I_VALID {
+				fk.problem("directory %v: %q names free inode %v", inum, fn, child)
+				clear()
+				continue
+			}
+			if ct == I_DIR {
+				if child == iroot || fk.reach[child] {
+					fk.problem("directory %v: %q is an extra link to directory %v",
+						inum, fn, child)
+					clear()
+					continue
+				}
+				// mark now so that a second entry in this
+				// directory is caught too
+				fk.reach[child] = true
+				subdirs = append(subdirs, child)
+			} else {
+				fk.reach[child] = true
+			}
+			fk.nlinks[child]++
+		}
+	}
+	if !sawdot {
+		fk.problem("directory %v: no \".\" entry", inum)
+	}
+	if !sawdotdot {
+		fk.problem("directory %v: no \"..\" entry", inum)
+	}
+	for _, c := range subdirs {
+		fk.walk(c, inum)
+	}
+}
+
+// checks link counts and the inode and orphan maps
+func (fk *fsck_t) chkinodes() {
+	for i := 0; i < fk.ninode; i++ {
+		inum := defs.Inum_t(i)
+		ind := fk.inode(inum)
+		alloc := fk.isalloc(inum)
+		orphan := fk.isorphan(inum)
+		if fk.reach[inum] {
+			want := fk.nlinks[inum]
+			if inum == iroot {
+				want = 1
+			}
+			if ind.linkcount() != want {
+				fk.problem("inode %v: link count %v, should be %v", inum,
+					ind.linkcount(), want)
+				if fk.repair {
+					ind.W_linkcount(want)
+					fk.bdirty(fk.iblkno(inum))
+				}
+			}
+			if !alloc {
+				fk.problem("inode %v: in use but free in inode map", inum)
+				if fk.repair {
+					fk.bitw(fk.imapstart, i, true)
+				}
+			}
+			if orphan {
+				fk.problem("inode %v: in use but marked orphan", inum)
+				if fk.repair {
+					fk.bitw(fk.superb.Iorphanblock(), i, false)
+				}
+			}
+			fk.inodeblks(inum, ind, false)
+			continue
+		}
+		if !alloc {
+			if orphan {
+				fk.problem("inode %v: free but marked orphan", inum)
+				if fk.repair {
+					fk.bitw(fk.superb.Iorphanblock(), i, false)
+				}
+			}
+			continue
+		}
+		it := itype_raw(ind)
+		if orphan && (it > I_INVALID && it <= I_VALID) {
+			// freed the next time the file system is mounted
+			fk.inodeblks(inum, ind, true)
+			continue
+		}
+		fk.problem("inode %v: allocated but unreachable", inum)
+		if it <= I_INVALID || it > I_VALID {
+			// nothing to free
+			if fk.repair {
+				fk.bitw(fk.imapstart, i, false)
+			}
+			continue
+		}
+		fk.inodeblks(inum, ind, true)
+		if fk.repair {
+			// make it an orphan so that the next mount frees it
+			// and its blocks; ifree() uses major to track the
+			// freed blocks.
+			ind.W_linkcount(0)
+			ind.w_major(0)
+			fk.bdirty(fk.iblkno(inum))
+			fk.bitw(fk.superb.Iorphanblock(), i, true)
+		}
+	}
+}
+
+// records the blocks of the inode, clearing bad block pointers. the blocks of
+// orphans are only recorded since ifree() does not clear the pointers to
+// blocks it has already freed.
+func (fk *fsck_t) inodeblks(inum defs.Inum_t, ind *Inode_t, orphan bool) {
+	ref := func(blkn int) bool {
+		if blkn == 0 {
+			return false
+		}
+		if !fk.validblk(blkn) {
+			if !orphan {
+				fk.problem("inode %v: bad block pointer %v", inum, blkn)
+			}
+			return true
+		}
+		if orphan {
+			fk.oblks[blkn] = true
+			return false
+		}
+		if fk.rcblks[blkn] {
+			fk.problem("block %v: referenced by inode %v and the reference count table",
+				blkn, inum)
+			return false
+		}
+		if fk.gblks[blkn] {
+			fk.problem("block %v: referenced by inode %v and the superblock", blkn, inum)
+			return false
+		}
+		if o, ok := fk.bref[blkn]; ok {
+			// a cloned block has as many references as its count
+			// allows
+			if fk.nshare[blkn] == fk.rcnt[blkn] {
+				fk.problem("block %v: referenced by inodes %v and %v", blkn, o, inum)
+				return false
+			}
+			fk.nshare[blkn]++
+			return false
+		}
+		fk.bref[blkn] = inum
+		return false
+	}
+	iblk := fk.iblkno(inum)
+	if ref(ind.xattr()) && fk.repair && !orphan {
+		ind.w_xattr(0)
+		fk.bdirty(iblk)
+	}
+	if ind.iflags()&IF_EXTENTS != 0 {
+		root := ind.eroot()
+		if fk.extblks(inum, &enode_t{root: &root}, ref, orphan) {
+			ind.w_eroot(&root)
+			fk.bdirty(iblk)
+		}
+		return
+	}
+	// scans the pointers in an indirect block
+	indir := func(indno int, f func(int) bool) {
+		d := fk.bread(indno)
+		for i := 0; i < INDADDR; i++ {
+			if f(util.Readn(d[:], 8, i*8)) && fk.repair && !orphan {
+				util.Writen(d[:], 8, i*8, 0)
+				fk.bdirty(indno)
+			}
+		}
+	}
+	for i := 0; i < NIADDRS; i++ {
+		if ref(ind.addr(i)) && fk.repair && !orphan {
+			ind.W_addr(i, 0)
+			fk.bdirty(iblk)
+		}
+	}
+	if indno := ind.indirect(); ref(indno) {
+		if fk.repair && !orphan {
+			ind.w_indirect(0)
+			fk.bdirty(iblk)
+		}
+	} else if indno != 0 {
+		indir(indno, ref)
+	}
+	if dindno := ind.dindirect(); ref(dindno) {
+		if fk.repair && !orphan {
+			ind.w_dindirect(0)
+			fk.bdirty(iblk)
+		}
+	} else if dindno != 0 {
+		indir(dindno, func(indno int) bool {
+			if ref(indno) {
+				return true
+			}
+			if indno != 0 {
+				indir(indno, ref)
+			}
+			return false
+		})
+	}
+}
+
+// records the blocks of the extent tree node n and its descendants, removing
+// entries which refer to bad blocks. returns true if n was modified.
+func (fk *fsck_t) extblks(inum defs.Inum_t, n *enode_t, ref func(int) bool,
+	orphan bool) bool {
+	if !n.magicok() || n.nents() > n.max() {
+		fk.problem("inode %v: bad extent tree node", inum)
+		if fk.repair && !orphan {
+			n.whdr(0, 0)
+			return true
+		}
+		return false
+	}
+	mod := false
+	for i := 0; i < n.nents(); {
+		e := n.ent(i)
+		bad := false
+		if n.height() == 0 {
+			for b := e.blk; b < e.blk+e.len && !bad; b++ {
+				bad = ref(b)
+			}
+		} else if bad = ref(e.blk); !bad {
+			c := &enode_t{d: fk.bread(e.blk)}
+			if fk.extblks(inum, c, ref, orphan) {
+				fk.bdirty(e.blk)
+			}
+		}
+		if bad && fk.repair && !orphan {
+			n.remove(i)
+			mod = true
+			continue
+		}
+		i++
+	}
+	return mod
+}
+
+// checks the block map against the referenced blocks
+func (fk *fsck_t) chkblocks() {
+	bstart := fk.superb.Freeblock()
+	for bit := 0; bit < fk.superb.Freeblocklen()*bitsperblk; bit++ {
+		used := fk.bitr(bstart, bit)
+		if bit >= fk.ndata {
+			if !used {
+				fk.problem("block map: bit %v past the last block is clear", bit)
+				if fk.repair {
+					fk.bitw(bstart, bit, true)
+				}
+			}
+			continue
+		}
+		blkn := fk.datastart + bit
+		_, ref := fk.bref[blkn]
+		ref = ref || fk.rcblks[blkn] || fk.gblks[blkn]
+		// an orphan may or may not have given up its reference yet
+		if n := fk.nshare[blkn]; n != fk.rcnt[blkn] && !fk.oblks[blkn] {
+			fk.problem("block %v: reference count %v, should be %v", blkn,
+				fk.rcnt[blkn]+1, n+1)
+			if leaf, ok := fk.rcleaves[bit/rccnts]; ok && fk.repair {
+				util.Writen(fk.bread(leaf)[:], 2, bit%rccnts*2, n)
+				fk.bdirty(leaf)
+			}
+		}
+		if ref && !used {
+			fk.problem("block %v: in use but free in block map", blkn)
+			if fk.repair {
+				fk.bitw(bstart, bit, true)
+			}
+		} else if !ref && used && !fk.oblks[blkn] {
+			fk.problem("block %v: allocated but unreferenced", blkn)
+			if fk.repair {
+				fk.bitw(bstart, bit, false)
+			}
+		}
+	}
+	for i := fk.ninode; i < fk.superb.Imaplen()*bitsperblk; i++ {
+		if !fk.bitr(fk.imapstart, i) {
+			fk.problem("inode map: bit %v past the last inode is clear", i)
+			if fk.repair {
+				fk.bitw(fk.imapstart, i, true)
+			}
+		}
+	}
+}
@@ -3,19 +3,24 @@ package fs
 import "fmt"
 import "sync"
 import "sort"
+import "time"
 import "unsafe"
 
 import "bounds"
 import "defs"
 import "fdops"
+import "flock"
 import "hashtable"
+import "inotify"
 import "limits"
 import "mem"
+import "proc"
 import "res"
 import "stat"
 import "stats"
 import "ustr"
 import "util"
+import "vm"
 
 type inode_stats_t struct {
 	Nopen       stats.Counter_t
@@ -26,6 +31,12 @@ type inode_stats_t struct {
 	Niread      stats.Counter_t
 	Niwrite     stats.Counter_t
 	Ndo_write   stats.Counter_t
+	Ndirectrd   stats.Counter_t
+	Ndirectwr   stats.Counter_t
+	Nfalloc     stats.Counter_t
+	Nreflink    stats.Counter_t
+	Ncow        stats.Counter_t
+	Nresize     stats.Counter_t
 	Nfillhole   stats.Counter_t
 	Ngrow       stats.Counter_t
 	Nitrunc     stats.Counter_t
@@ -39,6 +50,7 @@ type inode_stats_t struct {
 	Nmkdir      stats.Counter_t
 	Nclose      stats.Counter_t
 	Nsync       stats.Counter_t
+	Nfsync      stats.Counter_t
 	Nreopen     stats.Counter_t
 	CWrite      stats.Cycles_t
 	Cwrite      stats.Cycles_t
@@ -56,6 +68,14 @@ func (is *inode_stats_t) Stats() string {
 type Inode_t struct {
 	Iblk *Bdev_block_t
 	Ioff int
+	// ISIZE or XISIZE; see Superblock_t.Isize()
+	Isize int
+}
+
+// returns inode inum, which is in inode block b, of a file system with inodes
+// of isize bytes
+func mkInode(b *Bdev_block_t, inum defs.Inum_t, isize int) *Inode_t {
+	return &Inode_t{b, int(inum) % (BSIZE / isize), isize}
 }
 
 // inode file types
@@ -65,104 +85,270 @@ const (
 	I_FILE    = 1
 	I_DIR     = 2
 	I_DEV     = 3
-	I_VALID   = I_DEV
+	I_SYMLINK = 4
+	I_VALID   = I_SYMLINK
 	// ready to be reclaimed
-	I_DEAD = 4
+	I_DEAD = 5
 	I_LAST = I_DEAD
 
 	// direct block addresses
-	NIADDRS = 9
-	// number of words in an inode
-	NIWORDS = 7 + NIADDRS
+	NIADDRS = 7
+	// word offset of the first direct block address
+	IADDROFF = 9
+	// word offset of the extended attribute block
+	IXATTROFF = IADDROFF + NIADDRS
+	// number of words of inode fields
+	NIWORDS = IXATTROFF + 1
 	// number of address in indirect block
 	INDADDR = (BSIZE / 8)
-	ISIZE   = 128
+	// the size of an inode, and of one on a file system with FEAT_XATTR
+	ISIZE  = 128
+	XISIZE = 256
 )
 
-func ifield(iidx int, fieldn int) int {
-	return iidx*NIWORDS + fieldn
-}
+// inode flags
+const (
+	// blocks are mapped by an extent tree instead of block pointers
+	IF_EXTENTS = 1 << 0
+	// data blocks are written through the log
+	IF_JOURNAL = 1 << 1
+)
+
+// special permission bits
+const (
+	S_ISUID = 04000
+	S_ISGID = 02000
+	// only owners may remove entries of a sticky directory
+	S_ISVTX = 01000
+)
+
+func (ind *Inode_t) field(fieldn int) int {
+	return ind.Ioff*(ind.Isize/8) + fieldn
+}
+
+// On-disk inode layout, in 64-bit words. Small fields share a word to leave
+// room for NIADDRS direct block addresses:
+//	0	itype (bits 0-7), flags (8-15), permission bits (16-31), link count
+//		(32-63)
+//	1	size
+//	2	major (bits 0-31), minor (32-63)
+//	3	indirect block
+//	4	double indirect block
+//	5	uid (bits 0-31), gid (32-63)
+//	6-8	atime, mtime, ctime in nanoseconds since the epoch
+//	9-15	direct block addresses
+// an extent-mapped inode keeps the root of its extent tree in words 3-4 and
+// 9-15 instead of block addresses. an inode of a file system with FEAT_XATTR
+// is XISIZE bytes and continues with:
+//	16	extended attribute block
+// the bytes after the last word hold extended attributes; see xattr.go. the
+// last CSUMSIZE bytes of each such inode are unused, since those of the last
+// inode in a block hold the block's checksum.
 
 // iidx is the inode index; necessary since there are four inodes in one block
 func (ind *Inode_t) itype() int {
-	it := fieldr(ind.Iblk.Data, ifield(ind.Ioff, 0))
+	it := ind.bitsr(0, 0, 8)
 	if it < I_FIRST || it > I_LAST {
 		panic(fmt.Sprintf("weird inode type %d", it))
 	}
 	return it
 }
 
+func (ind *Inode_t) iflags() int {
+	return ind.bitsr(0, 8, 8)
+}
+
+func (ind *Inode_t) mode() int {
+	return ind.bitsr(0, 16, 16)
+}
+
 func (ind *Inode_t) linkcount() int {
-	return fieldr(ind.Iblk.Data, ifield(ind.Ioff, 1))
+	return int(int32(ind.bitsr(0, 32, 32)))
 }
 
 func (ind *Inode_t) size() int {
-	return fieldr(ind.Iblk.Data, ifield(ind.Ioff, 2))
+	return fieldr(ind.Iblk.Data, ind.field(1))
 }
 
 func (ind *Inode_t) major() int {
-	return fieldr(ind.Iblk.Data, ifield(ind.Ioff, 3))
+	return ind.bitsr(2, 0, 32)
 }
 
 func (ind *Inode_t) minor() int {
-	return fieldr(ind.Iblk.Data, ifield(ind.Ioff, 4))
+	return ind.bitsr(2, 32, 32)
 }
 
 func (ind *Inode_t) indirect() int {
-	return fieldr(ind.Iblk.Data, ifield(ind.Ioff, 5))
+	return fieldr(ind.Iblk.Data, ind.field(3))
 }
 
 func (ind *Inode_t) dindirect() int {
-	return fieldr(ind.Iblk.Data, ifield(ind.Ioff, 6))
+	return fieldr(ind.Iblk.Data, ind.field(4))
+}
+
+func (ind *Inode_t) uid() int {
+	return ind.bitsr(5, 0, 32)
+}
+
+func (ind *Inode_t) gid() int {
+	return ind.bitsr(5, 32, 32)
+}
+
+func (ind *Inode_t) atime() int {
+	return fieldr(ind.Iblk.Data, ind.field(6))
+}
+
+func (ind *Inode_t) mtime() int {
+	return fieldr(ind.Iblk.Data, ind.field(7))
+}
+
+func (ind *Inode_t) ctime() int {
+	return fieldr(ind.Iblk.Data, ind.field(8))
 }
 
 func (ind *Inode_t) addr(i int) int {
 	if i < 0 || i > NIADDRS {
 		panic("bad inode block index")
 	}
-	addroff := 7
-	return fieldr(ind.Iblk.Data, ifield(ind.Ioff, addroff+i))
+	return fieldr(ind.Iblk.Data, ind.field(IADDROFF+i))
+}
+
+func (ind *Inode_t) xattr() int {
+	if ind.Isize == ISIZE {
+		return 0
+	}
+	return fieldr(ind.Iblk.Data, ind.field(IXATTROFF))
+}
+
+// the spare bytes at the end of the inode, which an ISIZE inode lacks
+func (ind *Inode_t) xinline() []uint8 {
+	if ind.Isize == ISIZE {
+		return nil
+	}
+	off := ind.Ioff*ind.Isize + NIWORDS*8
+	return ind.Iblk.Data[off : (ind.Ioff+1)*ind.Isize-CSUMSIZE]
 }
 
 func (ind *Inode_t) W_itype(n int) {
 	if n < I_FIRST || n > I_LAST {
 		panic("weird inode type")
 	}
-	fieldw(ind.Iblk.Data, ifield(ind.Ioff, 0), n)
+	ind.bitsw(0, 0, 8, n)
+}
+
+func (ind *Inode_t) w_iflags(n int) {
+	ind.bitsw(0, 8, 8, n)
+}
+
+func (ind *Inode_t) W_mode(n int) {
+	ind.bitsw(0, 16, 16, n&07777)
 }
 
 func (ind *Inode_t) W_linkcount(n int) {
-	fieldw(ind.Iblk.Data, ifield(ind.Ioff, 1), n)
+	ind.bitsw(0, 32, 32, n)
 }
 
 func (ind *Inode_t) W_size(n int) {
-	fieldw(ind.Iblk.Data, ifield(ind.Ioff, 2), n)
+	fieldw(ind.Iblk.Data, ind.field(1), n)
 }
 
 func (ind *Inode_t) w_major(n int) {
-	fieldw(ind.Iblk.Data, ifield(ind.Ioff, 3), n)
+	ind.bitsw(2, 0, 32, n)
 }
 
 func (ind *Inode_t) w_minor(n int) {
-	fieldw(ind.Iblk.Data, ifield(ind.Ioff, 4), n)
+	ind.bitsw(2, 32, 32, n)
 }
 
 // blk is the block number and iidx in the index of the inode on block blk.
 func (ind *Inode_t) w_indirect(blk int) {
-	fieldw(ind.Iblk.Data, ifield(ind.Ioff, 5), blk)
+	fieldw(ind.Iblk.Data, ind.field(3), blk)
 }
 
 // blk is the block number and iidx in the index of the inode on block blk.
 func (ind *Inode_t) w_dindirect(blk int) {
-	fieldw(ind.Iblk.Data, ifield(ind.Ioff, 6), blk)
+	fieldw(ind.Iblk.Data, ind.field(4), blk)
+}
+
+func (ind *Inode_t) W_owner(uid, gid int) {
+	ind.bitsw(5, 0, 32, uid)
+	ind.bitsw(5, 32, 32, gid)
+}
+
+func (ind *Inode_t) W_atime(n int) {
+	fieldw(ind.Iblk.Data, ind.field(6), n)
+}
+
+func (ind *Inode_t) W_mtime(n int) {
+	fieldw(ind.Iblk.Data, ind.field(7), n)
+}
+
+func (ind *Inode_t) W_ctime(n int) {
+	fieldw(ind.Iblk.Data, ind.field(8), n)
 }
 
 func (ind *Inode_t) W_addr(i int, blk int) {
 	if i < 0 || i > NIADDRS {
 		panic("bad inode block index")
 	}
-	addroff := 7
-	fieldw(ind.Iblk.Data, ifield(ind.Ioff, addroff+i), blk)
+	fieldw(ind.Iblk.Data, ind.field(IADDROFF+i), blk)
+}
+
+func (ind *Inode_t) w_xattr(blk int) {
+	if ind.Isize == ISIZE {
+		if blk != 0 {
+			panic("no room for xattr block")
+		}
+		return
+	}
+	fieldw(ind.Iblk.Data, ind.field(IXATTROFF), blk)
+}
+
+// the root of an extent tree is stored in place of the block addresses
+func (ind *Inode_t) eroot() [EXTROOTW]int {
+	var r [EXTROOTW]int
+	r[0] = ind.indirect()
+	r[1] = ind.dindirect()
+	for i := 0; i < NIADDRS; i++ {
+		r[2+i] = ind.addr(i)
+	}
+	return r
+}
+
+func (ind *Inode_t) w_eroot(r *[EXTROOTW]int) {
+	ind.w_indirect(r[0])
+	ind.w_dindirect(r[1])
+	for i := 0; i < NIADDRS; i++ {
+		ind.W_addr(i, r[2+i])
+	}
+}
+
+// W_extmap makes the inode extent-mapped, with file blocks [0, n) stored in
+// blocks [blk, blk+n).
+func (ind *Inode_t) W_extmap(blk, n int) {
+	r := mkeroot()
+	if n > 0 {
+		er := &enode_t{root: &r}
+		er.went(0, extent_t{fbn: 0, len: n, blk: blk})
+		er.whdr(1, 0)
+	}
+	ind.w_iflags(ind.iflags() | IF_EXTENTS)
+	ind.w_eroot(&r)
+}
+
+// reads width bits starting at bit shift of word fieldn
+func (ind *Inode_t) bitsr(fieldn, shift, width int) int {
+	v := uint(fieldr(ind.Iblk.Data, ind.field(fieldn)))
+	mask := uint(1)<<uint(width) - 1
+	return int(v >> uint(shift) & mask)
+}
+
+func (ind *Inode_t) bitsw(fieldn, shift, width, n int) {
+	f := ind.field(fieldn)
+	mask := (uint(1)<<uint(width) - 1) << uint(shift)
+	v := uint(fieldr(ind.Iblk.Data, f))
+	v = v&^mask | uint(n)<<uint(shift)&mask
+	fieldw(ind.Iblk.Data, f, int(v))
 }
 
 // In-memory representation of an inode.
@@ -178,6 +364,7 @@ type imemnode_t struct {
 	_amlocked bool
 
 	itype  int
+	iflags int
 	links  int
 	size   int
 	major  int
@@ -185,6 +372,26 @@ type imemnode_t struct {
 	indir  int
 	dindir int
 	addrs  [NIADDRS]int
+	mode   int
+	uid    int
+	gid    int
+	atime  int
+	mtime  int
+	ctime  int
+	// extended attribute block
+	xattr int
+	// the transactions with the last update of the inode and the last
+	// update other than of its timestamps, which fsync(2) and
+	// fdatasync(2) wait for, or -1 if they are unknown since the inode was
+	// evicted. dirtydata is set when the inode's data is written in the
+	// current operation.
+	syncseq   int
+	dsyncseq  int
+	dirtydata bool
+	// the file's advisory locks, which the flock package protects
+	locks flock.Locks_t
+	// sequential read detection; see readahead()
+	ra ra_t
 	// inode specific metadata blocks
 	dentc struct {
 		// true iff all non-empty directory entries are cached, thus
@@ -192,6 +399,10 @@ type imemnode_t struct {
 		haveall bool
 		// true iff all free directory entries are on the free list.
 		scanned bool
+		// true iff indexed says whether the directory has a hashed
+		// index; see dirindex.go
+		dxknown bool
+		indexed bool
 		// maximum number of cached dents this icache is allowed to
 		// have
 		max   int
@@ -287,6 +498,9 @@ func (idm *imemnode_t) idm_init(inum defs.Inum_t) {
 	idm.fill(blk, inum)
 	blk.Unlock()
 	idm.fs.fslog.Relse(blk, "idm_init")
+	// an update before the inode was evicted may not be committed yet
+	idm.syncseq = -1
+	idm.dsyncseq = -1
 }
 
 func (idm *imemnode_t) iunlock_refdown(s string) bool {
@@ -306,7 +520,9 @@ func (idm *imemnode_t) _iupdate(opid opid_t) defs.Err_t {
 	if idm.fs.diskfs {
 		idm.fs.istats.Niupdate.Inc()
 		iblk := idm.idibread()
-		if idm.flushto(iblk, idm.inum) {
+		changed, more := idm.flushto(iblk, idm.inum)
+		if changed {
+			idm.fs.ialloc.csumw(iblk)
 			iblk.Unlock()
 			idm.fs.fslog.Write(opid, iblk)
 		} else {
@@ -314,29 +530,94 @@ func (idm *imemnode_t) _iupdate(opid opid_t) defs.Err_t {
 		}
 		idm.fs.fslog.Relse(iblk, "_iupdate")
 
+		// an update of only the timestamps needn't be waited for by
+		// fdatasync(2)
+		seq := idm.fs.fslog.Curseq()
+		idm.syncseq = seq
+		if !changed || more || idm.dirtydata {
+			idm.dsyncseq = seq
+		}
+		idm.dirtydata = false
 	}
 	return 0
 }
 
-func (idm *imemnode_t) do_trunc(opid opid_t, truncto uint) defs.Err_t {
-	if idm.itype != I_FILE && idm.itype != I_DEV {
-		panic("bad truncate")
-	}
-	err := idm.itrunc(opid, truncto)
-	if err == 0 {
+// sets the size of idm to truncto. shrinking frees the blocks past the new end
+// first, using as many operations as needed, and commits the new size in the
+// operation that finds none left; thus a crash, a failure or a concurrent write
+// never leaves blocks mapped past the end of the file. caller must not hold
+// lock on idm.
+func (idm *imemnode_t) do_trunc(truncto uint) defs.Err_t {
+	for {
+		gimme := bounds.Bounds(bounds.B_IMEMNODE_T_DO_WRITE)
+		if !res.Resadd_noblock(gimme) {
+			return -defs.ENOHEAP
+		}
+		opid := idm.fs.fslog.Op_begin("dotrunc")
+		idm.ilock("dotrunc")
+		if idm.itype != I_FILE && idm.itype != I_DEV {
+			panic("bad truncate")
+		}
+		var err defs.Err_t
+		more := false
+		if int(truncto) < idm.size {
+			s := util.Roundup(int(truncto), BSIZE) / BSIZE
+			e := idm.maxfbn()
+			var next int
+			next, err = idm._punch(opid, s, e)
+			more = next < e
+		}
+		if err == 0 && !more {
+			err = idm.itrunc(opid, truncto)
+		}
 		idm._iupdate(opid)
+		idm.iunlock("dotrunc")
+		idm.fs.fslog.Op_end(opid)
+		if err != 0 || !more {
+			return err
+		}
 	}
-	return err
 }
 
-func (idm *imemnode_t) do_read(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
+// direct is true for O_DIRECT reads, which bypass the block cache if they
+// can.
+func (idm *imemnode_t) do_read(dst fdops.Userio_i, offset int, direct bool) (int, defs.Err_t) {
+	var up fdops.Userpages_i
+	if direct {
+		var err defs.Err_t
+		if up, err = idm.direct(dst, offset); err != 0 {
+			return 0, err
+		}
+	}
+	// the access time is not logged; it reaches the disk with the next
+	// update of the inode.
+	idm.atime = inodetime()
+	if up != nil {
+		return idm.iread_direct(up, offset)
+	}
 	return idm.iread(dst, offset)
 }
 
-func (idm *imemnode_t) do_write(src fdops.Userio_i, offset int, app bool) (int, defs.Err_t) {
+// returns the user pages of ub if an O_DIRECT transfer of ub at offset off
+// can bypass the block cache, or nil if it must use the cache. like linux,
+// the offset and length must be block aligned.
+func (idm *imemnode_t) direct(ub fdops.Userio_i, off int) (fdops.Userpages_i, defs.Err_t) {
+	if off%BSIZE != 0 || ub.Remain()%BSIZE != 0 {
+		return nil, -defs.EINVAL
+	}
+	// iovecs, in-memory file systems and journaled files use the cache
+	up, ok := ub.(fdops.Userpages_i)
+	if !ok || !idm.fs.diskfs || idm.journaled() {
+		return nil, 0
+	}
+	return up, 0
+}
+
+func (idm *imemnode_t) do_write(src fdops.Userio_i, offset int, app bool, direct bool) (int, defs.Err_t) {
 	// break write system calls into one or more calls with no more than
-	// maxblkpersys blocks per call. account for indirect blocks.
-	max := (MaxBlkPerOp - 3) * BSIZE
+	// maxblkpersys blocks per call, or more for a journaled file; see
+	// opsize().
+	max, nblks := idm.opsize()
 	sz := src.Totalsz()
 	i := 0
 
@@ -358,7 +639,7 @@ func (idm *imemnode_t) do_write(src fdops.Userio_i, offset int, app bool) (int,
 
 		s := stats.Rdtsc()
 
-		opid := idm.fs.fslog.Op_begin("dowrite")
+		opid := idm.fs.fslog.Op_begin_n("dowrite", nblks)
 
 		idm.ilock("")
 		if idm.itype == I_DIR {
@@ -368,8 +649,23 @@ func (idm *imemnode_t) do_write(src fdops.Userio_i, offset int, app bool) (int,
 		if app {
 			off = idm.size
 		}
+		var up fdops.Userpages_i
+		var err defs.Err_t
+		if direct {
+			up, err = idm.direct(src, off)
+		}
+		if err != 0 {
+			idm.iunlock("")
+			idm.fs.fslog.Op_end(opid)
+			return i, err
+		}
 		s1 := stats.Rdtsc()
-		wrote, err := idm.iwrite(opid, src, off, n)
+		var wrote int
+		if up != nil {
+			wrote, err = idm.iwrite_direct(opid, up, off, n)
+		} else {
+			wrote, err = idm.iwrite(opid, src, off, n)
+		}
 		idm.fs.istats.Ciwrite.Add(s1)
 
 		s2 := stats.Rdtsc()
@@ -392,16 +688,157 @@ func (idm *imemnode_t) do_write(src fdops.Userio_i, offset int, app bool) (int,
 	return i, 0
 }
 
+// implements fallocate(2): allocates the blocks of [off, off+len), also
+// zeroing the mapped ones if mode has FALLOC_FL_ZERO_RANGE, or frees them if
+// mode has FALLOC_FL_PUNCH_HOLE. the file grows to include the range unless
+// mode has FALLOC_FL_KEEP_SIZE. like do_write(), uses as many operations as
+// needed.
+func (idm *imemnode_t) do_fallocate(mode, off, len int) defs.Err_t {
+	keep := mode&defs.FALLOC_FL_KEEP_SIZE != 0
+	punch := mode&defs.FALLOC_FL_PUNCH_HOLE != 0
+	zero := mode&defs.FALLOC_FL_ZERO_RANGE != 0
+	if off < 0 || len <= 0 {
+		return -defs.EINVAL
+	}
+	modes := defs.FALLOC_FL_KEEP_SIZE | defs.FALLOC_FL_PUNCH_HOLE |
+		defs.FALLOC_FL_ZERO_RANGE
+	// a punched hole never changes the size
+	if mode&^modes != 0 || (punch && (zero || !keep)) {
+		return -defs.EOPNOTSUPP
+	}
+	end := off + len
+	if end < off || (end-1)/BSIZE >= idm.maxfbn() {
+		return -defs.EFBIG
+	}
+	idm.ilock("")
+	itype := idm.itype
+	idm.iunlock("")
+	if itype != I_FILE {
+		return -defs.ENODEV
+	}
+
+	idm.fs.istats.Nfalloc.Inc()
+	if punch {
+		// zero the partial blocks at either end of the range, then free
+		// the whole blocks in between
+		f0, f1 := util.Roundup(off, BSIZE)/BSIZE, end/BSIZE
+		opid := idm.fs.fslog.Op_begin("dopunch")
+		idm.ilock("")
+		var err defs.Err_t
+		if f0 > f1 {
+			err = idm._zero(opid, off, len, false)
+		} else {
+			if off < f0*BSIZE {
+				err = idm._zero(opid, off, f0*BSIZE-off, false)
+			}
+			if err == 0 && end > f1*BSIZE {
+				err = idm._zero(opid, f1*BSIZE, end-f1*BSIZE, false)
+			}
+		}
+		idm.touch()
+		idm._iupdate(opid)
+		idm.iunlock("")
+		idm.fs.fslog.Op_end(opid)
+		if err != 0 || f0 >= f1 {
+			return err
+		}
+		return idm.do_punch(f0, f1)
+	}
+
+	for fbn, last := off/BSIZE, (end-1)/BSIZE; fbn <= last; {
+		gimme := bounds.Bounds(bounds.B_IMEMNODE_T_DO_FALLOCATE)
+		if !res.Resadd_noblock(gimme) {
+			return -defs.ENOHEAP
+		}
+		max, nblks := idm.opsize()
+		opid := idm.fs.fslog.Op_begin_n("dofallocate", nblks)
+		idm.ilock("")
+		var err defs.Err_t
+		// as many blocks as do_write() writes in one operation
+		for n := 0; n < max/BSIZE && fbn <= last && err == 0; n++ {
+			if zero {
+				s := fbn * BSIZE
+				if s < off {
+					s = off
+				}
+				e := min(end, (fbn+1)*BSIZE)
+				err = idm._zero(opid, s, e-s, true)
+			} else {
+				_, _, err = idm.fbn2block(opid, fbn, true)
+			}
+			if err == 0 {
+				fbn++
+			}
+		}
+		grow := min(end, fbn*BSIZE)
+		if !keep && grow > idm.size {
+			idm.size = grow
+			idm.touch()
+		} else if zero {
+			idm.touch()
+		}
+		idm._iupdate(opid)
+		idm.iunlock("")
+		idm.fs.fslog.Op_end(opid)
+		if err != 0 {
+			return err
+		}
+	}
+	return 0
+}
+
+// implements lseek(2)'s SEEK_DATA and SEEK_HOLE: returns the offset of the
+// first data, or the first hole, at or after off. the end of the file counts
+// as a hole. caller holds lock on idm.
+func (idm *imemnode_t) do_seekdata(off int, hole bool) (int, defs.Err_t) {
+	if off < 0 {
+		return 0, -defs.EINVAL
+	}
+	if off >= idm.size {
+		return 0, -defs.ENXIO
+	}
+	fbn := off / BSIZE
+	lim := util.Roundup(idm.size, BSIZE) / BSIZE
+	if hole {
+		h := idm._nexthole(fbn, lim)
+		if h == fbn {
+			return off, 0
+		}
+		return min(h*BSIZE, idm.size), 0
+	}
+	d := idm._nextdata(fbn)
+	if d == -1 || d >= lim {
+		return 0, -defs.ENXIO
+	}
+	if d == fbn {
+		return off, 0
+	}
+	return d * BSIZE, 0
+}
+
+// returns the transaction fsync(2), or fdatasync(2) if datasync, waits for, or
+// -1 if it is unknown. caller holds lock on idm.
+func (idm *imemnode_t) do_syncseq(datasync bool) int {
+	if datasync {
+		return idm.dsyncseq
+	}
+	return idm.syncseq
+}
+
 func (idm *imemnode_t) do_stat(st *stat.Stat_t) defs.Err_t {
 	idm.fs.istats.Nistat.Inc()
-	st.Wdev(0)
+	st.Wdev(idm.fs.dev)
 	st.Wino(uint(idm.inum))
-	st.Wmode(idm.mkmode())
+	st.Wmode(idm.mkmode() | uint(idm.mode))
 	st.Wsize(uint(idm.size))
 	st.Wrdev(defs.Mkdev(idm.major, idm.minor))
+	st.Wuid(uint(idm.uid))
+	st.Wmtime(uint(idm.mtime/1e9), uint(idm.mtime%1e9))
 	return 0
 }
 
+// do_mmapfill() allocates the holes of the mapped range and copies its shared
+// blocks beforehand, thus immapinfo() maps the range without an operation.
 func (idm *imemnode_t) do_mmapi(off, len int, inc bool) ([]mem.Mmapinfo_t, defs.Err_t) {
 	if idm.itype != I_FILE && idm.itype != I_DIR {
 		panic("bad mmapinfo")
@@ -409,6 +846,70 @@ func (idm *imemnode_t) do_mmapi(off, len int, inc bool) ([]mem.Mmapinfo_t, defs.
 	return idm.immapinfo(off, len, inc)
 }
 
+// returns true if immapinfo() would map a hole. caller holds lock on idm.
+func (idm *imemnode_t) mmaphole(off, len int) bool {
+	if off < 0 || off >= idm.size {
+		return false
+	}
+	if len == -1 || off+len > idm.size {
+		len = idm.size - off
+	}
+	return idm._nexthole(off/BSIZE, util.Roundup(off+len, BSIZE)/BSIZE)*BSIZE < off+len
+}
+
+// allocates the holes in the mapped range [off, off+len) and, if cow, copies
+// the blocks in it that other files share, in as many operations as needed,
+// each changing at most as many blocks as do_write() writes in one, so that
+// immapinfo() can map the range without an operation. caller must not hold
+// lock on idm.
+func (idm *imemnode_t) do_mmapfill(off, len int, cow bool) defs.Err_t {
+	fbn := off / BSIZE
+	for {
+		gimme := bounds.Bounds(bounds.B_IMEMNODE_T_DO_FALLOCATE)
+		if !res.Resadd_noblock(gimme) {
+			return -defs.ENOHEAP
+		}
+		max, nblks := idm.opsize()
+		opid := idm.fs.fslog.Op_begin_n("mmapfill", nblks)
+		idm.ilock("mmapfill")
+		// the file may have changed since the caller looked
+		end := idm.size
+		if len != -1 && off+len < end {
+			end = off + len
+		}
+		lim := util.Roundup(end, BSIZE) / BSIZE
+		var err defs.Err_t
+		for n := 0; n < max/BSIZE && err == 0; {
+			if !cow {
+				fbn = idm._nexthole(fbn, lim)
+			}
+			if fbn >= lim {
+				break
+			}
+			var blkn int
+			blkn, _, err = idm.fbn2block(opid_t(0), fbn, false)
+			switch {
+			case err != 0:
+			case blkn == 0:
+				_, _, err = idm.fbn2block(opid, fbn, true)
+				n++
+			case cow && idm.fs.balloc.Bshared(blkn):
+				_, err = idm._cow(opid, fbn, blkn)
+				n++
+			}
+			if err == 0 {
+				fbn++
+			}
+		}
+		idm._iupdate(opid)
+		idm.iunlock("mmapfill")
+		idm.fs.fslog.Op_end(opid)
+		if err != 0 || fbn >= lim {
+			return err
+		}
+	}
+}
+
 func (idm *imemnode_t) do_dirchk(opid opid_t, wantdir bool) defs.Err_t {
 	amdir := idm.itype == I_DIR
 	if wantdir && !amdir {
@@ -445,35 +946,74 @@ func (idm *imemnode_t) do_insert(opid opid_t, fn ustr.Ustr, n defs.Inum_t) defs.
 	return err
 }
 
-func (idm *imemnode_t) do_createnod(opid opid_t, fn ustr.Ustr, maj, min int) (*imemnode_t, defs.Err_t) {
+func (idm *imemnode_t) do_createnod(opid opid_t, fn ustr.Ustr, maj, min, mode int, cred *proc.Cred_t) (*imemnode_t, defs.Err_t) {
 	if idm.itype != I_DIR {
 		return nil, -defs.ENOTDIR
 	}
 
 	itype := I_DEV
-	child, err := idm.icreate(opid, fn, itype, maj, min)
+	child, err := idm.icreate(opid, fn, itype, maj, min, mode, cred)
 	idm._iupdate(opid)
 	return child, err
 }
 
-func (idm *imemnode_t) do_createfile(opid opid_t, fn ustr.Ustr) (*imemnode_t, defs.Err_t) {
+func (idm *imemnode_t) do_createfile(opid opid_t, fn ustr.Ustr, mode int, cred *proc.Cred_t) (*imemnode_t, defs.Err_t) {
 	if idm.itype != I_DIR {
 		return nil, -defs.ENOTDIR
 	}
 
 	itype := I_FILE
-	child, err := idm.icreate(opid, fn, itype, 0, 0)
+	child, err := idm.icreate(opid, fn, itype, 0, 0, mode, cred)
 	idm._iupdate(opid)
 	return child, err
 }
 
-func (idm *imemnode_t) do_createdir(opid opid_t, fn ustr.Ustr) (*imemnode_t, defs.Err_t) {
+func (idm *imemnode_t) do_createsymlink(opid opid_t, fn ustr.Ustr, cred *proc.Cred_t) (*imemnode_t, defs.Err_t) {
+	if idm.itype != I_DIR {
+		return nil, -defs.ENOTDIR
+	}
+
+	itype := I_SYMLINK
+	child, err := idm.icreate(opid, fn, itype, 0, 0, 0777, cred)
+	idm._iupdate(opid)
+	return child, err
+}
+
+// the target of a symlink is stored as its file data. caller holds lock on
+// idm.
+func (idm *imemnode_t) do_writelink(opid opid_t, target ustr.Ustr) defs.Err_t {
+	if idm.itype != I_SYMLINK {
+		panic("not a symlink")
+	}
+	ub := &vm.Fakeubuf_t{}
+	ub.Fake_init(target)
+	_, err := idm.iwrite(opid, ub, 0, len(target))
+	idm._iupdate(opid)
+	return err
+}
+
+// caller holds lock on idm
+func (idm *imemnode_t) do_readlink() (ustr.Ustr, defs.Err_t) {
+	if idm.itype != I_SYMLINK {
+		return nil, -defs.EINVAL
+	}
+	buf := make([]uint8, idm.size)
+	ub := &vm.Fakeubuf_t{}
+	ub.Fake_init(buf)
+	n, err := idm.iread(ub, 0)
+	if err != 0 {
+		return nil, err
+	}
+	return ustr.Ustr(buf[:n]), 0
+}
+
+func (idm *imemnode_t) do_createdir(opid opid_t, fn ustr.Ustr, mode int, cred *proc.Cred_t) (*imemnode_t, defs.Err_t) {
 	if idm.itype != I_DIR {
 		return nil, -defs.ENOTDIR
 	}
 
 	itype := I_DIR
-	child, err := idm.icreate(opid, fn, itype, 0, 0)
+	child, err := idm.icreate(opid, fn, itype, 0, 0, mode, cred)
 	idm._iupdate(opid)
 	return child, err
 }
@@ -481,14 +1021,26 @@ func (idm *imemnode_t) do_createdir(opid opid_t, fn ustr.Ustr) (*imemnode_t, def
 // caller holds lock on idm
 func (idm *imemnode_t) _linkdown(opid opid_t) {
 	idm.links--
+	idm.ctime = inodetime()
 	if idm.links <= 0 {
 		idm.fs.icache.markOrphan(opid, idm.inum)
 	}
 	idm._iupdate(opid)
 }
 
+// reports the removal of a link to idm to its watches: the last link deletes
+// the inode
+func (idm *imemnode_t) notify_linkdown() {
+	if idm.links <= 0 {
+		idm.notify(defs.IN_DELETE_SELF|idm.inisdir(), 0, nil)
+	} else {
+		idm.notify(defs.IN_ATTRIB, 0, nil)
+	}
+}
+
 func (idm *imemnode_t) _linkup(opid opid_t) {
 	idm.links++
+	idm.ctime = inodetime()
 	idm._iupdate(opid)
 }
 
@@ -500,13 +1052,14 @@ func (ic *imemnode_t) mbread(blockn int) *Bdev_block_t {
 }
 
 func (ic *imemnode_t) fill(blk *Bdev_block_t, inum defs.Inum_t) {
-	inode := Inode_t{blk, ioffset(inum)}
+	inode := ic.fs.ialloc.inode(blk, inum)
 	ic.itype = inode.itype()
 	if ic.itype <= I_FIRST || ic.itype > I_VALID {
 		fmt.Printf("itype: %v for %v\n", ic.itype, inum)
 		// we will soon panic
 		panic("no")
 	}
+	ic.iflags = inode.iflags()
 	ic.links = inode.linkcount()
 	ic.size = inode.size()
 	ic.major = inode.major()
@@ -516,20 +1069,31 @@ func (ic *imemnode_t) fill(blk *Bdev_block_t, inum defs.Inum_t) {
 	for i := 0; i < NIADDRS; i++ {
 		ic.addrs[i] = inode.addr(i)
 	}
+	ic.xattr = inode.xattr()
+	ic.mode = inode.mode()
+	ic.uid = inode.uid()
+	ic.gid = inode.gid()
+	ic.atime = inode.atime()
+	ic.mtime = inode.mtime()
+	ic.ctime = inode.ctime()
 	if ic.itype == I_DIR {
 		ic.dentc.dents = hashtable.MkHash(100)
 	}
 }
 
-// returns true if the inode data changed, and thus needs to be flushed to disk
-func (ic *imemnode_t) flushto(blk *Bdev_block_t, inum defs.Inum_t) bool {
-	inode := Inode_t{blk, ioffset(inum)}
+// returns true if the inode data changed, and thus needs to be flushed to disk,
+// and whether more than the timestamps changed
+func (ic *imemnode_t) flushto(blk *Bdev_block_t, inum defs.Inum_t) (bool, bool) {
+	inode := ic.fs.ialloc.inode(blk, inum)
 	j := inode
 	k := ic
 	ret := false
-	if j.itype() != k.itype || j.linkcount() != k.links ||
+	if j.itype() != k.itype || j.iflags() != k.iflags ||
+		j.linkcount() != k.links ||
 		j.size() != k.size || j.major() != k.major ||
-		j.minor() != k.minor || j.indirect() != k.indir {
+		j.minor() != k.minor || j.indirect() != k.indir ||
+		j.dindirect() != k.dindir || j.xattr() != k.xattr ||
+		j.mode() != k.mode || j.uid() != k.uid || j.gid() != k.gid {
 		ret = true
 	}
 	for i, v := range ic.addrs {
@@ -537,7 +1101,10 @@ func (ic *imemnode_t) flushto(blk *Bdev_block_t, inum defs.Inum_t) bool {
 			ret = true
 		}
 	}
+	ts := j.atime() != k.atime || j.mtime() != k.mtime ||
+		j.ctime() != k.ctime
 	inode.W_itype(ic.itype)
+	inode.w_iflags(ic.iflags)
 	inode.W_linkcount(ic.links)
 	inode.W_size(ic.size)
 	inode.w_major(ic.major)
@@ -547,7 +1114,13 @@ func (ic *imemnode_t) flushto(blk *Bdev_block_t, inum defs.Inum_t) bool {
 	for i := 0; i < NIADDRS; i++ {
 		inode.W_addr(i, ic.addrs[i])
 	}
-	return ret
+	inode.w_xattr(ic.xattr)
+	inode.W_mode(ic.mode)
+	inode.W_owner(ic.uid, ic.gid)
+	inode.W_atime(ic.atime)
+	inode.W_mtime(ic.mtime)
+	inode.W_ctime(ic.ctime)
+	return ret || ts, ret
 }
 
 // ensure block exists
@@ -575,11 +1148,14 @@ func (idm *imemnode_t) ensureind(opid opid_t, blk *Bdev_block_t, slot int, writi
 	return blkn, 0
 }
 
-// Assumes that every block until b exits
-// XXX change to wrap blockiter_t instead
+// returns the disk block holding file block fbn. a missing block (a hole) is
+// allocated if writing, otherwise 0 is returned for it.
 func (idm *imemnode_t) fbn2block(opid opid_t, fbn int, writing bool) (int, bool, defs.Err_t) {
+	if idm.extents() {
+		return idm._extfbn2block(opid, fbn, writing)
+	}
 	if fbn < NIADDRS {
-		if idm.addrs[fbn] != 0 {
+		if idm.addrs[fbn] != 0 || !writing {
 			return idm.addrs[fbn], false, 0
 		}
 		blkn, err := idm.fs.balloc.Balloc(opid)
@@ -595,7 +1171,7 @@ func (idm *imemnode_t) fbn2block(opid opid_t, fbn int, writing bool) (int, bool,
 		if fbn < INDADDR {
 			indno := idm.indir
 			indno, isnew, err := idm.ensureb(opid, indno, writing)
-			if err != 0 {
+			if err != 0 || indno == 0 {
 				return 0, false, err
 			}
 			if isnew {
@@ -610,7 +1186,7 @@ func (idm *imemnode_t) fbn2block(opid opid_t, fbn int, writing bool) (int, bool,
 			fbn -= INDADDR
 			dindno := idm.dindir
 			dindno, isnew, err := idm.ensureb(opid, dindno, writing)
-			if err != 0 {
+			if err != 0 || dindno == 0 {
 				return 0, false, err
 			}
 			if isnew {
@@ -620,53 +1196,197 @@ func (idm *imemnode_t) fbn2block(opid opid_t, fbn int, writing bool) (int, bool,
 			dindblk := idm.mbread(dindno)
 			indno, err := idm.ensureind(opid, dindblk, fbn/INDADDR, writing)
 			idm.fs.fslog.Relse(dindblk, "dindblk")
+			if err != 0 || indno == 0 {
+				return 0, false, err
+			}
 
 			indblk := idm.mbread(indno)
 			blkn, err := idm.ensureind(opid, indblk, fbn%INDADDR, writing)
 			idm.fs.fslog.Relse(indblk, "indblk2")
 			return blkn, false, err
 		} else {
-			panic("too big fbn")
-			return 0, false, 0
-
+			return 0, false, -defs.EFBIG
 		}
 	}
 }
 
-func (idm *imemnode_t) bmapfill(opid opid_t, lastblk int, whichblk int, writing bool) (int, bool, defs.Err_t) {
-	blkn := 0
-	new := false
-	var err defs.Err_t
+// the number of file blocks the inode can map
+func (idm *imemnode_t) maxfbn() int {
+	if idm.extents() {
+		return EXTMAXFBN
+	}
+	return NIADDRS + INDADDR*INDADDR
+}
 
-	if whichblk >= lastblk { // a hole?
-		// allocate the missing blocks
-		if whichblk > lastblk && writing {
-			idm.fs.istats.Nfillhole.Inc()
-		} else if writing {
-			idm.fs.istats.Ngrow.Inc()
-		}
-		for b := lastblk; b <= whichblk; b++ {
-			gimme := bounds.Bounds(bounds.B_IMEMNODE_T_BMAPFILL)
-			if !res.Resadd_noblock(gimme) {
-				return 0, false, -defs.ENOHEAP
+// returns the first mapped file block at or after fbn, or -1 if there is none.
+// missing indirect blocks are skipped whole.
+func (idm *imemnode_t) _nextdata(fbn int) int {
+	if idm.extents() {
+		e, ok := idm._extnext(fbn)
+		if !ok {
+			return -1
+		}
+		if e.fbn > fbn {
+			return e.fbn
+		}
+		return fbn
+	}
+	for ; fbn < NIADDRS; fbn++ {
+		if idm.addrs[fbn] != 0 {
+			return fbn
+		}
+	}
+	// scans slots [s, INDADDR) of the indirect block indno
+	scan := func(indno, s int) int {
+		blk := idm.mbread(indno)
+		defer idm.fs.fslog.Relse(blk, "nextdata")
+		for i := s; i < INDADDR; i++ {
+			if util.Readn(blk.Data[:], 8, i*8) != 0 {
+				return i
 			}
-			// XXX we could remember where the last slot was
-			blkn, new, err = idm.fbn2block(opid, b, writing)
-			if err != 0 {
-				return blkn, new, err
+		}
+		return -1
+	}
+	fbn -= NIADDRS
+	if fbn < INDADDR {
+		if idm.indir != 0 {
+			if i := scan(idm.indir, fbn); i != -1 {
+				return NIADDRS + i
 			}
 		}
-	} else {
-		blkn, new, err = idm.fbn2block(opid, whichblk, writing)
+		fbn = INDADDR
+	}
+	if idm.dindir == 0 {
+		return -1
+	}
+	fbn -= INDADDR
+	dblk := idm.mbread(idm.dindir)
+	defer idm.fs.fslog.Relse(dblk, "nextdata")
+	for ; fbn < INDADDR*INDADDR-INDADDR; fbn = (fbn/INDADDR + 1) * INDADDR {
+		indno := util.Readn(dblk.Data[:], 8, fbn/INDADDR*8)
+		if indno == 0 {
+			continue
+		}
+		if i := scan(indno, fbn%INDADDR); i != -1 {
+			return NIADDRS + INDADDR + fbn/INDADDR*INDADDR + i
+		}
+	}
+	return -1
+}
+
+// returns the first unmapped file block in [fbn, lim), or lim if there is
+// none.
+func (idm *imemnode_t) _nexthole(fbn, lim int) int {
+	for fbn < lim {
+		if idm.extents() {
+			e, ok := idm._extnext(fbn)
+			if !ok || e.fbn > fbn {
+				return fbn
+			}
+			fbn = e.fbn + e.len
+			continue
+		}
+		if blkn, _, _ := idm.fbn2block(opid_t(0), fbn, false); blkn == 0 {
+			return fbn
+		}
+		fbn++
+	}
+	return lim
+}
+
+// removes the mapping of file block fbn, which must be mapped, and returns the
+// block it was mapped to. emptied indirect blocks are kept; ifree() frees
+// them.
+func (idm *imemnode_t) _bunmap(opid opid_t, fbn int) (int, defs.Err_t) {
+	if idm.extents() {
+		return idm._extunmap(opid, fbn)
+	}
+	if fbn < NIADDRS {
+		blkn := idm.addrs[fbn]
+		idm.addrs[fbn] = 0
+		return blkn, 0
+	}
+	fbn -= NIADDRS
+	indno := idm.indir
+	if fbn >= INDADDR {
+		fbn -= INDADDR
+		dblk := idm.mbread(idm.dindir)
+		indno = util.Readn(dblk.Data[:], 8, fbn/INDADDR*8)
+		idm.fs.fslog.Relse(dblk, "bunmap")
+		fbn %= INDADDR
+	}
+	blk := idm.mbread(indno)
+	blkn := util.Readn(blk.Data[:], 8, fbn*8)
+	util.Writen(blk.Data[:], 8, fbn*8, 0)
+	idm.fs.fslog.Write(opid, blk)
+	idm.fs.fslog.Relse(blk, "bunmap")
+	return blkn, 0
+}
+
+// frees the mapped blocks in [f0, f1), but no more than one operation may
+// write to the log. returns the file block to continue from.
+func (idm *imemnode_t) _punch(opid opid_t, f0, f1 int) (int, defs.Err_t) {
+	// the blocks written by this operation, as in ifree(). each freed
+	// block also writes its index block, and splitting an extent may
+	// write a few more.
+	distinct := map[int]bool{idm.fs.ialloc.Iblock(idm.inum): true}
+	for n := 0; len(distinct)+n+4 <= MaxBlkPerOp; n++ {
+		fbn := idm._nextdata(f0)
+		if fbn == -1 || fbn >= f1 {
+			return f1, 0
+		}
+		blkn, err := idm._bunmap(opid, fbn)
 		if err != 0 {
-			return blkn, new, err
+			return fbn, err
 		}
+		// a shared mapping of the block keeps its page, which now
+		// reads as the hole does; the allocator doesn't reuse the block
+		// till the page is unmapped
+		idm.fs.bcache.zeromapped(blkn)
+		distinct[idm.fs.balloc.Bfree(opid, blkn)] = true
+		f0 = fbn + 1
 	}
-	return blkn, new, 0
+	return f0, 0
+}
+
+// frees the blocks of file blocks [f0, f1), using as many operations as
+// needed. caller must not hold lock on idm.
+func (idm *imemnode_t) do_punch(f0, f1 int) defs.Err_t {
+	for {
+		gimme := bounds.Bounds(bounds.B_IMEMNODE_T_DO_WRITE)
+		if !res.Resadd_noblock(gimme) {
+			return -defs.ENOHEAP
+		}
+		opid := idm.fs.fslog.Op_begin("dopunch")
+		idm.ilock("")
+		next, err := idm._punch(opid, f0, f1)
+		idm._iupdate(opid)
+		idm.iunlock("")
+		idm.fs.fslog.Op_end(opid)
+		if err != 0 || next >= f1 {
+			return err
+		}
+		f0 = next
+	}
+}
+
+func (idm *imemnode_t) bmapfill(opid opid_t, lastblk int, whichblk int, writing bool) (int, bool, defs.Err_t) {
+	// a write past the end of the file leaves a hole
+	if whichblk > lastblk && writing {
+		idm.fs.istats.Nfillhole.Inc()
+	} else if whichblk == lastblk && writing {
+		idm.fs.istats.Ngrow.Inc()
+	}
+	gimme := bounds.Bounds(bounds.B_IMEMNODE_T_BMAPFILL)
+	if !res.Resadd_noblock(gimme) {
+		return 0, false, -defs.ENOHEAP
+	}
+	return idm.fbn2block(opid, whichblk, writing)
 }
 
 // Takes as input the file offset and whether the operation is a write and
-// returns the block number of the block responsible for that offset.
+// returns the block number of the block responsible for that offset, or 0 if
+// the offset is in a hole and the operation isn't a write.
 func (idm *imemnode_t) offsetblk(opid opid_t, offset int, writing bool) (int, bool, defs.Err_t) {
 	if writing && opid == 0 && idm.fs.diskfs {
 		panic("offsetblk: writing but no opid\n")
@@ -677,23 +1397,33 @@ func (idm *imemnode_t) offsetblk(opid opid_t, offset int, writing bool) (int, bo
 	if err != 0 {
 		return blkn, new, err
 	}
-	if blkn <= 0 || blkn >= idm.fs.superb.Lastblock() {
+	if writing && !new && idm.itype == I_FILE && idm.fs.balloc.Bshared(blkn) {
+		blkn, err = idm._cow(opid, whichblk, blkn)
+		if err != 0 {
+			return 0, false, err
+		}
+	}
+	if blkn < 0 || blkn >= idm.fs.superb.Lastblock() || (blkn == 0 && writing) {
 		panic("offsetblk: bad data blocks")
 	}
 	return blkn, new, 0
 }
 
-// Return locked buffer for offset
+// Return locked buffer for offset, or nil if offset is in a hole and fillhole
+// is false
 func (idm *imemnode_t) off2buf(opid opid_t, offset int, len int, fillhole bool, fill bool, s string) (*Bdev_block_t, defs.Err_t) {
 	if offset%mem.PGSIZE+len > mem.PGSIZE {
 		panic("off2buf")
 	}
 	blkno, new, err := idm.offsetblk(opid, offset, fillhole)
-	if err != 0 {
+	if err != 0 || blkno == 0 {
 		return nil, err
 	}
 	var b *Bdev_block_t
-	if fill && !new {
+	if fill && !new && idm.itype == I_DIR {
+		// directory blocks end in a checksum
+		b = idm.fs.fslog.Get_fill_csum(blkno, s, true)
+	} else if fill && !new {
 		b = idm.fs.fslog.Get_fill(blkno, s, true)
 	} else {
 		b = idm.fs.fslog.Get_nofill(blkno, s, true)
@@ -701,6 +1431,9 @@ func (idm *imemnode_t) off2buf(opid opid_t, offset int, len int, fillhole bool,
 	return b, 0
 }
 
+// the data of a hole
+var zeroblk [BSIZE]uint8
+
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -708,9 +1441,70 @@ func min(a, b int) int {
 	return b
 }
 
+// the number of blocks read ahead of a sequential reader starts at minra and
+// doubles with each sequential read up to maxra
+const (
+	minra = 4
+	maxra = 32
+)
+
+type ra_t struct {
+	// the block that a sequential read starts in
+	next int
+	// the number of blocks to read ahead
+	win int
+	// the block after the last one read ahead
+	end int
+}
+
+// detects sequential reads and starts reading the blocks that follow a read of
+// n bytes at offset into the cache in the background. caller holds lock on
+// idm.
+func (idm *imemnode_t) readahead(offset, n int) {
+	ra := &idm.ra
+	end := min(offset+n, idm.size)
+	if !idm.fs.diskfs || end <= offset {
+		return
+	}
+	seq := offset/BSIZE == ra.next
+	ra.next = end / BSIZE
+	if !seq {
+		ra.win = 0
+		ra.end = 0
+		return
+	}
+	if ra.win == 0 {
+		ra.win = minra
+	} else {
+		ra.win = min(2*ra.win, maxra)
+	}
+	from := (end-1)/BSIZE + 1
+	to := min(from+ra.win, util.Roundup(idm.size, BSIZE)/BSIZE)
+	if ra.end > from {
+		from = ra.end
+	}
+	var blkns []int
+	for fbn := from; fbn < to; fbn++ {
+		blkn, _, err := idm.offsetblk(opid_t(0), fbn*BSIZE, false)
+		if err != 0 {
+			break
+		}
+		if blkn != 0 {
+			blkns = append(blkns, blkn)
+		}
+	}
+	if to > ra.end {
+		ra.end = to
+	}
+	if len(blkns) != 0 {
+		idm.fs.fslog.Readahead(blkns)
+	}
+}
+
 func (idm *imemnode_t) iread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
 	idm.fs.istats.Niread.Inc()
 	isz := idm.size
+	idm.readahead(offset, dst.Remain())
 	c := 0
 	gimme := bounds.Bounds(bounds.B_IMEMNODE_T_IREAD)
 	for offset < isz && dst.Remain() != 0 {
@@ -723,6 +1517,16 @@ func (idm *imemnode_t) iread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
 		if err != 0 {
 			return c, err
 		}
+		if b == nil {
+			// a hole reads as zeros
+			wrote, err := dst.Uiowrite(zeroblk[:m])
+			c += wrote
+			offset += wrote
+			if err != 0 {
+				return c, err
+			}
+			continue
+		}
 		s := offset % BSIZE
 		src := b.Data[s : s+m]
 
@@ -771,7 +1575,8 @@ func (idm *imemnode_t) iwrite(opid opid_t, src fdops.Userio_i, offset int, n int
 		read, err := src.Uioread(dst)
 		b.Unlock()
 		idm.fs.istats.Ciwritecopy.Add(ts)
-		idm.fs.fslog.Write_ordered(opid, b)
+		idm.bwrite(opid, b)
+		idm.dirtydata = true
 		idm.fs.fslog.Relse(b, "iwrite")
 		if err != 0 {
 			return c, err
@@ -783,22 +1588,159 @@ func (idm *imemnode_t) iwrite(opid opid_t, src fdops.Userio_i, offset int, n int
 	if newsz > idm.size {
 		idm.size = newsz
 	}
+	idm.touch()
+	idm.notify(defs.IN_MODIFY, 0, nil)
 	return wrote, 0
 }
 
-func (idm *imemnode_t) itrunc(opid opid_t, newlen uint) defs.Err_t {
-	if newlen > uint(idm.size) {
-		// this will cause the hole to filled in with zero blocks which
-		// are logged to disk
-		_, _, err := idm.offsetblk(opid, int(newlen), true)
+// reads whole blocks of the file from the disk straight into the user pages of
+// dst. a cached block is copied from the cache instead, since it may be newer
+// than the disk.
+func (idm *imemnode_t) iread_direct(dst fdops.Userpages_i, offset int) (int, defs.Err_t) {
+	idm.fs.istats.Ndirectrd.Inc()
+	isz := idm.size
+	c := 0
+	gimme := bounds.Bounds(bounds.B_IMEMNODE_T_IREAD)
+	for offset < isz && dst.Remain() != 0 {
+		if !res.Resadd_noblock(gimme) {
+			return c, -defs.ENOHEAP
+		}
+		blkn, _, err := idm.offsetblk(opid_t(0), offset, false)
 		if err != 0 {
-			return err
+			return c, err
+		}
+		pa, pg, err := dst.Userpage(true)
+		if err != 0 {
+			return c, err
 		}
+		if blkn == 0 {
+			copy(pg[:], zeroblk[:])
+		} else if b := idm.fs.bcache.Get_cached(blkn, "iread_direct"); b != nil {
+			copy(pg[:], b.Data[:])
+			b.Unlock()
+			idm.fs.fslog.Relse(b, "iread_direct")
+		} else {
+			idm.fs.bcache.Direct(BDEV_READ, blkn, pa, pg)
+		}
+		idm.fs.bcache.mem.Free(pa)
+		// the read ends at the end of the file
+		m := min(BSIZE, isz-offset)
+		c += m
+		offset += m
+	}
+	return c, 0
+}
 
+// writes whole blocks from the user pages of src straight to the disk. a block
+// that is cached, or that a committed transaction logged, is written through
+// the cache instead, so that the cache stays coherent and installing the log
+// doesn't overwrite the new data. the user pages are faulted in before any
+// block is allocated, and the file grows over the blocks written even if the
+// write fails part way, thus no block is left mapped past the end. like
+// iwrite(), the caller updates the inode.
+func (idm *imemnode_t) iwrite_direct(opid opid_t, src fdops.Userpages_i, offset int, n int) (int, defs.Err_t) {
+	idm.fs.istats.Ndirectwr.Inc()
+	sz := min(src.Remain(), n)
+	pas := make([]mem.Pa_t, 0, sz/BSIZE)
+	pgs := make([]*mem.Bytepg_t, 0, sz/BSIZE)
+	for len(pas)*BSIZE < sz {
+		pa, pg, err := src.Userpage(false)
+		if err != 0 {
+			for _, pa := range pas {
+				idm.fs.bcache.mem.Free(pa)
+			}
+			return 0, err
+		}
+		pas = append(pas, pa)
+		pgs = append(pgs, pg)
+	}
+	c := 0
+	var err defs.Err_t
+	gimme := bounds.Bounds(bounds.B_IMEMNODE_T_IWRITE)
+	for i, pa := range pas {
+		if !res.Resadd_noblock(gimme) {
+			err = -defs.ENOHEAP
+		}
+		var blkn int
+		if err == 0 {
+			blkn, _, err = idm.offsetblk(opid, offset, true)
+		}
+		if err != 0 {
+			for _, pa := range pas[i:] {
+				idm.fs.bcache.mem.Free(pa)
+			}
+			break
+		}
+		pg := pgs[i]
+		b := idm.fs.bcache.Get_cached(blkn, "iwrite_direct")
+		if b == nil && idm.fs.fslog.Islogged(blkn) {
+			b = idm.fs.fslog.Get_nofill(blkn, "iwrite_direct", true)
+		}
+		if b != nil {
+			copy(b.Data[:], pg[:])
+			b.Unlock()
+			idm.fs.fslog.Write_ordered(opid, b)
+			idm.fs.fslog.Relse(b, "iwrite_direct")
+		} else {
+			idm.fs.bcache.Direct(BDEV_WRITE, blkn, pa, pg)
+		}
+		idm.fs.bcache.mem.Free(pa)
+		// the transaction with the allocation of the block also makes
+		// the data durable
+		idm.dirtydata = true
+		c += BSIZE
+		offset += BSIZE
+	}
+	if offset > idm.size {
+		idm.size = offset
+	}
+	if c != 0 {
+		idm.touch()
+		idm.notify(defs.IN_MODIFY, 0, nil)
+	}
+	return c, err
+}
+
+// growing the file leaves a hole. when shrinking, the caller has freed the
+// blocks past the new end.
+func (idm *imemnode_t) itrunc(opid opid_t, newlen uint) defs.Err_t {
+	if n := int(newlen); n < idm.size && n%BSIZE != 0 {
+		// zero the rest of the new last block, so that growing the file
+		// again exposes zeros
+		if err := idm._zero(opid, n, BSIZE-n%BSIZE, false); err != 0 {
+			return err
+		}
 	}
 	idm.fs.istats.Nitrunc.Inc()
 	// inode is flushed by do_itrunc
 	idm.size = int(newlen)
+	idm.touch()
+	idm.notify(defs.IN_MODIFY, 0, nil)
+	return 0
+}
+
+// zeros n bytes at offset off, which must be within one block. a hole is
+// allocated if fillhole, otherwise left alone.
+func (idm *imemnode_t) _zero(opid opid_t, off, n int, fillhole bool) defs.Err_t {
+	// writing a mapped block copies it if other files share it
+	writing := fillhole
+	if !writing {
+		blkn, _, err := idm.fbn2block(opid_t(0), off/BSIZE, false)
+		if err != 0 {
+			return err
+		}
+		writing = blkn != 0
+	}
+	b, err := idm.off2buf(opid, off, n, writing, n != BSIZE, "zero")
+	if err != 0 || b == nil {
+		return err
+	}
+	s := off % BSIZE
+	copy(b.Data[s:s+n], zeroblk[:])
+	b.Unlock()
+	idm.bwrite(opid, b)
+	idm.dirtydata = true
+	idm.fs.fslog.Relse(b, "zero")
 	return 0
 }
 
@@ -812,8 +1754,8 @@ func (idm *imemnode_t) create_undo(opid opid_t, childi defs.Inum_t, childn ustr.
 	if ci != childi {
 		panic("inconsistent")
 	}
-	ib := idm.fs.fslog.Get_fill(idm.fs.ialloc.Iblock(childi), "create_undo", true)
-	ni := &Inode_t{ib, ioffset(childi)}
+	ib := idm.fs.ialloc.ibread(idm.fs.ialloc.Iblock(childi), "create_undo")
+	ni := idm.fs.ialloc.inode(ib, childi)
 	ni.W_itype(I_DEAD)
 	ib.Unlock()
 	idm.fs.fslog.Relse(ib, "create_undo")
@@ -821,7 +1763,8 @@ func (idm *imemnode_t) create_undo(opid opid_t, childi defs.Inum_t, childn ustr.
 	return 0
 }
 
-func (idm *imemnode_t) icreate(opid opid_t, name ustr.Ustr, nitype, major, minor int) (*imemnode_t, defs.Err_t) {
+// mode holds the permission bits of the new inode, which is owned by cred.
+func (idm *imemnode_t) icreate(opid opid_t, name ustr.Ustr, nitype, major, minor, mode int, cred *proc.Cred_t) (*imemnode_t, defs.Err_t) {
 	// XXX XXX fail if links == 0
 	if !idm._amlocked {
 		panic("lsjdf")
@@ -844,23 +1787,41 @@ func (idm *imemnode_t) icreate(opid opid_t, name ustr.Ustr, nitype, major, minor
 
 	idm.fs.istats.Nicreate.Inc()
 
+	now := inodetime()
+	uid, gid := cred.Euid, cred.Egid
+	// new entries of a set-group-ID directory inherit its group
+	if idm.mode&S_ISGID != 0 {
+		gid = idm.gid
+		if nitype == I_DIR {
+			mode |= S_ISGID
+		}
+	}
+	// inodes with data blocks use extents if the file system was made so
+	iflags := 0
+	if nitype != I_DEV && idm.fs.superb.Features()&FEAT_EXTENTS != 0 {
+		iflags |= IF_EXTENTS
+	}
+	// and regular files journal their data if it was made so
+	if nitype == I_FILE && idm.fs.superb.Features()&FEAT_JOURNAL != 0 {
+		iflags |= IF_JOURNAL
+	}
 	// allocate new inode
 	newinum, err := idm.fs.ialloc.Ialloc(opid)
 	var newidm *imemnode_t
 	var newinode *Inode_t
 	if idm.fs.diskfs {
 		newbn := idm.fs.ialloc.Iblock(newinum)
-		newioff := ioffset(newinum)
 		if err != 0 {
 			return nil, err
 		}
-		newiblk := idm.fs.fslog.Get_fill(newbn, "icreate", true)
+		newiblk := idm.fs.ialloc.ibread(newbn, "icreate")
+		newinode = idm.fs.ialloc.inode(newiblk, newinum)
 		if fs_debug {
-			fmt.Printf("ialloc: %v %v %v\n", newbn, newioff, newinum)
+			fmt.Printf("ialloc: %v %v %v\n", newbn, newinode.Ioff, newinum)
 		}
 
-		newinode = &Inode_t{newiblk, newioff}
 		newinode.W_itype(nitype)
+		newinode.w_iflags(iflags)
 		newinode.W_linkcount(1)
 		newinode.W_size(0)
 		newinode.w_major(major)
@@ -870,6 +1831,17 @@ func (idm *imemnode_t) icreate(opid opid_t, name ustr.Ustr, nitype, major, minor
 		for i := 0; i < NIADDRS; i++ {
 			newinode.W_addr(i, 0)
 		}
+		if iflags&IF_EXTENTS != 0 {
+			newinode.W_extmap(0, 0)
+		}
+		newinode.w_xattr(0)
+		xencode(newinode.xinline(), nil)
+		newinode.W_mode(mode)
+		newinode.W_owner(uid, gid)
+		newinode.W_atime(now)
+		newinode.W_mtime(now)
+		newinode.W_ctime(now)
+		idm.fs.ialloc.csumw(newiblk)
 		newiblk.Unlock()
 		idm.fs.fslog.Write(opid, newiblk)
 		idm.fs.fslog.Relse(newiblk, "icreate")
@@ -878,9 +1850,20 @@ func (idm *imemnode_t) icreate(opid opid_t, name ustr.Ustr, nitype, major, minor
 		// insert in icache
 		newidm = idm.fs.icache.Iref_locked_nofill(newinum, "icreate")
 		newidm.itype = nitype
+		newidm.iflags = iflags
+		if iflags&IF_EXTENTS != 0 {
+			root := mkeroot()
+			newidm._weroot(&root)
+		}
 		newidm.links = 1
 		newidm.major = major
 		newidm.minor = minor
+		newidm.mode = mode & 07777
+		newidm.uid = uid
+		newidm.gid = gid
+		newidm.atime = now
+		newidm.mtime = now
+		newidm.ctime = now
 		if newidm.itype == I_DIR {
 			newidm.dentc.dents = hashtable.MkHash(100)
 		}
@@ -895,6 +1878,9 @@ func (idm *imemnode_t) icreate(opid opid_t, name ustr.Ustr, nitype, major, minor
 		}
 		newidm.itype = I_DEAD
 		idm.fs.ialloc.Ifree(opid, newinum)
+	} else {
+		idm.touch()
+		idm.notify(defs.IN_CREATE|newidm.inisdir(), 0, name)
 	}
 	return newidm, err
 }
@@ -947,7 +1933,7 @@ func (idm *imemnode_t) immapinfo(offset, len int, mapshared bool) ([]mem.Mmapinf
 }
 
 func (idm *imemnode_t) idibread() *Bdev_block_t {
-	return idm.fs.fslog.Get_fill(idm.fs.ialloc.Iblock(idm.inum), "idibread", true)
+	return idm.fs.ialloc.ibread(idm.fs.ialloc.Iblock(idm.inum), "idibread")
 }
 
 // a type to iterate over the data and indirect blocks of an imemnode_t without
@@ -959,13 +1945,18 @@ type blockiter_t struct {
 	tryevict bool
 	dub      *Bdev_block_t
 	lasti    *Bdev_block_t
+	// for extent-mapped inodes, the last extent found, and the operation
+	// which removes blocks from the extent tree
+	ext  extent_t
+	opid opid_t
 }
 
-func (bl *blockiter_t) bi_init(idm *imemnode_t, tryevict bool) {
+func (bl *blockiter_t) bi_init(opid opid_t, idm *imemnode_t, tryevict bool) {
 	var zbl blockiter_t
 	*bl = zbl
 	bl.idm = idm
 	bl.tryevict = tryevict
+	bl.opid = opid
 }
 
 // if this imemnode_t has a double-indirect block, _isdub loads it and caches
@@ -1107,6 +2098,9 @@ func (bl *blockiter_t) next1(which int) (int, int) {
 // check, and whether any more blocks remain (so the caller can avoid acquiring
 // log admission spuriously).
 func (bl *blockiter_t) next(which int) (int, bool, int, bool) {
+	if bl.idm.extents() {
+		return bl.extnext(which)
+	}
 	const DBLOCKS = NIADDRS + INDADDR + INDADDR*INDADDR
 	const INDBLOCKS = DBLOCKS + INDADDR
 	const ALL = INDBLOCKS + 2
@@ -1130,6 +2124,51 @@ func (bl *blockiter_t) next(which int) (int, bool, int, bool) {
 	return ret, ok, which, remains
 }
 
+// next() for extent-mapped inodes. which is the file block to free next, or
+// EXTMAXFBN once all data blocks are freed, after which the blocks of the
+// extent tree are removed from the tree and freed one at a time.
+func (bl *blockiter_t) extnext(which int) (int, bool, int, bool) {
+	// returns the extent mapping the first data block at or after fbn
+	data := func(fbn int) (extent_t, bool) {
+		if e := bl.ext; e.len != 0 && fbn >= e.fbn && fbn < e.fbn+e.len {
+			return e, true
+		}
+		e, ok := bl.idm._extnext(fbn)
+		if ok {
+			bl.ext = e
+		}
+		return e, ok
+	}
+	ret := -1
+	if which < EXTMAXFBN {
+		if e, ok := data(which); ok {
+			if which < e.fbn {
+				which = e.fbn
+			}
+			ret = e.blk + which - e.fbn
+			which++
+		} else {
+			which = EXTMAXFBN
+		}
+	}
+	if ret == -1 {
+		ret = bl.idm._extpop(bl.opid)
+	}
+	ok := ret != -1
+	remains := false
+	if which < EXTMAXFBN {
+		_, remains = data(which)
+		if !remains {
+			which = EXTMAXFBN
+		}
+	}
+	if !remains {
+		root := bl.idm._eroot()
+		remains = (&enode_t{root: &root}).height() != 0
+	}
+	return ret, ok, which, remains
+}
+
 // free an orphaned inode
 func (idm *imemnode_t) ifree() defs.Err_t {
 	idm.fs.istats.Nifree.Inc()
@@ -1148,6 +2187,7 @@ func (idm *imemnode_t) ifree() defs.Err_t {
 	// 	DBLOCKS <= major < DBLOCKS + INDADDR, and the
 	// indirect/double-indirect itself when:
 	//	DBLOCKS+INADDR <= major DBLOCKS+INADDR+2
+	// for extent-mapped inodes, see blockiter_t.extnext().
 
 	var ca res.Cacheallocs_t
 	gimme := bounds.Bounds(bounds.B_IMEMNODE_T_IFREE)
@@ -1165,17 +2205,22 @@ func (idm *imemnode_t) ifree() defs.Err_t {
 
 		which := idm.major
 
+		// the attribute block goes first; flushto() below clears the
+		// inode's pointer to it in the same transaction
+		if idm.xattr != 0 {
+			distinct[idm.fs.balloc.Bfree(opid, idm.xattr)] = true
+			idm.xattr = 0
+		}
+
 		bliter := &blockiter_t{}
-		bliter.bi_init(idm, tryevict)
+		bliter.bi_init(opid, idm, tryevict)
 
 		for len(distinct) < MaxBlkPerOp && remains {
 			blkno := -1
 			var ok bool
 			blkno, ok, which, remains = bliter.next(which)
 			if ok {
-				idm.fs.balloc.Bfree(opid, blkno)
-				freeblk := idm.fs.balloc.alloc.bitmapblkno(blkno)
-				distinct[freeblk] = true
+				distinct[idm.fs.balloc.Bfree(opid, blkno)] = true
 			}
 		}
 		bliter.release()
@@ -1196,6 +2241,7 @@ func (idm *imemnode_t) ifree() defs.Err_t {
 				iblk.Tryevict()
 			}
 			idm.flushto(iblk, idm.inum)
+			idm.fs.ialloc.csumw(iblk)
 			iblk.Unlock()
 			idm.fs.fslog.Write(opid, iblk)
 			idm.fs.fslog.Relse(iblk, "ifree")
@@ -1210,7 +2256,7 @@ func (idm *imemnode_t) ifree() defs.Err_t {
 func (idm *imemnode_t) mkmode() uint {
 	itype := idm.itype
 	switch itype {
-	case I_DIR, I_FILE:
+	case I_DIR, I_FILE, I_SYMLINK:
 		return uint(itype << 16)
 	case I_DEV:
 		// this can happen by fs-internal stats
@@ -1220,6 +2266,71 @@ func (idm *imemnode_t) mkmode() uint {
 	}
 }
 
+// returns 0 if cred may access idm in the ways described by want, a mask of
+// defs.R_OK, defs.W_OK, and defs.X_OK. caller holds lock on idm.
+func (idm *imemnode_t) iaccess(cred *proc.Cred_t, want int) defs.Err_t {
+	return cred.Access(idm.mode, idm.uid, idm.gid, idm.itype == I_DIR, want)
+}
+
+// returns 0 if idm isn't a directory or cred may search it, i.e. look up the
+// names in it. caller holds lock on idm.
+func (idm *imemnode_t) searchchk(cred *proc.Cred_t) defs.Err_t {
+	if idm.itype != I_DIR {
+		return 0
+	}
+	return idm.iaccess(cred, defs.X_OK)
+}
+
+// returns 0 if cred may add entries to the directory idm or, if child is not
+// nil, remove child from it. caller holds locks on idm and child.
+func (idm *imemnode_t) dirmodchk(cred *proc.Cred_t, child *imemnode_t) defs.Err_t {
+	if err := idm.iaccess(cred, defs.W_OK|defs.X_OK); err != 0 {
+		return err
+	}
+	if child == nil || idm.mode&S_ISVTX == 0 || cred.Isroot() {
+		return 0
+	}
+	if cred.Euid != idm.uid && cred.Euid != child.uid {
+		return -defs.EPERM
+	}
+	return 0
+}
+
+// returns 0 if cred owns idm or is the superuser
+func (idm *imemnode_t) ownerchk(cred *proc.Cred_t) defs.Err_t {
+	if !cred.Isroot() && cred.Euid != idm.uid {
+		return -defs.EPERM
+	}
+	return 0
+}
+
+// returns the current time in nanoseconds since the epoch, the unit of inode
+// timestamps
+func inodetime() int {
+	return int(time.Now().UnixNano())
+}
+
+// records a modification of the inode's data. caller holds lock on idm.
+func (idm *imemnode_t) touch() {
+	now := inodetime()
+	idm.mtime = now
+	idm.ctime = now
+}
+
+// queues an inotify event for the watches of idm. name is the entry of
+// directory idm that the event is about, if any.
+func (idm *imemnode_t) notify(mask, cookie int, name ustr.Ustr) {
+	inotify.Notify(idm.fs.dev, idm.inum, mask, cookie, name)
+}
+
+// the IN_ISDIR bit of the events about idm
+func (idm *imemnode_t) inisdir() int {
+	if idm.itype == I_DIR {
+		return defs.IN_ISDIR
+	}
+	return 0
+}
+
 func fieldr(p *mem.Bytepg_t, field int) int {
 	return util.Readn(p[:], 8, field*8)
 }
@@ -1254,7 +2365,7 @@ func mkIcache(fs *Fs_t, start, len int) *icache_t {
 	icache := &icache_t{}
 	icache.cache = mkCache(limits.Syslimit.Vnodes)
 	icache.fs = fs
-	icache.orphanbitmap = mkAllocater(fs, start, len, fs.fslog)
+	icache.orphanbitmap = mkAllocater(fs, start, len, nil, fs.fslog)
 	return icache
 }
 
@@ -1395,24 +2506,27 @@ func iref_lockall(imems []*imemnode_t) []*imemnode_t {
 //
 
 type ibitmap_t struct {
+	fs       *Fs_t
 	alloc    *bitmap_t
 	start    int
 	len      int
-	first    int
 	inodelen int
 	maxinode int
+	// the size of an inode
+	isize int
 }
 
-func mkIalloc(fs *Fs_t, start, len, first, inodelen int) *ibitmap_t {
+func mkIalloc(fs *Fs_t, start, len, inodelen int) *ibitmap_t {
 	ialloc := &ibitmap_t{}
-	ialloc.alloc = mkAllocater(fs, start, len, fs.fslog)
+	ialloc.fs = fs
+	ialloc.alloc = mkAllocater(fs, start, len, nil, fs.fslog)
 	ialloc.start = start
 	ialloc.len = len
-	ialloc.first = first
 	ialloc.inodelen = inodelen
-	ialloc.maxinode = inodelen * (BSIZE / ISIZE)
-	//fmt.Printf("ialloc: mapstart %v maplen %v inode start %v inode len %v max inode# %v nfree %d\n",
-	//	ialloc.start, ialloc.len, ialloc.first, ialloc.inodelen, ialloc.maxinode,
+	ialloc.isize = fs.superb.Isize()
+	ialloc.maxinode = inodelen * (BSIZE / ialloc.isize)
+	//fmt.Printf("ialloc: mapstart %v maplen %v inode len %v max inode# %v nfree %d\n",
+	//	ialloc.start, ialloc.len, ialloc.inodelen, ialloc.maxinode,
 	//	ialloc.alloc.nfreebits)
 	return ialloc
 }
@@ -1444,18 +2558,33 @@ func (ialloc *ibitmap_t) Ifree(opid opid_t, inum defs.Inum_t) {
 }
 
 func (ialloc *ibitmap_t) Iblock(inum defs.Inum_t) int {
-	b := int(inum) / (BSIZE / ISIZE)
-	b += ialloc.first
-	if b < ialloc.first || b >= ialloc.first+ialloc.inodelen {
+	b := int(inum) / (BSIZE / ialloc.isize)
+	if b < 0 || b >= ialloc.inodelen {
 		fmt.Printf("inum=%v b = %d\n", inum, b)
 		panic("Iblock: too big inum")
 	}
-	return b
+	return ialloc.fs.superb.Inodeblk(b)
 }
 
-func ioffset(inum defs.Inum_t) int {
-	o := int(inum) % (BSIZE / ISIZE)
-	return o
+// returns inode inum in its inode block b
+func (ialloc *ibitmap_t) inode(b *Bdev_block_t, inum defs.Inum_t) *Inode_t {
+	return mkInode(b, inum, ialloc.isize)
+}
+
+// reads inode block blkn. only the inode blocks of a file system with
+// FEAT_XATTR end in a checksum, since ISIZE inodes leave no bytes unused.
+func (ialloc *ibitmap_t) ibread(blkn int, s string) *Bdev_block_t {
+	if ialloc.isize == ISIZE {
+		return ialloc.fs.fslog.Get_fill(blkn, s, true)
+	}
+	return ialloc.fs.fslog.Get_fill_csum(blkn, s, true)
+}
+
+// stamps the checksum of inode block b, if it has one
+func (ialloc *ibitmap_t) csumw(b *Bdev_block_t) {
+	if ialloc.isize != ISIZE {
+		Csumw(b.Data)
+	}
 }
 
 func (ialloc *ibitmap_t) Stats() string {
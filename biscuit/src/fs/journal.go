@@ -0,0 +1,49 @@
+package fs
+
+// Data journaling.
+//
+// Ordinarily the log journals only metadata, and a file's data blocks are
+// ordered writes: they reach their home location before the transaction that
+// maps them commits, thus a crash during an overwrite may leave a file with
+// some blocks of the write and not others. On a file system made with the
+// FEAT_JOURNAL feature, new regular files are marked with IF_JOURNAL, and
+// their data blocks are logged like metadata, thus they reach their home
+// location only when their transaction is installed.
+//
+// do_write() writes a journaled file in operations that reserve up to
+// Maxop() log blocks with Op_begin_n(), and a write that fits in one
+// operation, which opsize() reports, is atomic with respect to crashes: after
+// recovery the file has either all of the write or none of it. Journaled
+// files don't use O_DIRECT, which bypasses the log.
+
+// returns true if the data blocks of idm are written through the log
+func (idm *imemnode_t) journaled() bool {
+	return idm.iflags&IF_JOURNAL != 0
+}
+
+// returns the largest number of bytes that an operation of do_write()
+// writes, and the number of log blocks that it reserves.
+func (idm *imemnode_t) opsize() (int, int) {
+	// account for the inode, indirect blocks and a bitmap block
+	if !idm.journaled() {
+		return (MaxBlkPerOp - 3) * BSIZE, MaxBlkPerOp
+	}
+	// an unaligned write spans a block more than its length. leave
+	// MaxBlkPerOp for the metadata, since a large write may allocate
+	// several indirect or extent blocks and touch two bitmap blocks.
+	nblks := idm.fs.fslog.Maxop()
+	if n := nblks - MaxBlkPerOp - 1; n > MaxBlkPerOp-4 {
+		return n * BSIZE, nblks
+	}
+	return (MaxBlkPerOp - 4) * BSIZE, MaxBlkPerOp
+}
+
+// writes the data block b of idm through the log if idm is journaled, and
+// ordered otherwise.
+func (idm *imemnode_t) bwrite(opid opid_t, b *Bdev_block_t) {
+	if idm.journaled() {
+		idm.fs.fslog.Write(opid, b)
+	} else {
+		idm.fs.fslog.Write_ordered(opid, b)
+	}
+}
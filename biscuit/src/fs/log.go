@@ -1,6 +1,7 @@
 package fs
 
 import "fmt"
+import "hash/crc32"
 import "sync"
 
 import "mem"
@@ -20,14 +21,25 @@ const log_debug = false
 // all its data structures, and use ordered writes only for file data.  The file
 // system must guarantee that it performs no more than maxblkspersys logged
 // writes in an operation, to ensure that its operation will fit in the log.
+// An operation that logs more, such as a write to a file whose data is
+// journaled (see IF_JOURNAL), reserves room for its blocks with Op_begin_n();
+// a transaction admits operations until their reservations and the blocks it
+// logged fill it.
+//
+// The commit block of a transaction ends with a checksum of the transaction's
+// blocks. Recovery installs the transactions from the tail whose checksums
+// match, and drops the first one that doesn't and the ones after it, thus a
+// transaction that was torn or corrupted on its way to the disk is never
+// installed.
 
 const LogOffset = 1 // log block 0 is used for head
 
 // an upperbound on the number of blocks written per system call. this is
 // necessary in order to guarantee that the log is long enough for the allowed
-// number of concurrent fs syscalls.
+// number of concurrent fs syscalls. it is the reservation of Op_begin(); an
+// operation that logs file data reserves more with Op_begin_n().
 const MaxBlkPerOp = 10
-const MaxDescriptor = BSIZE / 8
+const MaxDescriptor = BSIZE/8 - 1 // the last word is the checksum
 const MaxOrdered = 3000
 const EndDescriptor = 0
 const NCommitBlk = 1
@@ -41,9 +53,20 @@ type index_t uint64
 //
 
 func (log *log_t) Op_begin(s string) opid_t {
+	return log.Op_begin_n(s, MaxBlkPerOp)
+}
+
+// Op_begin_n is Op_begin for an operation that writes at most n blocks through
+// the log; n must be at most Maxop(). The operation waits till the current
+// transaction has room for n more blocks, and forces the transaction to
+// commit if it doesn't, so that a large operation isn't starved by small ones.
+func (log *log_t) Op_begin_n(s string, n int) opid_t {
 	if !log.logging {
 		return 0
 	}
+	if n > MaxBlkPerOp && n > log.Maxop() {
+		panic("op too large")
+	}
 
 	log.Lock()
 	defer log.Unlock()
@@ -56,14 +79,21 @@ func (log *log_t) Op_begin(s string) opid_t {
 
 	t := log.curtrans
 
-	for t.isfull() || t.committing {
+	for t.isfull_n(n) || t.committing {
 		if log_debug {
 			fmt.Printf("op_begin: %d wait %s\n", opid, s)
 		}
+		if n > MaxBlkPerOp && !t.committing && !t.isempty() && !t.force {
+			t.force = true
+			if t.iscommittable() {
+				t.committing = true
+				log.commitcond.Signal()
+			}
+		}
 		log.admissioncond.Wait()
 		t = log.curtrans // maybe a different trans
 	}
-	t.add_op(opid)
+	t.add_op(opid, n)
 
 	log.stats.Opbegincycles.Add(ts)
 
@@ -123,6 +153,10 @@ func (log *log_t) Force(doapply bool) {
 
 	if t.isempty() || t.forcedone {
 		log.stats.Nbatchforce++
+		// the previous transaction may still be committing
+		for log.committed < t.seq-1 {
+			log.commitdone.Wait()
+		}
 		return
 	}
 
@@ -158,6 +192,47 @@ func (log *log_t) Force(doapply bool) {
 	}
 }
 
+// Force_seq is Force, but only waits for transaction seq, which Curseq()
+// returned, and the transactions before it to commit; later transactions are
+// neither forced nor waited for.
+func (log *log_t) Force_seq(seq int) {
+	if !log.logging {
+		return
+	}
+
+	log.Lock()
+	defer log.Unlock()
+
+	log.stats.Nforceseq++
+	if seq <= log.committed {
+		log.stats.Nforceseqdone++
+		return
+	}
+
+	t := log.curtrans
+	if t.seq == seq && !t.force {
+		t.force = true
+		if t.iscommittable() && !t.committing {
+			t.committing = true
+			log.commitcond.Signal()
+		}
+	}
+	for log.committed < seq {
+		log.commitdone.Wait()
+	}
+}
+
+// Curseq returns the sequence number of the current transaction, which is the
+// transaction of the caller's operation, if the caller is in one.
+func (log *log_t) Curseq() int {
+	if !log.logging {
+		return 0
+	}
+	log.Lock()
+	defer log.Unlock()
+	return log.curtrans.seq
+}
+
 // Write increments ref so that the log has always a valid ref to the buf's
 // page.  The logging layer refdowns when it it is done with the page.  The
 // caller of log_write shouldn't hold buf's lock.
@@ -169,10 +244,35 @@ func (log *log_t) Write_ordered(opid opid_t, b *Bdev_block_t) {
 	log.write(opid, b, true)
 }
 
+// reports whether a committed transaction that is not yet installed logged
+// block blkn. a write to blkn that bypasses the log would be overwritten when
+// the transaction is installed.
+func (log *log_t) Islogged(blkn int) bool {
+	log.Lock()
+	defer log.Unlock()
+	return log.translog.islogged(blkn)
+}
+
 func (log *log_t) Loglen() int {
 	return log.ml.loglen
 }
 
+// Maxop returns the largest number of blocks an operation may reserve with
+// Op_begin_n().
+func (log *log_t) Maxop() int {
+	return log.ml.maxtrans - MaxBlkPerOp
+}
+
+// Busy returns true if an operation has begun and not ended.
+func (log *log_t) Busy() bool {
+	if !log.logging {
+		return false
+	}
+	log.Lock()
+	defer log.Unlock()
+	return !log.curtrans.iscommittable()
+}
+
 // All layers above log read blocks through the log layer, which are mostly
 // wrappers for the the corresponding cache operations.
 func (log *log_t) Get_fill(blkn int, s string, lock bool) *Bdev_block_t {
@@ -182,6 +282,24 @@ func (log *log_t) Get_fill(blkn int, s string, lock bool) *Bdev_block_t {
 	return r
 }
 
+// Get_fill_csum is Get_fill for a block that ends in a checksum; see csum.go.
+func (log *log_t) Get_fill_csum(blkn int, s string, lock bool) *Bdev_block_t {
+	t := stats.Rdtsc()
+	r := log.ml.bcache.Get_fill_csum(blkn, s, lock)
+	log.stats.Readcycles.Add(t)
+	return r
+}
+
+// returns the number of transactions recovery dropped because their checksums
+// didn't match
+func (log *log_t) Ncsumerr() int {
+	return log.ml.ncsumerr
+}
+
+func (log *log_t) Readahead(blkns []int) {
+	log.ml.bcache.Readahead(blkns)
+}
+
 func (log *log_t) Get_zero(blkn int, s string, lock bool) *Bdev_block_t {
 	return log.ml.bcache.Get_zero(blkn, s, lock)
 }
@@ -264,6 +382,7 @@ type memlog_t struct {
 	logstart int             // position of memlog on disk
 	bcache   *bcache_t       // the backing store for memlog
 	stats    memlogstat_t
+	ncsumerr int // transactions with a bad checksum found by recovery
 }
 
 func mk_memlog(ls, ll int, bcache *bcache_t) *memlog_t {
@@ -394,7 +513,7 @@ func (cp *copy_relse_t) Relse(blk *Bdev_block_t, s string) {
 func (rl *revokelist_t) addRevokeRecord(blkno int, ml *memlog_t) {
 	var db *logdescriptor_t
 	blk := rl.revoked.Back()
-	if blk == nil || rl.index >= MaxDescriptor {
+	if blk == nil || rl.index+1 >= ml.maxtrans {
 		blk = MkBlock_newpage(blkno, "addRevokeRecord", ml.bcache.mem,
 			ml.bcache.disk, &copy_relse_t{})
 		blk.Type = RevokeBlk
@@ -417,9 +536,11 @@ func (rl *revokelist_t) addRevokeRecord(blkno int, ml *memlog_t) {
 type trans_t struct {
 	forcecond      *sync.Cond
 	ml             *memlog_t
+	seq            int // transactions commit in order of seq
 	start          index_t
 	head           index_t
 	inprogress     int        // ops in progress this transaction
+	reserved       int        // blocks reserved by the ops in progress
 	logged         *BlkList_t // list of to-be-logged blocks
 	ordered        *BlkList_t // list of ordered blocks
 	orderedcopy    *BlkList_t // list of copied ordered blocks
@@ -430,11 +551,15 @@ type trans_t struct {
 	forceapply     bool
 	forcedone      bool
 	committing     bool
+	// the reservations of the ops in progress other than MaxBlkPerOp
+	opsize map[opid_t]int
 }
 
 func (log *log_t) mk_trans(start index_t, ml *memlog_t) *trans_t {
 	t := &trans_t{start: start, head: start + NCommitBlk}
 	t.ml = ml
+	t.seq = log.nextseq
+	log.nextseq++
 	t.forcecond = sync.NewCond(log)
 	t.logged = MkBlkList()      // bounded by MaxDescriptor
 	t.ordered = MkBlkList()     // bounded by MaxOrdered
@@ -442,18 +567,29 @@ func (log *log_t) mk_trans(start index_t, ml *memlog_t) *trans_t {
 	t.logpresent = make(map[int]bool, ml.loglen)
 	t.orderedpresent = make(map[int]bool, MaxOrdered)
 	t.revokel = mkRevokeList()
+	t.opsize = make(map[opid_t]int)
 	return t
 }
 
-func (trans *trans_t) add_op(opid opid_t) {
+func (trans *trans_t) add_op(opid opid_t, n int) {
 	trans.inprogress += 1
+	trans.reserved += n
+	if n != MaxBlkPerOp {
+		trans.opsize[opid] = n
+	}
 }
 
 func (trans *trans_t) mark_done(opid opid_t) {
 	if trans.inprogress == 0 {
 		panic("mark done")
 	}
+	n := MaxBlkPerOp
+	if m, ok := trans.opsize[opid]; ok {
+		n = m
+		delete(trans.opsize, opid)
+	}
 	trans.inprogress -= 1
+	trans.reserved -= n
 }
 
 func (trans *trans_t) add_write(opid opid_t, log *log_t, blk *Bdev_block_t, ordered bool) {
@@ -531,10 +667,12 @@ func (trans *trans_t) isorderedfull() bool {
 	return n >= MaxOrdered
 }
 
-func (trans *trans_t) iscommitdescriptorfull() bool {
+// reports whether the transaction has no room for another op that logs up to
+// m blocks, besides the blocks that the ops in progress reserved
+func (trans *trans_t) iscommitdescriptorfull(m int) bool {
 	n := trans.logged.Len() + trans.revokel.len()
-	n += trans.inprogress * MaxBlkPerOp
-	n += MaxBlkPerOp
+	n += trans.reserved
+	n += m
 	return n >= trans.ml.maxtrans
 }
 
@@ -543,7 +681,11 @@ func (trans *trans_t) isempty() bool {
 }
 
 func (trans *trans_t) isfull() bool {
-	return trans.iscommitdescriptorfull() || trans.isorderedfull()
+	return trans.isfull_n(MaxBlkPerOp)
+}
+
+func (trans *trans_t) isfull_n(n int) bool {
+	return trans.iscommitdescriptorfull(n) || trans.isorderedfull()
 }
 
 func (trans *trans_t) copyrevoked(ml *memlog_t) {
@@ -623,6 +765,11 @@ func (trans *trans_t) commit(tail index_t, ml *memlog_t) {
 		}
 	}
 	db.w_logdest(j, EndDescriptor) // marker
+	crc := uint32(0)
+	for i := trans.start; i != trans.head; i++ {
+		crc = csumlog(crc, trans.start, i, ml.getmemlog(i).Data)
+	}
+	db.w_csum(int(crc))
 
 	if log_debug {
 		fmt.Printf("commit: commit descriptor block at %d:\n", trans.start)
@@ -663,9 +810,11 @@ type logstat_t struct {
 	Opbegincycles stats.Cycles_t
 	Opendcycles   stats.Cycles_t
 
-	Nforce      stats.Counter_t
-	Nbatchforce stats.Counter_t
-	Forcecycles stats.Cycles_t
+	Nforce        stats.Counter_t
+	Nbatchforce   stats.Counter_t
+	Forcecycles   stats.Cycles_t
+	Nforceseq     stats.Counter_t
+	Nforceseqdone stats.Counter_t
 
 	Nlogwrite       stats.Counter_t
 	Norderedwrite   stats.Counter_t
@@ -692,6 +841,12 @@ type log_t struct {
 	logging bool
 	nextop  opid_t
 	stats   logstat_t
+
+	// the sequence number of the next transaction, and of the last
+	// committed one; commitdone is signaled when the latter changes
+	nextseq    int
+	committed  int
+	commitdone *sync.Cond
 }
 
 // first log header block format
@@ -743,10 +898,35 @@ func (ld *logdescriptor_t) w_logdest(p int, n int) {
 	fieldw(ld.data, p, n)
 }
 
+// the checksum of the transaction, in its commit block
+func (ld *logdescriptor_t) r_csum() int {
+	return fieldr(ld.data, MaxDescriptor)
+}
+
+func (ld *logdescriptor_t) w_csum(n int) {
+	fieldw(ld.data, MaxDescriptor, n)
+}
+
+// adds block d, which is at index i of the log, to crc, the checksum of the
+// blocks before it of the transaction that starts at start. the checksum
+// covers start, so that a stale transaction from an earlier pass over the log
+// doesn't match, and skips the checksum in the commit block.
+func csumlog(crc uint32, start, i index_t, d *mem.Bytepg_t) uint32 {
+	if i != start {
+		return crc32.Update(crc, crctab, d[:])
+	}
+	var idx [8]uint8
+	util.Writen(idx[:], 8, 0, int(start))
+	crc = crc32.Update(0, crctab, idx[:])
+	return crc32.Update(crc, crctab, d[:MaxDescriptor*8])
+}
+
 func (log *log_t) mk_log(ls, ll int, bcache *bcache_t, logging bool) {
 	log.ml = mk_memlog(ls, ll, bcache)
 	log.admissioncond = sync.NewCond(log)
 	log.commitcond = sync.NewCond(log)
+	log.commitdone = sync.NewCond(log)
+	log.nextseq = 1
 	log.stopc = make(chan bool)
 	log.translog = mkTransLog()
 	log.nextop = opid_t(1)
@@ -893,6 +1073,8 @@ func (log *log_t) committer() {
 
 			t.forcedone = true
 			t.forcecond.Broadcast()
+			log.committed = t.seq
+			log.commitdone.Broadcast()
 
 			if t.forceapply || log.ml.almosthalffull(log.tail, t.head) {
 				log.cancel(log.tail, t.head, t.revokel)
@@ -1038,6 +1220,36 @@ func (log *log_t) installmap(tail, head index_t) []int {
 	return im
 }
 
+// returns the end of the transactions from tail which are intact: their
+// commit blocks are well-formed and their checksums match.
+func (log *log_t) chktrans(tail, head index_t) index_t {
+	for ti := tail; ti != head; {
+		db, dblk := log.ml.readdescriptor(ti)
+		n := 1
+		for n < log.ml.maxtrans && db.r_logdest(n) != EndDescriptor {
+			n++
+		}
+		ok := db.r_logdest(0) == int(CommitBlk) && n < log.ml.maxtrans &&
+			ti+index_t(n) <= head
+		if ok {
+			crc := csumlog(0, ti, ti, dblk.Data)
+			for i := ti + 1; i != ti+index_t(n); i++ {
+				b := log.ml.bcache.Get_fill(log.ml.diskindex(i), "chktrans", false)
+				crc = csumlog(crc, ti, i, b.Data)
+				log.ml.bcache.Relse(b, "chktrans")
+			}
+			ok = int(crc) == db.r_csum()
+		}
+		log.ml.bcache.Relse(dblk, "chktrans")
+		if !ok {
+			log.ml.ncsumerr++
+			return ti
+		}
+		ti += index_t(n)
+	}
+	return head
+}
+
 func (log *log_t) install(tail, head index_t) {
 	im := log.installmap(tail, head)
 	for i := tail; i != head; i++ {
@@ -1062,11 +1274,17 @@ func (log *log_t) recover() {
 	tail := lh.r_tail()
 	head := lh.r_head()
 	headblk.Unlock()
+	log.ml.bcache.Relse(headblk, "recover")
+
+	if end := log.chktrans(tail, head); end != head {
+		fmt.Printf("bad transaction; dropping the log from %d till %d\n", end, head)
+		head = end
+		log.ml.commit_head(head)
+	}
 
 	log.tail = tail
 	log.head = head
 
-	log.ml.bcache.Relse(headblk, "recover")
 	if tail == head {
 		fmt.Printf("no FS recovery needed: head %d\n", head)
 		return
@@ -0,0 +1,365 @@
+package fs
+
+import "bounds"
+import "defs"
+import "res"
+import "util"
+
+// Copy-on-write file clones.
+//
+// Fs_reflink() makes a new file that maps the data blocks of an existing one
+// instead of copying them. A block shared by several files is copied when one
+// of them writes it, and the writer's file then maps the copy instead; see
+// _cow().
+//
+// The free block bitmap still says which blocks are in use, while a reference
+// count table holds the number of files that map each block besides the
+// first. Thus most blocks have a count of zero, and a file system that never
+// cloned a file has no table at all. Bfree() removes an owner of a block whose
+// count is not zero, and marks the block free otherwise.
+//
+// The table is a radix tree whose root is recorded in the superblock. The root
+// and the blocks below it hold rcptrs block numbers, and the leaves hold
+// rccnts 16-bit counts, indexed by the block's bit in the bitmap. Table blocks
+// are allocated from the data blocks when they are first needed and are never
+// freed. Like the bitmap, the table is written through the log.
+
+const (
+	rcptrs = BSIZE / 8
+	rccnts = BSIZE / 2
+	// the number of blocks the table covers (2TB with 4KB blocks)
+	rcspan = rccnts * rcptrs * rcptrs
+	// the most files that may share a block
+	RCMAX = 1 << 16
+)
+
+// returns the table block holding the count of the block at bit and the offset
+// of the count in it. missing table blocks are allocated if alloc, otherwise
+// 0 is returned if one is missing. caller holds balloc.rc.
+func (balloc *bbitmap_t) rcleaf(opid opid_t, bit int, alloc bool) (int, int, defs.Err_t) {
+	fs := balloc.fs
+	blkn := fs.superb.Refcnt()
+	if blkn == 0 {
+		if !alloc {
+			return 0, 0, 0
+		}
+		n, err := balloc.Balloc(opid)
+		if err != 0 {
+			return 0, 0, err
+		}
+		sblk := fs.fslog.Get_fill(fs.superb_start, "rcleaf", false)
+		fs.superb.SetRefcnt(n)
+		fs.fslog.Write(opid, sblk)
+		fs.fslog.Relse(sblk, "rcleaf")
+		blkn = n
+	}
+	for span := rcspan / rcptrs; span >= rccnts; span /= rcptrs {
+		blk := fs.fslog.Get_fill(blkn, "rcleaf", true)
+		off := bit / span % rcptrs * 8
+		next := util.Readn(blk.Data[:], 8, off)
+		var err defs.Err_t
+		wrote := false
+		if next == 0 && alloc {
+			if next, err = balloc.Balloc(opid); err == 0 {
+				util.Writen(blk.Data[:], 8, off, next)
+				wrote = true
+			}
+		}
+		blk.Unlock()
+		if wrote {
+			fs.fslog.Write(opid, blk)
+		}
+		fs.fslog.Relse(blk, "rcleaf")
+		if next == 0 {
+			return 0, 0, err
+		}
+		blkn = next
+	}
+	return blkn, bit % rccnts * 2, 0
+}
+
+// returns the number of blocks starting at blkno whose counts are in the same
+// table block
+func (balloc *bbitmap_t) Brefspan(blkno int) int {
+	return rccnts - (blkno-balloc.first)%rccnts
+}
+
+// adds an owner to each of the n blocks starting at blkno, whose counts must be
+// in one table block. returns the table block, or EMLINK if a block has
+// RCMAX owners already.
+func (balloc *bbitmap_t) Bref(opid opid_t, blkno, n int) (int, defs.Err_t) {
+	bit := blkno - balloc.first
+	if bit < 0 || n < 1 || n > balloc.Brefspan(blkno) {
+		panic("bref")
+	}
+	if bit >= rcspan {
+		return 0, -defs.ENOSPC
+	}
+	balloc.rc.Lock()
+	defer balloc.rc.Unlock()
+	leaf, off, err := balloc.rcleaf(opid, bit, true)
+	if err != 0 {
+		return 0, err
+	}
+	blk := balloc.fs.fslog.Get_fill(leaf, "bref", true)
+	for i := 0; i < n; i++ {
+		if util.Readn(blk.Data[:], 2, off+2*i) == RCMAX-1 {
+			blk.Unlock()
+			balloc.fs.fslog.Relse(blk, "bref")
+			return 0, -defs.EMLINK
+		}
+	}
+	for i := 0; i < n; i++ {
+		o := off + 2*i
+		util.Writen(blk.Data[:], 2, o, util.Readn(blk.Data[:], 2, o)+1)
+	}
+	blk.Unlock()
+	balloc.fs.fslog.Write(opid, blk)
+	balloc.fs.fslog.Relse(blk, "bref")
+	return leaf, 0
+}
+
+// removes an owner of the block at bit and returns the table block, unless the
+// block has a single owner. caller holds balloc.rc.
+func (balloc *bbitmap_t) rcdec(opid opid_t, bit int) (int, bool) {
+	leaf, off, _ := balloc.rcleaf(opid, bit, false)
+	if leaf == 0 {
+		return 0, false
+	}
+	blk := balloc.fs.fslog.Get_fill(leaf, "rcdec", true)
+	n := util.Readn(blk.Data[:], 2, off)
+	if n != 0 {
+		util.Writen(blk.Data[:], 2, off, n-1)
+	}
+	blk.Unlock()
+	if n != 0 {
+		balloc.fs.fslog.Write(opid, blk)
+	}
+	balloc.fs.fslog.Relse(blk, "rcdec")
+	return leaf, n != 0
+}
+
+// reports whether block blkno has more than one owner
+func (balloc *bbitmap_t) Bshared(blkno int) bool {
+	if balloc.fs.superb.Refcnt() == 0 {
+		return false
+	}
+	balloc.rc.Lock()
+	defer balloc.rc.Unlock()
+	leaf, off, _ := balloc.rcleaf(opid_t(0), blkno-balloc.first, false)
+	if leaf == 0 {
+		return false
+	}
+	blk := balloc.fs.fslog.Get_fill(leaf, "bshared", false)
+	n := util.Readn(blk.Data[:], 2, off)
+	balloc.fs.fslog.Relse(blk, "bshared")
+	return n != 0
+}
+
+// allocates a block, copies the cached contents of block old to it, and
+// returns it.
+func (idm *imemnode_t) _bcopy(opid opid_t, old int) (int, defs.Err_t) {
+	blkn, err := idm.fs.balloc.Balloc(opid)
+	if err != 0 {
+		return 0, err
+	}
+	ob := idm.fs.fslog.Get_fill(old, "cow", true)
+	b := idm.fs.fslog.Get_fill(blkn, "cow", true)
+	copy(b.Data[:], ob.Data[:])
+	ob.Unlock()
+	idm.fs.fslog.Relse(ob, "cow")
+	b.Unlock()
+	// like written data, the copy must be on the disk before the
+	// transaction that maps it commits
+	idm.bwrite(opid, b)
+	idm.fs.fslog.Relse(b, "cow")
+	return blkn, 0
+}
+
+// gives file block fbn, which is mapped to block old that other files share, a
+// copy of old of its own, and returns the copy. caller holds lock on idm.
+func (idm *imemnode_t) _cow(opid opid_t, fbn, old int) (int, defs.Err_t) {
+	blkn, err := idm._bcopy(opid, old)
+	if err != 0 {
+		return 0, err
+	}
+	if idm.extents() {
+		if _, err := idm._extunmap(opid, fbn); err != 0 {
+			idm.fs.balloc.Bfree(opid, blkn)
+			return 0, err
+		}
+	}
+	if err := idm._bmap(opid, fbn, blkn, 1); err != 0 {
+		// only inserting into an extent tree fails
+		if idm._bmap(opid, fbn, old, 1) != 0 {
+			panic("cow: cannot remap")
+		}
+		idm.fs.balloc.Bfree(opid, blkn)
+		return 0, err
+	}
+	idm.fs.balloc.Bfree(opid, old)
+	idm.fs.istats.Ncow.Inc()
+	return blkn, 0
+}
+
+// maps the n file blocks starting at fbn to the blocks starting at blkn. with
+// an extent tree, the file blocks must not be mapped; with block pointers, they
+// must be in the inode or in one indirect block, and the pointers are
+// overwritten.
+func (idm *imemnode_t) _bmap(opid opid_t, fbn, blkn, n int) defs.Err_t {
+	if idm.extents() {
+		root := idm._eroot()
+		_, err := idm._extins(opid, &enode_t{root: &root}, extent_t{fbn, n, blkn})
+		if err == 0 {
+			idm._weroot(&root)
+		}
+		return err
+	}
+	if fbn < NIADDRS {
+		for i := 0; i < n; i++ {
+			idm.addrs[fbn+i] = blkn + i
+		}
+		return 0
+	}
+	fbn -= NIADDRS
+	var indno int
+	if fbn < INDADDR {
+		ino, isnew, err := idm.ensureb(opid, idm.indir, true)
+		if err != 0 {
+			return err
+		}
+		if isnew {
+			idm.indir = ino
+		}
+		indno = ino
+	} else {
+		fbn -= INDADDR
+		dindno, isnew, err := idm.ensureb(opid, idm.dindir, true)
+		if err != 0 {
+			return err
+		}
+		if isnew {
+			idm.dindir = dindno
+		}
+		dblk := idm.mbread(dindno)
+		indno, err = idm.ensureind(opid, dblk, fbn/INDADDR, true)
+		idm.fs.fslog.Relse(dblk, "bmap")
+		if err != 0 {
+			return err
+		}
+		fbn %= INDADDR
+	}
+	blk := idm.mbread(indno)
+	for i := 0; i < n; i++ {
+		util.Writen(blk.Data[:], 8, (fbn+i)*8, blkn+i)
+	}
+	idm.fs.fslog.Write(opid, blk)
+	idm.fs.fslog.Relse(blk, "bmap")
+	return 0
+}
+
+// makes dst, a new empty file, share the blocks of src. each operation clones
+// one run of consecutively mapped blocks whose counts are in one table block,
+// thus writes few blocks, and a crash leaves dst with a prefix of src. blocks
+// src writes meanwhile may or may not be in the clone. caller must not hold
+// locks on src or dst.
+func (dst *imemnode_t) do_clone(src *imemnode_t) defs.Err_t {
+	src.ilock("clone")
+	size := src.size
+	src.iunlock("clone")
+	lim := util.Roundup(size, BSIZE) / BSIZE
+	for fbn := 0; ; {
+		gimme := bounds.Bounds(bounds.B_IMEMNODE_T_DO_WRITE)
+		if !res.Resadd_noblock(gimme) {
+			return -defs.ENOHEAP
+		}
+		opid := dst.fs.fslog.Op_begin("doclone")
+		// dst is new, thus no other operation locks it before src
+		src.ilock("clone")
+		dst.ilock("clone")
+		next, err := dst._clone(opid, src, fbn, lim)
+		dst.size = min(size, next*BSIZE)
+		dst._iupdate(opid)
+		dst.iunlock("clone")
+		src.iunlock("clone")
+		dst.fs.fslog.Op_end(opid)
+		if err != 0 || next >= lim {
+			return err
+		}
+		fbn = next
+	}
+}
+
+// clones the first run of src's blocks at or after file block fbn and before
+// lim into dst, and returns the file block after the run. the run ends where
+// the blocks are no longer consecutive, where their counts move to another
+// table block, or, if dst has block pointers, where the pointers move to
+// another block. a shared mapping of src keeps writing to the pages of the
+// blocks it maps, thus dst gets a copy of such a block instead.
+func (dst *imemnode_t) _clone(opid opid_t, src *imemnode_t, fbn, lim int) (int, defs.Err_t) {
+	fbn = src._nextdata(fbn)
+	if fbn == -1 || fbn >= lim {
+		return lim, 0
+	}
+	blkn, _, err := src.fbn2block(opid_t(0), fbn, false)
+	if err != 0 {
+		return fbn, err
+	}
+	max := min(lim-fbn, dst.fs.balloc.Brefspan(blkn))
+	if !dst.extents() {
+		switch {
+		case fbn >= dst.maxfbn():
+			return fbn, -defs.EFBIG
+		case fbn < NIADDRS:
+			max = min(max, NIADDRS-fbn)
+		default:
+			max = min(max, INDADDR-(fbn-NIADDRS)%INDADDR)
+		}
+	}
+	if dst.fs.bcache.ismapped(blkn) {
+		nb, err := dst._bcopy(opid, blkn)
+		if err != 0 {
+			return fbn, err
+		}
+		if err := dst._bmap(opid, fbn, nb, 1); err != 0 {
+			dst.fs.balloc.Bfree(opid, nb)
+			return fbn, err
+		}
+		return fbn + 1, 0
+	}
+	n := 1
+	for ; n < max; n++ {
+		b, _, _ := src.fbn2block(opid_t(0), fbn+n, false)
+		if b != blkn+n || dst.fs.bcache.ismapped(b) {
+			break
+		}
+	}
+	if _, err := dst.fs.balloc.Bref(opid, blkn, n); err != 0 {
+		return fbn, err
+	}
+	if err := dst._bmap(opid, fbn, blkn, n); err != 0 {
+		for i := 0; i < n; i++ {
+			dst.fs.balloc.Bfree(opid, blkn+i)
+		}
+		return fbn, err
+	}
+	return fbn + n, 0
+}
+
+// reports whether a shared mapping of [off, off+len) must copy blocks that
+// other files share. caller holds lock on idm.
+func (idm *imemnode_t) mmapshared(off, len int) bool {
+	if idm.fs.superb.Refcnt() == 0 || off < 0 || off >= idm.size {
+		return false
+	}
+	if len == -1 || off+len > idm.size {
+		len = idm.size - off
+	}
+	for fbn := off / BSIZE; fbn*BSIZE < off+len; fbn++ {
+		blkn, _, _ := idm.fbn2block(opid_t(0), fbn, false)
+		if blkn != 0 && idm.fs.balloc.Bshared(blkn) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+package fs
+
+import "bounds"
+import "defs"
+import "res"
+
+// Online grow.
+//
+// Fs_resize() adds the disk blocks past the superblock's Lastblock to a
+// mounted file system. Each grow appends a group of blocks: blocks that
+// continue the block map, blocks that continue the inode table, and the new
+// data blocks. The block map and the inode table are thus no longer
+// contiguous; the superblock records where each grow put its part of them (see
+// Superblock_t.Grow()), and the allocators find their blocks through it. A
+// grow adds inodes in proportion to the data blocks, as far as the inode map,
+// whose size is fixed, has room for them.
+//
+// The bits of the new blocks and inodes are clear in the new block map blocks
+// but set in the bitmap blocks which existed already, since those bits were
+// past the end of the file system. A grow therefore first writes the new block
+// map and inode blocks, which nothing refers to yet, as ordered writes, which
+// are on disk before a later operation commits. A single operation then
+// updates the superblock and clears the bits in the existing bitmap blocks, so
+// that a crash leaves the file system either as it was or grown.
+
+// the most grows the superblock can record
+const GROWMAX = 64
+
+// Fs_resize grows the file system to end at block nblocks, which the disk must
+// hold. shrinking is not supported.
+func (fs *Fs_t) Fs_resize(nblocks int) defs.Err_t {
+	if !fs.diskfs {
+		return -defs.EOPNOTSUPP
+	}
+	fs.resizel.Lock()
+	defer fs.resizel.Unlock()
+
+	sb := &fs.superb
+	last := sb.Lastblock()
+	if nblocks <= last {
+		return -defs.EINVAL
+	}
+	if sb.Ngrow() >= GROWMAX {
+		return -defs.ENOSPC
+	}
+	first := fs.balloc.first
+	nbmap := (nblocks-first+bitsperblk-1)/bitsperblk - sb.Freeblocklen()
+	if nbmap < 0 {
+		nbmap = 0
+	}
+	niblks := sb.Inodelen() * (nblocks - last) / (last - first)
+	if max := sb.Imaplen()*bitsperblk/(BSIZE/sb.Isize()) - sb.Inodelen(); niblks > max {
+		niblks = max
+	}
+	meta := last + nbmap + niblks
+	if meta >= nblocks {
+		return -defs.EINVAL
+	}
+
+	// the new block map blocks mark the group's own blocks and the bits
+	// past nblocks in use
+	for b := last; b < meta; b += MaxBlkPerOp {
+		gimme := bounds.Bounds(bounds.B_IMEMNODE_T_DO_WRITE)
+		if !res.Resadd_noblock(gimme) {
+			return -defs.ENOHEAP
+		}
+		opid := fs.fslog.Op_begin("resize")
+		for i := b; i < meta && i < b+MaxBlkPerOp; i++ {
+			blk := fs.fslog.Get_zero(i, "resize", true)
+			var zdata [BSIZE]uint8
+			copy(blk.Data[:], zdata[:])
+			if i < last+nbmap {
+				start := (sb.Freeblocklen() + i - last) * bitsperblk
+				for bit := start; bit < start+bitsperblk; bit++ {
+					if bit < meta-first || bit >= nblocks-first {
+						blk.Data[byteno(bit)] |= 1 << uint(byteoffset(bit))
+					}
+				}
+				Csumw(blk.Data)
+			} else {
+				fs.ialloc.csumw(blk)
+			}
+			blk.Unlock()
+			fs.fslog.Write_ordered(opid, blk)
+			fs.fslog.Relse(blk, "resize")
+		}
+		fs.fslog.Op_end(opid)
+	}
+
+	opid := fs.fslog.Op_begin("resize")
+	balloc := fs.balloc.alloc
+	ialloc := fs.ialloc.alloc
+	balloc.Lock()
+	ialloc.Lock()
+	sblk := fs.fslog.Get_fill(fs.superb_start, "resize", false)
+	ng := sb.Ngrow()
+	oldbits := sb.Freeblocklen() * bitsperblk
+	oldinodes := sb.Inodelen() * (BSIZE / sb.Isize())
+	// record the group before the lengths which cover it
+	sb.SetGrow(ng, last, sb.Freeblocklen(), last+nbmap, sb.Inodelen())
+	sb.SetNgrow(ng + 1)
+	sb.SetFreeblocklen(sb.Freeblocklen() + nbmap)
+	sb.SetInodelen(sb.Inodelen() + niblks)
+	sb.SetLastblock(nblocks)
+	fs.fslog.Write(opid, sblk)
+	fs.fslog.Relse(sblk, "resize")
+
+	balloc._unmarkrange(opid, meta-first, min(oldbits, nblocks-first))
+	balloc.freelen += nbmap
+	balloc.nfreebits += uint(nblocks - meta)
+	fs.balloc.len += nbmap
+
+	ninode := niblks * (BSIZE / sb.Isize())
+	fs.ialloc.inodelen += niblks
+	fs.ialloc.maxinode += ninode
+	ialloc._unmarkrange(opid, oldinodes, oldinodes+ninode)
+	ialloc.nfreebits += uint(ninode)
+	ialloc.Unlock()
+	balloc.Unlock()
+	fs.fslog.Op_end(opid)
+
+	fs.istats.Nresize.Inc()
+	fs.fslog.Force(false)
+	return 0
+}
+
+// clears the bits from lo up to hi and logs the blocks holding them. unlike
+// Unmark, it leaves nfreebits alone. caller holds the lock of alloc.
+func (alloc *bitmap_t) _unmarkrange(opid opid_t, lo, hi int) {
+	for bit := lo; bit < hi; {
+		blk := alloc.Fbread(blkno(bit))
+		for end := min(hi, (blkno(bit)+1)*bitsperblk); bit < end; bit++ {
+			blk.Data[byteno(bit)] &^= 1 << uint(byteoffset(bit))
+		}
+		Csumw(blk.Data)
+		blk.Unlock()
+		alloc.storage.Write(opid, blk)
+		alloc.storage.Relse(blk, "unmarkrange")
+	}
+}
@@ -2,6 +2,18 @@ package fs
 
 import "mem"
 
+// feature flags
+const (
+	// new inodes map their blocks with extent trees; see extent.go
+	FEAT_EXTENTS = 1 << 0
+	// new regular files journal their data; see journal.go
+	FEAT_JOURNAL = 1 << 1
+	// inodes are XISIZE bytes and have extended attributes; see xattr.go
+	FEAT_XATTR = 1 << 2
+	// the features this file system knows; it refuses others
+	FEAT_ALL = FEAT_EXTENTS | FEAT_JOURNAL | FEAT_XATTR
+)
+
 type Superblock_t struct {
 	Data *mem.Bytepg_t
 }
@@ -38,6 +50,70 @@ func (sb *Superblock_t) Lastblock() int {
 	return fieldr(sb.Data, 7)
 }
 
+func (sb *Superblock_t) Features() int {
+	return fieldr(sb.Data, 8)
+}
+
+// the size of an inode
+func (sb *Superblock_t) Isize() int {
+	if sb.Features()&FEAT_XATTR != 0 {
+		return XISIZE
+	}
+	return ISIZE
+}
+
+// the root of the block reference count table, or 0; see reflink.go
+func (sb *Superblock_t) Refcnt() int {
+	return fieldr(sb.Data, 9)
+}
+
+// the number of times the file system was grown; see resize.go
+func (sb *Superblock_t) Ngrow() int {
+	return fieldr(sb.Data, 10)
+}
+
+// returns where grow i put its block map blocks and inode blocks, and the
+// index of the first of each in the block map and the inode table
+func (sb *Superblock_t) Grow(i int) (int, int, int, int) {
+	f := 11 + 4*i
+	return fieldr(sb.Data, f), fieldr(sb.Data, f+1), fieldr(sb.Data, f+2),
+		fieldr(sb.Data, f+3)
+}
+
+// the first data block. the block map and inode table that mkfs made are
+// followed by the data blocks; the blocks grows added are among them.
+func (sb *Superblock_t) Datastart() int {
+	bl, il := sb.Freeblocklen(), sb.Inodelen()
+	if sb.Ngrow() > 0 {
+		_, bl, _, il = sb.Grow(0)
+	}
+	return sb.Freeblock() + bl + il
+}
+
+// returns the disk block holding block n of the block map
+func (sb *Superblock_t) Bmapblk(n int) int {
+	for i := sb.Ngrow() - 1; i >= 0; i-- {
+		if b, first, _, _ := sb.Grow(i); n >= first {
+			return b + n - first
+		}
+	}
+	return sb.Freeblock() + n
+}
+
+// returns the disk block holding block n of the inode table
+func (sb *Superblock_t) Inodeblk(n int) int {
+	for i := sb.Ngrow() - 1; i >= 0; i-- {
+		if _, _, b, first := sb.Grow(i); n >= first {
+			return b + n - first
+		}
+	}
+	bl := sb.Freeblocklen()
+	if sb.Ngrow() > 0 {
+		_, bl, _, _ = sb.Grow(0)
+	}
+	return sb.Freeblock() + bl + n
+}
+
 // writing
 
 func (sb *Superblock_t) SetLoglen(ll int) {
@@ -71,3 +147,23 @@ func (sb *Superblock_t) SetInodelen(n int) {
 func (sb *Superblock_t) SetLastblock(n int) {
 	fieldw(sb.Data, 7, n)
 }
+
+func (sb *Superblock_t) SetFeatures(n int) {
+	fieldw(sb.Data, 8, n)
+}
+
+func (sb *Superblock_t) SetRefcnt(n int) {
+	fieldw(sb.Data, 9, n)
+}
+
+func (sb *Superblock_t) SetNgrow(n int) {
+	fieldw(sb.Data, 10, n)
+}
+
+func (sb *Superblock_t) SetGrow(i, bmap, bfirst, inodes, ifirst int) {
+	f := 11 + 4*i
+	fieldw(sb.Data, f, bmap)
+	fieldw(sb.Data, f+1, bfirst)
+	fieldw(sb.Data, f+2, inodes)
+	fieldw(sb.Data, f+3, ifirst)
+}
@@ -0,0 +1,233 @@
+package fs
+
+import "defs"
+import "proc"
+import "ustr"
+import "util"
+
+// Extended attributes.
+//
+// On a file system made with the FEAT_XATTR feature, an inode carries a set of
+// name/value pairs besides its fixed fields. Such inodes are XISIZE bytes, and
+// the attributes are kept in the spare bytes at the end of the on-disk inode
+// as long as they fit there; the others go in the inode's attribute block, which
+// is allocated when it is first needed and freed when it becomes empty or the
+// inode is freed. Setting an attribute rewrites both areas, placing each
+// attribute in the inode if it still fits, thus small attributes are read
+// without an extra block. Both areas are written through the log in the same
+// operation as the inode, like other metadata.
+//
+// Each area holds a sequence of entries, which ends at an entry whose name
+// length is zero or at the end of the area:
+// 0,     name length
+// 1-2,   value length
+// 3-,    name, followed by the value
+//
+// Names start with the namespace: user attributes follow the file's
+// permissions and exist only on regular files and directories, trusted
+// attributes are visible only to the superuser, and security attributes are
+// readable by all but only the superuser may set them.
+
+const (
+	XATTR_NAME_MAX = 255
+	// the largest value that fits in the attribute block with any name
+	XATTR_SIZE_MAX = BSIZE - xhdrlen - XATTR_NAME_MAX
+	xhdrlen        = 3
+)
+
+type xattr_t struct {
+	name  ustr.Ustr
+	value []uint8
+}
+
+func (x *xattr_t) size() int {
+	return xhdrlen + len(x.name) + len(x.value)
+}
+
+// appends the attributes in area b to xs
+func xdecode(b []uint8, xs []xattr_t) []xattr_t {
+	for off := 0; off+xhdrlen <= len(b) && b[off] != 0; {
+		nl := int(b[off])
+		vl := util.Readn(b, 2, off+1)
+		off += xhdrlen
+		if off+nl+vl > len(b) {
+			panic("xattr entry overflows")
+		}
+		x := xattr_t{}
+		x.name = ustr.Ustr(append([]uint8{}, b[off:off+nl]...))
+		x.value = append([]uint8{}, b[off+nl:off+nl+vl]...)
+		xs = append(xs, x)
+		off += nl + vl
+	}
+	return xs
+}
+
+// writes xs to area b, which they must fit in, and zeroes the rest of b
+func xencode(b []uint8, xs []xattr_t) {
+	off := 0
+	for i := range xs {
+		x := &xs[i]
+		b[off] = uint8(len(x.name))
+		util.Writen(b, 2, off+1, len(x.value))
+		off += xhdrlen
+		off += copy(b[off:], x.name)
+		off += copy(b[off:], x.value)
+	}
+	for i := off; i < len(b); i++ {
+		b[i] = 0
+	}
+}
+
+func xhasprefix(name ustr.Ustr, ns string) bool {
+	return len(name) > len(ns) && string(name[:len(ns)]) == ns
+}
+
+func xnamechk(name ustr.Ustr) defs.Err_t {
+	if len(name) == 0 || len(name) > XATTR_NAME_MAX {
+		return -defs.ERANGE
+	}
+	if !xhasprefix(name, "user.") && !xhasprefix(name, "trusted.") &&
+		!xhasprefix(name, "security.") {
+		return -defs.EOPNOTSUPP
+	}
+	return 0
+}
+
+// returns 0 if cred may read (want is defs.R_OK) or write (defs.W_OK)
+// attribute name of idm. caller holds lock on idm.
+func (idm *imemnode_t) xaccess(cred *proc.Cred_t, name ustr.Ustr, want int) defs.Err_t {
+	switch {
+	case xhasprefix(name, "trusted."):
+		if !cred.Isroot() {
+			if want == defs.W_OK {
+				return -defs.EPERM
+			}
+			return -defs.ENODATA
+		}
+		return 0
+	case xhasprefix(name, "security."):
+		if want == defs.W_OK && !cred.Isroot() {
+			return -defs.EPERM
+		}
+		return 0
+	}
+	if idm.itype != I_FILE && idm.itype != I_DIR {
+		if want == defs.W_OK {
+			return -defs.EPERM
+		}
+		return -defs.ENODATA
+	}
+	return idm.iaccess(cred, want)
+}
+
+// returns the attributes of the inode, those kept in the inode first
+func (idm *imemnode_t) xattrs() []xattr_t {
+	iblk := idm.idibread()
+	ind := idm.fs.ialloc.inode(iblk, idm.inum)
+	xs := xdecode(ind.xinline(), nil)
+	iblk.Unlock()
+	idm.fs.fslog.Relse(iblk, "xattrs")
+	if idm.xattr != 0 {
+		blk := idm.mbread(idm.xattr)
+		xs = xdecode(blk.Data[:], xs)
+		idm.fs.fslog.Relse(blk, "xattrs")
+	}
+	return xs
+}
+
+// replaces the attributes of the inode by xs. the caller logs the inode.
+func (idm *imemnode_t) xstore(opid opid_t, xs []xattr_t) defs.Err_t {
+	var in, out []xattr_t
+	left := XISIZE - NIWORDS*8 - CSUMSIZE
+	nout := 0
+	for _, x := range xs {
+		if n := x.size(); n <= left {
+			in = append(in, x)
+			left -= n
+		} else {
+			out = append(out, x)
+			nout += n
+		}
+	}
+	if nout > BSIZE {
+		return -defs.ENOSPC
+	}
+	if len(out) != 0 && idm.xattr == 0 {
+		blkn, err := idm.fs.balloc.Balloc(opid)
+		if err != 0 {
+			return err
+		}
+		idm.xattr = blkn
+	}
+
+	iblk := idm.idibread()
+	xencode(idm.fs.ialloc.inode(iblk, idm.inum).xinline(), in)
+	idm.fs.ialloc.csumw(iblk)
+	iblk.Unlock()
+	idm.fs.fslog.Write(opid, iblk)
+	idm.fs.fslog.Relse(iblk, "xstore")
+	if len(out) != 0 {
+		blk := idm.mbread(idm.xattr)
+		xencode(blk.Data[:], out)
+		idm.fs.fslog.Write(opid, blk)
+		idm.fs.fslog.Relse(blk, "xstore")
+	} else if idm.xattr != 0 {
+		idm.fs.balloc.Bfree(opid, idm.xattr)
+		idm.xattr = 0
+	}
+	return 0
+}
+
+func xfind(xs []xattr_t, name ustr.Ustr) int {
+	for i := range xs {
+		if xs[i].name.Eq(name) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (idm *imemnode_t) do_getxattr(name ustr.Ustr) ([]uint8, defs.Err_t) {
+	xs := idm.xattrs()
+	i := xfind(xs, name)
+	if i == -1 {
+		return nil, -defs.ENODATA
+	}
+	return xs[i].value, 0
+}
+
+// sets attribute name to value, or removes it if value is nil. flags is
+// defs.XATTR_CREATE to fail if the attribute exists or defs.XATTR_REPLACE to
+// fail if it doesn't.
+func (idm *imemnode_t) do_setxattr(opid opid_t, name ustr.Ustr, value []uint8, flags int) defs.Err_t {
+	xs := idm.xattrs()
+	i := xfind(xs, name)
+	if i != -1 && flags&defs.XATTR_CREATE != 0 {
+		return -defs.EEXIST
+	}
+	if i == -1 && (value == nil || flags&defs.XATTR_REPLACE != 0) {
+		return -defs.ENODATA
+	}
+	switch {
+	case value == nil:
+		xs = append(xs[:i], xs[i+1:]...)
+	case i == -1:
+		xs = append(xs, xattr_t{name: name, value: value})
+	default:
+		xs[i].value = value
+	}
+	return idm.xstore(opid, xs)
+}
+
+// returns the NUL-terminated names of the attributes that cred may see
+func (idm *imemnode_t) do_listxattr(cred *proc.Cred_t) []uint8 {
+	var names []uint8
+	for _, x := range idm.xattrs() {
+		if xhasprefix(x.name, "trusted.") && !cred.Isroot() {
+			continue
+		}
+		names = append(names, x.name...)
+		names = append(names, 0)
+	}
+	return names
+}
@@ -0,0 +1,39 @@
+package main
+
+import "os"
+import "fmt"
+
+import "ufs"
+
+func main() {
+	repair := false
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "-r" {
+		repair = true
+		args = args[1:]
+	}
+	if len(args) != 1 {
+		fmt.Printf("Usage: fsck [-r] <image>\n")
+		os.Exit(2)
+	}
+	image := args[0]
+
+	r := ufs.Fsck(image, repair)
+	for _, p := range r.Problems {
+		fmt.Printf("%v\n", p)
+	}
+	if r.Logdirty {
+		fmt.Printf("%v: the log must be replayed; run with -r\n", image)
+		os.Exit(1)
+	}
+	if len(r.Problems) == 0 {
+		fmt.Printf("%v: clean\n", image)
+		return
+	}
+	if repair {
+		fmt.Printf("%v: repaired %v problems\n", image, len(r.Problems))
+		return
+	}
+	fmt.Printf("%v: %v problems\n", image, len(r.Problems))
+	os.Exit(1)
+}
@@ -0,0 +1,398 @@
+package inotify
+
+import "sync"
+import "sync/atomic"
+
+import "defs"
+import "fdops"
+import "flock"
+import "mem"
+import "proc"
+import "stat"
+import "ustr"
+import "util"
+
+// file change notifications. a process creates an inotify instance, whose fd
+// it reads events from, and adds watches on inodes to it. file systems report
+// changes of inodes with Notify(); an inode is named by the device number of
+// its file system and its inode number.
+
+// the most events an instance queues; further events are dropped and an
+// IN_Q_OVERFLOW event is queued instead
+const maxevents = 16384
+
+type key_t struct {
+	dev  uint
+	inum defs.Inum_t
+}
+
+type watch_t struct {
+	in   *Inotify_t
+	wd   int
+	mask int
+	key  key_t
+}
+
+// the watches of all instances. watches.Mutex is acquired before the lock of
+// an instance.
+var watches = struct {
+	sync.Mutex
+	bykey map[key_t][]*watch_t
+	// the number of watches, so that Notify() is cheap while nobody
+	// watches
+	n int32
+}{bykey: map[key_t][]*watch_t{}}
+
+// the last cookie that relates the two events of a rename
+var lastcookie uint32
+
+// returns a cookie for the IN_MOVED_FROM and IN_MOVED_TO events of a rename
+func Cookie() int {
+	return int(atomic.AddUint32(&lastcookie, 1))
+}
+
+// queues an event for the watches of the inode inum of the file system with
+// device number dev. name is the entry of the watched directory that the
+// event is about, if any. a deleted inode loses its watches.
+func Notify(dev uint, inum defs.Inum_t, mask, cookie int, name ustr.Ustr) {
+	if atomic.LoadInt32(&watches.n) == 0 {
+		return
+	}
+	k := key_t{dev: dev, inum: inum}
+	watches.Lock()
+	defer watches.Unlock()
+	ws := watches.bykey[k]
+	for _, w := range ws {
+		if w.mask&mask&defs.IN_ALL_EVENTS == 0 {
+			continue
+		}
+		w.in.Lock()
+		w.in.queue(event_t{wd: w.wd, mask: mask & (w.mask | defs.IN_ISDIR),
+			cookie: cookie, name: name})
+		w.in.Unlock()
+	}
+	if mask&defs.IN_DELETE_SELF != 0 {
+		for len(watches.bykey[k]) != 0 {
+			w := watches.bykey[k][0]
+			w.in.Lock()
+			w.in._rmwatch(w)
+			w.in.Unlock()
+		}
+	}
+}
+
+type event_t struct {
+	wd     int
+	mask   int
+	cookie int
+	name   ustr.Ustr
+}
+
+// the length of the event's struct inotify_event, whose name is padded like
+// linux does
+func (ev *event_t) reclen() int {
+	const hdrsz = 16
+	if len(ev.name) == 0 {
+		return hdrsz
+	}
+	return hdrsz + util.Roundup(len(ev.name)+1, hdrsz)
+}
+
+// struct inotify_event {
+//	int		wd;
+//	uint32_t	mask;
+//	uint32_t	cookie;
+//	uint32_t	len;
+//	char		name[];
+// };
+func (ev *event_t) record() []uint8 {
+	ret := make([]uint8, ev.reclen())
+	util.Writen(ret, 4, 0, ev.wd)
+	util.Writen(ret, 4, 4, ev.mask)
+	util.Writen(ret, 4, 8, ev.cookie)
+	util.Writen(ret, 4, 12, len(ret)-16)
+	copy(ret[16:], ev.name)
+	return ret
+}
+
+// an inotify instance, which is also the fops of its fds
+type Inotify_t struct {
+	sync.Mutex
+	// the number of fds of the instance
+	count   int
+	options defs.Fdopt_t
+	evs     []event_t
+	wds     map[int]*watch_t
+	lastwd  int
+	cond    *sync.Cond
+	pollers fdops.Pollers_t
+}
+
+func MkInotify(options defs.Fdopt_t) *Inotify_t {
+	in := &Inotify_t{count: 1, options: options, wds: map[int]*watch_t{}}
+	in.cond = sync.NewCond(in)
+	return in
+}
+
+// caller holds the instance's lock
+func (in *Inotify_t) queue(ev event_t) {
+	if n := len(in.evs); n != 0 {
+		last := &in.evs[n-1]
+		// like linux, merge an event with an identical previous one
+		if last.wd == ev.wd && last.mask == ev.mask &&
+			last.cookie == ev.cookie && last.name.Eq(ev.name) {
+			return
+		}
+		if last.mask == defs.IN_Q_OVERFLOW {
+			return
+		}
+		if n == maxevents {
+			ev = event_t{wd: -1, mask: defs.IN_Q_OVERFLOW}
+		}
+	}
+	in.evs = append(in.evs, ev)
+	in.cond.Broadcast()
+	in.pollers.Wakeready(fdops.R_READ)
+}
+
+// adds a watch on the inode inum of the file system with device number dev or
+// changes the events of the instance's existing watch on the inode. returns
+// the watch descriptor.
+func (in *Inotify_t) Addwatch(dev uint, inum defs.Inum_t, mask int) (int, defs.Err_t) {
+	k := key_t{dev: dev, inum: inum}
+	watches.Lock()
+	defer watches.Unlock()
+	in.Lock()
+	defer in.Unlock()
+	if in.count <= 0 {
+		return 0, -defs.EBADF
+	}
+	for _, w := range watches.bykey[k] {
+		if w.in == in {
+			if mask&defs.IN_MASK_ADD != 0 {
+				w.mask |= mask & defs.IN_ALL_EVENTS
+			} else {
+				w.mask = mask & defs.IN_ALL_EVENTS
+			}
+			return w.wd, 0
+		}
+	}
+	in.lastwd++
+	w := &watch_t{in: in, wd: in.lastwd, mask: mask & defs.IN_ALL_EVENTS,
+		key: k}
+	in.wds[w.wd] = w
+	watches.bykey[k] = append(watches.bykey[k], w)
+	atomic.AddInt32(&watches.n, 1)
+	return w.wd, 0
+}
+
+// removes the watch with descriptor wd
+func (in *Inotify_t) Rmwatch(wd int) defs.Err_t {
+	watches.Lock()
+	defer watches.Unlock()
+	in.Lock()
+	defer in.Unlock()
+	w, ok := in.wds[wd]
+	if !ok {
+		return -defs.EINVAL
+	}
+	in._rmwatch(w)
+	return 0
+}
+
+// removes w and queues its IN_IGNORED event. caller holds watches.Mutex and
+// the instance's lock.
+func (in *Inotify_t) _rmwatch(w *watch_t) {
+	ws := watches.bykey[w.key]
+	for i := range ws {
+		if ws[i] == w {
+			ws = append(ws[:i], ws[i+1:]...)
+			break
+		}
+	}
+	if len(ws) == 0 {
+		delete(watches.bykey, w.key)
+	} else {
+		watches.bykey[w.key] = ws
+	}
+	delete(in.wds, w.wd)
+	atomic.AddInt32(&watches.n, -1)
+	in.queue(event_t{wd: w.wd, mask: defs.IN_IGNORED})
+}
+
+func (in *Inotify_t) Close() defs.Err_t {
+	watches.Lock()
+	defer watches.Unlock()
+	in.Lock()
+	defer in.Unlock()
+	if in.count <= 0 {
+		return -defs.EBADF
+	}
+	in.count--
+	if in.count == 0 {
+		for _, w := range in.wds {
+			in._rmwatch(w)
+		}
+		in.evs = nil
+	}
+	return 0
+}
+
+func (in *Inotify_t) Reopen() defs.Err_t {
+	in.Lock()
+	defer in.Unlock()
+	if in.count <= 0 {
+		return -defs.EBADF
+	}
+	in.count++
+	return 0
+}
+
+// copies as many whole events as fit in dst, waiting for an event if there
+// are none
+func (in *Inotify_t) Read(dst fdops.Userio_i) (int, defs.Err_t) {
+	in.Lock()
+	defer in.Unlock()
+	for len(in.evs) == 0 {
+		if in.count <= 0 {
+			return 0, -defs.EBADF
+		}
+		if in.options&defs.O_NONBLOCK != 0 {
+			return 0, -defs.EWOULDBLOCK
+		}
+		if err := proc.KillableWait(in.cond); err != 0 {
+			return 0, err
+		}
+	}
+	c := 0
+	for len(in.evs) != 0 {
+		ev := &in.evs[0]
+		if ev.reclen() > dst.Remain() {
+			if c == 0 {
+				return 0, -defs.EINVAL
+			}
+			break
+		}
+		n, err := dst.Uiowrite(ev.record())
+		if err != 0 {
+			return c, err
+		}
+		c += n
+		in.evs = in.evs[1:]
+	}
+	return c, 0
+}
+
+func (in *Inotify_t) Pollone(pm fdops.Pollmsg_t) (fdops.Ready_t, defs.Err_t) {
+	in.Lock()
+	defer in.Unlock()
+	if pm.Events&fdops.R_READ != 0 && len(in.evs) != 0 {
+		return fdops.R_READ, 0
+	}
+	if !pm.Dowait {
+		return 0, 0
+	}
+	pm.Events &= fdops.R_READ
+	return 0, in.pollers.Addpoller(&pm)
+}
+
+func (in *Inotify_t) Fcntl(cmd, opt int) int {
+	in.Lock()
+	defer in.Unlock()
+	switch cmd {
+	case defs.F_GETFL:
+		return int(in.options)
+	case defs.F_SETFL:
+		in.options = defs.Fdopt_t(opt)
+		return 0
+	default:
+		panic("weird cmd")
+	}
+}
+
+func (in *Inotify_t) Fstat(st *stat.Stat_t) defs.Err_t {
+	st.Wdev(0)
+	return 0
+}
+
+func (in *Inotify_t) Lseek(int, int) (int, defs.Err_t) {
+	return 0, -defs.ESPIPE
+}
+
+func (in *Inotify_t) Mmapi(int, int, bool) ([]mem.Mmapinfo_t, defs.Err_t) {
+	return nil, -defs.EINVAL
+}
+
+func (in *Inotify_t) Pathi() defs.Inum_t {
+	panic("inotify cwd")
+}
+
+func (in *Inotify_t) Write(fdops.Userio_i) (int, defs.Err_t) {
+	return 0, -defs.EINVAL
+}
+
+func (in *Inotify_t) Truncate(uint) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (in *Inotify_t) Fallocate(int, int, int) defs.Err_t {
+	return -defs.ESPIPE
+}
+
+func (in *Inotify_t) Fsync(bool) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (in *Inotify_t) Locks() (*flock.Locks_t, defs.Err_t) {
+	return nil, -defs.EINVAL
+}
+
+func (in *Inotify_t) Pread(fdops.Userio_i, int) (int, defs.Err_t) {
+	return 0, -defs.ESPIPE
+}
+
+func (in *Inotify_t) Pwrite(fdops.Userio_i, int) (int, defs.Err_t) {
+	return 0, -defs.ESPIPE
+}
+
+func (in *Inotify_t) Getdents(fdops.Userio_i) (int, defs.Err_t) {
+	return 0, -defs.ENOTDIR
+}
+
+func (in *Inotify_t) Accept(fdops.Userio_i) (fdops.Fdops_i, int, defs.Err_t) {
+	return nil, 0, -defs.ENOTSOCK
+}
+
+func (in *Inotify_t) Bind([]uint8) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (in *Inotify_t) Connect([]uint8) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (in *Inotify_t) Listen(int) (fdops.Fdops_i, defs.Err_t) {
+	return nil, -defs.ENOTSOCK
+}
+
+func (in *Inotify_t) Sendmsg(fdops.Userio_i, []uint8, []uint8,
+	int) (int, defs.Err_t) {
+	return 0, -defs.ENOTSOCK
+}
+
+func (in *Inotify_t) Recvmsg(fdops.Userio_i, fdops.Userio_i,
+	fdops.Userio_i, int) (int, int, int, defs.Msgfl_t, defs.Err_t) {
+	return 0, 0, 0, 0, -defs.ENOTSOCK
+}
+
+func (in *Inotify_t) Getsockopt(int, fdops.Userio_i, int) (int, defs.Err_t) {
+	return 0, -defs.ENOTSOCK
+}
+
+func (in *Inotify_t) Setsockopt(int, int, fdops.Userio_i, int) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (in *Inotify_t) Shutdown(read, write bool) defs.Err_t {
+	return -defs.ENOTSOCK
+}
@@ -14,6 +14,8 @@ import "apic"
 import "bnet"
 import "caller"
 import "defs"
+import "devfs"
+import "device"
 import "inet"
 import "fd"
 import "fdops"
@@ -23,11 +25,14 @@ import "ixgbe"
 import "mem"
 import "pci"
 import "proc"
+import "procfs"
 import "res"
 import "stat"
 import "stats"
 import "tinfo"
+import "tmpfs"
 import "ustr"
+import "vfs"
 import "vm"
 
 const (
@@ -439,6 +444,8 @@ func kbd_init() {
 
 	go trap_cons(defs.INT_KBD, cons.kbd_int)
 	go trap_cons(defs.INT_COM1, cons.com_int)
+	device.Register("console", defs.D_CONSOLE, 0, 0666,
+		fs.Devopen(defs.D_CONSOLE))
 }
 
 type cons_t struct {
@@ -1287,6 +1294,9 @@ var lhits int
 var physmem *mem.Physmem_t
 var thefs *fs.Fs_t
 
+// the mount table; thefs is mounted at its root
+var thevfs *vfs.Vfs_t
+
 const diskfs = false
 
 func main() {
@@ -1335,6 +1345,8 @@ func main() {
 	ncpu := attach_devs()
 
 	kbd_init()
+	device.Register("null", defs.D_DEVNULL, 0, 0666, fs.Devopen(defs.D_DEVNULL))
+	device.Register("prof", defs.D_PROF, 0, 0600, fs.Devopen(defs.D_PROF))
 
 	// control CPUs
 	aplim := 3
@@ -1346,6 +1358,31 @@ func main() {
 	res.Resbegin(manymeg)
 	rf, fs := fs.StartFS(ahci.Blockmem, ahci.Ahci, console, diskfs)
 	thefs = fs
+	thevfs = vfs.MkVfs(thefs)
+	device.Register("rsd0c", defs.D_RAWDISK, 0, 0600, thefs.Rawopen)
+	device.Register("stats", defs.D_STAT, 0, 0644, thefs.Statopen)
+	vfs.Register("tmpfs", func(source, data ustr.Ustr) (vfs.Fs_i, defs.Err_t) {
+		return tmpfs.MkTmpfs(mem.Physmem), 0
+	})
+	// temporary files need not be journaled
+	tmp := tmpfs.MkTmpfs(mem.Physmem)
+	if err := thevfs.Mountfs(tmp, ustr.Ustr("/tmp"), thefs.MkRootCwd(), proc.Rootcred); err != 0 {
+		fmt.Printf("cannot mount tmpfs at /tmp: %v\n", err)
+	}
+	vfs.Register("procfs", func(source, data ustr.Ustr) (vfs.Fs_i, defs.Err_t) {
+		return procfs.MkProcfs(mem.Physmem), 0
+	})
+	pfs := procfs.MkProcfs(mem.Physmem)
+	if err := thevfs.Mountfs(pfs, ustr.Ustr("/proc"), thefs.MkRootCwd(), proc.Rootcred); err != 0 {
+		fmt.Printf("cannot mount procfs at /proc: %v\n", err)
+	}
+	vfs.Register("devfs", func(source, data ustr.Ustr) (vfs.Fs_i, defs.Err_t) {
+		return devfs.MkDevfs(), 0
+	})
+	dfs := devfs.MkDevfs()
+	if err := thevfs.Mountfs(dfs, ustr.Ustr("/dev"), thefs.MkRootCwd(), proc.Rootcred); err != 0 {
+		fmt.Printf("cannot mount devfs at /dev: %v\n", err)
+	}
 
 	proc.Oom_init(thefs.Fs_evict)
 
@@ -1354,7 +1391,7 @@ func main() {
 		nargs := []ustr.Ustr{cmd}
 		nargs = append(nargs, args...)
 		defaultfds := []*fd.Fd_t{&fd_stdin, &fd_stdout, &fd_stderr}
-		p, ok := proc.Proc_new(cmd, fd.MkRootCwd(rf), defaultfds, sys)
+		p, ok := proc.Proc_new(cmd, fd.MkRootCwd(rf), defaultfds, proc.Rootcred, sys)
 		if !ok {
 			panic("silly sysprocs")
 		}
@@ -13,12 +13,13 @@ import "unsafe"
 
 import "bnet"
 import "bounds"
-import "bpath"
 import "circbuf"
 import "defs"
 import "fd"
 import "fdops"
+import "flock"
 import "fs"
+import "inotify"
 import "limits"
 import "mem"
 import "proc"
@@ -68,6 +69,9 @@ var _sysbounds = []*res.Res_t{
 	defs.SYS_KILL:       bounds.Bounds(bounds.B_SYS_KILL),
 	defs.SYS_FCNTL:      bounds.Bounds(bounds.B_SYS_FCNTL),
 	defs.SYS_TRUNC:      bounds.Bounds(bounds.B_SYS_TRUNCATE),
+	defs.SYS_FLOCK:      bounds.Bounds(bounds.B_SYS_FLOCK),
+	defs.SYS_FSYNC:      bounds.Bounds(bounds.B_SYS_FSYNC),
+	defs.SYS_FDATASYNC:  bounds.Bounds(bounds.B_SYS_FDATASYNC),
 	defs.SYS_FTRUNC:     bounds.Bounds(bounds.B_SYS_FTRUNCATE),
 	defs.SYS_GETCWD:     bounds.Bounds(bounds.B_SYS_GETCWD),
 	defs.SYS_CHDIR:      bounds.Bounds(bounds.B_SYS_CHDIR),
@@ -75,15 +79,39 @@ var _sysbounds = []*res.Res_t{
 	defs.SYS_MKDIR:      bounds.Bounds(bounds.B_SYS_MKDIR),
 	defs.SYS_LINK:       bounds.Bounds(bounds.B_SYS_LINK),
 	defs.SYS_UNLINK:     bounds.Bounds(bounds.B_SYS_UNLINK),
+	defs.SYS_SYMLINK:    bounds.Bounds(bounds.B_SYS_SYMLINK),
+	defs.SYS_READLINK:   bounds.Bounds(bounds.B_SYS_READLINK),
+	defs.SYS_CHMOD:      bounds.Bounds(bounds.B_SYS_CHMOD),
+	defs.SYS_CHOWN:      bounds.Bounds(bounds.B_SYS_CHOWN),
 	defs.SYS_GETTOD:     bounds.Bounds(bounds.B_SYS_GETTIMEOFDAY),
 	defs.SYS_GETRLMT:    bounds.Bounds(bounds.B_SYS_GETRLIMIT),
 	defs.SYS_GETRUSG:    bounds.Bounds(bounds.B_SYS_GETRUSAGE),
+	defs.SYS_GETUID:     bounds.Bounds(bounds.B_SYS_GETUID),
+	defs.SYS_GETGID:     bounds.Bounds(bounds.B_SYS_GETGID),
+	defs.SYS_SETUID:     bounds.Bounds(bounds.B_SYS_SETUID),
+	defs.SYS_SETGID:     bounds.Bounds(bounds.B_SYS_SETGID),
+	defs.SYS_GETEUID:    bounds.Bounds(bounds.B_SYS_GETEUID),
+	defs.SYS_GETEGID:    bounds.Bounds(bounds.B_SYS_GETEGID),
+	defs.SYS_GETGROUPS:  bounds.Bounds(bounds.B_SYS_GETGROUPS),
+	defs.SYS_SETGROUPS:  bounds.Bounds(bounds.B_SYS_SETGROUPS),
 	defs.SYS_MKNOD:      bounds.Bounds(bounds.B_SYS_MKNOD),
 	defs.SYS_SETRLMT:    bounds.Bounds(bounds.B_SYS_SETRLIMIT),
 	defs.SYS_SYNC:       bounds.Bounds(bounds.B_SYS_SYNC),
+	defs.SYS_MOUNT:      bounds.Bounds(bounds.B_SYS_MOUNT),
+	defs.SYS_UMOUNT2:    bounds.Bounds(bounds.B_SYS_UMOUNT2),
 	defs.SYS_REBOOT:     bounds.Bounds(bounds.B_SYS_REBOOT),
+	defs.SYS_SETXATTR:    bounds.Bounds(bounds.B_SYS_SETXATTR),
+	defs.SYS_GETXATTR:    bounds.Bounds(bounds.B_SYS_GETXATTR),
+	defs.SYS_LISTXATTR:   bounds.Bounds(bounds.B_SYS_LISTXATTR),
+	defs.SYS_REMOVEXATTR: bounds.Bounds(bounds.B_SYS_REMOVEXATTR),
+	defs.SYS_GETDENTS64: bounds.Bounds(bounds.B_SYS_GETDENTS64),
 	defs.SYS_NANOSLEEP:  bounds.Bounds(bounds.B_SYS_NANOSLEEP),
+	defs.SYS_UTIMENSAT:  bounds.Bounds(bounds.B_SYS_UTIMENSAT),
+	defs.SYS_FALLOCATE:  bounds.Bounds(bounds.B_SYS_FALLOCATE),
+	defs.SYS_INOTIFY_ADD_WATCH: bounds.Bounds(bounds.B_SYS_INOTIFY_ADD_WATCH),
+	defs.SYS_INOTIFY_RM_WATCH: bounds.Bounds(bounds.B_SYS_INOTIFY_RM_WATCH),
 	defs.SYS_PIPE2:      bounds.Bounds(bounds.B_SYS_PIPE2),
+	defs.SYS_INOTIFY_INIT1: bounds.Bounds(bounds.B_SYS_INOTIFY_INIT1),
 	defs.SYS_PROF:       bounds.Bounds(bounds.B_SYS_PROF),
 	defs.SYS_THREXIT:    bounds.Bounds(bounds.B_SYS_THREXIT),
 	defs.SYS_INFO:       bounds.Bounds(bounds.B_SYS_INFO),
@@ -91,6 +119,8 @@ var _sysbounds = []*res.Res_t{
 	defs.SYS_PWRITE:     bounds.Bounds(bounds.B_SYS_PWRITE),
 	defs.SYS_FUTEX:      bounds.Bounds(bounds.B_SYS_FUTEX),
 	defs.SYS_GETTID:     bounds.Bounds(bounds.B_SYS_GETTID),
+	defs.SYS_REFLINK:    bounds.Bounds(bounds.B_SYS_REFLINK),
+	defs.SYS_RESIZEFS:   bounds.Bounds(bounds.B_SYS_RESIZEFS),
 }
 
 // Implements Syscall_i
@@ -206,6 +236,12 @@ func (s *syscall_t) Syscall(p *proc.Proc_t, tid defs.Tid_t, tf *[defs.TFSIZE]uin
 		ret = sys_kill(p, a1, a2)
 	case defs.SYS_FCNTL:
 		ret = sys_fcntl(p, a1, a2, a3)
+	case defs.SYS_FLOCK:
+		ret = sys_flock(p, a1, a2)
+	case defs.SYS_FSYNC:
+		ret = sys_fsync(p, a1, false)
+	case defs.SYS_FDATASYNC:
+		ret = sys_fsync(p, a1, true)
 	case defs.SYS_TRUNC:
 		ret = sys_truncate(p, a1, uint(a2))
 	case defs.SYS_FTRUNC:
@@ -222,24 +258,72 @@ func (s *syscall_t) Syscall(p *proc.Proc_t, tid defs.Tid_t, tf *[defs.TFSIZE]uin
 		ret = sys_link(p, a1, a2)
 	case defs.SYS_UNLINK:
 		ret = sys_unlink(p, a1, a2)
+	case defs.SYS_SYMLINK:
+		ret = sys_symlink(p, a1, a2)
+	case defs.SYS_READLINK:
+		ret = sys_readlink(p, a1, a2, a3)
+	case defs.SYS_CHMOD:
+		ret = sys_chmod(p, a1, a2)
+	case defs.SYS_CHOWN:
+		ret = sys_chown(p, a1, a2, a3)
 	case defs.SYS_GETTOD:
 		ret = sys_gettimeofday(p, a1)
 	case defs.SYS_GETRLMT:
 		ret = sys_getrlimit(p, a1, a2)
 	case defs.SYS_GETRUSG:
 		ret = sys_getrusage(p, a1, a2)
+	case defs.SYS_GETUID:
+		ret = p.Cred().Uid
+	case defs.SYS_GETGID:
+		ret = p.Cred().Gid
+	case defs.SYS_SETUID:
+		ret = sys_setuid(p, a1)
+	case defs.SYS_SETGID:
+		ret = sys_setgid(p, a1)
+	case defs.SYS_GETEUID:
+		ret = p.Cred().Euid
+	case defs.SYS_GETEGID:
+		ret = p.Cred().Egid
+	case defs.SYS_GETGROUPS:
+		ret = sys_getgroups(p, a1, a2)
+	case defs.SYS_SETGROUPS:
+		ret = sys_setgroups(p, a1, a2)
 	case defs.SYS_MKNOD:
 		ret = sys_mknod(p, a1, a2, a3)
 	case defs.SYS_SETRLMT:
 		ret = sys_setrlimit(p, a1, a2)
 	case defs.SYS_SYNC:
 		ret = sys_sync(p)
+	case defs.SYS_MOUNT:
+		ret = sys_mount(p, a1, a2, a3, a4, a5)
+	case defs.SYS_UMOUNT2:
+		ret = sys_umount2(p, a1, a2)
 	case defs.SYS_REBOOT:
 		ret = sys_reboot(p)
+	case defs.SYS_SETXATTR:
+		ret = sys_setxattr(p, a1, a2, a3, a4, a5)
+	case defs.SYS_GETXATTR:
+		ret = sys_getxattr(p, a1, a2, a3, a4)
+	case defs.SYS_LISTXATTR:
+		ret = sys_listxattr(p, a1, a2, a3)
+	case defs.SYS_REMOVEXATTR:
+		ret = sys_removexattr(p, a1, a2)
+	case defs.SYS_GETDENTS64:
+		ret = sys_getdents64(p, a1, a2, a3)
 	case defs.SYS_NANOSLEEP:
 		ret = sys_nanosleep(p, a1, a2)
+	case defs.SYS_UTIMENSAT:
+		ret = sys_utimensat(p, a1, a2, a3, a4)
+	case defs.SYS_FALLOCATE:
+		ret = sys_fallocate(p, a1, a2, a3, a4)
+	case defs.SYS_INOTIFY_ADD_WATCH:
+		ret = sys_inotify_add_watch(p, a1, a2, a3)
+	case defs.SYS_INOTIFY_RM_WATCH:
+		ret = sys_inotify_rm_watch(p, a1, a2)
 	case defs.SYS_PIPE2:
 		ret = sys_pipe2(p, a1, a2)
+	case defs.SYS_INOTIFY_INIT1:
+		ret = sys_inotify_init1(p, a1)
 	case defs.SYS_PROF:
 		ret = sys_prof(p, a1, a2, a3, a4)
 	case defs.SYS_INFO:
@@ -254,6 +338,10 @@ func (s *syscall_t) Syscall(p *proc.Proc_t, tid defs.Tid_t, tf *[defs.TFSIZE]uin
 		ret = sys_futex(p, a1, a2, a3, a4, a5)
 	case defs.SYS_GETTID:
 		ret = sys_gettid(p, tid)
+	case defs.SYS_REFLINK:
+		ret = sys_reflink(p, a1, a2)
+	case defs.SYS_RESIZEFS:
+		ret = sys_resizefs(p, a1, a2)
 	default:
 		fmt.Printf("unexpected syscall %v\n", sysno)
 		s.Sys_exit(p, tid, defs.SIGNALED|defs.Mkexitsig(31))
@@ -341,6 +429,20 @@ func sys_read(p *proc.Proc_t, fdn int, bufp int, sz int) int {
 	return ret
 }
 
+func sys_getdents64(p *proc.Proc_t, fdn int, bufp int, sz int) int {
+	fd, err := _fd_read(p, fdn)
+	if err != 0 {
+		return int(err)
+	}
+	userbuf := p.Vm.Mkuserbuf(bufp, sz)
+
+	ret, err := fd.Fops.Getdents(userbuf)
+	if err != 0 {
+		return int(err)
+	}
+	return ret
+}
+
 func sys_write(p *proc.Proc_t, fdn int, bufp int, sz int) int {
 	if sz == 0 {
 		return 0
@@ -364,7 +466,8 @@ func sys_open(p *proc.Proc_t, pathn int, _flags int, mode int) int {
 	if err != 0 {
 		return int(err)
 	}
-	flags := defs.Fdopt_t(_flags)
+	// O_EXEC is for the kernel only
+	flags := defs.Fdopt_t(_flags) &^ defs.O_EXEC
 	temp := flags & (defs.O_RDONLY | defs.O_WRONLY | defs.O_RDWR)
 	if temp != defs.O_RDONLY && temp != defs.O_WRONLY && temp != defs.O_RDWR {
 		return int(-defs.EINVAL)
@@ -387,7 +490,7 @@ func sys_open(p *proc.Proc_t, pathn int, _flags int, mode int) int {
 	if err != 0 {
 		return int(err)
 	}
-	file, err := thefs.Fs_open(path, flags, mode, p.Cwd, 0, 0)
+	file, err := thevfs.Fs_open(path, flags, mode, p.Cwd, p.Cred(), 0, 0)
 	if err != 0 {
 		return int(err)
 	}
@@ -418,10 +521,25 @@ func (s *syscall_t) Sys_close(p *proc.Proc_t, fdn int) int {
 	if !ok {
 		return int(-defs.EBADF)
 	}
+	unlockrecs(p, fd)
 	ret := fd.Fops.Close()
 	return int(ret)
 }
 
+// releases p's record locks on the file of f, which p is closing. closing any
+// fd of a file releases them.
+func unlockrecs(p *proc.Proc_t, f *fd.Fd_t) {
+	p.Fdl.Lock()
+	reclocks := p.Reclocks
+	p.Fdl.Unlock()
+	if !reclocks {
+		return
+	}
+	if ls, err := f.Fops.Locks(); err == 0 {
+		ls.Close(p.Pid)
+	}
+}
+
 func sys_mmap(p *proc.Proc_t, addrn, lenn, protflags, fdn, offset int) int {
 	if lenn == 0 {
 		return int(-defs.EINVAL)
@@ -468,6 +586,10 @@ func sys_mmap(p *proc.Proc_t, addrn, lenn, protflags, fdn, offset int) int {
 				f.Perms&fd.FD_WRITE == 0) {
 			return int(-defs.EACCES)
 		}
+		// shared mappings pin pages of the file's file system
+		if _, ok := f.Fops.(mem.Unpin_i); shared && !ok {
+			return int(-defs.ENODEV)
+		}
 	}
 
 	p.Vm.Lock_pmap()
@@ -501,7 +623,7 @@ func sys_mmap(p *proc.Proc_t, addrn, lenn, protflags, fdn, offset int) int {
 		// vmadd_*file will increase the open count on the file
 		if shared {
 			p.Vm.Vmadd_sharefile(addr, lenn, perms, fops, offset,
-				thefs)
+				fops.(mem.Unpin_i))
 		} else {
 			p.Vm.Vmadd_file(addr, lenn, perms, fops, offset)
 		}
@@ -628,21 +750,12 @@ func sys_access(p *proc.Proc_t, pathn, mode int) int {
 		return int(-defs.EINVAL)
 	}
 
-	fsf, err := thefs.Fs_open_inner(path, defs.O_RDONLY, 0, p.Cwd, 0, 0)
-	if err != 0 {
-		return int(err)
+	if mode&^(defs.R_OK|defs.W_OK|defs.X_OK) != 0 {
+		return int(-defs.EINVAL)
 	}
 
-	// XXX no permissions yet
-	//R_OK := 1 << 0
-	//W_OK := 1 << 1
-	//X_OK := 1 << 2
-	ret := 0
-
-	if thefs.Fs_close(fsf.Inum) != 0 {
-		panic("must succeed")
-	}
-	return ret
+	// access(2) checks the real ids, not the effective ids
+	return int(thevfs.Fs_access(path, mode, p.Cwd, p.Cred().Realcred()))
 }
 
 func sys_dup2(p *proc.Proc_t, oldn, newn int) int {
@@ -654,6 +767,7 @@ func sys_dup2(p *proc.Proc_t, oldn, newn int) int {
 		return int(err)
 	}
 	if needclose {
+		unlockrecs(p, ofd)
 		fd.Close_panic(ofd)
 	}
 	return newn
@@ -665,7 +779,7 @@ func sys_stat(p *proc.Proc_t, pathn, statn int) int {
 		return int(err)
 	}
 	buf := &stat.Stat_t{}
-	err = thefs.Fs_stat(path, buf, p.Cwd)
+	err = thevfs.Fs_stat(path, buf, p.Cwd, p.Cred())
 	if err != 0 {
 		return int(err)
 	}
@@ -894,6 +1008,76 @@ bail:
 	return int(err)
 }
 
+func sys_inotify_init1(p *proc.Proc_t, _flags int) int {
+	flags := defs.Fdopt_t(_flags)
+	if flags&^(defs.IN_NONBLOCK|defs.IN_CLOEXEC) != 0 {
+		return int(-defs.EINVAL)
+	}
+	perms := fd.FD_READ
+	if flags&defs.IN_CLOEXEC != 0 {
+		perms |= fd.FD_CLOEXEC
+	}
+	in := inotify.MkInotify(flags & defs.O_NONBLOCK)
+	f := &fd.Fd_t{Fops: in}
+	fdn, ok := p.Fd_insert(f, perms)
+	if !ok {
+		fd.Close_panic(f)
+		return int(-defs.EMFILE)
+	}
+	return fdn
+}
+
+func inotifyfd(p *proc.Proc_t, fdn int) (*inotify.Inotify_t, defs.Err_t) {
+	f, ok := p.Fd_get(fdn)
+	if !ok {
+		return nil, -defs.EBADF
+	}
+	in, ok := f.Fops.(*inotify.Inotify_t)
+	if !ok {
+		return nil, -defs.EINVAL
+	}
+	return in, 0
+}
+
+func sys_inotify_add_watch(p *proc.Proc_t, fdn, pathn, mask int) int {
+	in, err := inotifyfd(p, fdn)
+	if err != 0 {
+		return int(err)
+	}
+	if mask&defs.IN_ALL_EVENTS == 0 ||
+		mask&^(defs.IN_ALL_EVENTS|defs.IN_ONLYDIR|defs.IN_MASK_ADD) != 0 {
+		return int(-defs.EINVAL)
+	}
+	path, err := p.Vm.Userstr(pathn, fs.NAME_MAX)
+	if err != 0 {
+		return int(err)
+	}
+	// watching requires read permission, like linux
+	if err := thevfs.Fs_access(path, defs.R_OK, p.Cwd, p.Cred()); err != 0 {
+		return int(err)
+	}
+	st := &stat.Stat_t{}
+	if err := thevfs.Fs_stat(path, st, p.Cwd, p.Cred()); err != 0 {
+		return int(err)
+	}
+	if mask&defs.IN_ONLYDIR != 0 && st.Mode()>>16 != fs.I_DIR {
+		return int(-defs.ENOTDIR)
+	}
+	wd, err := in.Addwatch(st.Dev(), defs.Inum_t(st.Rino()), mask)
+	if err != 0 {
+		return int(err)
+	}
+	return wd
+}
+
+func sys_inotify_rm_watch(p *proc.Proc_t, fdn, wd int) int {
+	in, err := inotifyfd(p, fdn)
+	if err != 0 {
+		return int(err)
+	}
+	return int(in.Rmwatch(wd))
+}
+
 type pipe_t struct {
 	sync.Mutex
 	cbuf    circbuf.Circbuf_t
@@ -1146,6 +1330,18 @@ func (of *pipefops_t) Truncate(uint) defs.Err_t {
 	return -defs.EINVAL
 }
 
+func (of *pipefops_t) Fallocate(int, int, int) defs.Err_t {
+	return -defs.ESPIPE
+}
+
+func (of *pipefops_t) Fsync(bool) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (of *pipefops_t) Locks() (*flock.Locks_t, defs.Err_t) {
+	return nil, -defs.EINVAL
+}
+
 func (of *pipefops_t) Pread(fdops.Userio_i, int) (int, defs.Err_t) {
 	return 0, -defs.ESPIPE
 }
@@ -1154,6 +1350,10 @@ func (of *pipefops_t) Pwrite(fdops.Userio_i, int) (int, defs.Err_t) {
 	return 0, -defs.ESPIPE
 }
 
+func (of *pipefops_t) Getdents(fdops.Userio_i) (int, defs.Err_t) {
+	return 0, -defs.ENOTDIR
+}
+
 func (of *pipefops_t) Accept(fdops.Userio_i) (fdops.Fdops_i, int, defs.Err_t) {
 	return nil, 0, -defs.ENOTSOCK
 }
@@ -1230,7 +1430,7 @@ func sys_rename(p *proc.Proc_t, oldn int, newn int) int {
 	if err2 != 0 {
 		return int(err2)
 	}
-	err := thefs.Fs_rename(old, new, p.Cwd)
+	err := thevfs.Fs_rename(old, new, p.Cwd, p.Cred())
 	return int(err)
 }
 
@@ -1243,7 +1443,7 @@ func sys_mkdir(p *proc.Proc_t, pathn int, mode int) int {
 	if err != 0 {
 		return int(err)
 	}
-	err = thefs.Fs_mkdir(path, mode, p.Cwd)
+	err = thevfs.Fs_mkdir(path, mode, p.Cwd, p.Cred())
 	return int(err)
 }
 
@@ -1264,7 +1464,28 @@ func sys_link(p *proc.Proc_t, oldn int, newn int) int {
 	if err2 != 0 {
 		return int(err2)
 	}
-	err := thefs.Fs_link(old, new, p.Cwd)
+	err := thevfs.Fs_link(old, new, p.Cwd, p.Cred())
+	return int(err)
+}
+
+func sys_reflink(p *proc.Proc_t, srcn int, dstn int) int {
+	src, err1 := p.Vm.Userstr(srcn, fs.NAME_MAX)
+	dst, err2 := p.Vm.Userstr(dstn, fs.NAME_MAX)
+	if err1 != 0 {
+		return int(err1)
+	}
+	if err2 != 0 {
+		return int(err2)
+	}
+	err1 = badpath(src)
+	err2 = badpath(dst)
+	if err1 != 0 {
+		return int(err1)
+	}
+	if err2 != 0 {
+		return int(err2)
+	}
+	err := thevfs.Fs_reflink(src, dst, p.Cwd, p.Cred())
 	return int(err)
 }
 
@@ -1278,7 +1499,231 @@ func sys_unlink(p *proc.Proc_t, pathn, isdiri int) int {
 		return int(err)
 	}
 	wantdir := isdiri != 0
-	err = thefs.Fs_unlink(path, p.Cwd, wantdir)
+	err = thevfs.Fs_unlink(path, p.Cwd, p.Cred(), wantdir)
+	return int(err)
+}
+
+func sys_symlink(p *proc.Proc_t, targetn, pathn int) int {
+	target, err1 := p.Vm.Userstr(targetn, fs.NAME_MAX)
+	path, err2 := p.Vm.Userstr(pathn, fs.NAME_MAX)
+	if err1 != 0 {
+		return int(err1)
+	}
+	if err2 != 0 {
+		return int(err2)
+	}
+	err1 = badpath(target)
+	err2 = badpath(path)
+	if err1 != 0 {
+		return int(err1)
+	}
+	if err2 != 0 {
+		return int(err2)
+	}
+	err := thevfs.Fs_symlink(target, path, p.Cwd, p.Cred())
+	return int(err)
+}
+
+func sys_readlink(p *proc.Proc_t, pathn, bufn, sz int) int {
+	path, err := p.Vm.Userstr(pathn, fs.NAME_MAX)
+	if err != 0 {
+		return int(err)
+	}
+	err = badpath(path)
+	if err != 0 {
+		return int(err)
+	}
+	if sz <= 0 {
+		return int(-defs.EINVAL)
+	}
+	target, err := thevfs.Fs_readlink(path, p.Cwd, p.Cred())
+	if err != 0 {
+		return int(err)
+	}
+	// the target is silently truncated and not NUL terminated
+	dst := p.Vm.Mkuserbuf(bufn, sz)
+	ret, err := dst.Uiowrite([]uint8(target))
+	if err != 0 {
+		return int(err)
+	}
+	return ret
+}
+
+func sys_chmod(p *proc.Proc_t, pathn, mode int) int {
+	path, err := p.Vm.Userstr(pathn, fs.NAME_MAX)
+	if err != 0 {
+		return int(err)
+	}
+	err = badpath(path)
+	if err != 0 {
+		return int(err)
+	}
+	err = thevfs.Fs_chmod(path, mode, p.Cwd, p.Cred())
+	return int(err)
+}
+
+func sys_chown(p *proc.Proc_t, pathn, uid, gid int) int {
+	path, err := p.Vm.Userstr(pathn, fs.NAME_MAX)
+	if err != 0 {
+		return int(err)
+	}
+	err = badpath(path)
+	if err != 0 {
+		return int(err)
+	}
+	// ids are 32 bits; -1 leaves the id unchanged
+	if uid < -1 || uid > 0xffffffff || gid < -1 || gid > 0xffffffff {
+		return int(-defs.EINVAL)
+	}
+	err = thevfs.Fs_chown(path, uid, gid, p.Cwd, p.Cred())
+	return int(err)
+}
+
+func sys_utimensat(p *proc.Proc_t, dirfd, pathn, timesn, flags int) int {
+	// XXX only paths relative to the cwd are supported
+	if dirfd != defs.AT_FDCWD {
+		return int(-defs.EINVAL)
+	}
+	if flags&^defs.AT_SYMLINK_NOFOLLOW != 0 {
+		return int(-defs.EINVAL)
+	}
+	path, err := p.Vm.Userstr(pathn, fs.NAME_MAX)
+	if err != 0 {
+		return int(err)
+	}
+	err = badpath(path)
+	if err != 0 {
+		return int(err)
+	}
+	now := int(time.Now().UnixNano())
+	atime, mtime := now, now
+	if timesn != 0 {
+		atime, err = _utimespec(p, timesn, now)
+		if err != 0 {
+			return int(err)
+		}
+		mtime, err = _utimespec(p, timesn+16, now)
+		if err != 0 {
+			return int(err)
+		}
+	}
+	follow := flags&defs.AT_SYMLINK_NOFOLLOW == 0
+	err = thevfs.Fs_utimens(path, atime, mtime, follow, p.Cwd, p.Cred())
+	return int(err)
+}
+
+// reads the timespec at va and returns it in nanoseconds. returns now for
+// UTIME_NOW and -1 for UTIME_OMIT.
+func _utimespec(p *proc.Proc_t, va, now int) (int, defs.Err_t) {
+	secs, err := p.Vm.Userreadn(va, 8)
+	if err != 0 {
+		return 0, err
+	}
+	nsecs, err := p.Vm.Userreadn(va+8, 8)
+	if err != 0 {
+		return 0, err
+	}
+	switch nsecs {
+	case defs.UTIME_NOW:
+		return now, 0
+	case defs.UTIME_OMIT:
+		return -1, 0
+	}
+	if secs < 0 || nsecs < 0 || nsecs >= 1e9 {
+		return 0, -defs.EINVAL
+	}
+	return secs*1e9 + nsecs, 0
+}
+
+// copies in the path and the attribute name of an extended attribute system
+// call
+func _xattrargs(p *proc.Proc_t, pathn, namen int) (ustr.Ustr, ustr.Ustr, defs.Err_t) {
+	path, err := p.Vm.Userstr(pathn, fs.NAME_MAX)
+	if err != 0 {
+		return nil, nil, err
+	}
+	err = badpath(path)
+	if err != 0 {
+		return nil, nil, err
+	}
+	name, err := p.Vm.Userstr(namen, fs.XATTR_NAME_MAX+1)
+	if err == -defs.ENAMETOOLONG {
+		err = -defs.ERANGE
+	}
+	return path, name, err
+}
+
+// copies the value or list of an extended attribute system call out to the
+// user buffer at bufn of sz bytes. a size of 0 only returns the length.
+func _xattrout(p *proc.Proc_t, v []uint8, bufn, sz int) int {
+	if sz == 0 {
+		return len(v)
+	}
+	if len(v) > sz {
+		return int(-defs.ERANGE)
+	}
+	if err := p.Vm.K2user(v, bufn); err != 0 {
+		return int(err)
+	}
+	return len(v)
+}
+
+func sys_setxattr(p *proc.Proc_t, pathn, namen, valuen, sz, flags int) int {
+	path, name, err := _xattrargs(p, pathn, namen)
+	if err != 0 {
+		return int(err)
+	}
+	if sz < 0 || sz > fs.XATTR_SIZE_MAX {
+		return int(-defs.E2BIG)
+	}
+	value := make([]uint8, sz)
+	if err := p.Vm.User2k(value, valuen); err != 0 {
+		return int(err)
+	}
+	err = thevfs.Fs_setxattr(path, name, value, flags, p.Cwd, p.Cred())
+	return int(err)
+}
+
+func sys_getxattr(p *proc.Proc_t, pathn, namen, valuen, sz int) int {
+	path, name, err := _xattrargs(p, pathn, namen)
+	if err != 0 {
+		return int(err)
+	}
+	if sz < 0 {
+		return int(-defs.EINVAL)
+	}
+	value, err := thevfs.Fs_getxattr(path, name, p.Cwd, p.Cred())
+	if err != 0 {
+		return int(err)
+	}
+	return _xattrout(p, value, valuen, sz)
+}
+
+func sys_listxattr(p *proc.Proc_t, pathn, listn, sz int) int {
+	path, err := p.Vm.Userstr(pathn, fs.NAME_MAX)
+	if err != 0 {
+		return int(err)
+	}
+	err = badpath(path)
+	if err != 0 {
+		return int(err)
+	}
+	if sz < 0 {
+		return int(-defs.EINVAL)
+	}
+	names, err := thevfs.Fs_listxattr(path, p.Cwd, p.Cred())
+	if err != 0 {
+		return int(err)
+	}
+	return _xattrout(p, names, listn, sz)
+}
+
+func sys_removexattr(p *proc.Proc_t, pathn, namen int) int {
+	path, name, err := _xattrargs(p, pathn, namen)
+	if err != 0 {
+		return int(err)
+	}
+	err = thevfs.Fs_removexattr(path, name, p.Cwd, p.Cred())
 	return int(err)
 }
 
@@ -1379,18 +1824,77 @@ func sys_mknod(p *proc.Proc_t, pathn, moden, devn int) int {
 		return int(err)
 	}
 	maj, min := defs.Unmkdev(uint(devn))
-	fsf, err := thefs.Fs_open_inner(path, defs.O_CREAT, 0, p.Cwd, maj, min)
+	_, err = thevfs.Fs_mknod(path, defs.O_CREAT, moden&07777, p.Cwd, p.Cred(), maj, min)
+	return int(err)
+}
+
+func sys_sync(p *proc.Proc_t) int {
+	return int(thevfs.Fs_sync())
+}
+
+// grows the file system on which the path lives to end at disk block
+// nblocks
+func sys_resizefs(p *proc.Proc_t, pathn, nblocks int) int {
+	path, err := p.Vm.Userstr(pathn, fs.NAME_MAX)
 	if err != 0 {
 		return int(err)
 	}
-	if thefs.Fs_close(fsf.Inum) != 0 {
-		panic("must succeed")
+	err = badpath(path)
+	if err != 0 {
+		return int(err)
 	}
-	return 0
+	return int(thevfs.Fs_resize(path, nblocks, p.Cwd, p.Cred()))
 }
 
-func sys_sync(p *proc.Proc_t) int {
-	return int(thefs.Fs_sync())
+func sys_mount(p *proc.Proc_t, srcn, targetn, fstypen, flags, datan int) int {
+	var src, fstype, data ustr.Ustr
+	var err defs.Err_t
+	if srcn != 0 {
+		src, err = p.Vm.Userstr(srcn, fs.NAME_MAX)
+		if err != 0 {
+			return int(err)
+		}
+	}
+	target, err := p.Vm.Userstr(targetn, fs.NAME_MAX)
+	if err != 0 {
+		return int(err)
+	}
+	if fstypen != 0 {
+		fstype, err = p.Vm.Userstr(fstypen, fs.NAME_MAX)
+		if err != 0 {
+			return int(err)
+		}
+	}
+	if datan != 0 {
+		data, err = p.Vm.Userstr(datan, fs.NAME_MAX)
+		if err != 0 {
+			return int(err)
+		}
+	}
+	err = badpath(target)
+	if err != 0 {
+		return int(err)
+	}
+	return int(thevfs.Mount(src, target, fstype, flags, data, p.Cwd, p.Cred()))
+}
+
+func sys_umount2(p *proc.Proc_t, targetn, flags int) int {
+	target, err := p.Vm.Userstr(targetn, fs.NAME_MAX)
+	if err != 0 {
+		return int(err)
+	}
+	if flags != 0 {
+		return int(-defs.EINVAL)
+	}
+	return int(thevfs.Umount(target, p.Cwd, p.Cred()))
+}
+
+func sys_fsync(p *proc.Proc_t, fdn int, datasync bool) int {
+	f, ok := p.Fd_get(fdn)
+	if !ok {
+		return int(-defs.EBADF)
+	}
+	return int(f.Fops.Fsync(datasync))
 }
 
 func sys_reboot(p *proc.Proc_t) int {
@@ -1426,6 +1930,84 @@ func sys_nanosleep(p *proc.Proc_t, sleeptsn, remaintsn int) int {
 	}
 }
 
+// the superuser sets all user ids; others may only set the effective uid to
+// the real or saved uid.
+func sys_setuid(p *proc.Proc_t, uid int) int {
+	if uid < 0 || uid > 0xffffffff {
+		return int(-defs.EINVAL)
+	}
+	c := p.Cred()
+	nc := c.Copy()
+	if c.Isroot() {
+		nc.Uid, nc.Euid, nc.Suid = uid, uid, uid
+	} else if uid == c.Uid || uid == c.Suid {
+		nc.Euid = uid
+	} else {
+		return int(-defs.EPERM)
+	}
+	p.Setcred(nc)
+	return 0
+}
+
+func sys_setgid(p *proc.Proc_t, gid int) int {
+	if gid < 0 || gid > 0xffffffff {
+		return int(-defs.EINVAL)
+	}
+	c := p.Cred()
+	nc := c.Copy()
+	if c.Isroot() {
+		nc.Gid, nc.Egid, nc.Sgid = gid, gid, gid
+	} else if gid == c.Gid || gid == c.Sgid {
+		nc.Egid = gid
+	} else {
+		return int(-defs.EPERM)
+	}
+	p.Setcred(nc)
+	return 0
+}
+
+// group ids are 8 bytes in user space
+func sys_getgroups(p *proc.Proc_t, n, listn int) int {
+	groups := p.Cred().Groups
+	if n == 0 {
+		return len(groups)
+	}
+	if n < len(groups) {
+		return int(-defs.EINVAL)
+	}
+	for i, g := range groups {
+		if err := p.Vm.Userwriten(listn+8*i, 8, g); err != 0 {
+			return int(err)
+		}
+	}
+	return len(groups)
+}
+
+func sys_setgroups(p *proc.Proc_t, n, listn int) int {
+	c := p.Cred()
+	if !c.Isroot() {
+		return int(-defs.EPERM)
+	}
+	if n < 0 || n > proc.NGROUPS_MAX {
+		return int(-defs.EINVAL)
+	}
+	groups := make([]int, n)
+	for i := range groups {
+		g, err := p.Vm.Userreadn(listn+8*i, 8)
+		if err != 0 {
+			return int(err)
+		}
+		if g < 0 || g > 0xffffffff {
+			return int(-defs.EINVAL)
+		}
+		groups[i] = g
+	}
+	nc := c.Copy()
+	nc.Groups = groups
+	p.Setcred(nc)
+	return 0
+}
+
 func sys_getpid(p *proc.Proc_t, tid defs.Tid_t) int {
 	return p.Pid
 }
@@ -1904,7 +2486,8 @@ func (sf *sudfops_t) Close() defs.Err_t {
 }
 
 func (sf *sudfops_t) Fstat(s *stat.Stat_t) defs.Err_t {
-	panic("no imp")
+	s.Wmode(defs.Mkdev(defs.D_SUD, 0))
+	return 0
 }
 
 func (sf *sudfops_t) Mmapi(int, int, bool) ([]mem.Mmapinfo_t, defs.Err_t) {
@@ -1934,6 +2517,18 @@ func (sf *sudfops_t) Truncate(newlen uint) defs.Err_t {
 	return -defs.EINVAL
 }
 
+func (sf *sudfops_t) Fallocate(int, int, int) defs.Err_t {
+	return -defs.ENODEV
+}
+
+func (sf *sudfops_t) Fsync(bool) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (sf *sudfops_t) Locks() (*flock.Locks_t, defs.Err_t) {
+	return nil, -defs.EINVAL
+}
+
 func (sf *sudfops_t) Pread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
 	return 0, -defs.ESPIPE
 }
@@ -1942,6 +2537,10 @@ func (sf *sudfops_t) Pwrite(src fdops.Userio_i, offset int) (int, defs.Err_t) {
 	return 0, -defs.ESPIPE
 }
 
+func (sf *sudfops_t) Getdents(fdops.Userio_i) (int, defs.Err_t) {
+	return 0, -defs.ENOTDIR
+}
+
 func (sf *sudfops_t) Lseek(int, int) (int, defs.Err_t) {
 	return 0, -defs.ESPIPE
 }
@@ -1974,15 +2573,11 @@ func (sf *sudfops_t) Bind(sa []uint8) defs.Err_t {
 	path := ustr.MkUstrSlice(sa[poff:])
 	// try to create the specified file as a special device
 	bid := allbuds.bud_id_new()
-	fsf, err := thefs.Fs_open_inner(path, defs.O_CREAT|defs.O_EXCL, 0, proc.CurrentProc().Cwd, defs.D_SUD, int(bid))
+	inum, err := thevfs.Fs_mknod(path, defs.O_CREAT|defs.O_EXCL, 0777, proc.CurrentProc().Cwd, proc.CurrentProc().Cred(), defs.D_SUD, int(bid))
 	if err != 0 {
 		return err
 	}
-	inum := fsf.Inum
 	bud := allbuds.bud_new(bid, path, inum)
-	if thefs.Fs_close(fsf.Inum) != 0 {
-		panic("must succeed")
-	}
 	sf.bud = bud
 	sf.bound = true
 	return 0
@@ -2008,7 +2603,7 @@ func (sf *sudfops_t) Sendmsg(src fdops.Userio_i, sa []uint8,
 	st := &stat.Stat_t{}
 	path := ustr.MkUstrSlice(sa[poff:])
 
-	err := thefs.Fs_stat(path, st, proc.CurrentProc().Cwd)
+	err := thevfs.Fs_stat(path, st, proc.CurrentProc().Cwd, proc.CurrentProc().Cred())
 	if err != 0 {
 		return 0, err
 	}
@@ -2395,8 +2990,9 @@ func (sus *susfops_t) Close() defs.Err_t {
 	return err2
 }
 
-func (sus *susfops_t) Fstat(*stat.Stat_t) defs.Err_t {
-	panic("no imp")
+func (sus *susfops_t) Fstat(st *stat.Stat_t) defs.Err_t {
+	st.Wmode(defs.Mkdev(defs.D_SUS, 0))
+	return 0
 }
 
 func (sus *susfops_t) Lseek(int, int) (int, defs.Err_t) {
@@ -2440,6 +3036,18 @@ func (sus *susfops_t) Truncate(newlen uint) defs.Err_t {
 	return -defs.EINVAL
 }
 
+func (sus *susfops_t) Fallocate(int, int, int) defs.Err_t {
+	return -defs.ENODEV
+}
+
+func (sus *susfops_t) Fsync(bool) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (sus *susfops_t) Locks() (*flock.Locks_t, defs.Err_t) {
+	return nil, -defs.EINVAL
+}
+
 func (sus *susfops_t) Pread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
 	return 0, -defs.ESPIPE
 }
@@ -2448,6 +3056,10 @@ func (sus *susfops_t) Pwrite(src fdops.Userio_i, offset int) (int, defs.Err_t) {
 	return 0, -defs.ESPIPE
 }
 
+func (sus *susfops_t) Getdents(fdops.Userio_i) (int, defs.Err_t) {
+	return 0, -defs.ENOTDIR
+}
+
 func (sus *susfops_t) Accept(fdops.Userio_i) (fdops.Fdops_i, int, defs.Err_t) {
 	return nil, 0, -defs.EINVAL
 }
@@ -2464,13 +3076,10 @@ func (sus *susfops_t) Bind(saddr []uint8) defs.Err_t {
 	sid := susid_new()
 
 	// create special file
-	fsf, err := thefs.Fs_open_inner(path, defs.O_CREAT|defs.O_EXCL, 0, proc.CurrentProc().Cwd, defs.D_SUS, sid)
+	_, err := thevfs.Fs_mknod(path, defs.O_CREAT|defs.O_EXCL, 0777, proc.CurrentProc().Cwd, proc.CurrentProc().Cred(), defs.D_SUS, sid)
 	if err != 0 {
 		return err
 	}
-	if thefs.Fs_close(fsf.Inum) != 0 {
-		panic("must succeed")
-	}
 	sus.myaddr = path
 	sus.mysid = sid
 	sus.bound = true
@@ -2489,7 +3098,7 @@ func (sus *susfops_t) Connect(saddr []uint8) defs.Err_t {
 
 	// lookup sid
 	st := &stat.Stat_t{}
-	err := thefs.Fs_stat(path, st, proc.CurrentProc().Cwd)
+	err := thevfs.Fs_stat(path, st, proc.CurrentProc().Cwd, proc.CurrentProc().Cred())
 	if err != 0 {
 		return err
 	}
@@ -2932,8 +3541,9 @@ func (sf *suslfops_t) Close() defs.Err_t {
 	return sf.susl.susl_reopen(-1)
 }
 
-func (sf *suslfops_t) Fstat(*stat.Stat_t) defs.Err_t {
-	panic("no imp")
+func (sf *suslfops_t) Fstat(st *stat.Stat_t) defs.Err_t {
+	st.Wmode(defs.Mkdev(defs.D_SUS, 0))
+	return 0
 }
 
 func (sf *suslfops_t) Lseek(int, int) (int, defs.Err_t) {
@@ -2964,6 +3574,18 @@ func (sf *suslfops_t) Truncate(newlen uint) defs.Err_t {
 	return -defs.EINVAL
 }
 
+func (sf *suslfops_t) Fallocate(int, int, int) defs.Err_t {
+	return -defs.ENODEV
+}
+
+func (sf *suslfops_t) Fsync(bool) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (sf *suslfops_t) Locks() (*flock.Locks_t, defs.Err_t) {
+	return nil, -defs.EINVAL
+}
+
 func (sf *suslfops_t) Pread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
 	return 0, -defs.ESPIPE
 }
@@ -2972,6 +3594,10 @@ func (sf *suslfops_t) Pwrite(src fdops.Userio_i, offset int) (int, defs.Err_t) {
 	return 0, -defs.ESPIPE
 }
 
+func (sf *suslfops_t) Getdents(fdops.Userio_i) (int, defs.Err_t) {
+	return 0, -defs.ENOTDIR
+}
+
 func (sf *suslfops_t) Accept(fromsa fdops.Userio_i) (fdops.Fdops_i, int, defs.Err_t) {
 	// the connector has already taken syslimit.Socks (1 sock reservation
 	// counts for a connected pair of UNIX stream sockets).
@@ -3148,12 +3774,13 @@ func sys_fork(parent *proc.Proc_t, ptf *[defs.TFSIZE]uintptr, tforkp int, flags
 		// lock fd table for copying
 		parent.Fdl.Lock()
 		cwd := *parent.Cwd
-		child, ok = proc.Proc_new(parent.Name, &cwd, parent.Fds, sys)
+		child, ok = proc.Proc_new(parent.Name, &cwd, parent.Fds, parent.Cred(), sys)
 		parent.Fdl.Unlock()
 		if !ok {
 			lhits++
 			return int(-defs.ENOMEM)
 		}
+		child.Args = parent.Args
 
 		child.Vm.Pmap, child.Vm.P_pmap, ok = physmem.Pmap_new()
 		if !ok {
@@ -3303,13 +3930,21 @@ func sys_execv1(p *proc.Proc_t, tf *[defs.TFSIZE]uintptr, paths ustr.Ustr,
 		p.Vm.Vmregion = ovmreg
 	}
 
-	// load binary image -- get first block of file
-	file, err := thefs.Fs_open(paths, defs.O_RDONLY, 0, p.Cwd, 0, 0)
+	// load binary image -- get first block of file. executing a file only
+	// requires search permission on the directories in paths and execute
+	// permission, which an O_EXEC open checks instead of read permission.
+	// Fs_execperm checks the opened file again, for its set-user-ID bits.
+	file, err := thevfs.Fs_open(paths, defs.O_RDONLY|defs.O_EXEC, 0, p.Cwd, p.Cred(), 0, 0)
 	if err != 0 {
 		restore()
 		return int(err)
 	}
 	defer fd.Close_panic(file)
+	suid, sgid, err := thevfs.Fs_execperm(file, p.Cred())
+	if err != 0 {
+		restore()
+		return int(err)
+	}
 
 	hdata := make([]uint8, 512)
 	ub := &vm.Fakeubuf_t{}
@@ -3419,7 +4054,19 @@ func sys_execv1(p *proc.Proc_t, tf *[defs.TFSIZE]uintptr, paths ustr.Ustr,
 	tf[defs.TF_FSBASE] = uintptr(tls0addr)
 	p.Mmapi = mem.USERMIN
 	p.Name = paths
+	p.Args = args
 
+	// set-user-ID and set-group-ID; the saved ids become the effective
+	// ids.
+	nc := p.Cred().Copy()
+	if suid != -1 {
+		nc.Euid = suid
+	}
+	if sgid != -1 {
+		nc.Egid = sgid
+	}
+	nc.Suid, nc.Sgid = nc.Euid, nc.Egid
+	p.Setcred(nc)
 	return 0
 }
 
@@ -3945,9 +4592,119 @@ func sys_fcntl(p *proc.Proc_t, fdn, cmd, opt int) int {
 	// fd specific fcntl(2) ops
 	case defs.F_GETFL, defs.F_SETFL:
 		return f.Fops.Fcntl(cmd, opt)
+	case defs.F_GETLK, defs.F_SETLK, defs.F_SETLKW:
+		return fcntl_lock(p, f, cmd, opt)
+	default:
+		return int(-defs.EINVAL)
+	}
+}
+
+// implements the record lock commands of fcntl(2). flockn points to a struct
+// flock:
+//	short	l_type;
+//	short	l_whence;
+//	off_t	l_start;
+//	off_t	l_len;
+//	pid_t	l_pid;
+func fcntl_lock(p *proc.Proc_t, f *fd.Fd_t, cmd, flockn int) int {
+	ls, err := f.Fops.Locks()
+	if err != 0 {
+		return int(err)
+	}
+	var fl [32]uint8
+	if err := p.Vm.User2k(fl[:], flockn); err != 0 {
+		return int(err)
+	}
+	typ := util.Readn(fl[:], 2, 0)
+	whence := util.Readn(fl[:], 2, 2)
+	start := util.Readn(fl[:], 8, 8)
+	l := util.Readn(fl[:], 8, 16)
+	switch whence {
+	case defs.SEEK_SET:
+	case defs.SEEK_CUR:
+		off, err := f.Fops.Lseek(0, defs.SEEK_CUR)
+		if err != 0 {
+			return int(err)
+		}
+		start += off
+	case defs.SEEK_END:
+		st := &stat.Stat_t{}
+		if err := f.Fops.Fstat(st); err != 0 {
+			return int(err)
+		}
+		start += int(st.Size())
+	default:
+		return int(-defs.EINVAL)
+	}
+	// a length of zero locks through the end of the file and a negative
+	// length locks the bytes before start
+	end := flock.EOF
+	if l > 0 {
+		end = start + l
+	} else if l < 0 {
+		end = start
+		start += l
+	}
+	if start < 0 || end < start {
+		return int(-defs.EINVAL)
+	}
+
+	switch typ {
+	case defs.F_RDLCK:
+		if cmd != defs.F_GETLK && f.Perms&fd.FD_READ == 0 {
+			return int(-defs.EBADF)
+		}
+	case defs.F_WRLCK:
+		if cmd != defs.F_GETLK && f.Perms&fd.FD_WRITE == 0 {
+			return int(-defs.EBADF)
+		}
+	case defs.F_UNLCK:
+		if cmd == defs.F_GETLK {
+			return int(-defs.EINVAL)
+		}
+	default:
+		return int(-defs.EINVAL)
+	}
+
+	if cmd == defs.F_GETLK {
+		otyp, ostart, oend, opid := ls.Getlk(p.Pid, typ, start, end)
+		util.Writen(fl[:], 2, 0, otyp)
+		if otyp == defs.F_UNLCK {
+			return int(p.Vm.K2user(fl[:], flockn))
+		}
+		olen := oend - ostart
+		if oend == flock.EOF {
+			olen = 0
+		}
+		util.Writen(fl[:], 2, 2, defs.SEEK_SET)
+		util.Writen(fl[:], 8, 8, ostart)
+		util.Writen(fl[:], 8, 16, olen)
+		util.Writen(fl[:], 8, 24, opid)
+		return int(p.Vm.K2user(fl[:], flockn))
+	}
+
+	p.Fdl.Lock()
+	p.Reclocks = true
+	p.Fdl.Unlock()
+	return int(ls.Setlk(p.Pid, typ, start, end, cmd == defs.F_SETLKW))
+}
+
+func sys_flock(p *proc.Proc_t, fdn, op int) int {
+	f, ok := p.Fd_get(fdn)
+	if !ok {
+		return int(-defs.EBADF)
+	}
+	switch op &^ defs.LOCK_NB {
+	case defs.LOCK_SH, defs.LOCK_EX, defs.LOCK_UN:
 	default:
 		return int(-defs.EINVAL)
 	}
+	ls, err := f.Fops.Locks()
+	if err != 0 {
+		return int(err)
+	}
+	// the lock belongs to the open file, which dup(2) and fork(2) share
+	return int(ls.Flock(f.Fops, op))
 }
 
 func sys_truncate(p *proc.Proc_t, pathn int, newlen uint) int {
@@ -3958,7 +4715,7 @@ func sys_truncate(p *proc.Proc_t, pathn int, newlen uint) int {
 	if err := badpath(path); err != 0 {
 		return int(err)
 	}
-	f, err := thefs.Fs_open(path, defs.O_WRONLY, 0, p.Cwd, 0, 0)
+	f, err := thevfs.Fs_open(path, defs.O_WRONLY, 0, p.Cwd, p.Cred(), 0, 0)
 	if err != 0 {
 		return int(err)
 	}
@@ -3975,6 +4732,14 @@ func sys_ftruncate(p *proc.Proc_t, fdn int, newlen uint) int {
 	return int(fd.Fops.Truncate(newlen))
 }
 
+func sys_fallocate(p *proc.Proc_t, fdn, mode, offset, len int) int {
+	f, ok := p.Fd_get(fdn)
+	if !ok || f.Perms&fd.FD_WRITE == 0 {
+		return int(-defs.EBADF)
+	}
+	return int(f.Fops.Fallocate(mode, offset, len))
+}
+
 func sys_getcwd(p *proc.Proc_t, bufn, sz int) int {
 	dst := p.Vm.Mkuserbuf(bufn, sz)
 	_, err := dst.Uiowrite([]uint8(p.Cwd.Path))
@@ -4000,18 +4765,7 @@ func sys_chdir(p *proc.Proc_t, dirn int) int {
 	p.Cwd.Lock()
 	defer p.Cwd.Unlock()
 
-	newfd, err := thefs.Fs_open(path, defs.O_RDONLY|defs.O_DIRECTORY, 0, p.Cwd, 0, 0)
-	if err != 0 {
-		return int(err)
-	}
-	fd.Close_panic(p.Cwd.Fd)
-	p.Cwd.Fd = newfd
-	if path.IsAbsolute() {
-		p.Cwd.Path = bpath.Canonicalize(path)
-	} else {
-		p.Cwd.Path = p.Cwd.Canonicalpath(path)
-	}
-	return 0
+	return int(thevfs.Fs_chdir(path, p.Cwd, p.Cred()))
 }
 
 func badpath(path ustr.Ustr) defs.Err_t {
@@ -38,7 +38,26 @@ func copydata(src string, f *ufs.Ufs_t, dst string) {
 	}
 }
 
+// copies the host's permission bits and modification time of info to dst
+func setattrs(f *ufs.Ufs_t, dst string, info os.FileInfo) {
+	p := ustr.Ustr(dst)
+	if e := f.Chmod(p, int(info.Mode().Perm())); e != 0 {
+		fmt.Printf("failed to chmod %v\n", dst)
+	}
+	mtime := int(info.ModTime().UnixNano())
+	if e := f.Utimens(p, mtime, mtime); e != 0 {
+		fmt.Printf("failed to set times of %v\n", dst)
+	}
+}
+
 func addfiles(fs *ufs.Ufs_t, skeldir string) {
+	// a directory's mtime changes as entries are added, so set directory
+	// attributes after the walk
+	type dir_t struct {
+		p    string
+		info os.FileInfo
+	}
+	var dirs []dir_t
 	err := filepath.Walk(skeldir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			fmt.Printf("prevent panic by handling failure accessing a path %q: %v\n", skeldir, err)
@@ -53,6 +72,7 @@ func addfiles(fs *ufs.Ufs_t, skeldir string) {
 			if e != 0 {
 				fmt.Printf("failed to create dir %v\n", p)
 			}
+			dirs = append(dirs, dir_t{p, info})
 
 		} else {
 			e := fs.MkFile(ustr.Ustr(p), nil)
@@ -60,6 +80,7 @@ func addfiles(fs *ufs.Ufs_t, skeldir string) {
 				fmt.Printf("failed to create file %v\n", p)
 			}
 			copydata(path, fs, p)
+			setattrs(fs, p, info)
 		}
 		return nil
 	})
@@ -68,19 +89,39 @@ func addfiles(fs *ufs.Ufs_t, skeldir string) {
 		fmt.Printf("error walking the path %q: %v\n", skeldir, err)
 		os.Exit(1)
 	}
+	// children before parents
+	for i := len(dirs) - 1; i >= 0; i-- {
+		setattrs(fs, dirs[i].p, dirs[i].info)
+	}
 }
 
 func main() {
-	if len(os.Args) < 5 {
-		fmt.Printf("Usage: mkfs <bootimage> <kernel image> <output image> <skel dir>\n")
+	feat := 0
+	args := os.Args[1:]
+	for len(args) > 0 && (args[0] == "-e" || args[0] == "-j" || args[0] == "-x") {
+		switch args[0] {
+		case "-e":
+			// map file blocks with extents
+			feat |= fs.FEAT_EXTENTS
+		case "-j":
+			// journal the data of files
+			feat |= fs.FEAT_JOURNAL
+		default:
+			// give inodes room for extended attributes
+			feat |= fs.FEAT_XATTR
+		}
+		args = args[1:]
+	}
+	if len(args) < 4 {
+		fmt.Printf("Usage: mkfs [-e] [-j] [-x] <bootimage> <kernel image> <output image> <skel dir>\n")
 		os.Exit(1)
 	}
 
-	image := os.Args[3]
+	image := args[2]
 
-	imgs := []string{os.Args[1], os.Args[2]}
+	imgs := []string{args[0], args[1]}
 
-	ufs.MkDisk(image, imgs, nlogblks, ninodeblks, ndatablks)
+	ufs.MkDiskFeatures(image, imgs, nlogblks, ninodeblks, ndatablks, feat)
 
 	fs := ufs.BootFS(image)
 	_, err := fs.Stat(ustr.MkUstrRoot())
@@ -89,7 +130,7 @@ func main() {
 		os.Exit(1)
 	}
 
-	addfiles(fs, os.Args[4])
+	addfiles(fs, args[3])
 
 	// dir, err := fs.Ls("/")
 	// if err != 0 {
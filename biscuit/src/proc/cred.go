@@ -0,0 +1,110 @@
+package proc
+
+import "sync/atomic"
+import "unsafe"
+
+import "defs"
+
+// process credentials. a Cred_t is never modified once a process uses it;
+// set*id(2) install a modified copy instead, thus it is safe to read the
+// credentials of a running process without locks.
+type Cred_t struct {
+	// real, effective, and saved user/group ids
+	Uid  int
+	Euid int
+	Suid int
+	Gid  int
+	Egid int
+	Sgid int
+	// supplementary groups
+	Groups []int
+}
+
+// the credentials of init and of fs operations which should not be checked
+var Rootcred = &Cred_t{}
+
+// the maximum number of supplementary groups
+const NGROUPS_MAX = 32
+
+func (c *Cred_t) Copy() *Cred_t {
+	ret := &Cred_t{}
+	*ret = *c
+	ret.Groups = append([]int(nil), c.Groups...)
+	return ret
+}
+
+// returns true if gid is the effective or a supplementary group
+func (c *Cred_t) Ingroup(gid int) bool {
+	if c.Egid == gid {
+		return true
+	}
+	for _, g := range c.Groups {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// returns a copy of c whose effective ids are the real ids, used by
+// access(2).
+func (c *Cred_t) Realcred() *Cred_t {
+	ret := c.Copy()
+	ret.Euid = c.Uid
+	ret.Egid = c.Gid
+	return ret
+}
+
+func (c *Cred_t) Isroot() bool {
+	return c.Euid == 0
+}
+
+// returns 0 if c may access a file with permission bits mode, owned by uid and
+// gid, in the ways described by want, a mask of defs.R_OK, defs.W_OK, and
+// defs.X_OK. isdir tells whether the file is a directory.
+func (c *Cred_t) Access(mode, uid, gid int, isdir bool, want int) defs.Err_t {
+	if c.Isroot() {
+		// the superuser may execute a file only if some execute bit is
+		// set
+		if want&defs.X_OK != 0 && !isdir && mode&0111 == 0 {
+			return -defs.EACCES
+		}
+		return 0
+	}
+	var perm int
+	switch {
+	case c.Euid == uid:
+		perm = mode >> 6
+	case c.Ingroup(gid):
+		perm = mode >> 3
+	default:
+		perm = mode
+	}
+	// the permission bits are ordered rwx, the opposite of want
+	need := 0
+	if want&defs.R_OK != 0 {
+		need |= 4
+	}
+	if want&defs.W_OK != 0 {
+		need |= 2
+	}
+	if want&defs.X_OK != 0 {
+		need |= 1
+	}
+	if perm&need != need {
+		return -defs.EACCES
+	}
+	return 0
+}
+
+// returns the current credentials of p
+func (p *Proc_t) Cred() *Cred_t {
+	up := (*unsafe.Pointer)(unsafe.Pointer(&p.cred))
+	return (*Cred_t)(atomic.LoadPointer(up))
+}
+
+// installs nc as p's credentials. nc must not be modified afterwards.
+func (p *Proc_t) Setcred(nc *Cred_t) {
+	up := (*unsafe.Pointer)(unsafe.Pointer(&p.cred))
+	atomic.StorePointer(up, unsafe.Pointer(nc))
+}
@@ -53,19 +53,20 @@ outter:
 		// XXX expand kernel heap with free pages; page if none
 		// available
 
+		// evict a little at a time, until there is enough memory
 		last := 0
 		for {
 			a, b := o.evict()
+			o.gc()
+			if msg.Need < runtime.Remain() {
+				msg.Resume <- true
+				continue outter
+			}
 			if a+b == last || a+b < 1000 {
 				break
 			}
 			last = a + b
 		}
-		o.gc()
-		if msg.Need < runtime.Remain() {
-			msg.Resume <- true
-			continue outter
-		}
 		for {
 			// someone must die
 			o.dispatch_peasant(msg.Need)
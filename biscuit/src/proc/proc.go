@@ -9,6 +9,7 @@ import "accnt"
 import "bounds"
 import "defs"
 import "fd"
+import "flock"
 import "limits"
 import "mem"
 import "res"
@@ -29,6 +30,8 @@ type Proc_t struct {
 	// first thread id
 	tid0 defs.Tid_t
 	Name ustr.Ustr
+	// the arguments of the last exec
+	Args []ustr.Ustr
 
 	// waitinfo for my child processes
 	Mywait Wait_t
@@ -56,8 +59,13 @@ type Proc_t struct {
 	Fdl sync.Mutex
 	// number of valid file descriptors
 	nfds int
+	// set, with fdl held, once the process takes a record lock; closing
+	// an fd then releases the process's record locks on the fd's file
+	Reclocks bool
 
 	Cwd *fd.Cwd_t
+	// use Cred() and Setcred()
+	cred *Cred_t
 
 	Ulim Ulimit_t
 
@@ -619,6 +627,7 @@ func (p *Proc_t) terminate() {
 	}
 	p.Fdl.Unlock()
 	fd.Close_panic(p.Cwd.Fd)
+	flock.Exit(p.Pid)
 
 	p.Mywait.Pid = 1
 
@@ -673,6 +682,13 @@ func Proc_check(pid int) (*Proc_t, bool) {
 	return p, ok
 }
 
+// returns the number of threads of all processes
+func Nthreads() int {
+	Proclock.Lock()
+	defer Proclock.Unlock()
+	return int(nthreads)
+}
+
 func Proc_del(pid int) {
 	Proclock.Lock()
 	_, ok := Allprocs[pid]
@@ -695,8 +711,9 @@ var _deflimits = Ulimit_t{
 }
 
 // returns the new proc and success; can fail if the system-wide limit of
-// procs/threads has been reached. the parent's fdtable must be locked.
-func Proc_new(name ustr.Ustr, cwd *fd.Cwd_t, fds []*fd.Fd_t, sys Syscall_i) (*Proc_t, bool) {
+// procs/threads has been reached. the parent's fdtable must be locked. the new
+// proc shares cred, which must not be modified.
+func Proc_new(name ustr.Ustr, cwd *fd.Cwd_t, fds []*fd.Fd_t, cred *Cred_t, sys Syscall_i) (*Proc_t, bool) {
 	Proclock.Lock()
 
 	if nthreads >= int64(limits.Syslimit.Sysprocs) {
@@ -737,6 +754,7 @@ func Proc_new(name ustr.Ustr, cwd *fd.Cwd_t, fds []*fd.Fd_t, sys Syscall_i) (*Pr
 	if ret.Cwd.Fd.Fops.Reopen() != 0 {
 		panic("must succeed")
 	}
+	ret.cred = cred
 	ret.Mmapi = mem.USERMIN
 	ret.Ulim = _deflimits
 
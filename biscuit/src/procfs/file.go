@@ -0,0 +1,363 @@
+package procfs
+
+import "bytes"
+import "fmt"
+import "sync"
+import "sync/atomic"
+import "time"
+
+import "defs"
+import "fd"
+import "fdops"
+import "flock"
+import "mem"
+import "proc"
+import "stat"
+import "ustr"
+import "util"
+import "vm"
+
+// returns the contents of the file n, generated from the current state of the
+// system
+func (n pnode_t) contents(pgs Pgcount_i) ([]uint8, defs.Err_t) {
+	p, ok := n.proc()
+	if !ok {
+		return nil, -defs.ENOENT
+	}
+	var b bytes.Buffer
+	switch n.kind {
+	case kmemory:
+		free, pmaps := pgs.Pgcount()
+		kb := mem.PGSIZE >> 10
+		fmt.Fprintf(&b, "MemFree:\t%v kB\n", free*kb)
+		fmt.Fprintf(&b, "PageTables:\t%v kB\n", pmaps*kb)
+	case kuptime:
+		up := time.Since(boottime)
+		fmt.Fprintf(&b, "%d.%02d\n", up/time.Second,
+			up%time.Second/(10*time.Millisecond))
+	case kload:
+		// XXX there is no run queue, so only the number of processes
+		// and threads is known
+		proc.Proclock.Lock()
+		nprocs := len(proc.Allprocs)
+		proc.Proclock.Unlock()
+		fmt.Fprintf(&b, "Procs:\t%v\n", nprocs)
+		fmt.Fprintf(&b, "Threads:\t%v\n", proc.Nthreads())
+	case kstatus:
+		status(&b, p)
+	case kmaps:
+		maps(&b, p)
+	case kcmdline:
+		args := p.Args
+		if args == nil {
+			args = []ustr.Ustr{p.Name}
+		}
+		for _, a := range args {
+			b.Write(a)
+			b.WriteByte(0)
+		}
+	case kfd:
+		f, err := n.fd()
+		if err != 0 {
+			return nil, err
+		}
+		if off, err := f.Fops.Lseek(0, defs.SEEK_CUR); err == 0 {
+			fmt.Fprintf(&b, "pos:\t%v\n", off)
+		}
+		fl := ""
+		if f.Perms&fd.FD_READ != 0 {
+			fl += "r"
+		}
+		if f.Perms&fd.FD_WRITE != 0 {
+			fl += "w"
+		}
+		if f.Perms&fd.FD_CLOEXEC != 0 {
+			fl += ",cloexec"
+		}
+		fmt.Fprintf(&b, "flags:\t%v\n", fl)
+		// Pathi() panics for files that are not in a file system
+		st := &stat.Stat_t{}
+		if f.Fops.Fstat(st) == 0 {
+			fmt.Fprintf(&b, "mode:\t%o\n", st.Mode())
+			fmt.Fprintf(&b, "ino:\t%v\n", st.Rino())
+		}
+	default:
+		panic("not a file")
+	}
+	return b.Bytes(), 0
+}
+
+func status(b *bytes.Buffer, p *proc.Proc_t) {
+	state := "R (running)"
+	if p.Doomed() {
+		state = "K (killed)"
+	}
+	ppid := 0
+	if pw := p.Pwait; pw != nil {
+		ppid = pw.Pid
+	}
+	fmt.Fprintf(b, "Name:\t%s\n", p.Name)
+	fmt.Fprintf(b, "State:\t%v\n", state)
+	fmt.Fprintf(b, "Pid:\t%v\n", p.Pid)
+	fmt.Fprintf(b, "PPid:\t%v\n", ppid)
+	fmt.Fprintf(b, "Uid:\t%v\n", p.Cred().Euid)
+	fmt.Fprintf(b, "Threads:\t%v\n", p.Thread_count())
+	// nanoseconds of user and system time of the process and of its
+	// reaped children
+	fmt.Fprintf(b, "Userns:\t%v\n", atomic.LoadInt64(&p.Atime.Userns))
+	fmt.Fprintf(b, "Sysns:\t%v\n", atomic.LoadInt64(&p.Atime.Sysns))
+	p.Catime.Lock()
+	fmt.Fprintf(b, "Cuserns:\t%v\n", p.Catime.Userns)
+	fmt.Fprintf(b, "Csysns:\t%v\n", p.Catime.Sysns)
+	p.Catime.Unlock()
+}
+
+// one line per mapping: the address range, the permissions, the file offset,
+// and the inode number of the mapped file
+func maps(b *bytes.Buffer, p *proc.Proc_t) {
+	p.Vm.Lock_pmap()
+	defer p.Vm.Unlock_pmap()
+	p.Vm.Vmregion.Iter(func(vmi *vm.Vminfo_t) {
+		start := vmi.Pgn << vm.PGSHIFT
+		end := (vmi.Pgn + uintptr(vmi.Pglen)) << vm.PGSHIFT
+		perms := []uint8("---p")
+		// user pages are readable and executable
+		if vmi.Perms&uint(vm.PTE_U) != 0 {
+			perms[0], perms[2] = 'r', 'x'
+		}
+		if vmi.Perms&uint(vm.PTE_W) != 0 {
+			perms[1] = 'w'
+		}
+		foff, inum, shared := vmi.Fileinfo()
+		if shared {
+			perms[3] = 's'
+		}
+		fmt.Fprintf(b, "%016x-%016x %s %08x %v\n", start, end, perms,
+			foff, inum)
+	})
+}
+
+// returns the open file of a kfd node
+func (n pnode_t) fd() (*fd.Fd_t, defs.Err_t) {
+	p, ok := n.proc()
+	if !ok {
+		return nil, -defs.ENOENT
+	}
+	p.Fdl.Lock()
+	defer p.Fdl.Unlock()
+	if n.fdn >= len(p.Fds) || p.Fds[n.fdn] == nil {
+		return nil, -defs.ENOENT
+	}
+	return p.Fds[n.fdn], 0
+}
+
+type pfops_t struct {
+	pfs *Procfs_t
+	n   pnode_t
+	// the contents of a file as of the open
+	data []uint8
+	sync.Mutex
+	offset int
+	count  int
+}
+
+func (fo *pfops_t) Read(dst fdops.Userio_i) (int, defs.Err_t) {
+	fo.Lock()
+	defer fo.Unlock()
+	did, err := fo._pread(dst, fo.offset)
+	fo.offset += did
+	return did, err
+}
+
+func (fo *pfops_t) Pread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
+	fo.Lock()
+	defer fo.Unlock()
+	return fo._pread(dst, offset)
+}
+
+// caller holds fo's lock
+func (fo *pfops_t) _pread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
+	if fo.count <= 0 {
+		return 0, -defs.EBADF
+	}
+	if fo.n.isdir() {
+		return 0, -defs.EISDIR
+	}
+	if offset < 0 {
+		return 0, -defs.EINVAL
+	}
+	if offset >= len(fo.data) {
+		return 0, 0
+	}
+	return dst.Uiowrite(fo.data[offset:])
+}
+
+func (fo *pfops_t) Write(fdops.Userio_i) (int, defs.Err_t) {
+	return 0, -defs.EBADF
+}
+
+func (fo *pfops_t) Pwrite(fdops.Userio_i, int) (int, defs.Err_t) {
+	return 0, -defs.EBADF
+}
+
+func (fo *pfops_t) Truncate(newlen uint) defs.Err_t {
+	return -defs.EROFS
+}
+
+func (fo *pfops_t) Fallocate(mode, offset, len int) defs.Err_t {
+	return -defs.EROFS
+}
+
+func (fo *pfops_t) Fsync(datasync bool) defs.Err_t {
+	return 0
+}
+
+func (fo *pfops_t) Locks() (*flock.Locks_t, defs.Err_t) {
+	return nil, -defs.EINVAL
+}
+
+func (fo *pfops_t) Getdents(dst fdops.Userio_i) (int, defs.Err_t) {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return 0, -defs.EBADF
+	}
+	if !fo.n.isdir() {
+		return 0, -defs.ENOTDIR
+	}
+	if fo.offset < 0 {
+		return 0, -defs.EINVAL
+	}
+	ents, err := fo.n.entries()
+	if err != 0 {
+		return 0, err
+	}
+	did := 0
+	for _, e := range ents {
+		if e.off < fo.offset {
+			continue
+		}
+		if util.Direntlen(e.name) > dst.Remain() {
+			if did == 0 {
+				return 0, -defs.EINVAL
+			}
+			break
+		}
+		rec := util.Dirent(int(e.n.inum()), e.off+1, e.n.dtype(), e.name)
+		if _, err := dst.Uiowrite(rec); err != 0 {
+			return did, err
+		}
+		did += len(rec)
+		fo.offset = e.off + 1
+	}
+	return did, 0
+}
+
+func (fo *pfops_t) Fstat(st *stat.Stat_t) defs.Err_t {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return -defs.EBADF
+	}
+	return fo.n.stat(st, fo.pfs.dev, fo.pfs.pgs)
+}
+
+func (fo *pfops_t) Close() defs.Err_t {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return -defs.EBADF
+	}
+	fo.count--
+	atomic.AddInt64(&fo.pfs.nopen, -1)
+	return 0
+}
+
+func (fo *pfops_t) Pathi() defs.Inum_t {
+	return fo.n.inum()
+}
+
+func (fo *pfops_t) Reopen() defs.Err_t {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return -defs.EBADF
+	}
+	fo.count++
+	atomic.AddInt64(&fo.pfs.nopen, 1)
+	return 0
+}
+
+func (fo *pfops_t) Lseek(off, whence int) (int, defs.Err_t) {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return 0, -defs.EBADF
+	}
+
+	switch whence {
+	case defs.SEEK_SET:
+		fo.offset = off
+	case defs.SEEK_CUR:
+		fo.offset += off
+	case defs.SEEK_END:
+		fo.offset = len(fo.data) + off
+	default:
+		return 0, -defs.EINVAL
+	}
+	if fo.offset < 0 {
+		fo.offset = 0
+	}
+	return fo.offset, 0
+}
+
+func (fo *pfops_t) Mmapi(offset, len int, inc bool) ([]mem.Mmapinfo_t, defs.Err_t) {
+	return nil, -defs.ENODEV
+}
+
+func (fo *pfops_t) Accept(fdops.Userio_i) (fdops.Fdops_i, int, defs.Err_t) {
+	return nil, 0, -defs.ENOTSOCK
+}
+
+func (fo *pfops_t) Bind([]uint8) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (fo *pfops_t) Connect(sabuf []uint8) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (fo *pfops_t) Listen(int) (fdops.Fdops_i, defs.Err_t) {
+	return nil, -defs.ENOTSOCK
+}
+
+func (fo *pfops_t) Sendmsg(fdops.Userio_i, []uint8, []uint8,
+	int) (int, defs.Err_t) {
+	return 0, -defs.ENOTSOCK
+}
+
+func (fo *pfops_t) Recvmsg(fdops.Userio_i,
+	fdops.Userio_i, fdops.Userio_i, int) (int, int, int, defs.Msgfl_t, defs.Err_t) {
+	return 0, 0, 0, 0, -defs.ENOTSOCK
+}
+
+func (fo *pfops_t) Pollone(pm fdops.Pollmsg_t) (fdops.Ready_t, defs.Err_t) {
+	return pm.Events & fdops.R_READ, 0
+}
+
+func (fo *pfops_t) Fcntl(cmd, opt int) int {
+	return int(-defs.ENOSYS)
+}
+
+func (fo *pfops_t) Getsockopt(opt int, bufarg fdops.Userio_i,
+	intarg int) (int, defs.Err_t) {
+	return 0, -defs.ENOTSOCK
+}
+
+func (fo *pfops_t) Setsockopt(int, int, fdops.Userio_i, int) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (fo *pfops_t) Shutdown(read, write bool) defs.Err_t {
+	return -defs.ENOTSOCK
+}
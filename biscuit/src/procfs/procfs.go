@@ -0,0 +1,433 @@
+package procfs
+
+import "sort"
+import "strconv"
+import "sync/atomic"
+import "time"
+
+import "bpath"
+import "defs"
+import "fd"
+import "fs"
+import "proc"
+import "stat"
+import "ustr"
+import "vfs"
+
+// procfs is a read-only file system that describes the processes in
+// proc.Allprocs and the state of the system:
+//
+//	memory, uptime, load
+//	<pid>/status, <pid>/maps, <pid>/cmdline, <pid>/cwd, <pid>/fd/<n>
+//
+// nothing is stored; the contents of a file are generated when it is opened
+// or stat'ed.
+
+// Pgcount_i reports the number of free physical pages and the number of pages
+// used by page tables, like mem.Physmem.
+type Pgcount_i interface {
+	Pgcount() (int, int)
+}
+
+// the kinds of procfs nodes
+type kind_t int
+
+const (
+	kroot kind_t = iota + 1
+	kmemory
+	kuptime
+	kload
+	kpid
+	kstatus
+	kmaps
+	kcmdline
+	kcwd
+	kfddir
+	kfd
+)
+
+// a node is named by its kind, the process it describes, and, for the files in
+// fd/, the fd number. nodes are values; a node whose process has exited no
+// longer exists.
+type pnode_t struct {
+	kind kind_t
+	pid  int
+	fdn  int
+}
+
+type pname_t struct {
+	name string
+	kind kind_t
+}
+
+// the files of the root directory besides the process directories
+var globals = []pname_t{{"memory", kmemory}, {"uptime", kuptime},
+	{"load", kload}}
+
+// the files of a process directory
+var pidfiles = []pname_t{{"status", kstatus}, {"maps", kmaps},
+	{"cmdline", kcmdline}, {"cwd", kcwd}, {"fd", kfddir}}
+
+// when the system booted, for uptime
+var boottime = time.Now()
+
+type Procfs_t struct {
+	pgs Pgcount_i
+	dev uint
+	// the number of open files, including cwds; updated atomically
+	nopen int64
+}
+
+func MkProcfs(pgs Pgcount_i) *Procfs_t {
+	return &Procfs_t{pgs: pgs, dev: vfs.Newdev()}
+}
+
+func (n pnode_t) isdir() bool {
+	return n.kind == kroot || n.kind == kpid || n.kind == kfddir
+}
+
+// inode numbers are made from the kind, pid and fd number
+func (n pnode_t) inum() defs.Inum_t {
+	return defs.Inum_t(n.pid<<32 | n.fdn<<8 | int(n.kind))
+}
+
+func (n pnode_t) parent() pnode_t {
+	switch n.kind {
+	case kstatus, kmaps, kcmdline, kcwd, kfddir:
+		return pnode_t{kind: kpid, pid: n.pid}
+	case kfd:
+		return pnode_t{kind: kfddir, pid: n.pid}
+	}
+	return pnode_t{kind: kroot}
+}
+
+// returns the process described by n, or false if it has exited
+func (n pnode_t) proc() (*proc.Proc_t, bool) {
+	if n.pid == 0 {
+		return nil, true
+	}
+	return proc.Proc_check(n.pid)
+}
+
+// parses the name of a process directory or an fd file. the name must be
+// canonical so that every node has a single name.
+func atoi(name ustr.Ustr) (int, bool) {
+	v, err := strconv.Atoi(string(name))
+	if err != nil || v < 0 || strconv.Itoa(v) != string(name) {
+		return 0, false
+	}
+	return v, true
+}
+
+func (dir pnode_t) lookup(name ustr.Ustr) (pnode_t, defs.Err_t) {
+	if !dir.isdir() {
+		return dir, -defs.ENOTDIR
+	}
+	if name.Isdot() {
+		return dir, 0
+	} else if name.Isdotdot() {
+		return dir.parent(), 0
+	}
+	var names []pname_t
+	switch dir.kind {
+	case kroot:
+		if pid, ok := atoi(name); ok {
+			if _, ok := proc.Proc_check(pid); ok {
+				return pnode_t{kind: kpid, pid: pid}, 0
+			}
+		}
+		names = globals
+	case kpid:
+		names = pidfiles
+	case kfddir:
+		fdn, ok := atoi(name)
+		if !ok {
+			return dir, -defs.ENOENT
+		}
+		n := pnode_t{kind: kfd, pid: dir.pid, fdn: fdn}
+		if _, err := n.fd(); err != 0 {
+			return dir, err
+		}
+		return n, 0
+	}
+	for _, pn := range names {
+		if name.Eq(ustr.Ustr(pn.name)) {
+			return pnode_t{kind: pn.kind, pid: dir.pid}, 0
+		}
+	}
+	return dir, -defs.ENOENT
+}
+
+// resolves paths. the only symlinks, cwd, lead out of procfs and are never
+// followed; a path through one fails.
+func (pfs *Procfs_t) namei(paths ustr.Ustr, cwd *fd.Cwd_t) (pnode_t, defs.Err_t) {
+	n := pnode_t{kind: kroot}
+	if !paths.IsAbsolute() {
+		n = cwd.Fd.Fops.(*pfops_t).n
+	}
+	if _, ok := n.proc(); !ok {
+		return n, -defs.ENOENT
+	}
+	var pp bpath.Pathparts_t
+	pp.Pp_init(paths)
+	for cp, ok := pp.Next(); ok; cp, ok = pp.Next() {
+		var err defs.Err_t
+		if n, err = n.lookup(cp); err != 0 {
+			return n, err
+		}
+	}
+	return n, 0
+}
+
+// a directory entry; entries are sorted by offset
+type pdent_t struct {
+	name ustr.Ustr
+	n    pnode_t
+	off  int
+}
+
+// returns the entries of dir. the offset of a process directory or fd file is
+// derived from its pid or fd number so that a directory can be read
+// consistently while processes come and go.
+func (dir pnode_t) entries() ([]pdent_t, defs.Err_t) {
+	p, ok := dir.proc()
+	if !ok {
+		return nil, -defs.ENOENT
+	}
+	ret := []pdent_t{{ustr.MkUstrDot(), dir, 0},
+		{ustr.DotDot, dir.parent(), 1}}
+	add := func(names []pname_t) {
+		for _, pn := range names {
+			n := pnode_t{kind: pn.kind, pid: dir.pid}
+			ret = append(ret, pdent_t{ustr.Ustr(pn.name), n, len(ret)})
+		}
+	}
+	switch dir.kind {
+	case kroot:
+		add(globals)
+		first := len(ret)
+		var pids []int
+		proc.Proclock.Lock()
+		for pid := range proc.Allprocs {
+			pids = append(pids, pid)
+		}
+		proc.Proclock.Unlock()
+		sort.Ints(pids)
+		for _, pid := range pids {
+			name := ustr.Ustr(strconv.Itoa(pid))
+			n := pnode_t{kind: kpid, pid: pid}
+			ret = append(ret, pdent_t{name, n, first + pid})
+		}
+	case kpid:
+		add(pidfiles)
+	case kfddir:
+		p.Fdl.Lock()
+		for fdn, f := range p.Fds {
+			if f == nil {
+				continue
+			}
+			name := ustr.Ustr(strconv.Itoa(fdn))
+			n := pnode_t{kind: kfd, pid: dir.pid, fdn: fdn}
+			ret = append(ret, pdent_t{name, n, 2 + fdn})
+		}
+		p.Fdl.Unlock()
+	}
+	return ret, 0
+}
+
+// returns the linux_dirent64 file type of n
+func (n pnode_t) dtype() uint8 {
+	switch {
+	case n.isdir():
+		return defs.DT_DIR
+	case n.kind == kcwd:
+		return defs.DT_LNK
+	}
+	return defs.DT_REG
+}
+
+// the size of a file is the length of its current contents
+func (n pnode_t) stat(st *stat.Stat_t, dev uint, pgs Pgcount_i) defs.Err_t {
+	p, ok := n.proc()
+	if !ok {
+		return -defs.ENOENT
+	}
+	itype, mode, size := fs.I_FILE, 0444, 0
+	switch {
+	case n.isdir():
+		itype, mode = fs.I_DIR, 0555
+	case n.kind == kcwd:
+		itype, mode = fs.I_SYMLINK, 0777
+		size = len(n.readlink(p))
+	default:
+		d, err := n.contents(pgs)
+		if err != 0 {
+			return err
+		}
+		size = len(d)
+	}
+	st.Wdev(dev)
+	st.Wino(uint(n.inum()))
+	st.Wmode(uint(itype<<16 | mode))
+	st.Wsize(uint(size))
+	if p != nil {
+		st.Wuid(uint(p.Cred().Euid))
+	}
+	return 0
+}
+
+// caller checked that p is the process of n
+func (n pnode_t) readlink(p *proc.Proc_t) ustr.Ustr {
+	p.Cwd.Lock()
+	defer p.Cwd.Unlock()
+	return append(ustr.Ustr{}, p.Cwd.Path...)
+}
+
+func (pfs *Procfs_t) Fs_open(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.Cwd_t, cred *proc.Cred_t, major, minor int) (*fd.Fd_t, defs.Err_t) {
+	n, err := pfs.namei(paths, cwd)
+	if err != 0 {
+		if err == -defs.ENOENT && flags&defs.O_CREAT != 0 {
+			return nil, -defs.EROFS
+		}
+		return nil, err
+	}
+	if flags&defs.O_CREAT != 0 && flags&defs.O_EXCL != 0 {
+		return nil, -defs.EEXIST
+	}
+	if flags&(defs.O_WRONLY|defs.O_RDWR|defs.O_TRUNC) != 0 {
+		if n.isdir() {
+			return nil, -defs.EISDIR
+		}
+		return nil, -defs.EROFS
+	}
+	// XXX cwd cannot be followed since it leads out of procfs
+	if n.kind == kcwd {
+		return nil, -defs.ELOOP
+	}
+	if flags&defs.O_DIRECTORY != 0 && !n.isdir() {
+		return nil, -defs.ENOTDIR
+	}
+	fo := &pfops_t{pfs: pfs, n: n, count: 1}
+	if !n.isdir() {
+		// later reads see the contents as of the open
+		if fo.data, err = n.contents(pfs.pgs); err != 0 {
+			return nil, err
+		}
+	}
+	atomic.AddInt64(&pfs.nopen, 1)
+	return &fd.Fd_t{Fops: fo}, 0
+}
+
+func (pfs *Procfs_t) Fs_mknod(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.Cwd_t, cred *proc.Cred_t, major, minor int) (defs.Inum_t, defs.Err_t) {
+	return 0, -defs.EROFS
+}
+
+func (pfs *Procfs_t) Fs_stat(paths ustr.Ustr, st *stat.Stat_t, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	n, err := pfs.namei(paths, cwd)
+	if err != 0 {
+		return err
+	}
+	return n.stat(st, pfs.dev, pfs.pgs)
+}
+
+func (pfs *Procfs_t) Fs_access(paths ustr.Ustr, amode int, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	n, err := pfs.namei(paths, cwd)
+	if err != 0 {
+		return err
+	}
+	if amode&defs.W_OK != 0 {
+		return -defs.EROFS
+	}
+	if amode&defs.X_OK != 0 && !n.isdir() {
+		return -defs.EACCES
+	}
+	return 0
+}
+
+func (pfs *Procfs_t) Fs_mkdir(paths ustr.Ustr, mode int, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	return -defs.EROFS
+}
+
+func (pfs *Procfs_t) Fs_link(old, new ustr.Ustr, cwd, ncwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	return -defs.EROFS
+}
+
+func (pfs *Procfs_t) Fs_reflink(src, dst ustr.Ustr, cwd, ncwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	return -defs.EROFS
+}
+
+func (pfs *Procfs_t) Fs_unlink(paths ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t, wantdir bool) defs.Err_t {
+	return -defs.EROFS
+}
+
+func (pfs *Procfs_t) Fs_rename(oldp, newp ustr.Ustr, cwd, ncwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	return -defs.EROFS
+}
+
+func (pfs *Procfs_t) Fs_symlink(target, paths ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	return -defs.EROFS
+}
+
+func (pfs *Procfs_t) Fs_readlink(paths ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t) (ustr.Ustr, defs.Err_t) {
+	n, err := pfs.namei(paths, cwd)
+	if err != 0 {
+		return nil, err
+	}
+	if n.kind != kcwd {
+		return nil, -defs.EINVAL
+	}
+	p, ok := n.proc()
+	if !ok {
+		return nil, -defs.ENOENT
+	}
+	return n.readlink(p), 0
+}
+
+func (pfs *Procfs_t) Fs_chmod(paths ustr.Ustr, mode int, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	return -defs.EROFS
+}
+
+func (pfs *Procfs_t) Fs_chown(paths ustr.Ustr, uid, gid int, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	return -defs.EROFS
+}
+
+func (pfs *Procfs_t) Fs_utimens(paths ustr.Ustr, atime, mtime int, follow bool, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	return -defs.EROFS
+}
+
+func (pfs *Procfs_t) Fs_setxattr(paths, name ustr.Ustr, value []uint8, flags int, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	return -defs.EOPNOTSUPP
+}
+
+func (pfs *Procfs_t) Fs_getxattr(paths, name ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t) ([]uint8, defs.Err_t) {
+	return nil, -defs.EOPNOTSUPP
+}
+
+func (pfs *Procfs_t) Fs_listxattr(paths ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t) ([]uint8, defs.Err_t) {
+	return nil, -defs.EOPNOTSUPP
+}
+
+func (pfs *Procfs_t) Fs_removexattr(paths, name ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	return -defs.EOPNOTSUPP
+}
+
+func (pfs *Procfs_t) Fs_sync() defs.Err_t {
+	return 0
+}
+
+func (pfs *Procfs_t) Fs_resize(nblocks int) defs.Err_t {
+	return -defs.EOPNOTSUPP
+}
+
+func (pfs *Procfs_t) MkRootCwd() *fd.Cwd_t {
+	f := &fd.Fd_t{Fops: &pfops_t{pfs: pfs, n: pnode_t{kind: kroot}}}
+	return fd.MkRootCwd(f)
+}
+
+// fails if a file is open or a process has its cwd in procfs
+func (pfs *Procfs_t) Fs_umount() defs.Err_t {
+	if atomic.LoadInt64(&pfs.nopen) != 0 {
+		return -defs.EBUSY
+	}
+	return 0
+}
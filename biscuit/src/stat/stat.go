@@ -34,6 +34,15 @@ func (st *Stat_t) Wrdev(v uint) {
 	st._rdev = v
 }
 
+func (st *Stat_t) Wuid(v uint) {
+	st._uid = v
+}
+
+func (st *Stat_t) Wmtime(sec, nsec uint) {
+	st._m_sec = sec
+	st._m_nsec = nsec
+}
+
 func (st *Stat_t) Mode() uint {
 	return st._mode
 }
@@ -42,6 +51,10 @@ func (st *Stat_t) Size() uint {
 	return st._size
 }
 
+func (st *Stat_t) Dev() uint {
+	return st._dev
+}
+
 func (st *Stat_t) Rdev() uint {
 	return st._rdev
 }
@@ -50,6 +63,15 @@ func (st *Stat_t) Rino() uint {
 	return st._ino
 }
 
+func (st *Stat_t) Uid() uint {
+	return st._uid
+}
+
+// returns the modification time in nanoseconds
+func (st *Stat_t) Mtime() uint {
+	return st._m_sec*1e9 + st._m_nsec
+}
+
 func (st *Stat_t) Bytes() []uint8 {
 	const sz = unsafe.Sizeof(*st)
 	sl := (*[sz]uint8)(unsafe.Pointer(&st._dev))
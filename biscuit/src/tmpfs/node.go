@@ -0,0 +1,820 @@
+package tmpfs
+
+import "sync"
+import "sync/atomic"
+
+import "bounds"
+import "defs"
+import "fdops"
+import "flock"
+import "fs"
+import "limits"
+import "mem"
+import "proc"
+import "res"
+import "stat"
+import "ustr"
+import "util"
+
+// a file, directory, symlink or special file. the fields marked "tree" are
+// protected by the tmpfs tree lock, the others by the node's lock. fields
+// marked "both" are written with both locks held and may be read with either.
+type tnode_t struct {
+	sync.Mutex
+	tfs   *Tmpfs_t
+	inum  defs.Inum_t
+	itype int
+	major int
+	minor int
+	// both
+	mode  int
+	uid   int
+	gid   int
+	links int
+	// the number of opens, including those of cwds
+	nopen int
+	size  int
+	atime int
+	mtime int
+	ctime int
+	// file pages by page number; a missing page is a hole
+	pages map[int]mem.Mmapinfo_t
+	// the flock package protects the advisory locks
+	locks flock.Locks_t
+	// tree; the containing directory of a directory
+	parent *tnode_t
+	// tree; the target of a symlink
+	target ustr.Ustr
+	// tree; the entries of a directory. an entry lives in a slot, whose
+	// index is the stable getdents offset of the entry. slots of removed
+	// entries are reused.
+	ents  []tdent_t
+	names map[string]int
+	holes []int
+	nents int
+}
+
+type tdent_t struct {
+	name ustr.Ustr
+	n    *tnode_t
+}
+
+// caller holds the tree lock
+func (dir *tnode_t) lookup(name ustr.Ustr) *tnode_t {
+	if name.Isdot() {
+		return dir
+	} else if name.Isdotdot() {
+		return dir.parent
+	}
+	if i, ok := dir.names[string(name)]; ok {
+		return dir.ents[i].n
+	}
+	return nil
+}
+
+// records a modification of the node's data. caller holds lock on n.
+func (n *tnode_t) touch() {
+	now := nodetime()
+	n.mtime = now
+	n.ctime = now
+}
+
+// caller holds the tree lock for writing
+func (dir *tnode_t) insert(name ustr.Ustr, n *tnode_t) {
+	de := tdent_t{name: append(ustr.Ustr{}, name...), n: n}
+	if l := len(dir.holes); l != 0 {
+		i := dir.holes[l-1]
+		dir.holes = dir.holes[:l-1]
+		dir.ents[i] = de
+		dir.names[string(name)] = i
+	} else {
+		dir.ents = append(dir.ents, de)
+		dir.names[string(name)] = len(dir.ents) - 1
+	}
+	dir.nents++
+	dir.Lock()
+	dir.touch()
+	dir.Unlock()
+}
+
+// caller holds the tree lock for writing
+func (dir *tnode_t) remove(name ustr.Ustr) {
+	i, ok := dir.names[string(name)]
+	if !ok {
+		panic("no such entry")
+	}
+	delete(dir.names, string(name))
+	dir.ents[i] = tdent_t{}
+	dir.holes = append(dir.holes, i)
+	dir.nents--
+	dir.Lock()
+	dir.touch()
+	dir.Unlock()
+}
+
+// frees the data of an unlinked node which is no longer open. caller holds
+// lock on n.
+func (n *tnode_t) free() {
+	for pgn := range n.pages {
+		n.unpage(pgn)
+	}
+	n.pages = nil
+}
+
+// frees the nodes of the tree rooted at dir. caller holds the tree lock for
+// writing.
+func (dir *tnode_t) freetree() {
+	for _, de := range dir.ents {
+		if de.n == nil {
+			continue
+		}
+		if de.n.itype == fs.I_DIR {
+			de.n.freetree()
+		}
+		de.n.Lock()
+		de.n.free()
+		de.n.Unlock()
+	}
+	dir.ents, dir.names, dir.holes, dir.nents = nil, nil, nil, 0
+}
+
+// returns 0 if cred may access n in the ways described by want, a mask of
+// defs.R_OK, defs.W_OK, and defs.X_OK. caller holds the tree lock or the
+// node's lock.
+func (n *tnode_t) access(cred *proc.Cred_t, want int) defs.Err_t {
+	return cred.Access(n.mode, n.uid, n.gid, n.itype == fs.I_DIR, want)
+}
+
+// returns 0 if cred may add entries to the directory dir or, if child is not
+// nil, remove child from it. caller holds the tree lock.
+func (dir *tnode_t) dirmodchk(cred *proc.Cred_t, child *tnode_t) defs.Err_t {
+	if err := dir.access(cred, defs.W_OK|defs.X_OK); err != 0 {
+		return err
+	}
+	if child == nil || dir.mode&fs.S_ISVTX == 0 || cred.Isroot() {
+		return 0
+	}
+	if cred.Euid != dir.uid && cred.Euid != child.uid {
+		return -defs.EPERM
+	}
+	return 0
+}
+
+// returns 0 if cred owns n or is the superuser
+func (n *tnode_t) ownerchk(cred *proc.Cred_t) defs.Err_t {
+	if !cred.Isroot() && cred.Euid != n.uid {
+		return -defs.EPERM
+	}
+	return 0
+}
+
+// caller holds lock on n or the tree lock
+func (n *tnode_t) mkmode() uint {
+	if n.itype == fs.I_DEV {
+		return defs.Mkdev(n.major, n.minor)
+	}
+	return uint(n.itype << 16)
+}
+
+func (n *tnode_t) stat(st *stat.Stat_t) {
+	n.Lock()
+	st.Wdev(n.tfs.dev)
+	st.Wino(uint(n.inum))
+	st.Wmode(n.mkmode() | uint(n.mode))
+	st.Wsize(uint(n.size))
+	st.Wrdev(defs.Mkdev(n.major, n.minor))
+	st.Wuid(uint(n.uid))
+	st.Wmtime(uint(n.mtime/1e9), uint(n.mtime%1e9))
+	n.Unlock()
+}
+
+// returns the linux_dirent64 file type of n
+func (n *tnode_t) dtype() uint8 {
+	switch n.itype {
+	case fs.I_FILE:
+		return defs.DT_REG
+	case fs.I_DIR:
+		return defs.DT_DIR
+	case fs.I_SYMLINK:
+		return defs.DT_LNK
+	case fs.I_DEV:
+		if n.major == defs.D_SUD || n.major == defs.D_SUS {
+			return defs.DT_SOCK
+		}
+		return defs.DT_CHR
+	}
+	return defs.DT_UNKNOWN
+}
+
+// copies the entries of dir, starting with the entry at offset off, to dst as
+// linux_dirent64 records until dst is full. "." and ".." are at offsets 0 and
+// 1; the other entries are at the offset of their slot plus 2. returns the
+// number of bytes written and the offset from which to continue. caller holds
+// the tree lock.
+func (dir *tnode_t) getdents(dst fdops.Userio_i, off int) (int, int, defs.Err_t) {
+	if dir.itype != fs.I_DIR {
+		return 0, off, -defs.ENOTDIR
+	}
+	if off < 0 {
+		return 0, off, -defs.EINVAL
+	}
+	did := 0
+	for ; off < len(dir.ents)+2; off++ {
+		var name ustr.Ustr
+		var n *tnode_t
+		switch off {
+		case 0:
+			name, n = ustr.MkUstrDot(), dir
+		case 1:
+			name, n = ustr.DotDot, dir.parent
+		default:
+			name, n = dir.ents[off-2].name, dir.ents[off-2].n
+		}
+		if n == nil {
+			continue
+		}
+		if util.Direntlen(name) > dst.Remain() {
+			if did == 0 {
+				return 0, off, -defs.EINVAL
+			}
+			return did, off, 0
+		}
+		rec := util.Dirent(int(n.inum), off+1, n.dtype(), name)
+		if _, err := dst.Uiowrite(rec); err != 0 {
+			return did, off, err
+		}
+		did += len(rec)
+	}
+	dir.Lock()
+	dir.atime = nodetime()
+	dir.Unlock()
+	return did, off, 0
+}
+
+// the contents of holes
+var zeropg [mem.PGSIZE]uint8
+
+// returns page pgn of the file, allocating a zeroed page for a hole. caller
+// holds lock on n.
+func (n *tnode_t) page(pgn int) (mem.Mmapinfo_t, defs.Err_t) {
+	if pg, ok := n.pages[pgn]; ok {
+		return pg, 0
+	}
+	// each file gets its first page for free
+	charge := len(n.pages) != 0
+	if charge && !limits.Syslimit.Mfspgs.Take() {
+		return mem.Mmapinfo_t{}, -defs.ENOSPC
+	}
+	pg, pa, ok := n.tfs.pgs.Refpg_new()
+	if !ok {
+		if charge {
+			limits.Syslimit.Mfspgs.Give()
+		}
+		return mem.Mmapinfo_t{}, -defs.ENOMEM
+	}
+	n.tfs.pgs.Refup(pa)
+	if n.pages == nil {
+		n.pages = make(map[int]mem.Mmapinfo_t)
+	}
+	mi := mem.Mmapinfo_t{Pg: pg, Phys: pa}
+	n.pages[pgn] = mi
+	return mi, 0
+}
+
+// frees page pgn of the file, if it is not a hole. pages which are still
+// mapped are freed once they are unmapped. caller holds lock on n.
+func (n *tnode_t) unpage(pgn int) {
+	pg, ok := n.pages[pgn]
+	if !ok {
+		return
+	}
+	delete(n.pages, pgn)
+	if len(n.pages) != 0 {
+		limits.Syslimit.Mfspgs.Give()
+	}
+	n.tfs.pgs.Refdown(pg.Phys)
+}
+
+// zeroes len bytes at off, which lie within one page, unless the page is a
+// hole. caller holds lock on n.
+func (n *tnode_t) _zero(off, len int) {
+	if pg, ok := n.pages[off/mem.PGSIZE]; ok {
+		pgoff := off % mem.PGSIZE
+		copy(mem.Pg2bytes(pg.Pg)[pgoff:pgoff+len], zeropg[:])
+	}
+}
+
+// frees the pages in [off, off+len), zeroing the partial pages at either end.
+// caller holds lock on n.
+func (n *tnode_t) punch(off, len int) {
+	end := off + len
+	f0, f1 := util.Roundup(off, mem.PGSIZE)/mem.PGSIZE, end/mem.PGSIZE
+	if f0 > f1 {
+		n._zero(off, len)
+		return
+	}
+	if off < f0*mem.PGSIZE {
+		n._zero(off, f0*mem.PGSIZE-off)
+	}
+	if end > f1*mem.PGSIZE {
+		n._zero(f1*mem.PGSIZE, end-f1*mem.PGSIZE)
+	}
+	for pgn := range n.pages {
+		if pgn >= f0 && pgn < f1 {
+			n.unpage(pgn)
+		}
+	}
+}
+
+// caller holds lock on n
+func (n *tnode_t) trunc(newlen int) {
+	if newlen < n.size {
+		// zero the tail of the last page so that extending the file
+		// again exposes zeros
+		if pgoff := newlen % mem.PGSIZE; pgoff != 0 {
+			n._zero(newlen, mem.PGSIZE-pgoff)
+		}
+		// including pages preallocated past the end with
+		// FALLOC_FL_KEEP_SIZE
+		for pgn := range n.pages {
+			if pgn*mem.PGSIZE >= newlen {
+				n.unpage(pgn)
+			}
+		}
+	}
+	n.size = newlen
+	n.touch()
+}
+
+// copies the file data at off to dst. caller holds lock on n.
+func (n *tnode_t) read(dst fdops.Userio_i, off int) (int, defs.Err_t) {
+	did := 0
+	for off < n.size && dst.Remain() != 0 {
+		if !res.Resadd_noblock(bounds.Bounds(bounds.B_TNODE_T_READ)) {
+			return did, -defs.ENOHEAP
+		}
+		pgoff := off % mem.PGSIZE
+		l := util.Min(mem.PGSIZE-pgoff, n.size-off)
+		src := zeropg[:l]
+		if pg, ok := n.pages[off/mem.PGSIZE]; ok {
+			src = mem.Pg2bytes(pg.Pg)[pgoff : pgoff+l]
+		}
+		c, err := dst.Uiowrite(src)
+		did += c
+		off += c
+		if err != 0 {
+			return did, err
+		}
+	}
+	n.atime = nodetime()
+	return did, 0
+}
+
+// copies src to the file at off, or at the end of the file if app is true.
+// caller holds lock on n.
+func (n *tnode_t) write(src fdops.Userio_i, off int, app bool) (int, defs.Err_t) {
+	if app {
+		off = n.size
+	}
+	did := 0
+	var err defs.Err_t
+	for src.Remain() != 0 {
+		if !res.Resadd_noblock(bounds.Bounds(bounds.B_TNODE_T_WRITE)) {
+			err = -defs.ENOHEAP
+			break
+		}
+		var pg mem.Mmapinfo_t
+		if pg, err = n.page(off / mem.PGSIZE); err != 0 {
+			break
+		}
+		pgoff := off % mem.PGSIZE
+		var c int
+		c, err = src.Uioread(mem.Pg2bytes(pg.Pg)[pgoff:])
+		did += c
+		off += c
+		if off > n.size {
+			n.size = off
+		}
+		if err != 0 {
+			break
+		}
+	}
+	if did != 0 {
+		n.touch()
+	}
+	return did, err
+}
+
+// implements fallocate(2) like fs does. caller holds lock on n.
+func (n *tnode_t) fallocate(mode, off, len int) defs.Err_t {
+	keep := mode&defs.FALLOC_FL_KEEP_SIZE != 0
+	punch := mode&defs.FALLOC_FL_PUNCH_HOLE != 0
+	zero := mode&defs.FALLOC_FL_ZERO_RANGE != 0
+	if off < 0 || len <= 0 {
+		return -defs.EINVAL
+	}
+	modes := defs.FALLOC_FL_KEEP_SIZE | defs.FALLOC_FL_PUNCH_HOLE |
+		defs.FALLOC_FL_ZERO_RANGE
+	// a punched hole never changes the size
+	if mode&^modes != 0 || (punch && (zero || !keep)) {
+		return -defs.EOPNOTSUPP
+	}
+	end := off + len
+	if end < off {
+		return -defs.EFBIG
+	}
+	if n.itype != fs.I_FILE {
+		return -defs.ENODEV
+	}
+	if punch {
+		n.punch(off, len)
+		n.touch()
+		return 0
+	}
+	for pgn := off / mem.PGSIZE; pgn*mem.PGSIZE < end; pgn++ {
+		if !res.Resadd_noblock(bounds.Bounds(bounds.B_TNODE_T_FALLOCATE)) {
+			return -defs.ENOHEAP
+		}
+		if _, err := n.page(pgn); err != 0 {
+			return err
+		}
+		if zero {
+			s := pgn * mem.PGSIZE
+			if s < off {
+				s = off
+			}
+			e := util.Min(end, (pgn+1)*mem.PGSIZE)
+			n._zero(s, e-s)
+		}
+	}
+	if !keep && end > n.size {
+		n.size = end
+		n.touch()
+	} else if zero {
+		n.touch()
+	}
+	return 0
+}
+
+// implements lseek(2)'s SEEK_DATA and SEEK_HOLE at page granularity. caller
+// holds lock on n.
+func (n *tnode_t) seekdata(off int, hole bool) (int, defs.Err_t) {
+	if off < 0 {
+		return 0, -defs.EINVAL
+	}
+	if off >= n.size {
+		return 0, -defs.ENXIO
+	}
+	for pgn := off / mem.PGSIZE; pgn*mem.PGSIZE < n.size; pgn++ {
+		if _, ok := n.pages[pgn]; ok != hole {
+			if s := pgn * mem.PGSIZE; s > off {
+				return s, 0
+			}
+			return off, 0
+		}
+	}
+	// the end of the file counts as a hole
+	if hole {
+		return n.size, 0
+	}
+	return 0, -defs.ENXIO
+}
+
+// returns the pages of the file in [off, off+len), allocating pages for holes.
+// the VM system holds a reference to each returned page. caller holds lock on
+// n.
+func (n *tnode_t) mmapi(off, len int) ([]mem.Mmapinfo_t, defs.Err_t) {
+	if n.itype != fs.I_FILE {
+		return nil, -defs.ENODEV
+	}
+	if (len != -1 && len < 0) || off < 0 {
+		panic("bad off/len")
+	}
+	if off >= n.size {
+		return nil, -defs.EINVAL
+	}
+	if len == -1 || off+len > n.size {
+		len = n.size - off
+	}
+	o := util.Rounddown(off, mem.PGSIZE)
+	len = util.Roundup(off+len, mem.PGSIZE) - o
+	ret := make([]mem.Mmapinfo_t, 0, len/mem.PGSIZE)
+	for i := 0; i < len; i += mem.PGSIZE {
+		if !res.Resadd_noblock(bounds.Bounds(bounds.B_TNODE_T_MMAPI)) {
+			n.unmmapi(ret)
+			return nil, -defs.ENOHEAP
+		}
+		pg, err := n.page((o + i) / mem.PGSIZE)
+		if err != 0 {
+			n.unmmapi(ret)
+			return nil, err
+		}
+		n.tfs.pgs.Refup(pg.Phys)
+		ret = append(ret, pg)
+	}
+	return ret, 0
+}
+
+// drops the references of a failed mmapi
+func (n *tnode_t) unmmapi(mmi []mem.Mmapinfo_t) {
+	for _, pg := range mmi {
+		n.tfs.pgs.Refdown(pg.Phys)
+	}
+}
+
+type tfops_t struct {
+	n   *tnode_t
+	tfs *Tmpfs_t
+	// protects offset and count
+	sync.Mutex
+	offset int
+	append bool
+	count  int
+}
+
+func (fo *tfops_t) _read(dst fdops.Userio_i, toff int) (int, defs.Err_t) {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return 0, -defs.EBADF
+	}
+	if fo.n.itype == fs.I_DIR {
+		return 0, -defs.EISDIR
+	}
+	useoffset := toff != -1
+	offset := fo.offset
+	if useoffset {
+		offset = toff
+	}
+	fo.n.Lock()
+	did, err := fo.n.read(dst, offset)
+	fo.n.Unlock()
+	if !useoffset && err == 0 {
+		fo.offset += did
+	}
+	return did, err
+}
+
+func (fo *tfops_t) Read(dst fdops.Userio_i) (int, defs.Err_t) {
+	return fo._read(dst, -1)
+}
+
+func (fo *tfops_t) Pread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
+	return fo._read(dst, offset)
+}
+
+func (fo *tfops_t) _write(src fdops.Userio_i, toff int) (int, defs.Err_t) {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return 0, -defs.EBADF
+	}
+	useoffset := toff != -1
+	offset := fo.offset
+	append := fo.append
+	if useoffset {
+		offset = toff
+		append = false
+	}
+	fo.n.Lock()
+	did, err := fo.n.write(src, offset, append)
+	fo.n.Unlock()
+	if !useoffset && err == 0 {
+		fo.offset += did
+	}
+	return did, err
+}
+
+func (fo *tfops_t) Write(src fdops.Userio_i) (int, defs.Err_t) {
+	return fo._write(src, -1)
+}
+
+func (fo *tfops_t) Pwrite(src fdops.Userio_i, offset int) (int, defs.Err_t) {
+	return fo._write(src, offset)
+}
+
+func (fo *tfops_t) Truncate(newlen uint) defs.Err_t {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return -defs.EBADF
+	}
+	if fo.n.itype != fs.I_FILE {
+		return -defs.EINVAL
+	}
+	fo.n.Lock()
+	fo.n.trunc(int(newlen))
+	fo.n.Unlock()
+	return 0
+}
+
+func (fo *tfops_t) Fallocate(mode, offset, len int) defs.Err_t {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return -defs.EBADF
+	}
+	fo.n.Lock()
+	err := fo.n.fallocate(mode, offset, len)
+	fo.n.Unlock()
+	return err
+}
+
+// tmpfs data is never written back
+func (fo *tfops_t) Fsync(datasync bool) defs.Err_t {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return -defs.EBADF
+	}
+	return 0
+}
+
+func (fo *tfops_t) Locks() (*flock.Locks_t, defs.Err_t) {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return nil, -defs.EBADF
+	}
+	return &fo.n.locks, 0
+}
+
+func (fo *tfops_t) Getdents(dst fdops.Userio_i) (int, defs.Err_t) {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return 0, -defs.EBADF
+	}
+	fo.tfs.RLock()
+	did, next, err := fo.n.getdents(dst, fo.offset)
+	fo.tfs.RUnlock()
+	fo.offset = next
+	if did > 0 {
+		return did, 0
+	}
+	return did, err
+}
+
+func (fo *tfops_t) Fstat(st *stat.Stat_t) defs.Err_t {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return -defs.EBADF
+	}
+	fo.n.stat(st)
+	return 0
+}
+
+func (fo *tfops_t) Close() defs.Err_t {
+	fo.Lock()
+	if fo.count <= 0 {
+		fo.Unlock()
+		return -defs.EBADF
+	}
+	fo.count--
+	last := fo.count == 0
+	fo.Unlock()
+	if last {
+		fo.n.locks.Fclose(fo)
+	}
+	fo.tfs._close(fo.n)
+	return 0
+}
+
+func (fo *tfops_t) Pathi() defs.Inum_t {
+	return fo.n.inum
+}
+
+// tmpfs pages are never evicted, thus shared mappings need not pin them
+func (fo *tfops_t) Unpin(pa mem.Pa_t) {
+}
+
+func (fo *tfops_t) Reopen() defs.Err_t {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return -defs.EBADF
+	}
+	fo.n.Lock()
+	fo.n.nopen++
+	fo.n.Unlock()
+	atomic.AddInt64(&fo.tfs.nopen, 1)
+	fo.count++
+	return 0
+}
+
+func (fo *tfops_t) Lseek(off, whence int) (int, defs.Err_t) {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return 0, -defs.EBADF
+	}
+
+	switch whence {
+	case defs.SEEK_SET:
+		fo.offset = off
+	case defs.SEEK_CUR:
+		fo.offset += off
+	case defs.SEEK_END:
+		fo.n.Lock()
+		fo.offset = fo.n.size + off
+		fo.n.Unlock()
+	case defs.SEEK_DATA, defs.SEEK_HOLE:
+		fo.n.Lock()
+		n, err := fo.n.seekdata(off, whence == defs.SEEK_HOLE)
+		fo.n.Unlock()
+		if err != 0 {
+			return 0, err
+		}
+		fo.offset = n
+	default:
+		return 0, -defs.EINVAL
+	}
+	if fo.offset < 0 {
+		fo.offset = 0
+	}
+	return fo.offset, 0
+}
+
+func (fo *tfops_t) Mmapi(offset, len int, inc bool) ([]mem.Mmapinfo_t, defs.Err_t) {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return nil, -defs.EBADF
+	}
+	fo.n.Lock()
+	mmi, err := fo.n.mmapi(offset, len)
+	fo.n.Unlock()
+	return mmi, err
+}
+
+// checks whether cred may execute the open file. returns the uid and gid which
+// a set-user-ID or set-group-ID file executes with, or -1.
+func (fo *tfops_t) Execperm(cred *proc.Cred_t) (int, int, defs.Err_t) {
+	n := fo.n
+	n.Lock()
+	defer n.Unlock()
+	if n.itype != fs.I_FILE {
+		return -1, -1, -defs.EACCES
+	}
+	if err := n.access(cred, defs.X_OK); err != 0 {
+		return -1, -1, err
+	}
+	uid, gid := -1, -1
+	if n.mode&fs.S_ISUID != 0 {
+		uid = n.uid
+	}
+	// set-group-ID without group execute permission means mandatory
+	// locking, not set-group-ID
+	if n.mode&fs.S_ISGID != 0 && n.mode&0010 != 0 {
+		gid = n.gid
+	}
+	return uid, gid, 0
+}
+
+func (fo *tfops_t) Accept(fdops.Userio_i) (fdops.Fdops_i, int, defs.Err_t) {
+	return nil, 0, -defs.ENOTSOCK
+}
+
+func (fo *tfops_t) Bind([]uint8) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (fo *tfops_t) Connect(sabuf []uint8) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (fo *tfops_t) Listen(int) (fdops.Fdops_i, defs.Err_t) {
+	return nil, -defs.ENOTSOCK
+}
+
+func (fo *tfops_t) Sendmsg(fdops.Userio_i, []uint8, []uint8,
+	int) (int, defs.Err_t) {
+	return 0, -defs.ENOTSOCK
+}
+
+func (fo *tfops_t) Recvmsg(fdops.Userio_i,
+	fdops.Userio_i, fdops.Userio_i, int) (int, int, int, defs.Msgfl_t, defs.Err_t) {
+	return 0, 0, 0, 0, -defs.ENOTSOCK
+}
+
+func (fo *tfops_t) Pollone(pm fdops.Pollmsg_t) (fdops.Ready_t, defs.Err_t) {
+	return pm.Events & (fdops.R_READ | fdops.R_WRITE), 0
+}
+
+func (fo *tfops_t) Fcntl(cmd, opt int) int {
+	return int(-defs.ENOSYS)
+}
+
+func (fo *tfops_t) Getsockopt(opt int, bufarg fdops.Userio_i,
+	intarg int) (int, defs.Err_t) {
+	return 0, -defs.ENOTSOCK
+}
+
+func (fo *tfops_t) Setsockopt(int, int, fdops.Userio_i, int) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (fo *tfops_t) Shutdown(read, write bool) defs.Err_t {
+	return -defs.ENOTSOCK
+}
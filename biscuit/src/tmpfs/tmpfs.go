@@ -0,0 +1,689 @@
+package tmpfs
+
+import "sync"
+import "sync/atomic"
+import "time"
+
+import "bounds"
+import "bpath"
+import "defs"
+import "device"
+import "fd"
+import "fs"
+import "mem"
+import "proc"
+import "res"
+import "stat"
+import "ustr"
+import "vfs"
+
+// tmpfs keeps its inodes, directories and file pages in memory only; nothing
+// is journaled or written to disk, and everything is lost at umount. file
+// pages are physical pages, which mmap maps directly, and are charged against
+// limits.Syslimit.Mfspgs.
+
+// the longest name of a directory entry
+const namemax = 255
+
+type Tmpfs_t struct {
+	// protects the namespace: directory entries, link counts, parents and
+	// symlink targets, and the owner and mode of every node. it is
+	// acquired before any node lock.
+	sync.RWMutex
+	pgs  mem.Page_i
+	root *tnode_t
+	dev  uint
+	// the last inode number handed out; protected by the lock
+	inum defs.Inum_t
+	// the number of open files, including cwds; updated atomically
+	nopen int64
+}
+
+// the file pages of the returned tmpfs are allocated from pgs
+func MkTmpfs(pgs mem.Page_i) *Tmpfs_t {
+	tfs := &Tmpfs_t{pgs: pgs}
+	tfs.dev = vfs.Newdev()
+	// like /tmp, anyone may create files in the root, but only remove
+	// their own
+	tfs.root = tfs.mknode(fs.I_DIR, 01777, 0, 0)
+	tfs.root.parent = tfs.root
+	return tfs
+}
+
+// returns the current time in nanoseconds since the epoch, the unit of node
+// timestamps
+func nodetime() int {
+	return int(time.Now().UnixNano())
+}
+
+// caller holds the tree lock for writing
+func (tfs *Tmpfs_t) mknode(itype, mode, uid, gid int) *tnode_t {
+	tfs.inum++
+	now := nodetime()
+	n := &tnode_t{tfs: tfs, inum: tfs.inum, itype: itype, mode: mode & 07777,
+		uid: uid, gid: gid, links: 1, atime: now, mtime: now, ctime: now}
+	if itype == fs.I_DIR {
+		n.names = make(map[string]int)
+	}
+	return n
+}
+
+// returns the directory of cwd, which must be in tfs
+func (tfs *Tmpfs_t) cwdnode(cwd *fd.Cwd_t) *tnode_t {
+	return cwd.Fd.Fops.(*tfops_t).n
+}
+
+// resolves paths. symlinks in the middle of the path are always followed; a
+// symlink in the last component is followed only if follow is true. like in
+// fs, cred must have search permission on the directories in paths. caller
+// holds the tree lock.
+func (tfs *Tmpfs_t) _namei(paths ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t, follow bool) (*tnode_t, defs.Err_t) {
+	n := tfs.root
+	if !paths.IsAbsolute() {
+		n = tfs.cwdnode(cwd)
+	}
+	nlinks := 0
+	var pp bpath.Pathparts_t
+	pp.Pp_init(paths)
+	for cp, ok := pp.Next(); ok; cp, ok = pp.Next() {
+		if !res.Resadd_noblock(bounds.Bounds(bounds.B_TMPFS_T__NAMEI)) {
+			return nil, -defs.ENOHEAP
+		}
+		if n.itype != fs.I_DIR {
+			return nil, -defs.ENOTDIR
+		}
+		if err := n.access(cred, defs.X_OK); err != 0 {
+			return nil, err
+		}
+		dir := n
+		if n = dir.lookup(cp); n == nil {
+			return nil, -defs.ENOENT
+		}
+		_, rest := pp.Split()
+		if n.itype != fs.I_SYMLINK || (!follow && len(rest) == 0) {
+			continue
+		}
+		if nlinks == fs.MAXSYMLINKS {
+			return nil, -defs.ELOOP
+		}
+		nlinks++
+		// resolve the rest of the path relative to the symlink's
+		// target
+		var p ustr.Ustr
+		p = append(p, n.target...)
+		p = append(p, rest...)
+		pp.Pp_init(p)
+		n = dir
+		if p.IsAbsolute() {
+			n = tfs.root
+		}
+	}
+	return n, 0
+}
+
+// returns 0 if fn can name a new directory entry. nilpatherr is returned if fn
+// is empty.
+func crname(fn ustr.Ustr, nilpatherr defs.Err_t) defs.Err_t {
+	if len(fn) == 0 {
+		return nilpatherr
+	} else if fn.Isdot() || fn.Isdotdot() {
+		return -defs.EINVAL
+	} else if len(fn) > namemax {
+		return -defs.ENAMETOOLONG
+	}
+	return 0
+}
+
+// adds a new node named fn to dir. if fn exists, returns the existing node and
+// EEXIST. caller holds the tree lock for writing.
+func (tfs *Tmpfs_t) _create(dir *tnode_t, fn ustr.Ustr, itype, mode int, cred *proc.Cred_t) (*tnode_t, defs.Err_t) {
+	if dir.itype != fs.I_DIR {
+		return nil, -defs.ENOTDIR
+	}
+	// cannot create files in a removed directory
+	if dir.links == 0 {
+		return nil, -defs.ENOENT
+	}
+	if n := dir.lookup(fn); n != nil {
+		return n, -defs.EEXIST
+	}
+	if err := dir.dirmodchk(cred, nil); err != 0 {
+		return nil, err
+	}
+	uid, gid := cred.Euid, cred.Egid
+	// new entries of a set-group-ID directory inherit its group
+	if dir.mode&fs.S_ISGID != 0 {
+		gid = dir.gid
+		if itype == fs.I_DIR {
+			mode |= fs.S_ISGID
+		}
+	}
+	n := tfs.mknode(itype, mode, uid, gid)
+	if itype == fs.I_DIR {
+		n.parent = dir
+	}
+	dir.insert(fn, n)
+	return n, 0
+}
+
+// opens the node named by paths, creating it if O_CREAT is given. the caller
+// must release the returned node with _close.
+func (tfs *Tmpfs_t) _open(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.Cwd_t, cred *proc.Cred_t, major, minor int) (*tnode_t, defs.Err_t) {
+	trunc := flags&defs.O_TRUNC != 0
+	creat := flags&defs.O_CREAT != 0
+	nofollow := flags&defs.O_NOFOLLOW != 0
+	nodir := false
+
+	if creat {
+		tfs.Lock()
+		defer tfs.Unlock()
+	} else {
+		tfs.RLock()
+		defer tfs.RUnlock()
+	}
+
+	var n *tnode_t
+	// true if this open created the file
+	created := false
+	if creat {
+		nodir = true
+		isdev := major != 0 || minor != 0
+		dirs, fn := bpath.Sdirname(paths)
+		if err := crname(fn, -defs.EEXIST); err != 0 {
+			return nil, err
+		}
+		dir, err := tfs._namei(dirs, cwd, cred, true)
+		if err != 0 {
+			return nil, err
+		}
+		itype := fs.I_FILE
+		if isdev {
+			itype = fs.I_DEV
+		}
+		n, err = tfs._create(dir, fn, itype, mode, cred)
+		switch {
+		case err == 0:
+			created = true
+			n.major, n.minor = major, minor
+		case err != -defs.EEXIST:
+			return nil, err
+		case flags&defs.O_EXCL != 0 || isdev:
+			return nil, err
+		case n.itype == fs.I_SYMLINK && !nofollow:
+			// XXX O_CREAT through a dangling symlink fails instead
+			// of creating the target, like in fs
+			if n, err = tfs._namei(paths, cwd, cred, true); err != 0 {
+				return nil, err
+			}
+		}
+	} else {
+		var err defs.Err_t
+		if n, err = tfs._namei(paths, cwd, cred, !nofollow); err != 0 {
+			return nil, err
+		}
+	}
+
+	// a symlink can only be found here if O_NOFOLLOW was given
+	if n.itype == fs.I_SYMLINK {
+		return nil, -defs.ELOOP
+	}
+	if flags&(defs.O_WRONLY|defs.O_RDWR) != 0 {
+		nodir = true
+	}
+	if flags&defs.O_DIRECTORY != 0 && n.itype != fs.I_DIR {
+		return nil, -defs.ENOTDIR
+	}
+	if nodir && n.itype == fs.I_DIR {
+		return nil, -defs.EISDIR
+	}
+
+	// the creator may open a new file regardless of the mode
+	if !created {
+		want := defs.R_OK
+		switch flags & (defs.O_RDONLY | defs.O_WRONLY | defs.O_RDWR) {
+		case defs.O_WRONLY:
+			want = defs.W_OK
+		case defs.O_RDWR:
+			want = defs.R_OK | defs.W_OK
+		}
+		if trunc {
+			want |= defs.W_OK
+		}
+		if flags&defs.O_EXEC != 0 {
+			want = defs.X_OK
+		}
+		if err := n.access(cred, want); err != 0 {
+			return nil, err
+		}
+	}
+
+	n.Lock()
+	n.nopen++
+	if trunc && n.itype == fs.I_FILE {
+		n.trunc(0)
+	}
+	n.Unlock()
+	atomic.AddInt64(&tfs.nopen, 1)
+	return n, 0
+}
+
+// releases a node returned by _open and frees it if it was the last reference
+// to an unlinked node
+func (tfs *Tmpfs_t) _close(n *tnode_t) {
+	n.Lock()
+	n.nopen--
+	if n.nopen == 0 && n.links == 0 {
+		n.free()
+	}
+	n.Unlock()
+	atomic.AddInt64(&tfs.nopen, -1)
+}
+
+// socket files cannot be open(2)'ed (must use connect(2)/sendto(2) etc.)
+var _denyopen = map[int]bool{defs.D_SUD: true, defs.D_SUS: true}
+
+func (tfs *Tmpfs_t) Fs_open(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.Cwd_t, cred *proc.Cred_t, major, minor int) (*fd.Fd_t, defs.Err_t) {
+	n, err := tfs._open(paths, flags, mode, cwd, cred, major, minor)
+	if err != 0 {
+		return nil, err
+	}
+	ret := &fd.Fd_t{}
+	if n.itype == fs.I_DEV {
+		// don't need underlying file open
+		tfs._close(n)
+		if _denyopen[n.major] {
+			return nil, -defs.EPERM
+		}
+		if ret.Fops, err = device.Open(n.major, n.minor); err != 0 {
+			return nil, err
+		}
+		return ret, 0
+	}
+	apnd := flags&defs.O_APPEND != 0
+	ret.Fops = &tfops_t{n: n, tfs: tfs, append: apnd, count: 1}
+	return ret, 0
+}
+
+// creates the special file paths and returns its inode number
+func (tfs *Tmpfs_t) Fs_mknod(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.Cwd_t, cred *proc.Cred_t, major, minor int) (defs.Inum_t, defs.Err_t) {
+	n, err := tfs._open(paths, flags|defs.O_CREAT, mode, cwd, cred, major, minor)
+	if err != 0 {
+		return 0, err
+	}
+	tfs._close(n)
+	return n.inum, 0
+}
+
+func (tfs *Tmpfs_t) Fs_stat(paths ustr.Ustr, st *stat.Stat_t, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	tfs.RLock()
+	defer tfs.RUnlock()
+	n, err := tfs._namei(paths, cwd, cred, true)
+	if err != 0 {
+		return err
+	}
+	n.stat(st)
+	return 0
+}
+
+// checks whether cred may access paths in the ways described by amode, a mask
+// of defs.R_OK, defs.W_OK and defs.X_OK.
+func (tfs *Tmpfs_t) Fs_access(paths ustr.Ustr, amode int, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	tfs.RLock()
+	defer tfs.RUnlock()
+	n, err := tfs._namei(paths, cwd, cred, true)
+	if err != 0 {
+		return err
+	}
+	return n.access(cred, amode)
+}
+
+func (tfs *Tmpfs_t) Fs_mkdir(paths ustr.Ustr, mode int, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	tfs.Lock()
+	defer tfs.Unlock()
+	dirs, fn := bpath.Sdirname(paths)
+	if err := crname(fn, -defs.EINVAL); err != 0 {
+		return err
+	}
+	dir, err := tfs._namei(dirs, cwd, cred, true)
+	if err != 0 {
+		return err
+	}
+	_, err = tfs._create(dir, fn, fs.I_DIR, mode, cred)
+	return err
+}
+
+func (tfs *Tmpfs_t) Fs_link(old, new ustr.Ustr, cwd, ncwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	tfs.Lock()
+	defer tfs.Unlock()
+	orig, err := tfs._namei(old, cwd, cred, false)
+	if err != 0 {
+		return err
+	}
+	if orig.itype != fs.I_FILE && orig.itype != fs.I_SYMLINK {
+		return -defs.EINVAL
+	}
+	dirs, fn := bpath.Sdirname(new)
+	if err := crname(fn, -defs.EEXIST); err != 0 {
+		return err
+	}
+	dir, err := tfs._namei(dirs, ncwd, cred, true)
+	if err != 0 {
+		return err
+	}
+	if dir.itype != fs.I_DIR {
+		return -defs.ENOTDIR
+	}
+	if dir.links == 0 {
+		return -defs.ENOENT
+	}
+	if dir.lookup(fn) != nil {
+		return -defs.EEXIST
+	}
+	if err := dir.dirmodchk(cred, nil); err != 0 {
+		return err
+	}
+	dir.insert(fn, orig)
+	orig.Lock()
+	orig.links++
+	orig.ctime = nodetime()
+	orig.Unlock()
+	return 0
+}
+
+func (tfs *Tmpfs_t) Fs_reflink(src, dst ustr.Ustr, cwd, ncwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	return -defs.EOPNOTSUPP
+}
+
+// returns 0 if the directory entry for n may be removed, or replaced by an
+// entry of a directory if wantdir is true. caller holds the tree lock.
+func (n *tnode_t) dirchk(wantdir bool) defs.Err_t {
+	amdir := n.itype == fs.I_DIR
+	if wantdir && !amdir {
+		return -defs.ENOTDIR
+	} else if !wantdir && amdir {
+		return -defs.EISDIR
+	} else if amdir && n.nents != 0 {
+		return -defs.ENOTEMPTY
+	}
+	return 0
+}
+
+// removes the directory entry fn, which names n, from dir. caller holds the
+// tree lock for writing.
+func (dir *tnode_t) _unlink(fn ustr.Ustr, n *tnode_t) {
+	dir.remove(fn)
+	n.Lock()
+	n.links--
+	n.ctime = nodetime()
+	if n.links == 0 && n.nopen == 0 {
+		n.free()
+	}
+	n.Unlock()
+}
+
+func (tfs *Tmpfs_t) Fs_unlink(paths ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t, wantdir bool) defs.Err_t {
+	tfs.Lock()
+	defer tfs.Unlock()
+	dirs, fn := bpath.Sdirname(paths)
+	if fn.Isdot() || fn.Isdotdot() {
+		return -defs.EPERM
+	}
+	dir, err := tfs._namei(dirs, cwd, cred, true)
+	if err != 0 {
+		return err
+	}
+	if dir.itype != fs.I_DIR {
+		return -defs.ENOTDIR
+	}
+	child := dir.lookup(fn)
+	if child == nil {
+		return -defs.ENOENT
+	}
+	if err := dir.dirmodchk(cred, child); err != 0 {
+		return err
+	}
+	if err := child.dirchk(wantdir); err != 0 {
+		return err
+	}
+	dir._unlink(fn, child)
+	return 0
+}
+
+func (tfs *Tmpfs_t) Fs_rename(oldp, newp ustr.Ustr, cwd, ncwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	odirs, ofn := bpath.Sdirname(oldp)
+	ndirs, nfn := bpath.Sdirname(newp)
+	if err := crname(ofn, -defs.EINVAL); err != 0 {
+		return err
+	}
+	if err := crname(nfn, -defs.EINVAL); err != 0 {
+		return err
+	}
+
+	tfs.Lock()
+	defer tfs.Unlock()
+	opar, err := tfs._namei(odirs, cwd, cred, true)
+	if err != 0 {
+		return err
+	}
+	npar, err := tfs._namei(ndirs, ncwd, cred, true)
+	if err != 0 {
+		return err
+	}
+	if opar.itype != fs.I_DIR || npar.itype != fs.I_DIR {
+		return -defs.ENOTDIR
+	}
+	ochild := opar.lookup(ofn)
+	if ochild == nil {
+		return -defs.ENOENT
+	}
+	if npar.links == 0 {
+		return -defs.ENOENT
+	}
+	nchild := npar.lookup(nfn)
+	odir := ochild.itype == fs.I_DIR
+	// a directory cannot be moved below itself
+	if odir {
+		for d := npar; ; d = d.parent {
+			if d == ochild {
+				return -defs.EINVAL
+			}
+			if d == tfs.root {
+				break
+			}
+		}
+	}
+
+	if err := opar.dirmodchk(cred, ochild); err != 0 {
+		return err
+	}
+	if err := npar.dirmodchk(cred, nchild); err != 0 {
+		return err
+	}
+	// moving a directory rewrites its ".."
+	if odir && opar != npar {
+		if err := ochild.access(cred, defs.W_OK); err != 0 {
+			return err
+		}
+	}
+	// if src and dst are the same file, we are done
+	if nchild == ochild {
+		return 0
+	}
+	if nchild != nil {
+		// make sure old and new are either both files or both
+		// directories
+		if err := nchild.dirchk(odir); err != 0 {
+			return err
+		}
+		npar._unlink(nfn, nchild)
+	}
+	opar.remove(ofn)
+	npar.insert(nfn, ochild)
+	if odir {
+		ochild.parent = npar
+	}
+	ochild.Lock()
+	ochild.ctime = nodetime()
+	ochild.Unlock()
+	return 0
+}
+
+// creates a symlink named paths which refers to target
+func (tfs *Tmpfs_t) Fs_symlink(target, paths ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	if len(target) == 0 {
+		return -defs.ENOENT
+	}
+	if len(target) > fs.NAME_MAX {
+		return -defs.ENAMETOOLONG
+	}
+	tfs.Lock()
+	defer tfs.Unlock()
+	dirs, fn := bpath.Sdirname(paths)
+	if err := crname(fn, -defs.ENOENT); err != 0 {
+		return err
+	}
+	dir, err := tfs._namei(dirs, cwd, cred, true)
+	if err != 0 {
+		return err
+	}
+	n, err := tfs._create(dir, fn, fs.I_SYMLINK, 0777, cred)
+	if err != 0 {
+		return err
+	}
+	n.target = append(ustr.Ustr{}, target...)
+	n.size = len(target)
+	return 0
+}
+
+// returns the target of the symlink named by paths
+func (tfs *Tmpfs_t) Fs_readlink(paths ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t) (ustr.Ustr, defs.Err_t) {
+	tfs.RLock()
+	defer tfs.RUnlock()
+	n, err := tfs._namei(paths, cwd, cred, false)
+	if err != 0 {
+		return nil, err
+	}
+	if n.itype != fs.I_SYMLINK {
+		return nil, -defs.EINVAL
+	}
+	return append(ustr.Ustr{}, n.target...), 0
+}
+
+func (tfs *Tmpfs_t) Fs_chmod(paths ustr.Ustr, mode int, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	return tfs._setattr(paths, cwd, cred, true, func(n *tnode_t) defs.Err_t {
+		if err := n.ownerchk(cred); err != 0 {
+			return err
+		}
+		if !cred.Isroot() && !cred.Ingroup(n.gid) {
+			mode &^= fs.S_ISGID
+		}
+		n.mode = mode & 07777
+		return 0
+	})
+}
+
+// a uid or gid of -1 is left unchanged. only the superuser may change the
+// owner; the owner may change the group to one of its groups.
+func (tfs *Tmpfs_t) Fs_chown(paths ustr.Ustr, uid, gid int, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	return tfs._setattr(paths, cwd, cred, true, func(n *tnode_t) defs.Err_t {
+		if !cred.Isroot() {
+			if uid != -1 && uid != n.uid {
+				return -defs.EPERM
+			}
+			if err := n.ownerchk(cred); err != 0 {
+				return err
+			}
+			if gid != -1 && !cred.Ingroup(gid) {
+				return -defs.EPERM
+			}
+		}
+		if uid != -1 {
+			n.uid = uid
+		}
+		if gid != -1 {
+			n.gid = gid
+		}
+		if n.itype != fs.I_DIR {
+			n.mode &^= fs.S_ISUID | fs.S_ISGID
+		}
+		return 0
+	})
+}
+
+// atime and mtime are in nanoseconds since the epoch; a negative time is left
+// unchanged. if follow is false, a symlink in the last component is updated
+// instead of its target.
+func (tfs *Tmpfs_t) Fs_utimens(paths ustr.Ustr, atime, mtime int, follow bool, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	return tfs._setattr(paths, cwd, cred, follow, func(n *tnode_t) defs.Err_t {
+		if err := n.ownerchk(cred); err != 0 {
+			return err
+		}
+		if atime >= 0 {
+			n.atime = atime
+		}
+		if mtime >= 0 {
+			n.mtime = mtime
+		}
+		return 0
+	})
+}
+
+// applies setattr to the node named by paths with both the tree lock and the
+// node's lock held
+func (tfs *Tmpfs_t) _setattr(paths ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t, follow bool, setattr func(*tnode_t) defs.Err_t) defs.Err_t {
+	tfs.Lock()
+	defer tfs.Unlock()
+	n, err := tfs._namei(paths, cwd, cred, follow)
+	if err != 0 {
+		return err
+	}
+	n.Lock()
+	err = setattr(n)
+	if err == 0 {
+		n.ctime = nodetime()
+	}
+	n.Unlock()
+	return err
+}
+
+// there is nothing to write back
+func (tfs *Tmpfs_t) Fs_setxattr(paths, name ustr.Ustr, value []uint8, flags int, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	return -defs.EOPNOTSUPP
+}
+
+func (tfs *Tmpfs_t) Fs_getxattr(paths, name ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t) ([]uint8, defs.Err_t) {
+	return nil, -defs.EOPNOTSUPP
+}
+
+func (tfs *Tmpfs_t) Fs_listxattr(paths ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t) ([]uint8, defs.Err_t) {
+	return nil, -defs.EOPNOTSUPP
+}
+
+func (tfs *Tmpfs_t) Fs_removexattr(paths, name ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	return -defs.EOPNOTSUPP
+}
+
+func (tfs *Tmpfs_t) Fs_sync() defs.Err_t {
+	return 0
+}
+
+func (tfs *Tmpfs_t) Fs_resize(nblocks int) defs.Err_t {
+	return -defs.EOPNOTSUPP
+}
+
+func (tfs *Tmpfs_t) MkRootCwd() *fd.Cwd_t {
+	f := &fd.Fd_t{Fops: &tfops_t{n: tfs.root, tfs: tfs, count: 0}}
+	return fd.MkRootCwd(f)
+}
+
+// fails if a file is open or a process has its cwd in the file system.
+// otherwise frees all nodes.
+func (tfs *Tmpfs_t) Fs_umount() defs.Err_t {
+	tfs.Lock()
+	defer tfs.Unlock()
+	if atomic.LoadInt64(&tfs.nopen) != 0 {
+		return -defs.EBUSY
+	}
+	tfs.root.freetree()
+	return 0
+}
@@ -0,0 +1,62 @@
+package ufs
+
+import "testing"
+
+import "defs"
+import "device"
+import "fs"
+import "ustr"
+
+func TestDevfs(t *testing.T) {
+	tfs, done := mkTestFS(t, "Devfs")
+	if e := tfs.MkDir(ustr.Ustr("dev")); e != 0 {
+		t.Fatalf("mkDir failed %v", e)
+	}
+	if e := tfs.MountDevfs(ustr.Ustr("dev")); e != 0 {
+		t.Fatalf("MountDevfs failed %v", e)
+	}
+	maj := device.Majalloc()
+	device.Register("testnull", maj, 3, 0640, fs.Devopen(defs.D_DEVNULL))
+	des, e := tfs.Ls(ustr.Ustr("dev"))
+	if e != 0 {
+		t.Fatalf("Ls failed %v", e)
+	}
+	st, ok := des["testnull"]
+	if !ok || st.Rdev() != defs.Mkdev(maj, 3) || st.Mode()&0777 != 0640 {
+		t.Fatalf("bad node %v %v", ok, st)
+	}
+	f, e := tfs.vfs.Fs_open(ustr.Ustr("dev/testnull"), defs.O_WRONLY, 0, tfs.cwd, tfs.cred, 0, 0)
+	if e != 0 {
+		t.Fatalf("open failed %v", e)
+	}
+	if n, e := f.Fops.Write(mkData(1, SMALL)); e != 0 || n != SMALL {
+		t.Fatalf("Write failed %v %v", n, e)
+	}
+	f.Fops.Close()
+	if e := tfs.MkFile(ustr.Ustr("dev/x"), nil); e != -defs.EPERM {
+		t.Fatalf("MkFile in devfs %v", e)
+	}
+
+	// a node in another file system opens the same device
+	n := ustr.Ustr("n")
+	if _, e := tfs.vfs.Fs_mknod(n, defs.O_CREAT, 0666, tfs.cwd, tfs.cred, maj, 3); e != 0 {
+		t.Fatalf("mknod failed %v", e)
+	}
+	f, e = tfs.vfs.Fs_open(n, defs.O_WRONLY, 0, tfs.cwd, tfs.cred, 0, 0)
+	if e != 0 {
+		t.Fatalf("open failed %v", e)
+	}
+	f.Fops.Close()
+
+	device.Unregister("testnull")
+	if _, e := tfs.vfs.Fs_open(n, defs.O_WRONLY, 0, tfs.cwd, tfs.cred, 0, 0); e != -defs.ENXIO {
+		t.Fatalf("open of unregistered device %v", e)
+	}
+	if _, e := tfs.Stat(ustr.Ustr("dev/testnull")); e != -defs.ENOENT {
+		t.Fatalf("Stat of unregistered device %v", e)
+	}
+	if e := tfs.Umount(ustr.Ustr("dev")); e != 0 {
+		t.Fatalf("Umount failed %v", e)
+	}
+	done()
+}
@@ -18,8 +18,8 @@ type ahci_disk_t struct {
 	t *tracef_t
 }
 
-func (ahci *ahci_disk_t) StartTrace() {
-	ahci.t = mkTrace()
+func (ahci *ahci_disk_t) StartTrace(p string) {
+	ahci.t = mkTrace(p)
 }
 
 func (ahci *ahci_disk_t) Seek(o int) {
@@ -35,19 +35,21 @@ func (ahci *ahci_disk_t) Start(req *fs.Bdev_req_t) bool {
 
 	switch req.Cmd {
 	case fs.BDEV_READ:
-		if req.Blks.Len() != 1 {
-			panic("read: too many blocks")
-		}
-		blk := req.Blks.FrontBlock()
-		ahci.Seek(blk.Block * fs.BSIZE)
-		b := make([]byte, fs.BSIZE)
-		n, err := ahci.f.Read(b)
-		if n != fs.BSIZE || err != nil {
-			panic(err)
-		}
-		blk.Data = &mem.Bytepg_t{}
-		for i, _ := range b {
-			blk.Data[i] = uint8(b[i])
+		for blk := req.Blks.FrontBlock(); blk != nil; blk = req.Blks.NextBlock() {
+			ahci.Seek(blk.Block * fs.BSIZE)
+			b := make([]byte, fs.BSIZE)
+			n, err := ahci.f.Read(b)
+			if n != fs.BSIZE || err != nil {
+				panic(err)
+			}
+			// like DMA, fill the block's page, which may be a user
+			// page
+			if blk.Data == nil {
+				blk.Data = &mem.Bytepg_t{}
+			}
+			for i, _ := range b {
+				blk.Data[i] = uint8(b[i])
+			}
 		}
 	case fs.BDEV_WRITE:
 		for b := req.Blks.FrontBlock(); b != nil; b = req.Blks.NextBlock() {
@@ -93,14 +95,21 @@ func (ahci *ahci_disk_t) close() {
 // Glue
 //
 
+// hands out the pages of blocks. the addresses are distinct, since the block
+// cache keys the blocks a shared mapping pins by address.
 type blockmem_t struct {
+	sync.Mutex
+	last mem.Pa_t
 }
 
 var blockmem = &blockmem_t{}
 
 func (bm *blockmem_t) Alloc() (mem.Pa_t, *mem.Bytepg_t, bool) {
+	bm.Lock()
+	defer bm.Unlock()
+	bm.last += mem.Pa_t(mem.PGSIZE)
 	d := &mem.Bytepg_t{}
-	return mem.Pa_t(0), d, true
+	return bm.last, d, true
 }
 
 func (bm *blockmem_t) Free(pa mem.Pa_t) {
@@ -109,6 +118,69 @@ func (bm *blockmem_t) Free(pa mem.Pa_t) {
 func (bm *blockmem_t) Refup(pa mem.Pa_t) {
 }
 
+// hands out the pages of tmpfs and tracks their references
+type pagemem_t struct {
+	sync.Mutex
+	last mem.Pa_t
+	refs map[mem.Pa_t]int
+}
+
+var pagemem = &pagemem_t{refs: make(map[mem.Pa_t]int)}
+
+func (pm *pagemem_t) Refpg_new() (*mem.Pg_t, mem.Pa_t, bool) {
+	pm.Lock()
+	defer pm.Unlock()
+	pm.last += mem.Pa_t(mem.PGSIZE)
+	pm.refs[pm.last] = 0
+	return &mem.Pg_t{}, pm.last, true
+}
+
+func (pm *pagemem_t) Refpg_new_nozero() (*mem.Pg_t, mem.Pa_t, bool) {
+	return pm.Refpg_new()
+}
+
+func (pm *pagemem_t) Refcnt(pa mem.Pa_t) int {
+	pm.Lock()
+	defer pm.Unlock()
+	return pm.refs[pa]
+}
+
+func (pm *pagemem_t) Dmap(pa mem.Pa_t) *mem.Pg_t {
+	return nil
+}
+
+func (pm *pagemem_t) Refup(pa mem.Pa_t) {
+	pm.Lock()
+	defer pm.Unlock()
+	pm.refs[pa]++
+}
+
+func (pm *pagemem_t) Refdown(pa mem.Pa_t) bool {
+	pm.Lock()
+	defer pm.Unlock()
+	pm.refs[pa]--
+	if pm.refs[pa] < 0 {
+		panic("refdown")
+	}
+	if pm.refs[pa] == 0 {
+		delete(pm.refs, pa)
+		return true
+	}
+	return false
+}
+
+// returns the number of pages which have not been freed
+func (pm *pagemem_t) npages() int {
+	pm.Lock()
+	defer pm.Unlock()
+	return len(pm.refs)
+}
+
+// pagemem has no free pages and no page tables
+func (pm *pagemem_t) Pgcount() (int, int) {
+	return 0, 0
+}
+
 type console_t struct {
 }
 
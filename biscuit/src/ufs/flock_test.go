@@ -0,0 +1,96 @@
+package ufs
+
+import "testing"
+import "time"
+
+import "defs"
+import "fd"
+import "flock"
+import "ustr"
+
+func TestLocks(t *testing.T) {
+	tfs, done := mkTestFS(t, "Locks")
+	if e := tfs.MkFile(ustr.Ustr("f"), mkData(1, SMALL)); e != 0 {
+		t.Fatalf("mkFile failed %v", e)
+	}
+	open := func() *fd.Fd_t {
+		f, e := tfs.vfs.Fs_open(ustr.Ustr("f"), defs.O_RDWR, 0, tfs.cwd, tfs.cred, 0, 0)
+		if e != 0 {
+			t.Fatalf("open failed %v", e)
+		}
+		return f
+	}
+	f1, f2 := open(), open()
+	ls, e := f1.Fops.Locks()
+	if e != 0 {
+		t.Fatalf("Locks failed %v", e)
+	}
+
+	// flock(2) locks belong to the open file and its dups
+	if e := ls.Flock(f1.Fops, defs.LOCK_EX); e != 0 {
+		t.Fatalf("Flock failed %v", e)
+	}
+	if e := ls.Flock(f2.Fops, defs.LOCK_SH|defs.LOCK_NB); e != -defs.EWOULDBLOCK {
+		t.Fatalf("Flock of locked file %v", e)
+	}
+	dup, e := fd.Copyfd(f1)
+	if e != 0 {
+		t.Fatalf("Copyfd failed %v", e)
+	}
+	fd.Close_panic(f1)
+	if e := ls.Flock(f2.Fops, defs.LOCK_EX|defs.LOCK_NB); e != -defs.EWOULDBLOCK {
+		t.Fatalf("Flock with dup open %v", e)
+	}
+	c := make(chan defs.Err_t)
+	go func() {
+		c <- ls.Flock(f2.Fops, defs.LOCK_EX)
+	}()
+	fd.Close_panic(dup)
+	if e := <-c; e != 0 {
+		t.Fatalf("blocked Flock failed %v", e)
+	}
+
+	// record locks belong to processes
+	const p1, p2, p3 = 1001, 1002, 1003
+	if e := ls.Setlk(p1, defs.F_WRLCK, 0, 10, false); e != 0 {
+		t.Fatalf("Setlk failed %v", e)
+	}
+	if e := ls.Setlk(p2, defs.F_WRLCK, 5, 15, false); e != -defs.EAGAIN {
+		t.Fatalf("Setlk of locked range %v", e)
+	}
+	if e := ls.Setlk(p2, defs.F_RDLCK, 10, 20, false); e != 0 {
+		t.Fatalf("Setlk failed %v", e)
+	}
+	typ, start, end, pid := ls.Getlk(p3, defs.F_RDLCK, 0, 5)
+	if typ != defs.F_WRLCK || start != 0 || end != 10 || pid != p1 {
+		t.Fatalf("Getlk %v %v %v %v", typ, start, end, pid)
+	}
+	if e := ls.Setlk(p1, defs.F_UNLCK, 2, 4, false); e != 0 {
+		t.Fatalf("unlock failed %v", e)
+	}
+	if typ, _, _, _ := ls.Getlk(p3, defs.F_WRLCK, 2, 4); typ != defs.F_UNLCK {
+		t.Fatalf("Getlk of split lock %v", typ)
+	}
+	if typ, _, _, _ := ls.Getlk(p3, defs.F_WRLCK, 4, 5); typ != defs.F_WRLCK {
+		t.Fatalf("Getlk of split lock %v", typ)
+	}
+
+	// p1 sleeps for p2's read lock; p2 sleeping for p1 would deadlock
+	go func() {
+		c <- ls.Setlk(p1, defs.F_WRLCK, 10, 12, true)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if e := ls.Setlk(p2, defs.F_WRLCK, 0, 1, true); e != -defs.EDEADLK {
+		t.Fatalf("Setlk did not detect deadlock %v", e)
+	}
+	ls.Close(p2)
+	if e := <-c; e != 0 {
+		t.Fatalf("blocked Setlk failed %v", e)
+	}
+	flock.Exit(p1)
+	if typ, _, _, _ := ls.Getlk(p3, defs.F_WRLCK, 0, flock.EOF); typ != defs.F_UNLCK {
+		t.Fatalf("locks of exited process remain %v", typ)
+	}
+	fd.Close_panic(f2)
+	done()
+}
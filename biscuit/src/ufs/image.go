@@ -2,6 +2,7 @@ package ufs
 
 import "os"
 import "fmt"
+import "time"
 
 import "fs"
 import "mem"
@@ -23,7 +24,8 @@ import "util"
 // data blocks
 
 const (
-	nbitsperblock = fs.BSIZE * 8
+	// the inode, bitmap, and directory blocks end in a checksum
+	nbitsperblock = (fs.BSIZE - fs.CSUMSIZE) * 8
 )
 
 func bytepg2byte(d *mem.Bytepg_t) []byte {
@@ -46,20 +48,29 @@ func mkBlock() []byte {
 	return make([]byte, fs.BSIZE)
 }
 
+// writes block d, which ends in a checksum
+func writeCsum(f *os.File, d []byte) {
+	pg := &mem.Bytepg_t{}
+	copy(pg[:], d)
+	fs.Csumw(pg)
+	f.Write(bytepg2byte(pg))
+}
+
 func writeBootBlock(f *os.File, superb int) {
 	d := &mem.Bytepg_t{}
 	util.Writen(d[:], 4, fs.FSOFF, superb)
 	f.Write(bytepg2byte(d))
 }
 
-func writeSuperBlock(f *os.File, start int, nlogblks, ninodeblks, ndatablks int) *fs.Superblock_t {
+func writeSuperBlock(f *os.File, start int, nlogblks, ninodeblks, ndatablks, feat int) *fs.Superblock_t {
 	if Tell(f) != start {
 		panic("superblock in wrong location")
 	}
 	d := &mem.Bytepg_t{}
 	sb := fs.Superblock_t{d}
 	sb.SetLoglen(nlogblks)
-	ninode := ninodeblks * (fs.BSIZE / fs.ISIZE)
+	sb.SetFeatures(feat)
+	ninode := ninodeblks * (fs.BSIZE / sb.Isize())
 	ni := ninode/nbitsperblock + 1
 	sb.SetIorphanblock(start + 1 + nlogblks)
 	sb.SetIorphanlen(ni)
@@ -74,7 +85,7 @@ func writeSuperBlock(f *os.File, start int, nlogblks, ninodeblks, ndatablks int)
 }
 
 func markAllocated(d []byte, startbit int) {
-	for i := (startbit / 8) + 1; i < fs.BSIZE; i++ {
+	for i := (startbit / 8) + 1; i < nbitsperblock/8; i++ {
 		d[i] = byte(0xff)
 	}
 	rem := startbit % 8
@@ -94,21 +105,20 @@ func writeInodeMap(f *os.File, sb *fs.Superblock_t, ninodeblks int) {
 	if Tell(f) != sb.Iorphanblock()+sb.Iorphanlen() {
 		panic("incorrect inode map start\n")
 	}
-	ninode := ninodeblks * (fs.BSIZE / fs.ISIZE)
+	ninode := ninodeblks * (fs.BSIZE / sb.Isize())
 	oneblock := mkBlock()
 	oneblock[0] |= 1 << 0 // mark root inode as allocated
 	if sb.Imaplen() == 1 {
 		markAllocated(oneblock, ninode)
-		f.Write(oneblock)
+		writeCsum(f, oneblock)
 	} else {
-		f.Write(oneblock)
+		writeCsum(f, oneblock)
 		block := mkBlock()
 		for i := 1; i < sb.Imaplen()-1; i++ {
-			f.Write(block)
+			writeCsum(f, block)
 		}
-		start := nbitsperblock - ninode%nbitsperblock
-		markAllocated(block, start)
-		f.Write(block)
+		markAllocated(block, ninode%nbitsperblock)
+		writeCsum(f, block)
 	}
 }
 
@@ -118,7 +128,7 @@ func writeOrphanMap(f *os.File, sb *fs.Superblock_t, ninodeblks int) {
 	}
 	block := mkBlock()
 	for i := 0; i < sb.Iorphanlen(); i++ {
-		f.Write(block)
+		writeCsum(f, block)
 	}
 }
 
@@ -131,21 +141,21 @@ func writeBlockMap(f *os.File, sb *fs.Superblock_t, ndatablks int) {
 		block := mkBlock()
 		block[0] |= 1 << 0 // mark root dir block as allocated
 		markAllocated(block, ndatablks)
-		f.Write(block)
+		writeCsum(f, block)
 	} else {
 		block := mkBlock()
 		block[0] |= 1 << 0 // mark root dir block as allocated
-		f.Write(block)
+		writeCsum(f, block)
 
 		block = mkBlock()
 		for i := 1; i < sb.Freeblocklen()-1; i++ {
-			f.Write(block)
+			writeCsum(f, block)
 		}
 
 		// write last block
 		o := ndatablks % nbitsperblock
 		markAllocated(block, o)
-		f.Write(block)
+		writeCsum(f, block)
 	}
 	if Tell(f) != sb.Freeblock()+sb.Freeblocklen() {
 		panic("incorrect free block map\n")
@@ -156,13 +166,23 @@ func writeBlockMap(f *os.File, sb *fs.Superblock_t, ndatablks int) {
 func writeInodes(f *os.File, sb *fs.Superblock_t) {
 	b := fs.MkBlock(0, "", nil, nil, nil)
 	b.Data = &mem.Bytepg_t{}
-	root := fs.Inode_t{b, 0}
+	root := fs.Inode_t{b, 0, sb.Isize()}
 
 	firstdata := sb.Freeblock() + sb.Freeblocklen() + sb.Inodelen()
 	root.W_itype(fs.I_DIR)
 	root.W_linkcount(1)
 	root.W_size(fs.BSIZE)
-	root.W_addr(0, firstdata)
+	if sb.Features()&fs.FEAT_EXTENTS != 0 {
+		root.W_extmap(firstdata, 1)
+	} else {
+		root.W_addr(0, firstdata)
+	}
+	root.W_mode(0755)
+	root.W_owner(0, 0)
+	now := int(time.Now().UnixNano())
+	root.W_atime(now)
+	root.W_mtime(now)
+	root.W_ctime(now)
 	block := bytepg2byte(b.Data)
 
 	if Tell(f) != sb.Freeblock()+sb.Freeblocklen() {
@@ -170,10 +190,15 @@ func writeInodes(f *os.File, sb *fs.Superblock_t) {
 		panic("inodes don't line up")
 	}
 
-	f.Write(block)
+	// ISIZE inodes leave no room for a checksum
+	write := writeCsum
+	if sb.Isize() == fs.ISIZE {
+		write = func(f *os.File, d []byte) { f.Write(d) }
+	}
+	write(f, block)
 	zeroblock := mkBlock()
 	for i := 1; i < sb.Inodelen(); i++ {
-		f.Write(zeroblock)
+		write(f, zeroblock)
 	}
 }
 
@@ -189,6 +214,7 @@ func writeDataBlocks(f *os.File, sb *fs.Superblock_t, ndatablks int) {
 		ddata.W_filename(i, ustr.MkUstr())
 		ddata.W_inodenext(i, 0)
 	}
+	fs.Csumw(data)
 	d := bytepg2byte(data)
 
 	if Tell(f) != sb.Freeblock()+sb.Freeblocklen()+sb.Inodelen() {
@@ -281,6 +307,12 @@ func pokeboot(f *os.File, start int) {
 }
 
 func MkDisk(disk string, images []string, nlogblks, ninodeblks, ndatablks int) {
+	MkDiskFeatures(disk, images, nlogblks, ninodeblks, ndatablks, 0)
+}
+
+// MkDiskFeatures is MkDisk for a file system with the given superblock feature
+// flags, such as fs.FEAT_EXTENTS.
+func MkDiskFeatures(disk string, images []string, nlogblks, ninodeblks, ndatablks, feat int) {
 	fmt.Printf("Make FS disk %s\n", disk)
 	f, err := os.Create(disk)
 	if err != nil {
@@ -301,7 +333,7 @@ func MkDisk(disk string, images []string, nlogblks, ninodeblks, ndatablks int) {
 	}
 
 	fmt.Printf("superblock at block %d\n", start)
-	sb := writeSuperBlock(f, start, nlogblks, ninodeblks, ndatablks)
+	sb := writeSuperBlock(f, start, nlogblks, ninodeblks, ndatablks, feat)
 	writeLog(f, nlogblks)
 	writeOrphanMap(f, sb, ninodeblks)
 	writeInodeMap(f, sb, ninodeblks)
@@ -0,0 +1,143 @@
+package ufs
+
+import "strings"
+import "testing"
+
+import "defs"
+import "fdops"
+import "inotify"
+import "ustr"
+import "util"
+import "vm"
+
+type inevent_t struct {
+	wd     int
+	mask   int
+	cookie int
+	name   string
+}
+
+// reads the queued events of in
+func inevents(t *testing.T, in *inotify.Inotify_t) []inevent_t {
+	buf := make([]uint8, 4096)
+	ub := &vm.Fakeubuf_t{}
+	ub.Fake_init(buf)
+	n, e := in.Read(ub)
+	if e != 0 {
+		t.Fatalf("inotify read failed %v", e)
+	}
+	var ret []inevent_t
+	for off := 0; off < n; {
+		ev := inevent_t{wd: util.Readn(buf, 4, off),
+			mask: util.Readn(buf, 4, off+4), cookie: util.Readn(buf, 4, off+8)}
+		l := util.Readn(buf, 4, off+12)
+		off += 16
+		ev.name = strings.TrimRight(string(buf[off:off+l]), "\x00")
+		off += l
+		ret = append(ret, ev)
+	}
+	return ret
+}
+
+func TestInotify(t *testing.T) {
+	tfs, done := mkTestFS(t, "Inotify")
+	in := inotify.MkInotify(defs.O_NONBLOCK)
+	watch := func(p string, mask int) int {
+		st, e := tfs.Stat(ustr.Ustr(p))
+		if e != 0 {
+			t.Fatalf("stat %v failed %v", p, e)
+		}
+		wd, e := in.Addwatch(st.Dev(), defs.Inum_t(st.Rino()), mask)
+		if e != 0 {
+			t.Fatalf("Addwatch %v failed %v", p, e)
+		}
+		return wd
+	}
+	expect := func(want ...inevent_t) {
+		got := inevents(t, in)
+		if len(got) != len(want) {
+			t.Fatalf("events %v, want %v", got, want)
+		}
+		// the events with a non-zero cookie in want must share some
+		// other non-zero cookie
+		cookie := 0
+		for i := range got {
+			if want[i].cookie != 0 && got[i].cookie != 0 {
+				if cookie == 0 {
+					cookie = got[i].cookie
+				}
+				want[i].cookie = cookie
+			}
+			if got[i] != want[i] {
+				t.Fatalf("events %v, want %v", got, want)
+			}
+		}
+	}
+
+	rwd := watch("/", defs.IN_ALL_EVENTS)
+	if e := tfs.MkFile(ustr.Ustr("f"), nil); e != 0 {
+		t.Fatalf("mkFile failed %v", e)
+	}
+	if e := tfs.MkDir(ustr.Ustr("d")); e != 0 {
+		t.Fatalf("mkDir failed %v", e)
+	}
+	expect(inevent_t{wd: rwd, mask: defs.IN_CREATE, name: "f"},
+		inevent_t{wd: rwd, mask: defs.IN_CREATE | defs.IN_ISDIR, name: "d"})
+
+	fwd := watch("f", defs.IN_MODIFY|defs.IN_DELETE_SELF)
+	if fwd2 := watch("f", defs.IN_ATTRIB|defs.IN_MOVE_SELF|defs.IN_MASK_ADD); fwd2 != fwd {
+		t.Fatalf("second watch of f %v %v", fwd, fwd2)
+	}
+	if e := tfs.Append(ustr.Ustr("f"), mkData(1, SMALL)); e != 0 {
+		t.Fatalf("append failed %v", e)
+	}
+	if e := tfs.Truncate(ustr.Ustr("f"), 1); e != 0 {
+		t.Fatalf("truncate failed %v", e)
+	}
+	if e := tfs.Chmod(ustr.Ustr("f"), 0600); e != 0 {
+		t.Fatalf("chmod failed %v", e)
+	}
+	expect(inevent_t{wd: fwd, mask: defs.IN_MODIFY},
+		inevent_t{wd: fwd, mask: defs.IN_ATTRIB})
+
+	// the events of a rename share a cookie
+	dwd := watch("d", defs.IN_ALL_EVENTS)
+	if e := tfs.Rename(ustr.Ustr("f"), ustr.Ustr("d/g")); e != 0 {
+		t.Fatalf("rename failed %v", e)
+	}
+	expect(inevent_t{wd: rwd, mask: defs.IN_MOVED_FROM, cookie: 1, name: "f"},
+		inevent_t{wd: dwd, mask: defs.IN_MOVED_TO, cookie: 1, name: "g"},
+		inevent_t{wd: fwd, mask: defs.IN_MOVE_SELF})
+
+	// deleting an inode removes its watches
+	if e := tfs.Unlink(ustr.Ustr("d/g")); e != 0 {
+		t.Fatalf("unlink failed %v", e)
+	}
+	expect(inevent_t{wd: dwd, mask: defs.IN_DELETE, name: "g"},
+		inevent_t{wd: fwd, mask: defs.IN_DELETE_SELF},
+		inevent_t{wd: fwd, mask: defs.IN_IGNORED})
+	if e := in.Rmwatch(fwd); e != -defs.EINVAL {
+		t.Fatalf("Rmwatch of removed watch %v", e)
+	}
+
+	if _, e := in.Read(mkData(0, 4096)); e != -defs.EWOULDBLOCK {
+		t.Fatalf("read of empty instance %v", e)
+	}
+	pm := fdops.Pollmsg_t{}
+	pm.Pm_set(0, fdops.R_READ, false)
+	if r, _ := in.Pollone(pm); r != 0 {
+		t.Fatalf("empty instance is ready %v", r)
+	}
+	if e := in.Rmwatch(dwd); e != 0 {
+		t.Fatalf("Rmwatch failed %v", e)
+	}
+	if r, _ := in.Pollone(pm); r != fdops.R_READ {
+		t.Fatalf("instance is not ready %v", r)
+	}
+	if _, e := in.Read(mkData(0, 8)); e != -defs.EINVAL {
+		t.Fatalf("read with small buffer %v", e)
+	}
+	expect(inevent_t{wd: dwd, mask: defs.IN_IGNORED})
+	in.Close()
+	done()
+}
@@ -0,0 +1,269 @@
+package ufs
+
+import "os"
+import "testing"
+
+import "defs"
+import "fd"
+import "proc"
+import "tmpfs"
+import "ustr"
+import "vfs"
+
+// a file system whose access checks wait for the test
+type slowfs_t struct {
+	vfs.Fs_i
+	in  chan bool
+	out chan bool
+}
+
+func (s *slowfs_t) Fs_access(paths ustr.Ustr, amode int, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	s.in <- true
+	<-s.out
+	return s.Fs_i.Fs_access(paths, amode, cwd, cred)
+}
+
+func TestMount(t *testing.T) {
+	tfs, done := mkTestFS(t, "Mount")
+	dst2 := "tmp2.img"
+	MkDisk(dst2, nil, nlogblks, ninodeblks, ndatablks)
+	other := BootFS(dst2)
+	if e := other.MkFile(ustr.Ustr("x"), mkData(1, SMALL)); e != 0 {
+		t.Fatalf("mkFile x failed %v", e)
+	}
+	for _, d := range []string{"mnt", "d", "d/e"} {
+		if e := tfs.MkDir(ustr.Ustr(d)); e != 0 {
+			t.Fatalf("mkDir %v failed %v", d, e)
+		}
+	}
+	if e := tfs.MkFile(ustr.Ustr("mnt/hidden"), nil); e != 0 {
+		t.Fatalf("mkFile failed %v", e)
+	}
+	if e := tfs.Mount(ustr.Ustr("mnt/hidden"), other); e != -defs.ENOTDIR {
+		t.Fatalf("Mount on a file %v", e)
+	}
+	if e := tfs.Mount(ustr.Ustr("mnt"), other); e != 0 {
+		t.Fatalf("Mount failed %v", e)
+	}
+	// each disk file system has a device number of its own
+	st1, e1 := tfs.Stat(ustr.Ustr("/"))
+	st2, e2 := tfs.Stat(ustr.Ustr("mnt"))
+	if e1 != 0 || e2 != 0 || st1.Dev() == st2.Dev() || st1.Rino() != st2.Rino() {
+		t.Fatalf("Stat of the roots %v %v", e1, e2)
+	}
+
+	// the mount hides mnt's contents
+	if d, e := tfs.Read(ustr.Ustr("/mnt/x")); e != 0 || len(d) != SMALL {
+		t.Fatalf("Read mnt/x failed %v", e)
+	}
+	if _, e := tfs.Stat(ustr.Ustr("mnt/hidden")); e != -defs.ENOENT {
+		t.Fatalf("Stat mnt/hidden %v", e)
+	}
+	if e := tfs.MkFile(ustr.Ustr("mnt/y"), nil); e != 0 {
+		t.Fatalf("mkFile mnt/y failed %v", e)
+	}
+	// .. leaves the mount
+	if e := tfs.MkFile(ustr.Ustr("mnt/../z"), nil); e != 0 {
+		t.Fatalf("mkFile mnt/../z failed %v", e)
+	}
+	if _, e := tfs.Stat(ustr.Ustr("z")); e != 0 {
+		t.Fatalf("Stat z failed %v", e)
+	}
+	if e := tfs.Rename(ustr.Ustr("mnt/y"), ustr.Ustr("y")); e != -defs.EXDEV {
+		t.Fatalf("Rename across mounts %v", e)
+	}
+
+	// bind the mounted file system's root below d
+	if e := tfs.Bind(ustr.Ustr("mnt"), ustr.Ustr("d/e")); e != 0 {
+		t.Fatalf("Bind failed %v", e)
+	}
+	if _, e := tfs.Stat(ustr.Ustr("d/e/y")); e != 0 {
+		t.Fatalf("Stat d/e/y failed %v", e)
+	}
+	if e := tfs.Rename(ustr.Ustr("mnt/y"), ustr.Ustr("d/e/y2")); e != -defs.EXDEV {
+		t.Fatalf("Rename across bind mounts %v", e)
+	}
+	// the mount moves with its mount point
+	if e := tfs.Rename(ustr.Ustr("d"), ustr.Ustr("d2")); e != 0 {
+		t.Fatalf("Rename of a mount point's parent %v", e)
+	}
+	if _, e := tfs.Stat(ustr.Ustr("d2/e/y")); e != 0 {
+		t.Fatalf("Stat d2/e/y failed %v", e)
+	}
+	if e := tfs.Umount(ustr.Ustr("mnt")); e != -defs.EBUSY {
+		t.Fatalf("Umount with a bind mount %v", e)
+	}
+	if e := tfs.Umount(ustr.Ustr("d2/e")); e != 0 {
+		t.Fatalf("Umount d2/e failed %v", e)
+	}
+	if e := tfs.Umount(ustr.Ustr("d2/e")); e != -defs.EINVAL {
+		t.Fatalf("Umount of a directory %v", e)
+	}
+
+	// an open directory keeps the file system busy
+	f, e := tfs.Opendir(ustr.Ustr("mnt"))
+	if e != 0 {
+		t.Fatalf("Opendir failed %v", e)
+	}
+	if e := tfs.Umount(ustr.Ustr("mnt")); e != -defs.EBUSY {
+		t.Fatalf("Umount with an open file %v", e)
+	}
+	f.Fops.Close()
+	if e := tfs.Umount(ustr.Ustr("mnt")); e != 0 {
+		t.Fatalf("Umount failed %v", e)
+	}
+	if _, e := tfs.Stat(ustr.Ustr("mnt/hidden")); e != 0 {
+		t.Fatalf("Stat mnt/hidden failed %v", e)
+	}
+	if e := tfs.Umount(ustr.Ustr("/")); e != -defs.EBUSY {
+		t.Fatalf("Umount / %v", e)
+	}
+
+	// an operation in progress keeps the file system busy, even before
+	// it references an inode
+	slow := &slowfs_t{Fs_i: tmpfs.MkTmpfs(pagemem), in: make(chan bool),
+		out: make(chan bool)}
+	if e := tfs.vfs.Mountfs(slow, ustr.Ustr("mnt"), tfs.cwd, tfs.cred); e != 0 {
+		t.Fatalf("Mountfs failed %v", e)
+	}
+	res := make(chan defs.Err_t)
+	go func() {
+		res <- tfs.vfs.Fs_access(ustr.Ustr("mnt"), 0, tfs.cwd, tfs.cred)
+	}()
+	<-slow.in
+	if e := tfs.Umount(ustr.Ustr("mnt")); e != -defs.EBUSY {
+		t.Fatalf("Umount with an operation in progress %v", e)
+	}
+	slow.out <- true
+	if e := <-res; e != 0 {
+		t.Fatalf("Fs_access mnt failed %v", e)
+	}
+	if e := tfs.Umount(ustr.Ustr("mnt")); e != 0 {
+		t.Fatalf("Umount failed %v", e)
+	}
+	done()
+	other.ahci.close()
+
+	// umount committed the mounted file system
+	other = BootFS(dst2)
+	if _, e := other.Stat(ustr.Ustr("y")); e != 0 {
+		t.Fatalf("Stat y failed %v", e)
+	}
+	ShutdownFS(other)
+	if r := Fsck(dst2, false); len(r.Problems) != 0 {
+		t.Fatalf("fsck %v: %v", dst2, r.Problems)
+	}
+	os.Remove(dst2)
+}
+
+// paths cross mounts at mount point directories, wherever the walk to them
+// starts
+func TestMountPaths(t *testing.T) {
+	tfs, done := mkTestFS(t, "MountPaths")
+	for _, d := range []string{"a", "a/b", "tmp"} {
+		if e := tfs.MkDir(ustr.Ustr(d)); e != 0 {
+			t.Fatalf("mkDir %v failed %v", d, e)
+		}
+	}
+	if e := tfs.MountTmpfs(ustr.Ustr("tmp")); e != 0 {
+		t.Fatalf("MountTmpfs failed %v", e)
+	}
+	if e := tfs.MkFile(ustr.Ustr("tmp/f"), mkData(1, SMALL)); e != 0 {
+		t.Fatalf("mkFile failed %v", e)
+	}
+	if e := tfs.MkFile(ustr.Ustr("a/b/x"), nil); e != 0 {
+		t.Fatalf("mkFile failed %v", e)
+	}
+
+	// relative paths start at the cwd, even after it moved
+	if e := tfs.Chdir(ustr.Ustr("a/b")); e != 0 {
+		t.Fatalf("Chdir failed %v", e)
+	}
+	if e := tfs.Rename(ustr.Ustr("/a"), ustr.Ustr("/c")); e != 0 {
+		t.Fatalf("Rename failed %v", e)
+	}
+	if _, e := tfs.Stat(ustr.Ustr("x")); e != 0 {
+		t.Fatalf("Stat x in the moved cwd %v", e)
+	}
+	if d, e := tfs.Read(ustr.Ustr("../../tmp/f")); e != 0 || len(d) != SMALL {
+		t.Fatalf("Read ../../tmp/f %v", e)
+	}
+
+	// a symlink to a mount point leads into the mount
+	if e := tfs.Symlink(ustr.Ustr("/tmp"), ustr.Ustr("/l")); e != 0 {
+		t.Fatalf("Symlink failed %v", e)
+	}
+	if d, e := tfs.Read(ustr.Ustr("/l/f")); e != 0 || len(d) != SMALL {
+		t.Fatalf("Read /l/f %v", e)
+	}
+
+	// .. after a symlink to a directory is the directory's parent
+	if e := tfs.Symlink(ustr.Ustr("/c/b"), ustr.Ustr("/s")); e != 0 {
+		t.Fatalf("Symlink failed %v", e)
+	}
+	if _, e := tfs.Stat(ustr.Ustr("/s/../b/x")); e != 0 {
+		t.Fatalf("Stat /s/../b/x %v", e)
+	}
+
+	// an absolute symlink in a mount starts at the root of all mounts
+	if e := tfs.Symlink(ustr.Ustr("/c/b/x"), ustr.Ustr("/tmp/abs")); e != 0 {
+		t.Fatalf("Symlink failed %v", e)
+	}
+	if _, e := tfs.Stat(ustr.Ustr("/tmp/abs")); e != 0 {
+		t.Fatalf("Stat /tmp/abs %v", e)
+	}
+
+	// a cwd in the mount; .. from its root leaves it
+	if e := tfs.Chdir(ustr.Ustr("/l")); e != 0 {
+		t.Fatalf("Chdir failed %v", e)
+	}
+	if _, e := tfs.Stat(ustr.Ustr("../c/b/x")); e != 0 {
+		t.Fatalf("Stat ../c/b/x %v", e)
+	}
+	if e := tfs.Rename(ustr.Ustr("f"), ustr.Ustr("/tmp/g")); e != 0 {
+		t.Fatalf("Rename in the mount %v", e)
+	}
+	if e := tfs.Umount(ustr.Ustr("/tmp")); e != -defs.EBUSY {
+		t.Fatalf("Umount of the cwd's mount %v", e)
+	}
+	if e := tfs.Chdir(ustr.Ustr("..")); e != 0 {
+		t.Fatalf("Chdir failed %v", e)
+	}
+	if e := tfs.Umount(ustr.Ustr("/l")); e != 0 {
+		t.Fatalf("Umount failed %v", e)
+	}
+	if _, e := tfs.Stat(ustr.Ustr("l/g")); e != -defs.ENOENT {
+		t.Fatalf("Stat l/g after umount %v", e)
+	}
+
+	// the walk needs search permission on each directory, but no read
+	// permission
+	if e := tfs.MountTmpfs(ustr.Ustr("tmp")); e != 0 {
+		t.Fatalf("MountTmpfs failed %v", e)
+	}
+	if e := tfs.Chmod(ustr.Ustr("c"), 0711); e != 0 {
+		t.Fatalf("Chmod failed %v", e)
+	}
+	if e := tfs.Chmod(ustr.Ustr("c/b"), 0311); e != 0 {
+		t.Fatalf("Chmod failed %v", e)
+	}
+	tfs.SetCred(&proc.Cred_t{Uid: 1000, Euid: 1000, Suid: 1000,
+		Gid: 1000, Egid: 1000, Sgid: 1000})
+	if _, e := tfs.Stat(ustr.Ustr("/c/b/x")); e != 0 {
+		t.Fatalf("Stat through search-only directories %v", e)
+	}
+	tfs.SetCred(proc.Rootcred)
+	if e := tfs.Chmod(ustr.Ustr("c"), 0700); e != 0 {
+		t.Fatalf("Chmod failed %v", e)
+	}
+	tfs.SetCred(&proc.Cred_t{Uid: 1000, Euid: 1000, Suid: 1000,
+		Gid: 1000, Egid: 1000, Sgid: 1000})
+	if _, e := tfs.Stat(ustr.Ustr("/c/b/x")); e != -defs.EACCES {
+		t.Fatalf("Stat through a 0700 directory by non-owner %v", e)
+	}
+	tfs.SetCred(proc.Rootcred)
+	if e := tfs.Umount(ustr.Ustr("tmp")); e != 0 {
+		t.Fatalf("Umount failed %v", e)
+	}
+	done()
+}
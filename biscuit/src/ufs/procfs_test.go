@@ -0,0 +1,95 @@
+package ufs
+
+import "strconv"
+import "strings"
+import "testing"
+
+import "defs"
+import "fd"
+import "proc"
+import "ustr"
+
+func TestProcfs(t *testing.T) {
+	tfs, done := mkTestFS(t, "Procfs")
+	if e := tfs.MkDir(ustr.Ustr("proc")); e != 0 {
+		t.Fatalf("mkDir failed %v", e)
+	}
+	if e := tfs.MountProcfs(ustr.Ustr("proc")); e != 0 {
+		t.Fatalf("MountProcfs failed %v", e)
+	}
+	root, e := tfs.Opendir(ustr.MkUstrRoot())
+	if e != 0 {
+		t.Fatalf("Opendir failed %v", e)
+	}
+	p, ok := proc.Proc_new(ustr.Ustr("prog"), fd.MkRootCwd(root),
+		make([]*fd.Fd_t, 4), tfs.cred, nil)
+	if !ok {
+		t.Fatalf("Proc_new failed")
+	}
+	fd.Close_panic(root)
+	p.Args = []ustr.Ustr{ustr.Ustr("prog"), ustr.Ustr("-v")}
+	if e := tfs.MkFile(ustr.Ustr("f"), mkData(1, SMALL)); e != 0 {
+		t.Fatalf("mkFile failed %v", e)
+	}
+	f, e := tfs.vfs.Fs_open(ustr.Ustr("f"), defs.O_RDONLY, 0, tfs.cwd, tfs.cred, 0, 0)
+	if e != 0 {
+		t.Fatalf("open failed %v", e)
+	}
+	fdn, ok := p.Fd_insert(f, fd.FD_READ)
+	if !ok {
+		t.Fatalf("Fd_insert failed")
+	}
+
+	des, e := tfs.Ls(ustr.Ustr("proc"))
+	if e != 0 {
+		t.Fatalf("Ls failed %v", e)
+	}
+	pdir := "proc/" + strconv.Itoa(p.Pid)
+	for _, n := range []string{"memory", "uptime", "load", strconv.Itoa(p.Pid)} {
+		if _, ok := des[n]; !ok {
+			t.Fatalf("%v missing from %v", n, des)
+		}
+	}
+	if des, e := tfs.Ls(ustr.Ustr(pdir)); e != 0 || len(des) != 7 {
+		t.Fatalf("Ls %v failed %v %v", pdir, e, des)
+	}
+	d, e := tfs.Read(ustr.Ustr(pdir + "/status"))
+	if e != 0 || !strings.Contains(string(d), "Name:\tprog\n") {
+		t.Fatalf("Read status failed %v %q", e, d)
+	}
+	if d, e := tfs.Read(ustr.Ustr(pdir + "/cmdline")); e != 0 || string(d) != "prog\x00-v\x00" {
+		t.Fatalf("Read cmdline failed %v %q", e, d)
+	}
+	if s, e := tfs.Readlink(ustr.Ustr(pdir + "/cwd")); e != 0 || s.String() != "/" {
+		t.Fatalf("Readlink cwd failed %v %v", e, s)
+	}
+	fdp := ustr.Ustr(pdir + "/fd/" + strconv.Itoa(fdn))
+	d, e = tfs.Read(fdp)
+	if e != 0 || !strings.Contains(string(d), "flags:\tr\n") {
+		t.Fatalf("Read fd failed %v %q", e, d)
+	}
+	if d, e := tfs.Read(ustr.Ustr("proc/load")); e != 0 || !strings.Contains(string(d), "Procs:") {
+		t.Fatalf("Read load failed %v %q", e, d)
+	}
+	if e := tfs.MkFile(ustr.Ustr("proc/x"), nil); e != -defs.EROFS {
+		t.Fatalf("MkFile in procfs %v", e)
+	}
+
+	// files disappear with their fd or process
+	if f, ok := p.Fd_del(fdn); !ok || f.Fops.Close() != 0 {
+		t.Fatalf("close failed")
+	}
+	if _, e := tfs.Stat(fdp); e != -defs.ENOENT {
+		t.Fatalf("Stat of closed fd %v", e)
+	}
+	fd.Close_panic(p.Cwd.Fd)
+	proc.Proc_del(p.Pid)
+	proc.Tid_del()
+	if _, e := tfs.Stat(ustr.Ustr(pdir)); e != -defs.ENOENT {
+		t.Fatalf("Stat of exited process %v", e)
+	}
+	if e := tfs.Umount(ustr.Ustr("proc")); e != 0 {
+		t.Fatalf("Umount failed %v", e)
+	}
+	done()
+}
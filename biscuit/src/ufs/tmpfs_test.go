@@ -0,0 +1,117 @@
+package ufs
+
+import "testing"
+
+import "defs"
+import "limits"
+import "mem"
+import "proc"
+import "ustr"
+
+func TestTmpfs(t *testing.T) {
+	tfs, done := mkTestFS(t, "Tmpfs")
+	if e := tfs.MkDir(ustr.Ustr("tmp")); e != 0 {
+		t.Fatalf("mkDir failed %v", e)
+	}
+	if e := tfs.MountTmpfs(ustr.Ustr("tmp")); e != 0 {
+		t.Fatalf("MountTmpfs failed %v", e)
+	}
+	free := limits.Syslimit.Mfspgs
+	f := ustr.Ustr("tmp/f")
+	const sz = 3*mem.PGSIZE + SMALL
+	if e := tfs.MkFile(f, mkData(1, sz)); e != 0 {
+		t.Fatalf("mkFile failed %v", e)
+	}
+	// a file's first page is free
+	if n := free - limits.Syslimit.Mfspgs; n != 3 || pagemem.npages() != 4 {
+		t.Fatalf("charged %v pages for %v", n, pagemem.npages())
+	}
+	g := ustr.Ustr("tmp/g")
+	if e := tfs.Rename(f, g); e != 0 {
+		t.Fatalf("Rename failed %v", e)
+	}
+	if e := tfs.Rename(g, ustr.Ustr("g")); e != -defs.EXDEV {
+		t.Fatalf("Rename out of tmpfs %v", e)
+	}
+	if e := tfs.MkDir(ustr.Ustr("tmp/d")); e != 0 {
+		t.Fatalf("mkDir failed %v", e)
+	}
+	if e := tfs.Symlink(ustr.Ustr("../g"), ustr.Ustr("tmp/d/l")); e != 0 {
+		t.Fatalf("Symlink failed %v", e)
+	}
+	if d, e := tfs.Read(ustr.Ustr("/tmp/d/l")); e != 0 || len(d) != sz || d[sz-1] != 1 {
+		t.Fatalf("Read through symlink failed %v %v", e, len(d))
+	}
+	if e := tfs.UnlinkDir(ustr.Ustr("tmp/d")); e != -defs.ENOTEMPTY {
+		t.Fatalf("UnlinkDir non-empty %v", e)
+	}
+	if des, e := tfs.Ls(ustr.Ustr("tmp")); e != 0 || len(des) != 4 {
+		t.Fatalf("Ls failed %v %v", e, des)
+	}
+	// like on the disk, a 0700 directory hides its contents
+	if e := tfs.Chmod(ustr.Ustr("tmp/d"), 0700); e != 0 {
+		t.Fatalf("Chmod failed %v", e)
+	}
+	tfs.SetCred(&proc.Cred_t{Uid: 1000, Euid: 1000, Suid: 1000,
+		Gid: 1000, Egid: 1000, Sgid: 1000})
+	if _, e := tfs.Stat(ustr.Ustr("tmp/d/l")); e != -defs.EACCES {
+		t.Fatalf("Stat under 0700 dir by non-owner: %v", e)
+	}
+	tfs.SetCred(proc.Rootcred)
+
+	// stores through a shared mapping are visible to reads, and the
+	// mapped pages outlive the file
+	fd, e := tfs.vfs.Fs_open(g, defs.O_RDWR, 0, tfs.cwd, tfs.cred, 0, 0)
+	if e != 0 {
+		t.Fatalf("open failed %v", e)
+	}
+	mmi, e := fd.Fops.Mmapi(0, -1, true)
+	if e != 0 || len(mmi) != 4 {
+		t.Fatalf("Mmapi failed %v %v", e, len(mmi))
+	}
+	mem.Pg2bytes(mmi[3].Pg)[0] = 2
+	if d, e := tfs.Read(g); e != 0 || d[3*mem.PGSIZE] != 2 {
+		t.Fatalf("Read after store failed %v", e)
+	}
+	if e := tfs.Unlink(g); e != 0 {
+		t.Fatalf("Unlink failed %v", e)
+	}
+	if e := tfs.Umount(ustr.Ustr("tmp")); e != -defs.EBUSY {
+		t.Fatalf("Umount with open file %v", e)
+	}
+	fd.Fops.Close()
+	if n := pagemem.npages(); n != 4 || limits.Syslimit.Mfspgs != free {
+		t.Fatalf("%v pages after unlink", n)
+	}
+	for _, pg := range mmi {
+		pagemem.Refdown(pg.Phys)
+	}
+	if n := pagemem.npages(); n != 0 {
+		t.Fatalf("%v pages after unmap", n)
+	}
+
+	// holes take no pages and read as zeros
+	if e := tfs.MkFile(f, nil); e != 0 {
+		t.Fatalf("mkFile failed %v", e)
+	}
+	if e := tfs.Pwrite(f, mkData(3, SMALL), 10*mem.PGSIZE); e != 0 {
+		t.Fatalf("Pwrite failed %v", e)
+	}
+	if d, e := tfs.Read(f); e != 0 || len(d) != 10*mem.PGSIZE+SMALL || d[0] != 0 {
+		t.Fatalf("Read sparse failed %v", e)
+	}
+	if o, e := tfs.Seek(f, 0, defs.SEEK_DATA); e != 0 || o != 10*mem.PGSIZE {
+		t.Fatalf("SEEK_DATA %v %v", o, e)
+	}
+	if e := tfs.Truncate(f, 0); e != 0 || pagemem.npages() != 0 {
+		t.Fatalf("Truncate failed %v", e)
+	}
+	if e := tfs.Umount(ustr.Ustr("tmp")); e != 0 {
+		t.Fatalf("Umount failed %v", e)
+	}
+	// nothing reached the disk
+	if des, e := tfs.Ls(ustr.Ustr("tmp")); e != 0 || len(des) != 2 {
+		t.Fatalf("Ls after umount %v %v", e, des)
+	}
+	done()
+}
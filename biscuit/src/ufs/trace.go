@@ -16,19 +16,21 @@ type tracef_t struct {
 	enc  *json.Encoder
 }
 
-type record_t struct {
+// a write of block BlkNo with BlkData or a flush ("sync") of the disk's write
+// cache
+type Record_t struct {
 	Cmd     string
 	BlkNo   int
 	BlkData []byte
 }
 
-type trace_t []record_t
+type trace_t []Record_t
 type order_t []int
 type orders_t []order_t
 
-func mkTrace() *tracef_t {
+func mkTrace(p string) *tracef_t {
 	t := &tracef_t{}
-	f, uerr := os.Create("trace.json")
+	f, uerr := os.Create(p)
 	if uerr != nil {
 		panic(uerr)
 	}
@@ -37,15 +39,21 @@ func mkTrace() *tracef_t {
 	return t
 }
 
+// ReadTrace returns the records of the trace file p in the order the disk saw
+// them.
+func ReadTrace(p string) []Record_t {
+	return readTrace(p)
+}
+
 func readTrace(p string) trace_t {
-	res := make([]record_t, 0)
-	f, uerr := os.Open("trace.json")
+	res := make([]Record_t, 0)
+	f, uerr := os.Open(p)
 	if uerr != nil {
 		panic(uerr)
 	}
 	dec := json.NewDecoder(f)
 	for {
-		var r record_t
+		var r Record_t
 		if err := dec.Decode(&r); err != nil {
 			break
 		}
@@ -78,8 +86,8 @@ func (trace trace_t) findSync(index int) int {
 	return -1
 }
 
-func (r *record_t) copyRecord() record_t {
-	c := record_t{}
+func (r *Record_t) copyRecord() Record_t {
+	c := Record_t{}
 	c.BlkNo = r.BlkNo
 	c.Cmd = r.Cmd
 	c.BlkData = make([]byte, len(r.BlkData))
@@ -88,7 +96,7 @@ func (r *record_t) copyRecord() record_t {
 }
 
 func (trace trace_t) copyTrace(start int, end int) trace_t {
-	sub := make([]record_t, end-start)
+	sub := make([]Record_t, end-start)
 	for i, _ := range sub {
 		sub[i] = trace[start+i].copyRecord()
 	}
@@ -105,7 +113,7 @@ func (trace trace_t) permTrace(index int, o order_t) trace_t {
 }
 
 func (t *tracef_t) write(n int, v *mem.Bytepg_t) {
-	r := record_t{}
+	r := Record_t{}
 	r.BlkNo = n
 	r.Cmd = "write"
 	r.BlkData = make([]byte, fs.BSIZE)
@@ -118,7 +126,7 @@ func (t *tracef_t) write(n int, v *mem.Bytepg_t) {
 }
 
 func (t *tracef_t) sync() {
-	r := record_t{}
+	r := Record_t{}
 	r.BlkNo = 0
 	r.Cmd = "sync"
 	if err := t.enc.Encode(&r); err != nil {
@@ -5,10 +5,16 @@ import "os"
 import "log"
 
 import "defs"
+import "devfs"
 import "fd"
 import "fs"
+import "proc"
+import "procfs"
 import "stat"
+import "tmpfs"
 import "ustr"
+import "util"
+import "vfs"
 import "vm"
 
 //
@@ -18,7 +24,13 @@ import "vm"
 type Ufs_t struct {
 	ahci *ahci_disk_t
 	fs   *fs.Fs_t
-	cwd  *fd.Cwd_t
+	// path operations go through the mount table, whose root is fs
+	vfs *vfs.Vfs_t
+	cwd *fd.Cwd_t
+	// the initial cwd is not open; Chdir opens the root first
+	cwdopen bool
+	// the credentials used for all fs operations
+	cred *proc.Cred_t
 }
 
 func mkData(v uint8, n int) *vm.Fakeubuf_t {
@@ -58,7 +70,7 @@ func (ufs *Ufs_t) SyncApply() defs.Err_t {
 }
 
 func (ufs *Ufs_t) MkFile(p ustr.Ustr, ub *vm.Fakeubuf_t) defs.Err_t {
-	fd, err := ufs.fs.Fs_open(p, defs.O_CREAT, 0, ufs.cwd, 0, 0)
+	fd, err := ufs.vfs.Fs_open(p, defs.O_CREAT, 0644, ufs.cwd, ufs.cred, 0, 0)
 	if err != 0 {
 		return err
 	}
@@ -77,7 +89,7 @@ func (ufs *Ufs_t) MkFile(p ustr.Ustr, ub *vm.Fakeubuf_t) defs.Err_t {
 }
 
 func (ufs *Ufs_t) MkDir(p ustr.Ustr) defs.Err_t {
-	err := ufs.fs.Fs_mkdir(p, 0755, ufs.cwd)
+	err := ufs.vfs.Fs_mkdir(p, 0755, ufs.cwd, ufs.cred)
 	if err != 0 {
 		return err
 	}
@@ -85,13 +97,74 @@ func (ufs *Ufs_t) MkDir(p ustr.Ustr) defs.Err_t {
 }
 
 func (ufs *Ufs_t) Rename(oldp, newp ustr.Ustr) defs.Err_t {
-	err := ufs.fs.Fs_rename(oldp, newp, ufs.cwd)
+	err := ufs.vfs.Fs_rename(oldp, newp, ufs.cwd, ufs.cred)
+	return err
+}
+
+func (ufs *Ufs_t) Reflink(src, dst ustr.Ustr) defs.Err_t {
+	err := ufs.vfs.Fs_reflink(src, dst, ufs.cwd, ufs.cred)
+	return err
+}
+
+func (ufs *Ufs_t) Symlink(target, p ustr.Ustr) defs.Err_t {
+	err := ufs.vfs.Fs_symlink(target, p, ufs.cwd, ufs.cred)
+	return err
+}
+
+func (ufs *Ufs_t) Readlink(p ustr.Ustr) (ustr.Ustr, defs.Err_t) {
+	target, err := ufs.vfs.Fs_readlink(p, ufs.cwd, ufs.cred)
+	return target, err
+}
+
+func (ufs *Ufs_t) Chmod(p ustr.Ustr, mode int) defs.Err_t {
+	err := ufs.vfs.Fs_chmod(p, mode, ufs.cwd, ufs.cred)
+	return err
+}
+
+func (ufs *Ufs_t) Chown(p ustr.Ustr, uid, gid int) defs.Err_t {
+	err := ufs.vfs.Fs_chown(p, uid, gid, ufs.cwd, ufs.cred)
+	return err
+}
+
+// sets the access and modification times of p, which are in nanoseconds
+func (ufs *Ufs_t) Utimens(p ustr.Ustr, atime, mtime int) defs.Err_t {
+	err := ufs.vfs.Fs_utimens(p, atime, mtime, true, ufs.cwd, ufs.cred)
+	return err
+}
+
+func (ufs *Ufs_t) Setxattr(p, name ustr.Ustr, value []uint8, flags int) defs.Err_t {
+	err := ufs.vfs.Fs_setxattr(p, name, value, flags, ufs.cwd, ufs.cred)
+	return err
+}
+
+func (ufs *Ufs_t) Getxattr(p, name ustr.Ustr) ([]uint8, defs.Err_t) {
+	value, err := ufs.vfs.Fs_getxattr(p, name, ufs.cwd, ufs.cred)
+	return value, err
+}
+
+// returns the names of the extended attributes of p
+func (ufs *Ufs_t) Listxattr(p ustr.Ustr) ([]string, defs.Err_t) {
+	names, err := ufs.vfs.Fs_listxattr(p, ufs.cwd, ufs.cred)
+	if err != 0 {
+		return nil, err
+	}
+	var ret []string
+	for len(names) != 0 {
+		i := ustr.Ustr(names).IndexByte(0)
+		ret = append(ret, string(names[:i]))
+		names = names[i+1:]
+	}
+	return ret, 0
+}
+
+func (ufs *Ufs_t) Removexattr(p, name ustr.Ustr) defs.Err_t {
+	err := ufs.vfs.Fs_removexattr(p, name, ufs.cwd, ufs.cred)
 	return err
 }
 
 // update (XXX check that ub < len(file)?)
 func (ufs *Ufs_t) Update(p ustr.Ustr, ub *vm.Fakeubuf_t) defs.Err_t {
-	fd, err := ufs.fs.Fs_open(p, defs.O_RDWR, 0, ufs.cwd, 0, 0)
+	fd, err := ufs.vfs.Fs_open(p, defs.O_RDWR, 0, ufs.cwd, ufs.cred, 0, 0)
 	if err != 0 {
 		return err
 	}
@@ -108,7 +181,7 @@ func (ufs *Ufs_t) Update(p ustr.Ustr, ub *vm.Fakeubuf_t) defs.Err_t {
 }
 
 func (ufs *Ufs_t) Append(p ustr.Ustr, ub *vm.Fakeubuf_t) defs.Err_t {
-	fd, err := ufs.fs.Fs_open(p, defs.O_RDWR, 0, ufs.cwd, 0, 0)
+	fd, err := ufs.vfs.Fs_open(p, defs.O_RDWR, 0, ufs.cwd, ufs.cred, 0, 0)
 	if err != 0 {
 		return err
 	}
@@ -130,8 +203,67 @@ func (ufs *Ufs_t) Append(p ustr.Ustr, ub *vm.Fakeubuf_t) defs.Err_t {
 	return err
 }
 
+func (ufs *Ufs_t) Pwrite(p ustr.Ustr, ub *vm.Fakeubuf_t, off int) defs.Err_t {
+	fd, err := ufs.vfs.Fs_open(p, defs.O_RDWR, 0, ufs.cwd, ufs.cred, 0, 0)
+	if err != 0 {
+		return err
+	}
+	_, err = fd.Fops.Pwrite(ub, off)
+	if err != 0 || ub.Remain() != 0 {
+		return err
+	}
+	return fd.Fops.Close()
+}
+
+func (ufs *Ufs_t) Truncate(p ustr.Ustr, newlen int) defs.Err_t {
+	fd, err := ufs.vfs.Fs_open(p, defs.O_RDWR, 0, ufs.cwd, ufs.cred, 0, 0)
+	if err != 0 {
+		return err
+	}
+	if err := fd.Fops.Truncate(uint(newlen)); err != 0 {
+		fd.Fops.Close()
+		return err
+	}
+	return fd.Fops.Close()
+}
+
+func (ufs *Ufs_t) Fallocate(p ustr.Ustr, mode, off, len int) defs.Err_t {
+	fd, err := ufs.vfs.Fs_open(p, defs.O_RDWR, 0, ufs.cwd, ufs.cred, 0, 0)
+	if err != 0 {
+		return err
+	}
+	if err := fd.Fops.Fallocate(mode, off, len); err != 0 {
+		fd.Fops.Close()
+		return err
+	}
+	return fd.Fops.Close()
+}
+
+// returns the offset lseek(2) finds from off
+func (ufs *Ufs_t) Seek(p ustr.Ustr, off, whence int) (int, defs.Err_t) {
+	fd, err := ufs.vfs.Fs_open(p, defs.O_RDONLY, 0, ufs.cwd, ufs.cred, 0, 0)
+	if err != 0 {
+		return 0, err
+	}
+	n, err := fd.Fops.Lseek(off, whence)
+	fd.Fops.Close()
+	return n, err
+}
+
+func (ufs *Ufs_t) Fsync(p ustr.Ustr, datasync bool) defs.Err_t {
+	fd, err := ufs.vfs.Fs_open(p, defs.O_RDONLY, 0, ufs.cwd, ufs.cred, 0, 0)
+	if err != 0 {
+		return err
+	}
+	if err := fd.Fops.Fsync(datasync); err != 0 {
+		fd.Fops.Close()
+		return err
+	}
+	return fd.Fops.Close()
+}
+
 func (ufs *Ufs_t) Unlink(p ustr.Ustr) defs.Err_t {
-	err := ufs.fs.Fs_unlink(p, ufs.cwd, false)
+	err := ufs.vfs.Fs_unlink(p, ufs.cwd, ufs.cred, false)
 	if err != 0 {
 		return err
 	}
@@ -139,7 +271,7 @@ func (ufs *Ufs_t) Unlink(p ustr.Ustr) defs.Err_t {
 }
 
 func (ufs *Ufs_t) UnlinkDir(p ustr.Ustr) defs.Err_t {
-	err := ufs.fs.Fs_unlink(p, ufs.cwd, true)
+	err := ufs.vfs.Fs_unlink(p, ufs.cwd, ufs.cred, true)
 	if err != 0 {
 		return err
 	}
@@ -148,19 +280,62 @@ func (ufs *Ufs_t) UnlinkDir(p ustr.Ustr) defs.Err_t {
 
 func (ufs *Ufs_t) Stat(p ustr.Ustr) (*stat.Stat_t, defs.Err_t) {
 	s := &stat.Stat_t{}
-	err := ufs.fs.Fs_stat(p, s, ufs.cwd)
+	err := ufs.vfs.Fs_stat(p, s, ufs.cwd, ufs.cred)
 	if err != 0 {
 		return nil, err
 	}
 	return s, err
 }
 
+// mounts the file system of other at p. other must not be shut down
+// afterwards; Umount stops its file system.
+func (ufs *Ufs_t) Mount(p ustr.Ustr, other *Ufs_t) defs.Err_t {
+	return ufs.vfs.Mountfs(other.fs, p, ufs.cwd, ufs.cred)
+}
+
+// mounts a new tmpfs, whose pages come from pagemem, at p
+func (ufs *Ufs_t) MountTmpfs(p ustr.Ustr) defs.Err_t {
+	return ufs.vfs.Mountfs(tmpfs.MkTmpfs(pagemem), p, ufs.cwd, ufs.cred)
+}
+
+// mounts a new procfs at p
+func (ufs *Ufs_t) MountProcfs(p ustr.Ustr) defs.Err_t {
+	return ufs.vfs.Mountfs(procfs.MkProcfs(pagemem), p, ufs.cwd, ufs.cred)
+}
+
+// mounts a new devfs at p
+func (ufs *Ufs_t) MountDevfs(p ustr.Ustr) defs.Err_t {
+	return ufs.vfs.Mountfs(devfs.MkDevfs(), p, ufs.cwd, ufs.cred)
+}
+
+func (ufs *Ufs_t) Bind(src, p ustr.Ustr) defs.Err_t {
+	return ufs.vfs.Mount(src, p, nil, defs.MS_BIND, nil, ufs.cwd, ufs.cred)
+}
+
+func (ufs *Ufs_t) Umount(p ustr.Ustr) defs.Err_t {
+	return ufs.vfs.Umount(p, ufs.cwd, ufs.cred)
+}
+
+// makes p the cwd of later operations. the cwd keeps its directory open, which
+// keeps the file system containing it busy.
+func (ufs *Ufs_t) Chdir(p ustr.Ustr) defs.Err_t {
+	if !ufs.cwdopen {
+		dir, err := ufs.fs.Fs_open(ustr.MkUstrRoot(), defs.O_RDONLY|defs.O_DIRECTORY, 0, ufs.cwd, ufs.cred, 0, 0)
+		if err != 0 {
+			return err
+		}
+		ufs.cwd = fd.MkRootCwd(dir)
+		ufs.cwdopen = true
+	}
+	return ufs.vfs.Fs_chdir(p, ufs.cwd, ufs.cred)
+}
+
 func (ufs *Ufs_t) Read(p ustr.Ustr) ([]byte, defs.Err_t) {
 	st, err := ufs.Stat(p)
 	if err != 0 {
 		return nil, err
 	}
-	fd, err := ufs.fs.Fs_open(p, defs.O_RDONLY, 0, ufs.cwd, 0, 0)
+	fd, err := ufs.vfs.Fs_open(p, defs.O_RDONLY, 0, ufs.cwd, ufs.cred, 0, 0)
 	if err != 0 {
 		return nil, err
 	}
@@ -181,33 +356,91 @@ func (ufs *Ufs_t) Read(p ustr.Ustr) ([]byte, defs.Err_t) {
 	return v, err
 }
 
+// a directory entry returned by Getdents
+type Dirent_t struct {
+	Inum defs.Inum_t
+	Off  int
+	Type int
+	Name string
+}
+
+func (ufs *Ufs_t) Opendir(p ustr.Ustr) (*fd.Fd_t, defs.Err_t) {
+	return ufs.vfs.Fs_open(p, defs.O_RDONLY|defs.O_DIRECTORY, 0, ufs.cwd,
+		ufs.cred, 0, 0)
+}
+
+// reads the next directory entries from the directory open at f using a
+// buffer of sz bytes.
+func (ufs *Ufs_t) Getdents(f *fd.Fd_t, sz int) ([]Dirent_t, defs.Err_t) {
+	buf := make([]uint8, sz)
+	ub := &vm.Fakeubuf_t{}
+	ub.Fake_init(buf)
+	n, err := f.Fops.Getdents(ub)
+	if err != 0 {
+		return nil, err
+	}
+	var res []Dirent_t
+	for i := 0; i < n; {
+		de := Dirent_t{}
+		de.Inum = defs.Inum_t(util.Readn(buf, 8, i))
+		de.Off = util.Readn(buf, 8, i+8)
+		reclen := util.Readn(buf, 2, i+16)
+		de.Type = util.Readn(buf, 1, i+18)
+		name := buf[i+19 : i+reclen]
+		for j, c := range name {
+			if c == 0 {
+				name = name[:j]
+				break
+			}
+		}
+		de.Name = string(name)
+		res = append(res, de)
+		i += reclen
+	}
+	return res, 0
+}
+
 func (ufs *Ufs_t) Ls(p ustr.Ustr) (map[string]*stat.Stat_t, defs.Err_t) {
 	res := make(map[string]*stat.Stat_t, 100)
-	d, e := ufs.Read(p)
+	f, e := ufs.Opendir(p)
 	if e != 0 {
 		return nil, e
 	}
-	for i := 0; i < len(d)/fs.BSIZE; i++ {
-		dd := fs.Dirdata_t{d[i*fs.BSIZE:]}
-		for j := 0; j < fs.NDIRENTS; j++ {
-			tfn := dd.Filename(j)
-			if len(tfn) > 0 {
-				f := p.Extend(tfn)
-				st, e := ufs.Stat(f)
-				if e != 0 {
-					return nil, e
-				}
-				res[string(tfn)] = st
+	defer f.Fops.Close()
+	for {
+		des, e := ufs.Getdents(f, fs.BSIZE)
+		if e != 0 {
+			return nil, e
+		}
+		if len(des) == 0 {
+			break
+		}
+		for _, de := range des {
+			st, e := ufs.Stat(p.ExtendStr(de.Name))
+			if e != 0 {
+				return nil, e
 			}
+			res[de.Name] = st
 		}
 	}
 	return res, 0
 }
 
+// performs subsequent operations with the credentials c
+func (ufs *Ufs_t) SetCred(c *proc.Cred_t) {
+	ufs.cred = c
+}
+
 func (ufs *Ufs_t) Statistics() string {
 	return ufs.fs.Fs_statistics()
 }
 
+// Csumerrs returns the checksum errors the file system found; see
+// fs.Fs_csumerrs.
+func (ufs *Ufs_t) Csumerrs() (int, int) {
+	return ufs.fs.Fs_csumerrs()
+}
+
 func (ufs *Ufs_t) Evict() {
 	ufs.fs.Fs_evict()
 }
@@ -216,6 +449,32 @@ func (ufs *Ufs_t) Sizes() (int, int) {
 	return ufs.fs.Sizes()
 }
 
+// Df returns the number of inodes and data blocks of the file system and the
+// number of each that its allocation bitmaps record as free.
+func (ufs *Ufs_t) Df() (int, int, int, int) {
+	ni, nb := ufs.fs.Fs_capacity()
+	nifree, nbfree := ufs.fs.Fs_size()
+	return int(ni), int(nifree), int(nb), int(nbfree)
+}
+
+// Resize enlarges the disk image to nblocks blocks, if it is smaller, and grows
+// the file system onto them; see fs.Fs_resize.
+func (ufs *Ufs_t) Resize(nblocks int) defs.Err_t {
+	sz := int64(nblocks) * fs.BSIZE
+	if st, err := ufs.ahci.f.Stat(); err != nil || st.Size() < sz {
+		if err := ufs.ahci.f.Truncate(sz); err != nil {
+			panic(err)
+		}
+	}
+	return ufs.vfs.Fs_resize(ustr.Ustr("/"), nblocks, ufs.cwd, ufs.cred)
+}
+
+// StartTrace records the blocks ufs writes and the flushes of the disk in the
+// trace file p until ShutdownFS; see ReadTrace.
+func (ufs *Ufs_t) StartTrace(p string) {
+	ufs.ahci.StartTrace(p)
+}
+
 func openDisk(d string) *ahci_disk_t {
 	a := &ahci_disk_t{}
 	f, uerr := os.OpenFile(d, os.O_RDWR, 0755)
@@ -228,22 +487,41 @@ func openDisk(d string) *ahci_disk_t {
 
 func BootFS(dst string) *Ufs_t {
 	log.Printf("reboot %v ...\n", dst)
-	ufs := &Ufs_t{}
+	ufs := &Ufs_t{cred: proc.Rootcred}
 	ufs.ahci = openDisk(dst)
 	ufs.cwd = ufs.fs.MkRootCwd()
 	_, ufs.fs = fs.StartFS(blockmem, ufs.ahci, c, true)
+	ufs.vfs = vfs.MkVfs(ufs.fs)
 	return ufs
 }
 
 func BootMemFS(dst string) *Ufs_t {
 	log.Printf("reboot %v ...\n", dst)
-	ufs := &Ufs_t{}
+	ufs := &Ufs_t{cred: proc.Rootcred}
 	ufs.ahci = openDisk(dst)
 	ufs.cwd = ufs.fs.MkRootCwd()
 	_, ufs.fs = fs.StartFS(blockmem, ufs.ahci, c, false)
+	ufs.vfs = vfs.MkVfs(ufs.fs)
 	return ufs
 }
 
+// checks the file system image dst; see fs.Fsck. if repair is true and the
+// log must be replayed, Fsck mounts the image to replay it, which also frees
+// orphans, and checks again.
+func Fsck(dst string, repair bool) *fs.Fsckres_t {
+	a := openDisk(dst)
+	r := fs.Fsck(a, repair)
+	a.close()
+	if r.Logdirty && repair {
+		ShutdownFS(BootFS(dst))
+		a = openDisk(dst)
+		r = fs.Fsck(a, repair)
+		a.close()
+		r.Repaired = true
+	}
+	return r
+}
+
 func ShutdownFS(ufs *Ufs_t) {
 	ufs.fs.StopFS()
 	ufs.ahci.close()
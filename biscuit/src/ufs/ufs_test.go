@@ -1,10 +1,13 @@
 package ufs
 
 import "testing"
+import "bytes"
 import "fmt"
 import "io"
+import "io/ioutil"
 import "os"
 import "strconv"
+import "strings"
 import "sync"
 import "time"
 
@@ -13,7 +16,10 @@ import "defs"
 import "fd"
 import "fs"
 import "mem"
+import "proc"
 import "ustr"
+import "util"
+import "vm"
 
 const (
 	SMALL = 512
@@ -26,6 +32,23 @@ const (
 	ndatablks  = 20
 )
 
+// makes and boots a small file system in tmp.img for the test name. done
+// shuts the file system down, checks it with fsck, and removes the image.
+func mkTestFS(t *testing.T, name string) (tfs *Ufs_t, done func()) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+	fmt.Printf("Test %v %v ...\n", name, dst)
+	tfs = BootFS(dst)
+	done = func() {
+		ShutdownFS(tfs)
+		if r := Fsck(dst, false); len(r.Problems) != 0 {
+			t.Fatalf("fsck: %v", r.Problems)
+		}
+		os.Remove(dst)
+	}
+	return tfs, done
+}
+
 func TestCanonicalize(t *testing.T) {
 	if !ustr.Ustr("/").Eq(bpath.Canonicalize(ustr.Ustr("//"))) {
 		t.Fatalf("//")
@@ -239,209 +262,2013 @@ func doTestSimple(tfs *Ufs_t, d ustr.Ustr) string {
 		return fmt.Sprintf("mkFile %v failed", "f1")
 	}
 
-	ub = mkData(2, SMALL)
-	e = tfs.MkFile(d.ExtendStr("f2"), ub)
-	if e != 0 {
-		return fmt.Sprintf("mkFile %v failed", "f2")
+	ub = mkData(2, SMALL)
+	e = tfs.MkFile(d.ExtendStr("f2"), ub)
+	if e != 0 {
+		return fmt.Sprintf("mkFile %v failed", "f2")
+	}
+
+	e = tfs.MkDir(d.ExtendStr("d0"))
+	if e != 0 {
+		return fmt.Sprintf("Mkdir %v failed", "d0")
+	}
+
+	e = tfs.MkDir(d.ExtendStr("d0/d1"))
+	if e != 0 {
+		return fmt.Sprintf("Mkdir %v failed", "d1")
+	}
+
+	e = tfs.Rename(d.ExtendStr("d0/d1"), d.ExtendStr("e0"))
+	if e != 0 {
+		return fmt.Sprintf("Rename failed")
+	}
+
+	ub = mkData(3, SMALL)
+	e = tfs.Append(d.ExtendStr("f1"), ub)
+	if e != 0 {
+		return fmt.Sprintf("Append failed")
+	}
+
+	e = tfs.Unlink(d.ExtendStr("f2"))
+	if e != 0 {
+		return fmt.Sprintf("Unlink failed")
+	}
+	return ""
+}
+
+func doCheckSimple(tfs *Ufs_t, d ustr.Ustr, t *testing.T) {
+	res, e := tfs.Ls(d)
+	if e != 0 {
+		t.Fatalf("doLs failed")
+	}
+	st, ok := res["f1"]
+	if !ok {
+		t.Fatalf("%s/f1 not present", d)
+	}
+	if st.Size() != 1024 {
+		t.Fatalf("f1 wrong size")
+	}
+
+	st, ok = res["f2"]
+	if ok {
+		t.Fatalf("f2 present")
+	}
+	st, ok = res["d0"]
+	if !ok {
+		t.Fatalf("d0 not present")
+	}
+	st, ok = res["e0"]
+	if !ok {
+		t.Fatalf("e0 not present")
+	}
+	res, e = tfs.Ls(d.ExtendStr("d0"))
+	if e != 0 {
+		t.Fatalf("doLs d0 failed")
+	}
+	st, ok = res["e0"]
+	if ok {
+		t.Fatalf("e0 present in d0")
+	}
+}
+
+//
+// Util
+//
+
+func uniqdir(id int) string {
+	return "d" + strconv.Itoa(id)
+}
+
+func uniqfile(id int) string {
+	return "f" + strconv.Itoa(id)
+}
+
+//
+// Simple test
+//
+
+func TestFSSimple(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+
+	fmt.Printf("Test FSSimple %v ...\n", dst)
+	d := ustr.Ustr("d/")
+	tfs := BootFS(dst)
+	s := doTestSimple(tfs, d)
+	if s != "" {
+		t.Fatalf("doTestSimple failed %s\n", s)
+	}
+	doCheckSimple(tfs, d, t)
+	ShutdownFS(tfs)
+
+	tfs = BootFS(dst)
+	doCheckSimple(tfs, d, t)
+	ShutdownFS(tfs)
+	os.Remove(dst)
+}
+
+//
+// Test eviction
+
+func TestEvict(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+
+	fmt.Printf("Test Evict %v ...\n", dst)
+	d := ustr.Ustr("d/")
+	tfs := BootFS(dst)
+	s := doTestSimple(tfs, d)
+	if s != "" {
+		t.Fatalf("doTestSimple failed %s\n", s)
+	}
+	ni, nb := tfs.Sizes()
+	tfs.Evict()
+	ni1, nb1 := tfs.Sizes()
+	if ni1 >= ni {
+		t.Fatalf("No inodes evicted %d %d\n", ni, ni1)
+	}
+	if nb1 >= nb {
+		t.Fatalf("No blocks evicted %d %d\n", nb, nb1)
+	}
+	fmt.Printf("inode %d %d\n", ni, ni1)
+	fmt.Printf("blks %d %d\n", nb, nb1)
+
+	// make sure we can still read what we created after eviction
+	doCheckSimple(tfs, d, t)
+}
+
+func TestDf(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+
+	fmt.Printf("Test Df %v ...\n", dst)
+	tfs := BootFS(dst)
+	ni, nifree, nb, nbfree := tfs.Df()
+	if ni != ninodeblks*(fs.BSIZE/fs.ISIZE) || nb != ndatablks {
+		t.Fatalf("capacity %v %v", ni, nb)
+	}
+	// the root directory
+	if ni-nifree != 1 || nb-nbfree != 1 {
+		t.Fatalf("used %v %v", ni-nifree, nb-nbfree)
+	}
+	if e := tfs.MkFile(ustr.Ustr("f"), mkData(1, 2*fs.BSIZE)); e != 0 {
+		t.Fatalf("mkFile failed %v", e)
+	}
+	_, nifree1, _, nbfree1 := tfs.Df()
+	if nifree-nifree1 != 1 || nbfree-nbfree1 != 2 {
+		t.Fatalf("file used %v %v", nifree-nifree1, nbfree-nbfree1)
+	}
+	ShutdownFS(tfs)
+	os.Remove(dst)
+}
+
+func TestEvictScan(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, 100)
+
+	fmt.Printf("Test EvictScan %v ...\n", dst)
+	tfs := BootFS(dst)
+	hot := ustr.Ustr("hot")
+	scan := ustr.Ustr("scan")
+	if e := tfs.MkFile(hot, mkData(1, fs.BSIZE)); e != 0 {
+		t.Fatalf("mkFile failed %v", e)
+	}
+	if e := tfs.MkFile(scan, mkData(2, 48*fs.BSIZE)); e != 0 {
+		t.Fatalf("mkFile failed %v", e)
+	}
+	ShutdownFS(tfs)
+
+	tfs = BootFS(dst)
+	read := func(p ustr.Ustr) {
+		if _, e := tfs.Read(p); e != 0 {
+			t.Fatalf("read failed %v", e)
+		}
+	}
+	evictall := func() {
+		for {
+			ni, nb := tfs.Sizes()
+			tfs.Evict()
+			if ni1, nb1 := tfs.Sizes(); ni1 == ni && nb1 == nb {
+				return
+			}
+		}
+	}
+
+	// the hot file is used again after it was evicted
+	read(hot)
+	evictall()
+	read(hot)
+	_, nb := tfs.Sizes()
+
+	// eviction after a scan evicts the scanned blocks, not the hot ones
+	read(scan)
+	_, nb1 := tfs.Sizes()
+	tfs.Evict()
+	tfs.Evict()
+	_, nb2 := tfs.Sizes()
+	if nb2 >= nb1 {
+		t.Fatalf("no blocks evicted %v %v", nb1, nb2)
+	}
+	read(hot)
+	if _, nb3 := tfs.Sizes(); nb3 != nb2 {
+		t.Fatalf("hot blocks evicted %v %v %v", nb, nb2, nb3)
+	}
+	ShutdownFS(tfs)
+	os.Remove(dst)
+}
+
+func TestGetdents(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, 8, ndatablks)
+
+	fmt.Printf("Test Getdents %v ...\n", dst)
+	tfs := BootFS(dst)
+	d := ustr.Ustr("d")
+	if e := tfs.MkDir(d); e != 0 {
+		t.Fatalf("mkDir %v failed %v", d, e)
+	}
+	// more entries than fit in one directory block
+	n := fs.NDIRENTS + 10
+	for i := 0; i < n; i++ {
+		f := d.ExtendStr(uniqfile(i))
+		if e := tfs.MkFile(f, nil); e != 0 {
+			t.Fatalf("mkFile %v failed %v", f, e)
+		}
+	}
+	sub := d.ExtendStr("sub")
+	if e := tfs.MkDir(sub); e != 0 {
+		t.Fatalf("mkDir %v failed %v", sub, e)
+	}
+	if e := tfs.Symlink(ustr.Ustr("sub"), d.ExtendStr("ln")); e != 0 {
+		t.Fatalf("Symlink failed %v", e)
+	}
+
+	fd, e := tfs.Opendir(d)
+	if e != 0 {
+		t.Fatalf("Opendir %v failed %v", d, e)
+	}
+	if _, e := tfs.Getdents(fd, 8); e != -defs.EINVAL {
+		t.Fatalf("Getdents with tiny buffer: %v", e)
+	}
+	seen := make(map[string]int)
+	types := make(map[string]int)
+	des, e := tfs.Getdents(fd, 256)
+	if e != 0 || len(des) == 0 {
+		t.Fatalf("Getdents failed %v", e)
+	}
+	for _, de := range des {
+		seen[de.Name]++
+		types[de.Name] = de.Type
+	}
+
+	// the cursor must survive removals and insertions; the entries that
+	// exist throughout must be returned exactly once.
+	removed := make(map[string]bool)
+	for i := 0; i < n; i += 2 {
+		f := d.ExtendStr(uniqfile(i))
+		if e := tfs.Unlink(f); e != 0 {
+			t.Fatalf("Unlink %v failed %v", f, e)
+		}
+		removed[uniqfile(i)] = true
+	}
+	for i := n; i < n+10; i++ {
+		f := d.ExtendStr(uniqfile(i))
+		if e := tfs.MkFile(f, nil); e != 0 {
+			t.Fatalf("mkFile %v failed %v", f, e)
+		}
+	}
+	for {
+		des, e := tfs.Getdents(fd, 256)
+		if e != 0 {
+			t.Fatalf("Getdents failed %v", e)
+		}
+		if len(des) == 0 {
+			break
+		}
+		for _, de := range des {
+			seen[de.Name]++
+			types[de.Name] = de.Type
+		}
+	}
+	fd.Fops.Close()
+
+	for name, c := range seen {
+		if c != 1 {
+			t.Fatalf("%v returned %v times", name, c)
+		}
+	}
+	for i := 1; i < n; i += 2 {
+		if seen[uniqfile(i)] != 1 {
+			t.Fatalf("%v missing", uniqfile(i))
+		}
+	}
+	for name, want := range map[string]int{".": defs.DT_DIR,
+		"f1": defs.DT_REG, "sub": defs.DT_DIR, "ln": defs.DT_LNK} {
+		if types[name] != want {
+			t.Fatalf("%v has type %v", name, types[name])
+		}
+	}
+	ShutdownFS(tfs)
+	os.Remove(dst)
+}
+
+func TestDirIndex(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, 80, 100)
+
+	fmt.Printf("Test DirIndex %v ...\n", dst)
+	tfs := BootFS(dst)
+	d := ustr.Ustr("d")
+	if e := tfs.MkDir(d); e != 0 {
+		t.Fatalf("mkDir %v failed %v", d, e)
+	}
+	// enough entries to split the index a few times
+	n := 4 * fs.DXNPAIRS
+	for i := 0; i < n; i++ {
+		f := d.ExtendStr(uniqfile(i))
+		if e := tfs.MkFile(f, nil); e != 0 {
+			t.Fatalf("mkFile %v failed %v", f, e)
+		}
+	}
+	for i := 0; i < n; i += 3 {
+		f := d.ExtendStr(uniqfile(i))
+		if e := tfs.Unlink(f); e != 0 {
+			t.Fatalf("Unlink %v failed %v", f, e)
+		}
+	}
+	ShutdownFS(tfs)
+
+	if r := Fsck(dst, false); len(r.Problems) != 0 {
+		t.Fatalf("fsck: %v", r.Problems)
+	}
+
+	// lookups with a cold dirent cache use the index
+	tfs = BootFS(dst)
+	for i := 0; i < n; i++ {
+		f := d.ExtendStr(uniqfile(i))
+		_, e := tfs.Stat(f)
+		if i%3 == 0 && e != -defs.ENOENT {
+			t.Fatalf("Stat %v of unlinked file: %v", f, e)
+		} else if i%3 != 0 && e != 0 {
+			t.Fatalf("Stat %v failed %v", f, e)
+		}
+	}
+	res, e := tfs.Ls(d)
+	if e != 0 {
+		t.Fatalf("Ls %v failed %v", d, e)
+	}
+	if want := n - (n+2)/3 + 2; len(res) != want {
+		t.Fatalf("Ls %v: %v entries, want %v", d, len(res), want)
+	}
+	ShutdownFS(tfs)
+	os.Remove(dst)
+}
+
+func TestExtents(t *testing.T) {
+	dst := "tmp.img"
+	MkDiskFeatures(dst, nil, nlogblks, ninodeblks, 2000, fs.FEAT_EXTENTS)
+
+	fmt.Printf("Test Extents %v ...\n", dst)
+	tfs := BootFS(dst)
+	_, nblock := tfs.fs.Fs_size()
+	a := ustr.Ustr("a")
+	b := ustr.Ustr("b")
+	c := ustr.Ustr("c")
+	for _, f := range []ustr.Ustr{a, b} {
+		if e := tfs.MkFile(f, nil); e != 0 {
+			t.Fatalf("mkFile %v failed %v", f, e)
+		}
+	}
+	// growing two files at once gives each block its own extent; enough
+	// extents to split the root and a leaf.
+	n := fs.EXTNODEN + 100
+	for i := 0; i < n; i++ {
+		for _, f := range []ustr.Ustr{a, b} {
+			// the high bit avoids the block cache's 0xc warning
+			v := uint8(i) | 0x80
+			if e := tfs.Append(f, mkData(v, fs.BSIZE)); e != 0 {
+				t.Fatalf("Append %v failed %v", f, e)
+			}
+		}
+	}
+	// a file written by itself is one extent and needs no other blocks
+	_, nblock1 := tfs.fs.Fs_size()
+	nc := 2 * fs.INDADDR
+	if e := tfs.MkFile(c, mkData(7, nc*fs.BSIZE)); e != 0 {
+		t.Fatalf("mkFile %v failed %v", c, e)
+	}
+	if _, nblock2 := tfs.fs.Fs_size(); nblock1-nblock2 != uint(nc) {
+		t.Fatalf("%v blocks used for %v blocks of data", nblock1-nblock2, nc)
+	}
+	ShutdownFS(tfs)
+
+	if r := Fsck(dst, false); len(r.Problems) != 0 {
+		t.Fatalf("fsck: %v", r.Problems)
+	}
+
+	tfs = BootFS(dst)
+	for _, f := range []ustr.Ustr{a, b} {
+		d, e := tfs.Read(f)
+		if e != 0 || len(d) != n*fs.BSIZE {
+			t.Fatalf("Read %v failed %v %v", f, e, len(d))
+		}
+		for i := range d {
+			if d[i] != byte(i/fs.BSIZE)|0x80 {
+				t.Fatalf("%v: wrong data at %v", f, i)
+			}
+		}
+	}
+	d, e := tfs.Read(c)
+	if e != 0 || len(d) != nc*fs.BSIZE {
+		t.Fatalf("Read %v failed %v %v", c, e, len(d))
+	}
+	for _, f := range []ustr.Ustr{a, b, c} {
+		if e := tfs.Unlink(f); e != 0 {
+			t.Fatalf("Unlink %v failed %v", f, e)
+		}
+	}
+	ShutdownFS(tfs)
+
+	tfs = BootFS(dst)
+	if _, nblock1 := tfs.fs.Fs_size(); nblock1 != nblock {
+		t.Fatalf("blocks not freed: free before %v after %v", nblock, nblock1)
+	}
+	ShutdownFS(tfs)
+	if r := Fsck(dst, false); len(r.Problems) != 0 {
+		t.Fatalf("fsck: %v", r.Problems)
+	}
+	os.Remove(dst)
+}
+
+func doTestSparse(t *testing.T, feat int) {
+	dst := "tmp.img"
+	MkDiskFeatures(dst, nil, nlogblks, ninodeblks, 200, feat)
+
+	fmt.Printf("Test Sparse %v features %#x ...\n", dst, feat)
+	tfs := BootFS(dst)
+	_, nblock := tfs.fs.Fs_size()
+	f := ustr.Ustr("f")
+	if e := tfs.MkFile(f, nil); e != 0 {
+		t.Fatalf("mkFile %v failed %v", f, e)
+	}
+	// a write far past the end, beyond the indirect block, leaves a hole
+	far := (fs.NIADDRS + fs.INDADDR + 10) * fs.BSIZE
+	if e := tfs.Pwrite(f, mkData(0x82, fs.BSIZE), far); e != 0 {
+		t.Fatalf("Pwrite %v failed %v", f, e)
+	}
+	if _, nblock1 := tfs.fs.Fs_size(); nblock-nblock1 > 3 {
+		t.Fatalf("%v blocks used for a block of data", nblock-nblock1)
+	}
+	seek := func(off, whence int, want int, wante defs.Err_t) {
+		n, e := tfs.Seek(f, off, whence)
+		if e != wante || (e == 0 && n != want) {
+			t.Fatalf("Seek(%v, %#x) = %v %v, want %v %v", off, whence,
+				n, e, want, wante)
+		}
+	}
+	size := far + fs.BSIZE
+	seek(0, defs.SEEK_DATA, far, 0)
+	seek(0, defs.SEEK_HOLE, 0, 0)
+	seek(far+10, defs.SEEK_HOLE, size, 0)
+	seek(size, defs.SEEK_DATA, 0, -defs.ENXIO)
+
+	// four blocks of data, a hole punched from the middle of the second
+	// to the middle of the fourth, and the first bytes zeroed
+	if e := tfs.Pwrite(f, mkData(0x81, 4*fs.BSIZE), 0); e != 0 {
+		t.Fatalf("Pwrite %v failed %v", f, e)
+	}
+	_, nblock1 := tfs.fs.Fs_size()
+	hs, he := fs.BSIZE+10, 3*fs.BSIZE+10
+	e := tfs.Fallocate(f, defs.FALLOC_FL_PUNCH_HOLE, hs, he-hs)
+	if e != -defs.EOPNOTSUPP {
+		t.Fatalf("punch without keep size: %v", e)
+	}
+	mode := defs.FALLOC_FL_PUNCH_HOLE | defs.FALLOC_FL_KEEP_SIZE
+	if e := tfs.Fallocate(f, mode, hs, he-hs); e != 0 {
+		t.Fatalf("Fallocate %v failed %v", f, e)
+	}
+	if _, nblock2 := tfs.fs.Fs_size(); nblock2 != nblock1+1 {
+		t.Fatalf("punch freed %v blocks", nblock2-nblock1)
+	}
+	if e := tfs.Fallocate(f, defs.FALLOC_FL_ZERO_RANGE, 0, 10); e != 0 {
+		t.Fatalf("Fallocate %v failed %v", f, e)
+	}
+	seek(0, defs.SEEK_HOLE, 2*fs.BSIZE, 0)
+	seek(2*fs.BSIZE, defs.SEEK_DATA, 3*fs.BSIZE, 0)
+	// allocating past the end, but keeping the size
+	mode = defs.FALLOC_FL_KEEP_SIZE
+	if e := tfs.Fallocate(f, mode, size, 2*fs.BSIZE); e != 0 {
+		t.Fatalf("Fallocate %v failed %v", f, e)
+	}
+	chk := func(d []byte) {
+		if len(d) != size {
+			t.Fatalf("%v: size %v, want %v", f, len(d), size)
+		}
+		for i := range d {
+			want := byte(0)
+			if (i >= 10 && i < hs) || (i >= he && i < 4*fs.BSIZE) {
+				want = 0x81
+			} else if i >= far {
+				want = 0x82
+			}
+			if d[i] != want {
+				t.Fatalf("%v: %#x at %v, want %#x", f, d[i], i, want)
+			}
+		}
+	}
+	d, e := tfs.Read(f)
+	if e != 0 {
+		t.Fatalf("Read %v failed %v", f, e)
+	}
+	chk(d)
+	ShutdownFS(tfs)
+
+	if r := Fsck(dst, false); len(r.Problems) != 0 {
+		t.Fatalf("fsck: %v", r.Problems)
+	}
+
+	tfs = BootFS(dst)
+	d, e = tfs.Read(f)
+	if e != 0 {
+		t.Fatalf("Read %v failed %v", f, e)
+	}
+	chk(d)
+	// shrinking frees the blocks past the end, and growing again exposes
+	// zeros
+	if e := tfs.Truncate(f, 10+fs.BSIZE/2); e != 0 {
+		t.Fatalf("Truncate %v failed %v", f, e)
+	}
+	if e := tfs.Truncate(f, 2*fs.BSIZE); e != 0 {
+		t.Fatalf("Truncate %v failed %v", f, e)
+	}
+	d, e = tfs.Read(f)
+	if e != 0 || len(d) != 2*fs.BSIZE {
+		t.Fatalf("Read %v failed %v %v", f, e, len(d))
+	}
+	for i := range d {
+		if want := byte(0x81); (i < 10 || i >= 10+fs.BSIZE/2) && d[i] != 0 ||
+			i >= 10 && i < 10+fs.BSIZE/2 && d[i] != want {
+			t.Fatalf("%v: %#x at %v", f, d[i], i)
+		}
+	}
+	seek(0, defs.SEEK_HOLE, fs.BSIZE, 0)
+	// so does opening with O_TRUNC
+	fd, e := tfs.vfs.Fs_open(f, defs.O_RDWR|defs.O_TRUNC, 0, tfs.cwd, tfs.cred, 0, 0)
+	if e != 0 {
+		t.Fatalf("open %v failed %v", f, e)
+	}
+	fd.Fops.Close()
+	if e := tfs.Truncate(f, 2*fs.BSIZE); e != 0 {
+		t.Fatalf("Truncate %v failed %v", f, e)
+	}
+	d, e = tfs.Read(f)
+	if e != 0 || !bytes.Equal(d, make([]byte, 2*fs.BSIZE)) {
+		t.Fatalf("Read %v after O_TRUNC failed %v %v", f, e, len(d))
+	}
+	seek(0, defs.SEEK_DATA, 0, -defs.ENXIO)
+
+	// a shared mapping of a punched block reads zeros, and its stores
+	// don't reach the next owner of the block, which for extents is the
+	// same file block again
+	if e := tfs.Pwrite(f, mkData(0x83, 2*fs.BSIZE), 0); e != 0 {
+		t.Fatalf("Pwrite %v failed %v", f, e)
+	}
+	fd, e = tfs.vfs.Fs_open(f, defs.O_RDWR, 0, tfs.cwd, tfs.cred, 0, 0)
+	if e != 0 {
+		t.Fatalf("open %v failed %v", f, e)
+	}
+	mmi, e := fd.Fops.Mmapi(0, -1, true)
+	if e != 0 || len(mmi) != 2 {
+		t.Fatalf("Mmapi failed %v %v", e, len(mmi))
+	}
+	mode = defs.FALLOC_FL_PUNCH_HOLE | defs.FALLOC_FL_KEEP_SIZE
+	if e := tfs.Fallocate(f, mode, fs.BSIZE, fs.BSIZE); e != 0 {
+		t.Fatalf("Fallocate %v failed %v", f, e)
+	}
+	pg := mem.Pg2bytes(mmi[1].Pg)
+	if !bytes.Equal(pg[:fs.BSIZE], make([]byte, fs.BSIZE)) {
+		t.Fatalf("mapping of punched block reads %#x", pg[0])
+	}
+	if e := tfs.Pwrite(f, mkData(0x84, fs.BSIZE), fs.BSIZE); e != 0 {
+		t.Fatalf("Pwrite %v failed %v", f, e)
+	}
+	pg[0] = 0x85
+	d, e = tfs.Read(f)
+	if e != 0 || d[fs.BSIZE] != 0x84 {
+		t.Fatalf("store through mapping of punched block reached %v", f)
+	}
+	for _, m := range mmi {
+		fd.Fops.(mem.Unpin_i).Unpin(m.Phys)
+	}
+	fd.Fops.Close()
+	if e := tfs.Unlink(f); e != 0 {
+		t.Fatalf("Unlink %v failed %v", f, e)
+	}
+	ShutdownFS(tfs)
+
+	tfs = BootFS(dst)
+	if _, nblock1 := tfs.fs.Fs_size(); nblock1 != nblock {
+		t.Fatalf("blocks not freed: free before %v after %v", nblock, nblock1)
+	}
+	ShutdownFS(tfs)
+	if r := Fsck(dst, false); len(r.Problems) != 0 {
+		t.Fatalf("fsck: %v", r.Problems)
+	}
+	os.Remove(dst)
+}
+
+func TestSparse(t *testing.T) {
+	doTestSparse(t, 0)
+	doTestSparse(t, fs.FEAT_EXTENTS)
+}
+
+func TestMmapHole(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, 300)
+
+	fmt.Printf("Test MmapHole %v ...\n", dst)
+	tfs := BootFS(dst)
+	f := ustr.Ustr("f")
+	if e := tfs.MkFile(f, nil); e != 0 {
+		t.Fatalf("mkFile %v failed %v", f, e)
+	}
+	// mapping a hole much larger than the log allocates its blocks in
+	// many operations
+	const nblk = 200
+	if e := tfs.Truncate(f, nblk*fs.BSIZE); e != 0 {
+		t.Fatalf("Truncate %v failed %v", f, e)
+	}
+	fd, e := tfs.vfs.Fs_open(f, defs.O_RDWR, 0, tfs.cwd, tfs.cred, 0, 0)
+	if e != 0 {
+		t.Fatalf("open failed %v", e)
+	}
+	mmi, e := fd.Fops.Mmapi(0, -1, false)
+	if e != 0 || len(mmi) != nblk {
+		t.Fatalf("Mmapi failed %v %v", e, len(mmi))
+	}
+	for i := range mmi {
+		if mem.Pg2bytes(mmi[i].Pg)[0] != 0 {
+			t.Fatalf("page %v of a hole not zero", i)
+		}
+	}
+	fd.Fops.Close()
+	if n, e := tfs.Seek(f, 0, defs.SEEK_HOLE); e != 0 || n != nblk*fs.BSIZE {
+		t.Fatalf("hole left at %v %v", n, e)
+	}
+	ShutdownFS(tfs)
+
+	if r := Fsck(dst, false); len(r.Problems) != 0 {
+		t.Fatalf("fsck: %v", r.Problems)
+	}
+	os.Remove(dst)
+}
+
+func readImg(t *testing.T, dst string) []byte {
+	d, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatalf("ReadFile %v: %v", dst, err)
+	}
+	return d
+}
+
+func TestFsync(t *testing.T) {
+	dst := "tmp.img"
+	snap := "snap.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+
+	fmt.Printf("Test Fsync %v ...\n", dst)
+	tfs := BootFS(dst)
+	a := ustr.Ustr("a")
+	b := ustr.Ustr("b")
+	for _, f := range []ustr.Ustr{a, b} {
+		if e := tfs.MkFile(f, nil); e != 0 {
+			t.Fatalf("mkFile %v failed %v", f, e)
+		}
+	}
+	if e := tfs.Update(a, mkData(0x81, SMALL)); e != 0 {
+		t.Fatalf("Update %v failed %v", a, e)
+	}
+	if e := tfs.Fsync(a, false); e != 0 {
+		t.Fatalf("Fsync %v failed %v", a, e)
+	}
+	img := readImg(t, dst)
+	if err := ioutil.WriteFile(snap, img, 0644); err != nil {
+		t.Fatalf("WriteFile %v: %v", snap, err)
+	}
+
+	// syncing a again doesn't commit b's update
+	if e := tfs.Update(b, mkData(0x82, SMALL)); e != 0 {
+		t.Fatalf("Update %v failed %v", b, e)
+	}
+	if e := tfs.Fsync(a, false); e != 0 {
+		t.Fatalf("Fsync %v failed %v", a, e)
+	}
+	if !bytes.Equal(img, readImg(t, dst)) {
+		t.Fatalf("Fsync %v wrote to the disk", a)
+	}
+	// neither does fdatasync of a after a timestamp update of a, but
+	// fsync does
+	if e := tfs.Utimens(a, 1e9, 1e9); e != 0 {
+		t.Fatalf("Utimens %v failed %v", a, e)
+	}
+	if e := tfs.Fsync(a, true); e != 0 {
+		t.Fatalf("Fdatasync %v failed %v", a, e)
+	}
+	if !bytes.Equal(img, readImg(t, dst)) {
+		t.Fatalf("Fdatasync %v wrote to the disk", a)
+	}
+	if e := tfs.Fsync(a, false); e != 0 {
+		t.Fatalf("Fsync %v failed %v", a, e)
+	}
+	if bytes.Equal(img, readImg(t, dst)) {
+		t.Fatalf("Fsync %v didn't write to the disk", a)
+	}
+	// the cache forgets the transaction of an evicted inode, thus
+	// fdatasync commits all updates
+	img = readImg(t, dst)
+	if e := tfs.Update(b, mkData(0x83, SMALL)); e != 0 {
+		t.Fatalf("Update %v failed %v", b, e)
+	}
+	for n, _ := tfs.Sizes(); ; {
+		tfs.Evict()
+		n1, _ := tfs.Sizes()
+		if n1 >= n {
+			break
+		}
+		n = n1
+	}
+	if e := tfs.Fsync(b, true); e != 0 {
+		t.Fatalf("Fdatasync %v failed %v", b, e)
+	}
+	if bytes.Equal(img, readImg(t, dst)) {
+		t.Fatalf("Fdatasync of evicted %v didn't write to the disk", b)
+	}
+	ShutdownFS(tfs)
+
+	// the snapshot, taken after the first fsync, has a's data
+	tfs = BootFS(snap)
+	d, e := tfs.Read(a)
+	if e != 0 || len(d) != SMALL {
+		t.Fatalf("Read %v failed %v %v", a, e, len(d))
+	}
+	for i := range d {
+		if d[i] != 0x81 {
+			t.Fatalf("%v: wrong data at %v", a, i)
+		}
+	}
+	ShutdownFS(tfs)
+	if r := Fsck(snap, false); len(r.Problems) != 0 {
+		t.Fatalf("fsck: %v", r.Problems)
+	}
+	os.Remove(snap)
+	os.Remove(dst)
+}
+
+// user pages that fault after the first n
+type faultpages_t struct {
+	*vm.Fakeubuf_t
+	n int
+}
+
+func (fp *faultpages_t) Userpage(k2u bool) (mem.Pa_t, *mem.Bytepg_t, defs.Err_t) {
+	if fp.n == 0 {
+		return 0, nil, -defs.EFAULT
+	}
+	fp.n--
+	return fp.Fakeubuf_t.Userpage(k2u)
+}
+
+func TestDirect(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+
+	fmt.Printf("Test Direct %v ...\n", dst)
+	tfs := BootFS(dst)
+	f := ustr.Ustr("f")
+	if e := tfs.MkFile(f, mkData(1, 2*fs.BSIZE)); e != 0 {
+		t.Fatalf("mkFile failed %v", e)
+	}
+	open := func() *fd.Fd_t {
+		of, e := tfs.vfs.Fs_open(f, defs.O_RDWR|defs.O_DIRECT, 0, tfs.cwd, tfs.cred, 0, 0)
+		if e != 0 {
+			t.Fatalf("open failed %v", e)
+		}
+		return of
+	}
+	check := func(d []byte, v ...uint8) {
+		if len(d) != len(v)*fs.BSIZE {
+			t.Fatalf("read %v bytes", len(d))
+		}
+		for i := range d {
+			if d[i] != v[i/fs.BSIZE] {
+				t.Fatalf("byte %v is %v", i, d[i])
+			}
+		}
+	}
+	dread := func(of *fd.Fd_t, off, n int) []byte {
+		buf := make([]uint8, n)
+		ub := &vm.Fakeubuf_t{}
+		ub.Fake_init(buf)
+		c, e := of.Fops.Pread(ub, off)
+		if e != 0 {
+			t.Fatalf("direct read failed %v", e)
+		}
+		return buf[:c]
+	}
+
+	// the file's blocks are cached, but the direct write of a new block
+	// goes to the disk
+	fd1 := open()
+	check(dread(fd1, 0, 2*fs.BSIZE), 1, 1)
+	if _, e := fd1.Fops.Pwrite(mkData(2, fs.BSIZE), 2*fs.BSIZE); e != 0 {
+		t.Fatalf("direct write failed %v", e)
+	}
+	if _, e := fd1.Fops.Pwrite(mkData(3, fs.BSIZE), 0); e != 0 {
+		t.Fatalf("direct write failed %v", e)
+	}
+	d, e := tfs.Read(f)
+	if e != 0 {
+		t.Fatalf("read failed %v", e)
+	}
+	check(d, 3, 1, 2)
+
+	// a fault in the user pages allocates no blocks
+	_, _, _, nbfree := tfs.Df()
+	fp := &faultpages_t{mkData(4, 2*fs.BSIZE), 1}
+	if _, e := fd1.Fops.Pwrite(fp, 3*fs.BSIZE); e != -defs.EFAULT {
+		t.Fatalf("direct write from bad pages %v", e)
+	}
+	if _, _, _, n := tfs.Df(); n != nbfree {
+		t.Fatalf("faulted write allocated %v blocks", nbfree-n)
+	}
+	if st, e := tfs.Stat(f); e != 0 || st.Size() != 3*fs.BSIZE {
+		t.Fatalf("faulted write changed the size %v", e)
+	}
+
+	// the offset and length must be block aligned
+	if _, e := fd1.Fops.Pwrite(mkData(4, SMALL), 0); e != -defs.EINVAL {
+		t.Fatalf("unaligned direct write %v", e)
+	}
+	if _, e := fd1.Fops.Pread(mkData(0, fs.BSIZE), SMALL); e != -defs.EINVAL {
+		t.Fatalf("unaligned direct read %v", e)
+	}
+	fd.Close_panic(fd1)
+	ShutdownFS(tfs)
+
+	// after a reboot, direct reads come from the disk; the read stops at
+	// the end of the file
+	tfs = BootFS(dst)
+	if e := tfs.Truncate(f, 2*fs.BSIZE+SMALL); e != 0 {
+		t.Fatalf("truncate failed %v", e)
+	}
+	fd1 = open()
+	d = dread(fd1, 0, 4*fs.BSIZE)
+	if len(d) != 2*fs.BSIZE+SMALL {
+		t.Fatalf("direct read %v bytes", len(d))
+	}
+	check(d[:2*fs.BSIZE], 3, 1)
+	check(dread(fd1, fs.BSIZE, fs.BSIZE), 1)
+	fd.Close_panic(fd1)
+	ShutdownFS(tfs)
+	os.Remove(dst)
+}
+
+func TestReadahead(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+
+	fmt.Printf("Test Readahead %v ...\n", dst)
+	tfs := BootFS(dst)
+	f := ustr.Ustr("f")
+	const nblk = 16
+	if e := tfs.MkFile(f, nil); e != 0 {
+		t.Fatalf("mkFile failed %v", e)
+	}
+	for i := 0; i < nblk; i++ {
+		if e := tfs.Append(f, mkData(uint8(i), fs.BSIZE)); e != 0 {
+			t.Fatalf("append failed %v", e)
+		}
+	}
+	ShutdownFS(tfs)
+
+	tfs = BootFS(dst)
+	of, e := tfs.vfs.Fs_open(f, defs.O_RDONLY, 0, tfs.cwd, tfs.cred, 0, 0)
+	if e != 0 {
+		t.Fatalf("open failed %v", e)
+	}
+	read := func(blk int) {
+		buf := make([]uint8, fs.BSIZE)
+		ub := &vm.Fakeubuf_t{}
+		ub.Fake_init(buf)
+		c, e := of.Fops.Pread(ub, blk*fs.BSIZE)
+		if e != 0 || c != fs.BSIZE {
+			t.Fatalf("read failed %v %v", c, e)
+		}
+		for i := range buf {
+			if buf[i] != uint8(blk) {
+				t.Fatalf("block %v byte %v is %v", blk, i, buf[i])
+			}
+		}
+	}
+	cached := func() int {
+		_, n := tfs.Sizes()
+		return n
+	}
+
+	// the first read of a file is sequential and reads ahead
+	n := cached()
+	read(0)
+	if c := cached() - n; c != 1+4 {
+		t.Fatalf("cached %v blocks", c)
+	}
+	// a random read doesn't
+	n = cached()
+	read(6)
+	if c := cached() - n; c != 1 {
+		t.Fatalf("cached %v blocks", c)
+	}
+	// sequential reads find the blocks read ahead and read further
+	for i := 0; i < nblk; i++ {
+		read(i)
+	}
+	fd.Close_panic(of)
+	ShutdownFS(tfs)
+	os.Remove(dst)
+}
+
+//
+// Test that inode are reused after freeing
+//
+
+func doTestInodeReuse(tfs *Ufs_t, n int, t *testing.T) {
+	for i := 0; i < n; i++ {
+		e := tfs.MkFile(ustr.Ustr(uniqfile(i)), nil)
+		if e != 0 {
+			t.Fatalf("mkFile %v failed", i)
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		e := tfs.Unlink(ustr.Ustr(uniqfile(i)))
+		if e != 0 {
+			t.Fatalf("Unlink %v failed", i)
+		}
+	}
+}
+
+func TestFSInodeReuse(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+
+	fmt.Printf("Test FSInodeReuce %v ...\n", dst)
+
+	tfs := BootFS(dst)
+	n := ninodeblks * (fs.BSIZE / fs.ISIZE)
+	for i := 0; i < n; i++ {
+		doTestInodeReuse(tfs, 10, t)
+	}
+	ShutdownFS(tfs)
+	os.Remove(dst)
+}
+
+func doTestInodeReuseRename(tfs *Ufs_t, n int, t *testing.T) {
+	for i := 0; i < n; i++ {
+		f := ustr.Ustr(uniqfile(i))
+		g := ustr.Ustr("g" + uniqfile(i))
+		e := tfs.MkFile(f, nil)
+		if e != 0 {
+			t.Fatalf("mkFile %v failed", i)
+		}
+		e = tfs.Rename(f, g)
+		if e != 0 {
+			t.Fatalf("rename %v failed", i)
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		g := ustr.Ustr("g" + uniqfile(i))
+		e := tfs.Unlink(g)
+		if e != 0 {
+			t.Fatalf("Unlink %v failed", i)
+		}
+	}
+}
+
+func TestFSInodeReuseRename(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+
+	fmt.Printf("Test FSInodeReuseRename %v ...\n", dst)
+
+	tfs := BootFS(dst)
+	n := ninodeblks * (fs.BSIZE / fs.ISIZE)
+	for i := 0; i < n; i++ {
+		doTestInodeReuseRename(tfs, 10, t)
+	}
+	ShutdownFS(tfs)
+	os.Remove(dst)
+}
+
+//
+// Test symlinks
+//
+
+func doTestSymlink(tfs *Ufs_t, d ustr.Ustr) string {
+	e := tfs.MkDir(d)
+	if e != 0 {
+		return fmt.Sprintf("mkDir %v failed", d)
+	}
+	e = tfs.MkFile(d.ExtendStr("f1"), mkData(1, SMALL))
+	if e != 0 {
+		return fmt.Sprintf("mkFile %v failed", "f1")
+	}
+	e = tfs.MkDir(d.ExtendStr("d0"))
+	if e != 0 {
+		return fmt.Sprintf("mkDir %v failed", "d0")
+	}
+	e = tfs.Symlink(ustr.Ustr("f1"), d.ExtendStr("l1"))
+	if e != 0 {
+		return fmt.Sprintf("Symlink %v failed", "l1")
+	}
+	e = tfs.Symlink(ustr.Ustr("/"+d.String()+"/d0"), d.ExtendStr("l2"))
+	if e != 0 {
+		return fmt.Sprintf("Symlink %v failed", "l2")
+	}
+	e = tfs.Symlink(ustr.Ustr("l1"), d.ExtendStr("l1"))
+	if e != -defs.EEXIST {
+		return fmt.Sprintf("Symlink over existing name %v", e)
+	}
+	// create a file through a symlink to a directory
+	e = tfs.MkFile(d.ExtendStr("l2/f2"), mkData(2, SMALL))
+	if e != 0 {
+		return fmt.Sprintf("mkFile %v failed", "l2/f2")
+	}
+	e = tfs.Symlink(ustr.Ustr("loop2"), d.ExtendStr("loop1"))
+	if e != 0 {
+		return fmt.Sprintf("Symlink %v failed", "loop1")
+	}
+	e = tfs.Symlink(ustr.Ustr("loop1"), d.ExtendStr("loop2"))
+	if e != 0 {
+		return fmt.Sprintf("Symlink %v failed", "loop2")
+	}
+	return ""
+}
+
+func doCheckSymlink(tfs *Ufs_t, d ustr.Ustr, t *testing.T) {
+	target, e := tfs.Readlink(d.ExtendStr("l1"))
+	if e != 0 || !target.Eq(ustr.Ustr("f1")) {
+		t.Fatalf("Readlink l1 %v %v", target, e)
+	}
+	data, e := tfs.Read(d.ExtendStr("l1"))
+	if e != 0 || len(data) != SMALL || data[0] != 1 {
+		t.Fatalf("Read through l1 failed %v", e)
+	}
+	data, e = tfs.Read(d.ExtendStr("d0/f2"))
+	if e != 0 || len(data) != SMALL || data[0] != 2 {
+		t.Fatalf("Read d0/f2 failed %v", e)
+	}
+	data, e = tfs.Read(d.ExtendStr("l2/../f1"))
+	if e != 0 || len(data) != SMALL || data[0] != 1 {
+		t.Fatalf("Read l2/../f1 failed %v", e)
+	}
+	_, e = tfs.Readlink(d.ExtendStr("f1"))
+	if e != -defs.EINVAL {
+		t.Fatalf("Readlink of a file %v", e)
+	}
+	_, e = tfs.Stat(d.ExtendStr("loop1"))
+	if e != -defs.ELOOP {
+		t.Fatalf("Stat of symlink loop %v", e)
+	}
+	_, e = tfs.fs.Fs_open(d.ExtendStr("l1"), defs.O_RDONLY|defs.O_NOFOLLOW, 0, tfs.cwd, tfs.cred, 0, 0)
+	if e != -defs.ELOOP {
+		t.Fatalf("open with O_NOFOLLOW %v", e)
+	}
+}
+
+func TestFSSymlink(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+
+	fmt.Printf("Test FSSymlink %v ...\n", dst)
+	d := ustr.Ustr("d")
+	tfs := BootFS(dst)
+	s := doTestSymlink(tfs, d)
+	if s != "" {
+		t.Fatalf("doTestSymlink failed %s\n", s)
+	}
+	doCheckSymlink(tfs, d, t)
+	ShutdownFS(tfs)
+
+	tfs = BootFS(dst)
+	doCheckSymlink(tfs, d, t)
+	// removing a symlink leaves its target alone
+	e := tfs.Unlink(d.ExtendStr("l1"))
+	if e != 0 {
+		t.Fatalf("Unlink l1 failed %v", e)
+	}
+	if _, e = tfs.Stat(d.ExtendStr("f1")); e != 0 {
+		t.Fatalf("f1 gone after unlinking l1")
+	}
+	if _, e = tfs.Readlink(d.ExtendStr("l1")); e != -defs.ENOENT {
+		t.Fatalf("l1 still present %v", e)
+	}
+	ShutdownFS(tfs)
+	os.Remove(dst)
+}
+
+//
+// Test that mode bits, owner and timestamps are kept on disk
+//
+
+const attrtime = 1500000000 * 1e9
+
+func doTestAttrs(tfs *Ufs_t, d ustr.Ustr) string {
+	e := tfs.MkDir(d)
+	if e != 0 {
+		return fmt.Sprintf("mkDir %v failed", d)
+	}
+	f1 := d.ExtendStr("f1")
+	e = tfs.MkFile(f1, mkData(1, SMALL))
+	if e != 0 {
+		return fmt.Sprintf("mkFile %v failed", f1)
+	}
+	st, e := tfs.Stat(f1)
+	if e != 0 || st.Mode()&07777 != 0644 || st.Mode()&^07777 != fs.I_FILE<<16 {
+		return fmt.Sprintf("new file mode %o %v", st.Mode(), e)
+	}
+	if st.Mtime() == 0 {
+		return "new file has no mtime"
+	}
+	if e = tfs.Chmod(f1, 0600); e != 0 {
+		return fmt.Sprintf("Chmod failed %v", e)
+	}
+	if e = tfs.Chown(f1, 5, 6); e != 0 {
+		return fmt.Sprintf("Chown failed %v", e)
+	}
+	// -1 leaves the owner unchanged
+	if e = tfs.Chown(f1, -1, 7); e != 0 {
+		return fmt.Sprintf("Chown failed %v", e)
+	}
+	if e = tfs.Utimens(f1, attrtime, attrtime); e != 0 {
+		return fmt.Sprintf("Utimens failed %v", e)
+	}
+	f2 := d.ExtendStr("f2")
+	e = tfs.MkFile(f2, nil)
+	if e != 0 {
+		return fmt.Sprintf("mkFile %v failed", f2)
+	}
+	if e = tfs.Utimens(f2, attrtime, attrtime); e != 0 {
+		return fmt.Sprintf("Utimens failed %v", e)
+	}
+	// writing updates the modification time
+	if e = tfs.Append(f2, mkData(2, SMALL)); e != 0 {
+		return fmt.Sprintf("Append failed %v", e)
+	}
+	return ""
+}
+
+func doCheckAttrs(tfs *Ufs_t, d ustr.Ustr, t *testing.T) {
+	st, e := tfs.Stat(d.ExtendStr("f1"))
+	if e != 0 {
+		t.Fatalf("Stat f1 failed %v", e)
+	}
+	if st.Mode()&07777 != 0600 {
+		t.Fatalf("f1 mode %o", st.Mode())
+	}
+	if st.Uid() != 5 {
+		t.Fatalf("f1 uid %v", st.Uid())
+	}
+	if st.Mtime() != attrtime {
+		t.Fatalf("f1 mtime %v", st.Mtime())
+	}
+	st, e = tfs.Stat(d.ExtendStr("f2"))
+	if e != 0 {
+		t.Fatalf("Stat f2 failed %v", e)
+	}
+	if st.Mtime() <= attrtime {
+		t.Fatalf("f2 mtime not updated by write %v", st.Mtime())
+	}
+	st, e = tfs.Stat(d)
+	if e != 0 || st.Mode()&07777 != 0755 {
+		t.Fatalf("dir mode %o %v", st.Mode(), e)
+	}
+}
+
+func TestFSAttrs(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+
+	fmt.Printf("Test FSAttrs %v ...\n", dst)
+	d := ustr.Ustr("d")
+	tfs := BootFS(dst)
+	s := doTestAttrs(tfs, d)
+	if s != "" {
+		t.Fatalf("doTestAttrs failed %s\n", s)
+	}
+	doCheckAttrs(tfs, d, t)
+	ShutdownFS(tfs)
+
+	tfs = BootFS(dst)
+	doCheckAttrs(tfs, d, t)
+	st, e := tfs.Stat(ustr.MkUstrRoot())
+	if e != 0 || st.Mode()&07777 != 0755 || st.Mtime() == 0 {
+		t.Fatalf("root attributes %o %v %v", st.Mode(), st.Mtime(), e)
+	}
+	ShutdownFS(tfs)
+	os.Remove(dst)
+}
+
+//
+// Test permission checks
+//
+
+func TestFSPerms(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+
+	fmt.Printf("Test FSPerms %v ...\n", dst)
+	tfs := BootFS(dst)
+	d := ustr.Ustr("d")
+	f := d.ExtendStr("f")
+	sticky := d.ExtendStr("tmp")
+	if e := tfs.MkDir(d); e != 0 {
+		t.Fatalf("mkDir %v failed %v", d, e)
+	}
+	if e := tfs.MkFile(f, mkData(1, SMALL)); e != 0 {
+		t.Fatalf("mkFile %v failed %v", f, e)
+	}
+	if e := tfs.MkDir(sticky); e != 0 {
+		t.Fatalf("mkDir %v failed %v", sticky, e)
+	}
+	if e := tfs.Chmod(sticky, 01777); e != 0 {
+		t.Fatalf("Chmod %v failed %v", sticky, e)
+	}
+	rootf := sticky.ExtendStr("root")
+	if e := tfs.MkFile(rootf, nil); e != 0 {
+		t.Fatalf("mkFile %v failed %v", rootf, e)
+	}
+
+	user := &proc.Cred_t{Uid: 1000, Euid: 1000, Suid: 1000,
+		Gid: 1000, Egid: 1000, Sgid: 1000}
+	tfs.SetCred(user)
+	if _, e := tfs.Read(f); e != 0 {
+		t.Fatalf("Read %v failed %v", f, e)
+	}
+	if e := tfs.Update(f, mkData(2, SMALL)); e != -defs.EACCES {
+		t.Fatalf("Update %v by non-owner: %v", f, e)
+	}
+	if e := tfs.MkFile(d.ExtendStr("g"), nil); e != -defs.EACCES {
+		t.Fatalf("mkFile in 0755 dir by non-owner: %v", e)
+	}
+	if e := tfs.Unlink(f); e != -defs.EACCES {
+		t.Fatalf("Unlink in 0755 dir by non-owner: %v", e)
+	}
+	if e := tfs.Chmod(f, 0666); e != -defs.EPERM {
+		t.Fatalf("Chmod by non-owner: %v", e)
+	}
+	if e := tfs.Chown(f, 1000, -1); e != -defs.EPERM {
+		t.Fatalf("Chown by non-root: %v", e)
+	}
+	userf := sticky.ExtendStr("user")
+	if e := tfs.MkFile(userf, nil); e != 0 {
+		t.Fatalf("mkFile in sticky dir failed %v", e)
+	}
+	if e := tfs.Unlink(rootf); e != -defs.EPERM {
+		t.Fatalf("Unlink of other's file in sticky dir: %v", e)
+	}
+	if e := tfs.Unlink(userf); e != 0 {
+		t.Fatalf("Unlink of own file in sticky dir failed %v", e)
+	}
+
+	tfs.SetCred(proc.Rootcred)
+	if e := tfs.Chown(f, 1000, 1000); e != 0 {
+		t.Fatalf("Chown failed %v", e)
+	}
+	tfs.SetCred(user)
+	if e := tfs.Chmod(f, 0600); e != 0 {
+		t.Fatalf("Chmod by owner failed %v", e)
+	}
+	if e := tfs.Update(f, mkData(2, SMALL)); e != 0 {
+		t.Fatalf("Update by owner failed %v", e)
+	}
+
+	// a 0700 directory hides its contents from other users, also once
+	// the names in it are cached
+	priv := ustr.Ustr("priv")
+	privf := priv.ExtendStr("f")
+	tfs.SetCred(proc.Rootcred)
+	if e := tfs.MkDir(priv); e != 0 {
+		t.Fatalf("mkDir %v failed %v", priv, e)
+	}
+	if e := tfs.MkFile(privf, mkData(3, SMALL)); e != 0 {
+		t.Fatalf("mkFile %v failed %v", privf, e)
+	}
+	if e := tfs.Chmod(priv, 0700); e != 0 {
+		t.Fatalf("Chmod %v failed %v", priv, e)
+	}
+	if _, e := tfs.Read(privf); e != 0 {
+		t.Fatalf("Read %v failed %v", privf, e)
+	}
+	tfs.SetCred(user)
+	if _, e := tfs.Stat(priv); e != 0 {
+		t.Fatalf("Stat %v failed %v", priv, e)
+	}
+	if _, e := tfs.Stat(privf); e != -defs.EACCES {
+		t.Fatalf("Stat under 0700 dir by non-owner: %v", e)
+	}
+	if _, e := tfs.Read(privf); e != -defs.EACCES {
+		t.Fatalf("Read under 0700 dir by non-owner: %v", e)
+	}
+	if e := tfs.MkFile(priv.ExtendStr("g").ExtendStr("h"), nil); e != -defs.EACCES {
+		t.Fatalf("mkFile under 0700 dir by non-owner: %v", e)
+	}
+
+	// executing a file requires execute, not read, permission, checked
+	// with the caller's credentials
+	x := ustr.Ustr("x")
+	tfs.SetCred(proc.Rootcred)
+	if e := tfs.MkFile(x, mkData(4, SMALL)); e != 0 {
+		t.Fatalf("mkFile %v failed %v", x, e)
+	}
+	if e := tfs.Chmod(x, 0711); e != 0 {
+		t.Fatalf("Chmod %v failed %v", x, e)
+	}
+	tfs.SetCred(user)
+	exec := func(p ustr.Ustr) defs.Err_t {
+		fd, e := tfs.vfs.Fs_open(p, defs.O_RDONLY|defs.O_EXEC, 0, tfs.cwd, tfs.cred, 0, 0)
+		if e != 0 {
+			return e
+		}
+		defer fd.Fops.Close()
+		_, _, e = tfs.vfs.Fs_execperm(fd, tfs.cred)
+		return e
+	}
+	if _, e := tfs.Read(x); e != -defs.EACCES {
+		t.Fatalf("Read of 0711 file by non-owner: %v", e)
+	}
+	if e := exec(x); e != 0 {
+		t.Fatalf("exec of 0711 file by non-owner failed %v", e)
+	}
+	if e := exec(f); e != -defs.EACCES {
+		t.Fatalf("exec of 0600 file: %v", e)
+	}
+	if e := exec(privf); e != -defs.EACCES {
+		t.Fatalf("exec under 0700 dir by non-owner: %v", e)
+	}
+	ShutdownFS(tfs)
+	os.Remove(dst)
+}
+
+//
+// Test extended attributes
+//
+
+func TestXattr(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+
+	fmt.Printf("Test Xattr %v ...\n", dst)
+	tfs := BootFS(dst)
+	f := ustr.Ustr("f")
+	if e := tfs.MkFile(f, mkData(1, SMALL)); e != 0 {
+		t.Fatalf("mkFile %v failed %v", f, e)
+	}
+	// ISIZE inodes have no room for attributes
+	if e := tfs.Setxattr(f, ustr.Ustr("user.a"), []uint8("v"), 0); e != -defs.EOPNOTSUPP {
+		t.Fatalf("Setxattr without FEAT_XATTR: %v", e)
+	}
+	ShutdownFS(tfs)
+
+	MkDiskFeatures(dst, nil, nlogblks, ninodeblks, ndatablks, fs.FEAT_XATTR)
+	tfs = BootFS(dst)
+	if e := tfs.MkFile(f, mkData(1, SMALL)); e != 0 {
+		t.Fatalf("mkFile %v failed %v", f, e)
+	}
+	small := ustr.Ustr("user.small")
+	if e := tfs.Setxattr(f, small, []uint8("v1"), 0); e != 0 {
+		t.Fatalf("Setxattr failed %v", e)
+	}
+	if e := tfs.Setxattr(f, small, []uint8("v2"), defs.XATTR_CREATE); e != -defs.EEXIST {
+		t.Fatalf("Setxattr create of existing: %v", e)
+	}
+	if e := tfs.Setxattr(f, ustr.Ustr("user.none"), nil, defs.XATTR_REPLACE); e != -defs.ENODATA {
+		t.Fatalf("Setxattr replace of missing: %v", e)
+	}
+	if e := tfs.Setxattr(f, ustr.Ustr("other.x"), nil, 0); e != -defs.EOPNOTSUPP {
+		t.Fatalf("Setxattr in unknown namespace: %v", e)
+	}
+	if e := tfs.Setxattr(f, small, []uint8("v2"), defs.XATTR_REPLACE); e != 0 {
+		t.Fatalf("Setxattr replace failed %v", e)
+	}
+	if e := tfs.Setxattr(f, ustr.Ustr("trusted.t"), []uint8("t"), 0); e != 0 {
+		t.Fatalf("Setxattr trusted failed %v", e)
+	}
+
+	// attributes that don't fit in the inode go in a block
+	_, _, _, nbfree := tfs.Df()
+	big := ustr.Ustr("user.big")
+	if e := tfs.Setxattr(f, big, bytes.Repeat([]uint8{7}, 2000), 0); e != 0 {
+		t.Fatalf("Setxattr big failed %v", e)
+	}
+	if _, _, _, n := tfs.Df(); nbfree-n != 1 {
+		t.Fatalf("attribute block %v", nbfree-n)
+	}
+	if e := tfs.Setxattr(f, ustr.Ustr("user.big2"), bytes.Repeat([]uint8{8}, 3000), 0); e != -defs.ENOSPC {
+		t.Fatalf("Setxattr beyond the block: %v", e)
+	}
+	ShutdownFS(tfs)
+
+	tfs = BootFS(dst)
+	if v, e := tfs.Getxattr(f, small); e != 0 || string(v) != "v2" {
+		t.Fatalf("Getxattr %q %v", v, e)
+	}
+	if v, e := tfs.Getxattr(f, big); e != 0 || !bytes.Equal(v, bytes.Repeat([]uint8{7}, 2000)) {
+		t.Fatalf("Getxattr big %v %v", len(v), e)
+	}
+	if _, e := tfs.Getxattr(f, ustr.Ustr("user.none")); e != -defs.ENODATA {
+		t.Fatalf("Getxattr of missing: %v", e)
+	}
+	names, e := tfs.Listxattr(f)
+	if e != 0 || strings.Join(names, " ") != "user.small trusted.t user.big" {
+		t.Fatalf("Listxattr %v %v", names, e)
+	}
+
+	user := &proc.Cred_t{Uid: 1000, Euid: 1000, Suid: 1000,
+		Gid: 1000, Egid: 1000, Sgid: 1000}
+	tfs.SetCred(user)
+	if _, e := tfs.Getxattr(f, small); e != 0 {
+		t.Fatalf("Getxattr by non-owner failed %v", e)
+	}
+	if e := tfs.Setxattr(f, small, nil, 0); e != -defs.EACCES {
+		t.Fatalf("Setxattr by non-owner: %v", e)
+	}
+	if _, e := tfs.Getxattr(f, ustr.Ustr("trusted.t")); e != -defs.ENODATA {
+		t.Fatalf("Getxattr trusted by non-root: %v", e)
+	}
+	if names, _ := tfs.Listxattr(f); len(names) != 2 {
+		t.Fatalf("Listxattr by non-root %v", names)
+	}
+	tfs.SetCred(proc.Rootcred)
+
+	if e := tfs.Removexattr(f, big); e != 0 {
+		t.Fatalf("Removexattr failed %v", e)
+	}
+	if e := tfs.Removexattr(f, big); e != -defs.ENODATA {
+		t.Fatalf("Removexattr of missing: %v", e)
+	}
+	if _, _, _, n := tfs.Df(); n != nbfree {
+		t.Fatalf("attribute block not freed %v %v", n, nbfree)
+	}
+	// unlinking the file frees its attribute block
+	if e := tfs.Setxattr(f, big, bytes.Repeat([]uint8{7}, 2000), 0); e != 0 {
+		t.Fatalf("Setxattr big failed %v", e)
+	}
+	if e := tfs.Unlink(f); e != 0 {
+		t.Fatalf("Unlink failed %v", e)
+	}
+	if _, _, _, n := tfs.Df(); n != nbfree+1 {
+		t.Fatalf("blocks not freed %v %v", n, nbfree)
+	}
+	ShutdownFS(tfs)
+
+	r := Fsck(dst, false)
+	if len(r.Problems) != 0 {
+		t.Fatalf("fsck: %v", r.Problems)
+	}
+	os.Remove(dst)
+}
+
+func TestReflink(t *testing.T) {
+	for _, feat := range []int{0, fs.FEAT_EXTENTS} {
+		doTestReflink(t, feat)
+	}
+}
+
+func doTestReflink(t *testing.T, feat int) {
+	dst := "tmp.img"
+	MkDiskFeatures(dst, nil, nlogblks, ninodeblks, 200, feat)
+
+	fmt.Printf("Test Reflink %v feat %v ...\n", dst, feat)
+	tfs := BootFS(dst)
+	f := ustr.Ustr("f")
+	g := ustr.Ustr("g")
+	// more blocks than the inode has pointers for
+	sz := 20 * fs.BSIZE
+	if e := tfs.MkFile(f, mkData(1, sz)); e != 0 {
+		t.Fatalf("mkFile %v failed %v", f, e)
+	}
+	_, _, _, nbfree := tfs.Df()
+	if e := tfs.Reflink(f, g); e != 0 {
+		t.Fatalf("Reflink failed %v", e)
+	}
+	// the count table and g's indirect block, but no data blocks
+	if _, _, _, n := tfs.Df(); nbfree-n > 4 {
+		t.Fatalf("clone used %v blocks", nbfree-n)
+	}
+	if e := tfs.Reflink(f, g); e != -defs.EEXIST {
+		t.Fatalf("Reflink to existing file: %v", e)
+	}
+	if e := tfs.Reflink(ustr.Ustr("/"), ustr.Ustr("d")); e != -defs.EISDIR {
+		t.Fatalf("Reflink of directory: %v", e)
+	}
+	if d, e := tfs.Read(g); e != 0 || !bytes.Equal(d, bytes.Repeat([]uint8{1}, sz)) {
+		t.Fatalf("Read clone %v %v", len(d), e)
+	}
+	ShutdownFS(tfs)
+	if r := Fsck(dst, false); len(r.Problems) != 0 {
+		t.Fatalf("fsck: %v", r.Problems)
+	}
+
+	// writing a shared block copies it
+	tfs = BootFS(dst)
+	_, _, _, nbfree = tfs.Df()
+	if e := tfs.Pwrite(g, mkData(2, fs.BSIZE), 3*fs.BSIZE); e != 0 {
+		t.Fatalf("Pwrite failed %v", e)
+	}
+	if _, _, _, n := tfs.Df(); nbfree-n != 1 {
+		t.Fatalf("copy used %v blocks", nbfree-n)
+	}
+	if d, e := tfs.Read(f); e != 0 || !bytes.Equal(d, bytes.Repeat([]uint8{1}, sz)) {
+		t.Fatalf("original changed %v", e)
+	}
+	want := bytes.Repeat([]uint8{1}, sz)
+	copy(want[3*fs.BSIZE:], bytes.Repeat([]uint8{2}, fs.BSIZE))
+	if d, e := tfs.Read(g); e != 0 || !bytes.Equal(d, want) {
+		t.Fatalf("Read clone after write %v", e)
+	}
+
+	// zeroing part of a shared block, by a punch or a truncate, copies it
+	h := ustr.Ustr("h")
+	if e := tfs.Reflink(f, h); e != 0 {
+		t.Fatalf("Reflink failed %v", e)
+	}
+	mode := defs.FALLOC_FL_PUNCH_HOLE | defs.FALLOC_FL_KEEP_SIZE
+	if e := tfs.Fallocate(h, mode, 10, 20); e != 0 {
+		t.Fatalf("Fallocate failed %v", e)
+	}
+	if e := tfs.Truncate(h, fs.BSIZE+10); e != 0 {
+		t.Fatalf("Truncate failed %v", e)
+	}
+	if d, e := tfs.Read(f); e != 0 || !bytes.Equal(d, bytes.Repeat([]uint8{1}, sz)) {
+		t.Fatalf("original changed by zeroing the clone %v", e)
+	}
+	hwant := bytes.Repeat([]uint8{1}, fs.BSIZE+10)
+	copy(hwant[10:30], make([]uint8, 20))
+	if d, e := tfs.Read(h); e != 0 || !bytes.Equal(d, hwant) {
+		t.Fatalf("Read zeroed clone %v", e)
+	}
+	if e := tfs.Unlink(h); e != 0 {
+		t.Fatalf("Unlink failed %v", e)
+	}
+
+	// the shared blocks are freed with their last owner
+	_, _, _, nbfree = tfs.Df()
+	if e := tfs.Unlink(f); e != 0 {
+		t.Fatalf("Unlink failed %v", e)
+	}
+	if _, _, _, n := tfs.Df(); n-nbfree > 2 {
+		t.Fatalf("unlink freed %v shared blocks", n-nbfree)
+	}
+	if d, e := tfs.Read(g); e != 0 || !bytes.Equal(d, want) {
+		t.Fatalf("Read clone after unlink %v", e)
+	}
+	if e := tfs.Truncate(g, 0); e != 0 {
+		t.Fatalf("Truncate failed %v", e)
+	}
+	if _, _, _, n := tfs.Df(); n-nbfree < 20 {
+		t.Fatalf("truncate freed %v blocks", n-nbfree)
+	}
+	ShutdownFS(tfs)
+	if r := Fsck(dst, false); len(r.Problems) != 0 {
+		t.Fatalf("fsck: %v", r.Problems)
+	}
+	os.Remove(dst)
+}
+
+func TestMmapShared(t *testing.T) {
+	for _, feat := range []int{0, fs.FEAT_JOURNAL} {
+		doTestMmapShared(t, feat)
 	}
+}
 
-	e = tfs.MkDir(d.ExtendStr("d0"))
-	if e != 0 {
-		return fmt.Sprintf("Mkdir %v failed", "d0")
-	}
+func doTestMmapShared(t *testing.T, feat int) {
+	dst := "tmp.img"
+	MkDiskFeatures(dst, nil, nlogblks, ninodeblks, 300, feat)
 
-	e = tfs.MkDir(d.ExtendStr("d0/d1"))
+	fmt.Printf("Test MmapShared %v feat %v ...\n", dst, feat)
+	tfs := BootFS(dst)
+	f := ustr.Ustr("f")
+	g := ustr.Ustr("g")
+	// a shared mapping of a clone much larger than the log copies its
+	// blocks in many operations
+	const nblk = 100
+	sz := nblk * fs.BSIZE
+	if e := tfs.MkFile(f, mkData(1, sz)); e != 0 {
+		t.Fatalf("mkFile %v failed %v", f, e)
+	}
+	if e := tfs.Reflink(f, g); e != 0 {
+		t.Fatalf("Reflink failed %v", e)
+	}
+	fd, e := tfs.vfs.Fs_open(g, defs.O_RDWR, 0, tfs.cwd, tfs.cred, 0, 0)
 	if e != 0 {
-		return fmt.Sprintf("Mkdir %v failed", "d1")
+		t.Fatalf("open failed %v", e)
 	}
-
-	e = tfs.Rename(d.ExtendStr("d0/d1"), d.ExtendStr("e0"))
-	if e != 0 {
-		return fmt.Sprintf("Rename failed")
+	_, _, _, nbfree := tfs.Df()
+	mmi, e := fd.Fops.Mmapi(0, -1, true)
+	if e != 0 || len(mmi) != nblk {
+		t.Fatalf("Mmapi failed %v %v", e, len(mmi))
 	}
-
-	ub = mkData(3, SMALL)
-	e = tfs.Append(d.ExtendStr("f1"), ub)
-	if e != 0 {
-		return fmt.Sprintf("Append failed")
+	if _, _, _, n := tfs.Df(); nbfree-n < nblk {
+		t.Fatalf("mapping copied %v blocks", nbfree-n)
 	}
-
-	e = tfs.Unlink(d.ExtendStr("f2"))
-	if e != 0 {
-		return fmt.Sprintf("Unlink failed")
+	// stores through the mapping leave the original alone
+	mem.Pg2bytes(mmi[nblk-1].Pg)[0] = 2
+	fd.Fops.Close()
+	if d, e := tfs.Read(f); e != 0 || !bytes.Equal(d, bytes.Repeat([]uint8{1}, sz)) {
+		t.Fatalf("original changed %v", e)
+	}
+	if d, e := tfs.Read(g); e != 0 || d[(nblk-1)*fs.BSIZE] != 2 {
+		t.Fatalf("Read after store failed %v", e)
 	}
-	return ""
-}
 
-func doCheckSimple(tfs *Ufs_t, d ustr.Ustr, t *testing.T) {
-	res, e := tfs.Ls(d)
+	// a clone of a mapped file gets copies of the mapped blocks, which
+	// the mapping keeps writing to
+	fd, e = tfs.vfs.Fs_open(f, defs.O_RDWR, 0, tfs.cwd, tfs.cred, 0, 0)
 	if e != 0 {
-		t.Fatalf("doLs failed")
+		t.Fatalf("open failed %v", e)
 	}
-	st, ok := res["f1"]
-	if !ok {
-		t.Fatalf("%s/f1 not present", d)
+	mmi, e = fd.Fops.Mmapi((nblk-2)*fs.BSIZE, 2*fs.BSIZE, true)
+	if e != 0 || len(mmi) != 2 {
+		t.Fatalf("Mmapi failed %v %v", e, len(mmi))
 	}
-	if st.Size() != 1024 {
-		t.Fatalf("f1 wrong size")
+	h := ustr.Ustr("h")
+	_, _, _, nbfree = tfs.Df()
+	if e := tfs.Reflink(f, h); e != 0 {
+		t.Fatalf("Reflink failed %v", e)
 	}
-
-	st, ok = res["f2"]
-	if ok {
-		t.Fatalf("f2 present")
+	if _, _, _, n := tfs.Df(); nbfree-n < 2 || nbfree-n > 10 {
+		t.Fatalf("clone of mapped file used %v blocks", nbfree-n)
 	}
-	st, ok = res["d0"]
-	if !ok {
-		t.Fatalf("d0 not present")
+	mem.Pg2bytes(mmi[1].Pg)[0] = 3
+	if d, e := tfs.Read(h); e != 0 || !bytes.Equal(d, bytes.Repeat([]uint8{1}, sz)) {
+		t.Fatalf("store through mapping changed the clone %v", e)
 	}
-	st, ok = res["e0"]
-	if !ok {
-		t.Fatalf("e0 not present")
+	if d, e := tfs.Read(f); e != 0 || d[(nblk-1)*fs.BSIZE] != 3 {
+		t.Fatalf("Read after store failed %v", e)
 	}
-	res, e = tfs.Ls(d.ExtendStr("d0"))
-	if e != 0 {
-		t.Fatalf("doLs d0 failed")
+	// once unmapped, the blocks are shared again
+	for _, m := range mmi {
+		fd.Fops.(mem.Unpin_i).Unpin(m.Phys)
 	}
-	st, ok = res["e0"]
-	if ok {
-		t.Fatalf("e0 present in d0")
+	fd.Fops.Close()
+	_, _, _, nbfree = tfs.Df()
+	if e := tfs.Reflink(f, ustr.Ustr("i")); e != 0 {
+		t.Fatalf("Reflink failed %v", e)
 	}
-}
-
-//
-// Util
-//
-
-func uniqdir(id int) string {
-	return "d" + strconv.Itoa(id)
-}
+	if _, _, _, n := tfs.Df(); nbfree-n > 4 {
+		t.Fatalf("clone of unmapped file used %v blocks", nbfree-n)
+	}
+	ShutdownFS(tfs)
 
-func uniqfile(id int) string {
-	return "f" + strconv.Itoa(id)
+	if r := Fsck(dst, false); len(r.Problems) != 0 {
+		t.Fatalf("fsck: %v", r.Problems)
+	}
+	os.Remove(dst)
 }
 
 //
-// Simple test
+// Test online grow
 //
 
-func TestFSSimple(t *testing.T) {
+func TestResize(t *testing.T) {
 	dst := "tmp.img"
-	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+	MkDisk(dst, nil, nlogblks, ninodeblks, 200)
 
-	fmt.Printf("Test FSSimple %v ...\n", dst)
-	d := ustr.Ustr("d/")
+	fmt.Printf("Test Resize %v ...\n", dst)
+	st, err := os.Stat(dst)
+	if err != nil {
+		t.Fatalf("stat %v", err)
+	}
+	last := int(st.Size()) / fs.BSIZE
 	tfs := BootFS(dst)
-	s := doTestSimple(tfs, d)
-	if s != "" {
-		t.Fatalf("doTestSimple failed %s\n", s)
+	if e := tfs.Resize(last); e != -defs.EINVAL {
+		t.Fatalf("Resize to the same size: %v", e)
+	}
+	f := ustr.Ustr("f")
+	if e := tfs.MkFile(f, mkData(1, 100*fs.BSIZE)); e != 0 {
+		t.Fatalf("mkFile %v failed %v", f, e)
+	}
+	ni, _, nb, _ := tfs.Df()
+
+	// the first block of the block map covers the new blocks
+	if e := tfs.Resize(last + 1000); e != 0 {
+		t.Fatalf("Resize failed %v", e)
+	}
+	ni1, _, nb1, _ := tfs.Df()
+	if nb1 != nb+1000 || ni1 <= ni {
+		t.Fatalf("grew to %v inodes %v blocks", ni1, nb1)
+	}
+	// more files than there were inodes, and a file bigger than the old
+	// file system
+	for i := 0; i < ni; i++ {
+		p := ustr.Ustr("d" + strconv.Itoa(i))
+		if e := tfs.MkFile(p, mkData(2, fs.BSIZE)); e != 0 {
+			t.Fatalf("mkFile %v failed %v", p, e)
+		}
+	}
+	g := ustr.Ustr("g")
+	if e := tfs.MkFile(g, mkData(3, 500*fs.BSIZE)); e != 0 {
+		t.Fatalf("mkFile %v failed %v", g, e)
 	}
-	doCheckSimple(tfs, d, t)
 	ShutdownFS(tfs)
+	if r := Fsck(dst, false); len(r.Problems) != 0 {
+		t.Fatalf("fsck: %v", r.Problems)
+	}
 
+	// the block map needs more blocks
 	tfs = BootFS(dst)
-	doCheckSimple(tfs, d, t)
+	_, _, nb1, nbfree1 := tfs.Df()
+	if e := tfs.Resize(last + 40000); e != 0 {
+		t.Fatalf("Resize failed %v", e)
+	}
+	// the new blocks are free, except the new inode blocks and one new
+	// block map block
+	ni2, nifree2, nb2, nbfree2 := tfs.Df()
+	if nb2 != nb+40000 || nbfree2-nbfree1 != 39000-(ni2-ni1)/(fs.BSIZE/fs.ISIZE)-1 {
+		t.Fatalf("grew to %v blocks %v free", nb2, nbfree2)
+	}
+	if d, e := tfs.Read(g); e != 0 || !bytes.Equal(d, bytes.Repeat([]uint8{3}, 500*fs.BSIZE)) {
+		t.Fatalf("Read %v %v", g, e)
+	}
+	ShutdownFS(tfs)
+	if r := Fsck(dst, false); len(r.Problems) != 0 {
+		t.Fatalf("fsck: %v", r.Problems)
+	}
+
+	tfs = BootFS(dst)
+	if ni, nifree, nb, nbfree := tfs.Df(); ni != ni2 || nifree != nifree2 ||
+		nb != nb2 || nbfree != nbfree2 {
+		t.Fatalf("after reboot %v %v %v %v", ni, nifree, nb, nbfree)
+	}
 	ShutdownFS(tfs)
 	os.Remove(dst)
 }
 
 //
-// Test eviction
+// Test fsck
+//
 
-func TestEvict(t *testing.T) {
+// applies f to block n of disk
+func pokeBlock(disk string, n int, f func(*mem.Bytepg_t)) {
+	fl, err := os.OpenFile(disk, os.O_RDWR, 0755)
+	if err != nil {
+		panic(err)
+	}
+	b := mkBlock()
+	if _, err = fl.ReadAt(b, int64(n*fs.BSIZE)); err != nil {
+		panic(err)
+	}
+	d := blk2bytepg(b)
+	f(d)
+	if _, err = fl.WriteAt(d[:], int64(n*fs.BSIZE)); err != nil {
+		panic(err)
+	}
+	fl.Close()
+}
+
+func TestFsck(t *testing.T) {
 	dst := "tmp.img"
 	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
 
-	fmt.Printf("Test Evict %v ...\n", dst)
-	d := ustr.Ustr("d/")
+	fmt.Printf("Test Fsck %v ...\n", dst)
 	tfs := BootFS(dst)
-	s := doTestSimple(tfs, d)
-	if s != "" {
-		t.Fatalf("doTestSimple failed %s\n", s)
+	d := ustr.Ustr("d")
+	f := d.ExtendStr("f")
+	if e := tfs.MkDir(d); e != 0 {
+		t.Fatalf("mkDir %v failed %v", d, e)
 	}
-	ni, nb := tfs.Sizes()
-	tfs.Evict()
-	ni1, nb1 := tfs.Sizes()
-	if ni1 >= ni {
-		t.Fatalf("No inodes evicted %d %d\n", ni, ni1)
+	if e := tfs.MkFile(f, mkData(1, SMALL)); e != 0 {
+		t.Fatalf("mkFile %v failed %v", f, e)
 	}
-	if nb1 >= nb {
-		t.Fatalf("No blocks evicted %d %d\n", nb, nb1)
+	ShutdownFS(tfs)
+
+	r := Fsck(dst, false)
+	if len(r.Problems) != 0 || r.Logdirty || r.Repaired {
+		t.Fatalf("fresh image: %v", r.Problems)
+	}
+
+	// free the root directory's block and bump the link count of f,
+	// whose inode is the third allocated.
+	var sb fs.Superblock_t
+	pokeBlock(dst, 1, func(d *mem.Bytepg_t) {
+		sb = fs.Superblock_t{d}
+	})
+	pokeBlock(dst, sb.Freeblock(), func(d *mem.Bytepg_t) {
+		d[0] &^= 1
+		fs.Csumw(d)
+	})
+	pokeBlock(dst, sb.Freeblock()+sb.Freeblocklen(), func(d *mem.Bytepg_t) {
+		b := fs.MkBlock(0, "", nil, nil, nil)
+		b.Data = d
+		ind := fs.Inode_t{b, 2, fs.ISIZE}
+		ind.W_linkcount(5)
+	})
+
+	r = Fsck(dst, false)
+	if len(r.Problems) != 2 || r.Repaired {
+		t.Fatalf("corrupt image: %v", r.Problems)
+	}
+	r = Fsck(dst, true)
+	if len(r.Problems) != 2 || !r.Repaired {
+		t.Fatalf("repair: %v", r.Problems)
+	}
+	r = Fsck(dst, false)
+	if len(r.Problems) != 0 {
+		t.Fatalf("repaired image: %v", r.Problems)
 	}
-	fmt.Printf("inode %d %d\n", ni, ni1)
-	fmt.Printf("blks %d %d\n", nb, nb1)
 
-	// make sure we can still read what we created after eviction
-	doCheckSimple(tfs, d, t)
+	tfs = BootFS(dst)
+	if _, e := tfs.Read(f); e != 0 {
+		t.Fatalf("Read %v failed %v", f, e)
+	}
+	ShutdownFS(tfs)
+	os.Remove(dst)
 }
 
 //
-// Test that inode are reused after freeing
+// Test checksums
 //
 
-func doTestInodeReuse(tfs *Ufs_t, n int, t *testing.T) {
-	for i := 0; i < n; i++ {
-		e := tfs.MkFile(ustr.Ustr(uniqfile(i)), nil)
-		if e != 0 {
-			t.Fatalf("mkFile %v failed", i)
-		}
+func TestCsum(t *testing.T) {
+	dst := "tmp.img"
+	snap := "snap.img"
+	// a log long enough that Sync doesn't install b's transaction
+	MkDisk(dst, nil, 128, ninodeblks, ndatablks)
+
+	fmt.Printf("Test Csum %v ...\n", dst)
+	tfs := BootFS(dst)
+	a := ustr.Ustr("a")
+	b := ustr.Ustr("b")
+	if e := tfs.MkFile(a, mkData(1, SMALL)); e != 0 {
+		t.Fatalf("mkFile %v failed %v", a, e)
+	}
+	if e := tfs.SyncApply(); e != 0 {
+		t.Fatalf("SyncApply failed %v", e)
+	}
+	if e := tfs.MkFile(b, mkData(2, SMALL)); e != 0 {
+		t.Fatalf("mkFile %v failed %v", b, e)
+	}
+	if e := tfs.Sync(); e != 0 {
+		t.Fatalf("Sync failed %v", e)
+	}
+	// b's transaction is committed but not installed in the snapshot
+	if err := ioutil.WriteFile(snap, readImg(t, dst), 0644); err != nil {
+		t.Fatalf("WriteFile %v: %v", snap, err)
+	}
+	ShutdownFS(tfs)
+	// install b's transaction
+	ShutdownFS(BootFS(dst))
+
+	var sb fs.Superblock_t
+	pokeBlock(dst, 1, func(d *mem.Bytepg_t) {
+		sb = fs.Superblock_t{d}
+	})
+
+	// damage a free entry of the root directory
+	pokeBlock(dst, sb.Datastart(), func(d *mem.Bytepg_t) {
+		d[fs.BSIZE-fs.CSUMSIZE-1] ^= 0x10
+	})
+	r := Fsck(dst, false)
+	if len(r.Problems) != 1 || !strings.Contains(r.Problems[0], "checksum") {
+		t.Fatalf("fsck: %v", r.Problems)
+	}
+	tfs = BootFS(dst)
+	if _, e := tfs.Stat(b); e != 0 {
+		t.Fatalf("Stat %v failed %v", b, e)
+	}
+	if nlog, nblk := tfs.Csumerrs(); nlog != 0 || nblk != 1 {
+		t.Fatalf("checksum errors %v %v", nlog, nblk)
+	}
+	if s := tfs.Statistics(); !strings.Contains(s, "checksum errors: log 0 blocks 1") {
+		t.Fatalf("statistics: %v", s)
+	}
+	ShutdownFS(tfs)
+	if r := Fsck(dst, true); len(r.Problems) != 1 || !r.Repaired {
+		t.Fatalf("repair: %v", r.Problems)
+	}
+	if r := Fsck(dst, false); len(r.Problems) != 0 {
+		t.Fatalf("repaired image: %v", r.Problems)
 	}
 
-	for i := 0; i < n; i++ {
-		e := tfs.Unlink(ustr.Ustr(uniqfile(i)))
-		if e != 0 {
-			t.Fatalf("Unlink %v failed", i)
-		}
+	// damage a block of b's transaction in the log; recovery drops the
+	// transaction, thus b doesn't exist
+	var tail int
+	pokeBlock(snap, 2, func(d *mem.Bytepg_t) {
+		tail = util.Readn(d[:], 8, 0)
+	})
+	pokeBlock(snap, 3+(tail+1)%(sb.Loglen()-1), func(d *mem.Bytepg_t) {
+		d[100] ^= 0x10
+	})
+	tfs = BootFS(snap)
+	if _, e := tfs.Stat(a); e != 0 {
+		t.Fatalf("Stat %v failed %v", a, e)
+	}
+	if _, e := tfs.Stat(b); e != -defs.ENOENT {
+		t.Fatalf("Stat %v: %v", b, e)
 	}
+	if nlog, nblk := tfs.Csumerrs(); nlog != 1 || nblk != 0 {
+		t.Fatalf("checksum errors %v %v", nlog, nblk)
+	}
+	ShutdownFS(tfs)
+	if r := Fsck(snap, false); len(r.Problems) != 0 {
+		t.Fatalf("fsck: %v", r.Problems)
+	}
+	os.Remove(snap)
+	os.Remove(dst)
 }
 
-func TestFSInodeReuse(t *testing.T) {
-	dst := "tmp.img"
-	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+//
+// Test data journaling
+//
 
-	fmt.Printf("Test FSInodeReuce %v ...\n", dst)
+func TestJournal(t *testing.T) {
+	dst := "tmp.img"
+	MkDiskFeatures(dst, nil, 256, ninodeblks, 2000, fs.FEAT_JOURNAL)
 
+	fmt.Printf("Test Journal %v ...\n", dst)
 	tfs := BootFS(dst)
-	n := ninodeblks * (fs.BSIZE / fs.ISIZE)
+	// a write of 100 blocks is one operation with a 256-block log, and
+	// runs concurrently with small ones, which may have to commit first
+	big := ustr.Ustr("big")
+	nbig := 100
+	n := 4
+	c := make(chan string)
+	go func() {
+		for i := 0; i < 4; i++ {
+			v := uint8(i) | 0x80
+			var e defs.Err_t
+			if i == 0 {
+				e = tfs.MkFile(big, mkData(v, nbig*fs.BSIZE))
+			} else {
+				e = tfs.Update(big, mkData(v, nbig*fs.BSIZE))
+			}
+			if e != 0 {
+				c <- fmt.Sprintf("write %v failed %v", big, e)
+				return
+			}
+		}
+		c <- ""
+	}()
 	for i := 0; i < n; i++ {
-		doTestInodeReuse(tfs, 10, t)
+		go func(id int) {
+			f := ustr.Ustr(fmt.Sprintf("s%d", id))
+			v := uint8(id) | 0x90
+			if e := tfs.MkFile(f, mkData(v, fs.BSIZE)); e != 0 {
+				c <- fmt.Sprintf("mkFile %v failed %v", f, e)
+				return
+			}
+			for j := 0; j < 20; j++ {
+				if e := tfs.Append(f, mkData(v, 3*fs.BSIZE)); e != 0 {
+					c <- fmt.Sprintf("Append %v failed %v", f, e)
+					return
+				}
+			}
+			c <- ""
+		}(i)
+	}
+	for i := 0; i < n+1; i++ {
+		if s := <-c; s != "" {
+			t.Fatalf("%v", s)
+		}
+	}
+	// a write larger than an operation takes several
+	huge := ustr.Ustr("huge")
+	nhuge := 3 * nbig
+	if e := tfs.MkFile(huge, mkData(0xa0, nhuge*fs.BSIZE)); e != 0 {
+		t.Fatalf("mkFile %v failed %v", huge, e)
 	}
 	ShutdownFS(tfs)
-	os.Remove(dst)
-}
 
-func doTestInodeReuseRename(tfs *Ufs_t, n int, t *testing.T) {
-	for i := 0; i < n; i++ {
-		f := ustr.Ustr(uniqfile(i))
-		g := ustr.Ustr("g" + uniqfile(i))
-		e := tfs.MkFile(f, nil)
-		if e != 0 {
-			t.Fatalf("mkFile %v failed", i)
-		}
-		e = tfs.Rename(f, g)
-		if e != 0 {
-			t.Fatalf("rename %v failed", i)
-		}
+	if r := Fsck(dst, false); len(r.Problems) != 0 {
+		t.Fatalf("fsck: %v", r.Problems)
 	}
 
-	for i := 0; i < n; i++ {
-		g := ustr.Ustr("g" + uniqfile(i))
-		e := tfs.Unlink(g)
-		if e != 0 {
-			t.Fatalf("Unlink %v failed", i)
+	check := func(f ustr.Ustr, v uint8, sz int) {
+		d, e := tfs.Read(f)
+		if e != 0 || len(d) != sz {
+			t.Fatalf("Read %v: %v %v", f, len(d), e)
+		}
+		for i := range d {
+			if d[i] != v {
+				t.Fatalf("%v: byte %v is %v, want %v", f, i, d[i], v)
+			}
 		}
 	}
-}
-
-func TestFSInodeReuseRename(t *testing.T) {
-	dst := "tmp.img"
-	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
-
-	fmt.Printf("Test FSInodeReuseRename %v ...\n", dst)
-
-	tfs := BootFS(dst)
-	n := ninodeblks * (fs.BSIZE / fs.ISIZE)
+	tfs = BootFS(dst)
+	check(big, 0x83, nbig*fs.BSIZE)
+	check(huge, 0xa0, nhuge*fs.BSIZE)
 	for i := 0; i < n; i++ {
-		doTestInodeReuseRename(tfs, 10, t)
+		check(ustr.Ustr(fmt.Sprintf("s%d", i)), uint8(i)|0x90, 61*fs.BSIZE)
 	}
 	ShutdownFS(tfs)
 	os.Remove(dst)
@@ -495,7 +2322,7 @@ func doTestOrphans(tfs *Ufs_t, t *testing.T, nfile int) {
 	for i := 0; i < nfile; i++ {
 		fn := ustr.Ustr(uniqfile(i))
 		var err defs.Err_t
-		fds[i], err = tfs.fs.Fs_open(fn, defs.O_CREAT, 0, tfs.fs.MkRootCwd(), 0, 0)
+		fds[i], err = tfs.fs.Fs_open(fn, defs.O_CREAT, 0, tfs.fs.MkRootCwd(), tfs.cred, 0, 0)
 		if err != 0 {
 			t.Fatalf("ufs.fs.Fs_open %v failed %v\n", fn, err)
 		}
@@ -504,7 +2331,7 @@ func doTestOrphans(tfs *Ufs_t, t *testing.T, nfile int) {
 		if err != 0 || ub.Remain() != 0 {
 			t.Fatalf("Write %v failed %v %d\n", fn, err, n)
 		}
-		err = tfs.fs.Fs_unlink(fn, tfs.fs.MkRootCwd(), false)
+		err = tfs.fs.Fs_unlink(fn, tfs.fs.MkRootCwd(), tfs.cred, false)
 		if err != 0 {
 			t.Fatalf("doUnlink %v failed %v\n", fn, err)
 		}
@@ -1123,7 +2950,7 @@ func produceTrace(disk string, t *testing.T, init func(*Ufs_t), run func(*Ufs_t,
 
 	// Now start tracing
 	tfs = BootFS("tmp.img")
-	tfs.ahci.StartTrace()
+	tfs.ahci.StartTrace("trace.json")
 
 	run(tfs, t)
 	tfs.fs.StopFS()
@@ -1143,6 +2970,64 @@ func TestTracesAtomic(t *testing.T) {
 	os.Remove(disk)
 }
 
+//
+// Test: crash consistency of the directory index
+//
+
+func doDirIndexInit(tfs *Ufs_t) {
+	d := ustr.Ustr("d")
+	if e := tfs.MkDir(d); e != 0 {
+		panic("mkDir d failed")
+	}
+	// one more entry than fits in the first block, which builds the index
+	for i := 0; i < fs.NDIRENTS-1; i++ {
+		if e := tfs.MkFile(d.ExtendStr(uniqfile(i)), nil); e != 0 {
+			panic("mkFile failed")
+		}
+	}
+	tfs.Sync()
+}
+
+func doTestDirIndex(tfs *Ufs_t, t *testing.T) {
+	x := ustr.Ustr("d/x")
+	if e := tfs.MkFile(x, nil); e != 0 {
+		t.Fatalf("mkFile %v failed", x)
+	}
+	tfs.Sync()
+}
+
+// the index must agree with the directory entries
+func doCheckDirIndex(tfs *Ufs_t) (string, bool) {
+	d := ustr.Ustr("d")
+	res, e := tfs.Ls(d)
+	if e != 0 {
+		return "Ls d failed", false
+	}
+	for _, name := range []string{uniqfile(0), uniqfile(fs.NDIRENTS - 2), "x"} {
+		_, inls := res[name]
+		_, e := tfs.Stat(d.ExtendStr(name))
+		if inls != (e == 0) {
+			return fmt.Sprintf("%v: listed %v, stat %v", name, inls, e), false
+		}
+	}
+	if _, ok := res[uniqfile(0)]; !ok {
+		return "f0 missing", false
+	}
+	return "", true
+}
+
+func TestTracesDirIndex(t *testing.T) {
+	fmt.Printf("Test TracesDirIndex ...\n")
+	disk := "disk.img"
+	MkDisk(disk, nil, nlogblks, 8, ndatablks)
+	produceTrace(disk, t, doDirIndexInit, doTestDirIndex)
+	trace := readTrace("trace.json")
+	trace.printTrace(0, len(trace))
+	cnt := genTraces(trace, t, disk, true, doCheckDirIndex)
+	fmt.Printf("#traces = %v\n", cnt)
+	os.Remove(disk)
+}
+
 //
 // Test: big ifree (i.e., several ops, spanning several transactions)
 //
@@ -1246,15 +3131,17 @@ func FillDisk(disk string) {
 		if err != nil {
 			panic(err)
 		}
-		for j := 1; j < fs.BSIZE; j++ {
+		for j := 1; j < fs.BSIZE-fs.CSUMSIZE; j++ {
 			b[j] = 0xFF // mark as allocated
 		}
+		d := blk2bytepg(b)
+		fs.Csumw(d)
 		_, err = f.Seek(int64(-fs.BSIZE), 1)
 		if err != nil {
 			panic(err)
 		}
 
-		_, err = f.Write(b)
+		_, err = f.Write(d[:])
 		if err != nil {
 			panic(err)
 		}
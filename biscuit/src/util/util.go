@@ -50,3 +50,25 @@ func Writen(a []uint8, sz int, off int, val int) {
 		panic("no")
 	}
 }
+
+// size of the fixed part of a linux_dirent64 record: inode number, offset of
+// the next record, record length, and file type
+const direntsz = 8 + 8 + 2 + 1
+
+// returns the length of the linux_dirent64 record for a file named name
+func Direntlen(name []uint8) int {
+	return Roundup(direntsz+len(name)+1, 8)
+}
+
+// returns the linux_dirent64 record for the file name with inode number inum
+// and file type dtype, followed by the record at offset next
+func Dirent(inum, next int, dtype uint8, name []uint8) []uint8 {
+	reclen := Direntlen(name)
+	rec := make([]uint8, reclen)
+	Writen(rec, 8, 0, inum)
+	Writen(rec, 8, 8, next)
+	Writen(rec, 2, 16, reclen)
+	Writen(rec, 1, 18, int(dtype))
+	copy(rec[direntsz:], name)
+	return rec
+}
@@ -0,0 +1,836 @@
+package vfs
+
+import "sync"
+import "sync/atomic"
+
+import "bpath"
+import "defs"
+import "fd"
+import "proc"
+import "stat"
+import "ustr"
+
+// Fs_i is implemented by every file system that can be mounted. the VFS
+// passes each method a path together with the cwd the path is relative to.
+// while other file systems are mounted, the VFS walks the path itself and
+// passes only the last component, relative to the directory the walk reached;
+// the path thus never leads to another mount, and file systems know nothing
+// about mounts.
+type Fs_i interface {
+	Fs_open(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.Cwd_t, cred *proc.Cred_t, major, minor int) (*fd.Fd_t, defs.Err_t)
+	// creates a special file and returns its inode number
+	Fs_mknod(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.Cwd_t, cred *proc.Cred_t, major, minor int) (defs.Inum_t, defs.Err_t)
+	Fs_stat(paths ustr.Ustr, st *stat.Stat_t, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t
+	Fs_access(paths ustr.Ustr, amode int, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t
+	Fs_mkdir(paths ustr.Ustr, mode int, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t
+	// the methods taking two paths resolve the first relative to cwd and
+	// the second relative to ncwd
+	Fs_link(old, new ustr.Ustr, cwd, ncwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t
+	// creates dst as a copy of src that shares its blocks; file systems
+	// that cannot share blocks fail with EOPNOTSUPP
+	Fs_reflink(src, dst ustr.Ustr, cwd, ncwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t
+	Fs_unlink(paths ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t, wantdir bool) defs.Err_t
+	Fs_rename(oldp, newp ustr.Ustr, cwd, ncwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t
+	Fs_symlink(target, paths ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t
+	Fs_readlink(paths ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t) (ustr.Ustr, defs.Err_t)
+	Fs_chmod(paths ustr.Ustr, mode int, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t
+	Fs_chown(paths ustr.Ustr, uid, gid int, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t
+	Fs_utimens(paths ustr.Ustr, atime, mtime int, follow bool, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t
+	// extended attributes; file systems without them fail with
+	// EOPNOTSUPP
+	Fs_setxattr(paths, name ustr.Ustr, value []uint8, flags int, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t
+	Fs_getxattr(paths, name ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t) ([]uint8, defs.Err_t)
+	Fs_listxattr(paths ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t) ([]uint8, defs.Err_t)
+	Fs_removexattr(paths, name ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t
+	Fs_sync() defs.Err_t
+	// grows the file system to end at disk block nblocks; file systems
+	// without a disk fail with EOPNOTSUPP
+	Fs_resize(nblocks int) defs.Err_t
+	// returns a cwd for the root directory of the file system
+	MkRootCwd() *fd.Cwd_t
+	// fails with EBUSY if the file system is in use. otherwise flushes
+	// and stops the file system, which is not used afterwards.
+	Fs_umount() defs.Err_t
+}
+
+// Execperm_i is implemented by the fops of files that can be executed. it
+// returns the uid and gid which a set-user-ID or set-group-ID file executes
+// with, or -1.
+type Execperm_i interface {
+	Execperm(cred *proc.Cred_t) (int, int, defs.Err_t)
+}
+
+// creates an instance of a file system type from the source and data
+// arguments of mount(2)
+type Mkfs_t func(source, data ustr.Ustr) (Fs_i, defs.Err_t)
+
+// the file system types known to mount(2), registered at boot
+var fstypes = map[string]Mkfs_t{}
+
+func Register(fstype string, mk Mkfs_t) {
+	if _, ok := fstypes[fstype]; ok {
+		panic("file system type registered twice")
+	}
+	fstypes[fstype] = mk
+}
+
+// the last device number handed out by Newdev
+var lastdev uint32
+
+// returns a new device number for a file system, which stat(2) reports and
+// inotify names the file system's inodes by
+func Newdev() uint {
+	return uint(atomic.AddUint32(&lastdev, 1))
+}
+
+type mount_t struct {
+	fs Fs_i
+	// the directory attached at the mount point; the root of fs, unless
+	// this is a bind mount
+	root *fd.Cwd_t
+	// the device and inode number of root
+	rdev, rino uint
+	// the mount on which the mount point lives, the mount point, which
+	// stays open while the mount is attached, and its device and inode
+	// number. parent and mp are nil for the root file system.
+	parent   *mount_t
+	mp       *fd.Cwd_t
+	dev, ino uint
+	bind     bool
+	// the number of operations that resolved a path on this mount and
+	// haven't finished; Umount fails while there are any
+	ops int32
+}
+
+// ends an operation that resolve() began on m
+func (m *mount_t) done() {
+	atomic.AddInt32(&m.ops, -1)
+}
+
+// Vfs_t is the mount table. it resolves each path to the file system on which
+// it lives and forwards the operation.
+type Vfs_t struct {
+	// protects mnts
+	sync.RWMutex
+	// mnts[0] is the root file system. a later mount on the same mount
+	// point hides an earlier one.
+	mnts []*mount_t
+}
+
+func MkVfs(root Fs_i) *Vfs_t {
+	v := &Vfs_t{}
+	m := &mount_t{fs: root, root: root.MkRootCwd()}
+	var st stat.Stat_t
+	if err := root.Fs_stat(ustr.MkUstrDot(), &st, m.root, proc.Rootcred); err != 0 {
+		panic("no root")
+	}
+	m.rdev, m.rino = st.Dev(), st.Rino()
+	v.mnts = []*mount_t{m}
+	return v
+}
+
+// maximum number of symlinks followed while resolving a single path, as in
+// the file systems
+const maxsymlinks = 8
+
+// a path resolved by resolve(): p, relative to the directory c, on mount m.
+// done() ends the operation on m and releases c.
+type lookup_t struct {
+	m *mount_t
+	p ustr.Ustr
+	c *fd.Cwd_t
+	// the directory which the walk opened for c, if any
+	held *fd.Fd_t
+}
+
+func (l *lookup_t) done() {
+	if l.held != nil {
+		fd.Close_panic(l.held)
+	}
+	l.m.done()
+}
+
+// the position of a path walk: the current directory dir, on mount m. the
+// walk has begun an operation on m, and holds dir open if held is not nil.
+type walk_t struct {
+	m    *mount_t
+	dir  *fd.Cwd_t
+	held *fd.Fd_t
+	// the device and inode number of dir, if known is true
+	dev, ino uint
+	known    bool
+}
+
+// makes the directory f, which the walk opened, the current directory
+func (w *walk_t) hold(f *fd.Fd_t) {
+	if w.held != nil {
+		fd.Close_panic(w.held)
+	}
+	w.held, w.dir, w.known = f, fd.MkRootCwd(f), false
+	var st stat.Stat_t
+	if f.Fops.Fstat(&st) == 0 {
+		w.dev, w.ino, w.known = st.Dev(), st.Rino(), true
+	}
+}
+
+// makes dir, which is kept open by mount m, the current directory. the
+// caller has begun an operation on m and ends the one on the previous mount.
+func (w *walk_t) moveto(m *mount_t, dir *fd.Cwd_t) {
+	if w.held != nil {
+		fd.Close_panic(w.held)
+	}
+	w.m, w.dir, w.held, w.known = m, dir, nil, false
+}
+
+// returns the device and inode number of the current directory
+func (w *walk_t) ident() (uint, uint, defs.Err_t) {
+	if !w.known {
+		var st stat.Stat_t
+		err := w.m.fs.Fs_stat(ustr.MkUstrDot(), &st, w.dir, proc.Rootcred)
+		if err != 0 {
+			return 0, 0, err
+		}
+		w.dev, w.ino, w.known = st.Dev(), st.Rino(), true
+	}
+	return w.dev, w.ino, 0
+}
+
+// ends the walk
+func (w *walk_t) release() {
+	if w.held != nil {
+		fd.Close_panic(w.held)
+		w.held = nil
+	}
+	w.m.done()
+}
+
+// returns the result of the walk: p relative to the current directory
+func (w *walk_t) lookup(p ustr.Ustr) *lookup_t {
+	return &lookup_t{m: w.m, p: p, c: w.dir, held: w.held}
+}
+
+// returns the most recent mount attached at the directory of mount m with
+// device dev and inode number ino, or rather the most recent one attached at
+// the root of that mount in turn, and begins an operation on it. returns nil
+// if no mount is attached there.
+func (v *Vfs_t) mounted(m *mount_t, dev, ino uint) *mount_t {
+	v.RLock()
+	defer v.RUnlock()
+	var top *mount_t
+	for {
+		var next *mount_t
+		for _, o := range v.mnts[1:] {
+			if o.parent == m && o.dev == dev && o.ino == ino {
+				next = o
+			}
+		}
+		if next == nil {
+			break
+		}
+		top, m = next, next
+		dev, ino = top.rdev, top.rino
+	}
+	if top != nil {
+		atomic.AddInt32(&top.ops, 1)
+	}
+	return top
+}
+
+// moves w onto the mount top, on which mounted() began an operation
+func (w *walk_t) enter(top *mount_t) {
+	old := w.m
+	w.moveto(top, top.root)
+	w.dev, w.ino, w.known = top.rdev, top.rino, true
+	old.done()
+}
+
+// if a mount is attached at the current directory, moves w onto it
+func (v *Vfs_t) cross(w *walk_t) defs.Err_t {
+	dev, ino, err := w.ident()
+	if err != 0 {
+		return err
+	}
+	if top := v.mounted(w.m, dev, ino); top != nil {
+		w.enter(top)
+	}
+	return 0
+}
+
+// moves w to the root directory, beginning an operation on the root file
+// system
+func (v *Vfs_t) root(w *walk_t) {
+	v.RLock()
+	r := v.mnts[0]
+	atomic.AddInt32(&r.ops, 1)
+	v.RUnlock()
+	w.moveto(r, r.root)
+	w.dev, w.ino, w.known = r.rdev, r.rino, true
+	// the identity of the root is known
+	v.cross(w)
+}
+
+// moves w to the parent of the current directory. ".." at the root of a mount
+// leads to the parent of the mount point.
+func (v *Vfs_t) dotdot(w *walk_t, cred *proc.Cred_t) defs.Err_t {
+	// the mounts which w leaves keep their mount points open until the
+	// walk has left those too
+	var left []*mount_t
+	defer func() {
+		for _, m := range left {
+			m.done()
+		}
+	}()
+	for w.m.parent != nil {
+		dev, ino, err := w.ident()
+		if err != 0 {
+			return err
+		}
+		if dev != w.m.rdev || ino != w.m.rino {
+			break
+		}
+		// w.m keeps its parent mounted
+		m := w.m
+		atomic.AddInt32(&m.parent.ops, 1)
+		left = append(left, m)
+		w.moveto(m.parent, m.mp)
+		w.dev, w.ino, w.known = m.dev, m.ino, true
+	}
+	f, err := v.opendir(w, ustr.DotDot, cred)
+	if err != 0 {
+		return err
+	}
+	w.hold(f)
+	return v.cross(w)
+}
+
+// opens the directory cp in the current directory, without following a
+// symlink. like a lookup by the file system, this requires search permission
+// on the current directory but no permission on cp.
+func (v *Vfs_t) opendir(w *walk_t, cp ustr.Ustr, cred *proc.Cred_t) (*fd.Fd_t, defs.Err_t) {
+	const flags = defs.O_RDONLY | defs.O_DIRECTORY | defs.O_NOFOLLOW
+	f, err := w.m.fs.Fs_open(cp, flags, 0, w.dir, cred, 0, 0)
+	if err != -defs.EACCES {
+		return f, err
+	}
+	// cred may search the current directory but not read cp
+	if err := w.m.fs.Fs_access(ustr.MkUstrDot(), defs.X_OK, w.dir, cred); err != 0 {
+		return nil, err
+	}
+	return w.m.fs.Fs_open(cp, flags, 0, w.dir, proc.Rootcred, 0, 0)
+}
+
+// returns the mount on which the directory cwd lives
+func (v *Vfs_t) _cwdmnt(cwd *fd.Cwd_t) *mount_t {
+	if m, ok := cwd.Mnt.(*mount_t); ok {
+		return m
+	}
+	return v.mnts[0]
+}
+
+// returns the mount on which paths lives, and the path and directory to pass
+// to its file system. without mounts, paths and cwd are passed unchanged.
+// otherwise resolve walks paths a component at a time, holding the directory
+// it has reached open: it crosses onto a mount at each directory on which one
+// is attached, leaves a mount at ".." from its root and follows symlinks, so
+// that the file system only looks up the last component of paths in that
+// directory. a symlink in the last component is followed only if follow is
+// true. unless it fails, resolve begins an operation on the mount, which the
+// caller ends with done().
+func (v *Vfs_t) resolve(paths ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t, follow bool) (*lookup_t, defs.Err_t) {
+	v.RLock()
+	if len(v.mnts) == 1 {
+		m := v.mnts[0]
+		atomic.AddInt32(&m.ops, 1)
+		v.RUnlock()
+		return &lookup_t{m: m, p: paths, c: cwd}, 0
+	}
+	var w walk_t
+	if !paths.IsAbsolute() {
+		w.m, w.dir = v._cwdmnt(cwd), cwd
+		atomic.AddInt32(&w.m.ops, 1)
+	}
+	v.RUnlock()
+	if w.m == nil {
+		v.root(&w)
+	}
+	l, err := v.walk(&w, paths, cred, follow)
+	if err != 0 {
+		w.release()
+		return nil, err
+	}
+	return l, 0
+}
+
+func (v *Vfs_t) walk(w *walk_t, paths ustr.Ustr, cred *proc.Cred_t, follow bool) (*lookup_t, defs.Err_t) {
+	nlinks := 0
+	var pp bpath.Pathparts_t
+	pp.Pp_init(paths)
+	for {
+		cp, ok := pp.Next()
+		if !ok {
+			return w.lookup(ustr.MkUstrDot()), 0
+		}
+		_, rest := pp.Split()
+		last := true
+		for _, c := range rest {
+			if c != '/' {
+				last = false
+				break
+			}
+		}
+		if cp.Isdot() {
+			continue
+		}
+		if cp.Isdotdot() {
+			if err := v.dotdot(w, cred); err != 0 {
+				return nil, err
+			}
+			continue
+		}
+		f, err := v.opendir(w, cp, cred)
+		switch {
+		case err == 0 && last:
+			// the file system looks up cp itself, unless it is a
+			// mount point
+			var st stat.Stat_t
+			err := f.Fops.Fstat(&st)
+			fd.Close_panic(f)
+			if err != 0 {
+				return nil, err
+			}
+			if top := v.mounted(w.m, st.Dev(), st.Rino()); top != nil {
+				w.enter(top)
+				return w.lookup(ustr.MkUstrDot()), 0
+			}
+			return w.lookup(cp), 0
+		case err == 0:
+			w.hold(f)
+			if err := v.cross(w); err != 0 {
+				return nil, err
+			}
+			continue
+		case err == -defs.ELOOP && (follow || !last):
+		default:
+			// the file system reports the error in, or creates,
+			// the last component, which is not a directory or is
+			// a symlink that is not followed
+			if last {
+				return w.lookup(cp), 0
+			}
+			return nil, err
+		}
+		target, err := w.m.fs.Fs_readlink(cp, w.dir, cred)
+		if err != 0 {
+			return nil, err
+		}
+		if nlinks == maxsymlinks {
+			return nil, -defs.ELOOP
+		}
+		nlinks++
+		// resolve the rest of the path with the symlink substituted
+		var np ustr.Ustr
+		np = append(np, target...)
+		np = append(np, rest...)
+		if np.IsAbsolute() {
+			w.release()
+			v.root(w)
+		}
+		pp.Pp_init(np)
+	}
+}
+
+// returns true if open(2) with flags follows a symlink in the last component
+func openfollow(flags defs.Fdopt_t) bool {
+	excl := defs.O_CREAT | defs.O_EXCL
+	return flags&defs.O_NOFOLLOW == 0 && flags&excl != excl
+}
+
+func (v *Vfs_t) Fs_open(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.Cwd_t, cred *proc.Cred_t, major, minor int) (*fd.Fd_t, defs.Err_t) {
+	l, err := v.resolve(paths, cwd, cred, openfollow(flags))
+	if err != 0 {
+		return nil, err
+	}
+	defer l.done()
+	return l.m.fs.Fs_open(l.p, flags, mode, l.c, cred, major, minor)
+}
+
+func (v *Vfs_t) Fs_mknod(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.Cwd_t, cred *proc.Cred_t, major, minor int) (defs.Inum_t, defs.Err_t) {
+	l, err := v.resolve(paths, cwd, cred, false)
+	if err != 0 {
+		return 0, err
+	}
+	defer l.done()
+	return l.m.fs.Fs_mknod(l.p, flags, mode, l.c, cred, major, minor)
+}
+
+func (v *Vfs_t) Fs_stat(paths ustr.Ustr, st *stat.Stat_t, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	l, err := v.resolve(paths, cwd, cred, true)
+	if err != 0 {
+		return err
+	}
+	defer l.done()
+	return l.m.fs.Fs_stat(l.p, st, l.c, cred)
+}
+
+func (v *Vfs_t) Fs_access(paths ustr.Ustr, amode int, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	l, err := v.resolve(paths, cwd, cred, true)
+	if err != 0 {
+		return err
+	}
+	defer l.done()
+	return l.m.fs.Fs_access(l.p, amode, l.c, cred)
+}
+
+func (v *Vfs_t) Fs_mkdir(paths ustr.Ustr, mode int, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	l, err := v.resolve(paths, cwd, cred, false)
+	if err != 0 {
+		return err
+	}
+	defer l.done()
+	return l.m.fs.Fs_mkdir(l.p, mode, l.c, cred)
+}
+
+// links and renames cannot cross mounts, not even two mounts of the same file
+// system.
+func (v *Vfs_t) Fs_link(old, new ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	l1, err := v.resolve(old, cwd, cred, false)
+	if err != 0 {
+		return err
+	}
+	defer l1.done()
+	l2, err := v.resolve(new, cwd, cred, false)
+	if err != 0 {
+		return err
+	}
+	defer l2.done()
+	if l1.m != l2.m {
+		return -defs.EXDEV
+	}
+	return l1.m.fs.Fs_link(l1.p, l2.p, l1.c, l2.c, cred)
+}
+
+func (v *Vfs_t) Fs_reflink(src, dst ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	l1, err := v.resolve(src, cwd, cred, true)
+	if err != 0 {
+		return err
+	}
+	defer l1.done()
+	l2, err := v.resolve(dst, cwd, cred, false)
+	if err != 0 {
+		return err
+	}
+	defer l2.done()
+	if l1.m != l2.m {
+		return -defs.EXDEV
+	}
+	return l1.m.fs.Fs_reflink(l1.p, l2.p, l1.c, l2.c, cred)
+}
+
+func (v *Vfs_t) Fs_unlink(paths ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t, wantdir bool) defs.Err_t {
+	l, err := v.resolve(paths, cwd, cred, false)
+	if err != 0 {
+		return err
+	}
+	defer l.done()
+	return l.m.fs.Fs_unlink(l.p, l.c, cred, wantdir)
+}
+
+func (v *Vfs_t) Fs_rename(oldp, newp ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	l1, err := v.resolve(oldp, cwd, cred, false)
+	if err != 0 {
+		return err
+	}
+	defer l1.done()
+	l2, err := v.resolve(newp, cwd, cred, false)
+	if err != 0 {
+		return err
+	}
+	defer l2.done()
+	if l1.m != l2.m {
+		return -defs.EXDEV
+	}
+	return l1.m.fs.Fs_rename(l1.p, l2.p, l1.c, l2.c, cred)
+}
+
+func (v *Vfs_t) Fs_symlink(target, paths ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	l, err := v.resolve(paths, cwd, cred, false)
+	if err != 0 {
+		return err
+	}
+	defer l.done()
+	return l.m.fs.Fs_symlink(target, l.p, l.c, cred)
+}
+
+func (v *Vfs_t) Fs_readlink(paths ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t) (ustr.Ustr, defs.Err_t) {
+	l, err := v.resolve(paths, cwd, cred, false)
+	if err != 0 {
+		return nil, err
+	}
+	defer l.done()
+	return l.m.fs.Fs_readlink(l.p, l.c, cred)
+}
+
+func (v *Vfs_t) Fs_chmod(paths ustr.Ustr, mode int, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	l, err := v.resolve(paths, cwd, cred, true)
+	if err != 0 {
+		return err
+	}
+	defer l.done()
+	return l.m.fs.Fs_chmod(l.p, mode, l.c, cred)
+}
+
+func (v *Vfs_t) Fs_chown(paths ustr.Ustr, uid, gid int, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	l, err := v.resolve(paths, cwd, cred, true)
+	if err != 0 {
+		return err
+	}
+	defer l.done()
+	return l.m.fs.Fs_chown(l.p, uid, gid, l.c, cred)
+}
+
+func (v *Vfs_t) Fs_utimens(paths ustr.Ustr, atime, mtime int, follow bool, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	l, err := v.resolve(paths, cwd, cred, follow)
+	if err != 0 {
+		return err
+	}
+	defer l.done()
+	return l.m.fs.Fs_utimens(l.p, atime, mtime, follow, l.c, cred)
+}
+
+func (v *Vfs_t) Fs_setxattr(paths, name ustr.Ustr, value []uint8, flags int, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	l, err := v.resolve(paths, cwd, cred, true)
+	if err != 0 {
+		return err
+	}
+	defer l.done()
+	return l.m.fs.Fs_setxattr(l.p, name, value, flags, l.c, cred)
+}
+
+func (v *Vfs_t) Fs_getxattr(paths, name ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t) ([]uint8, defs.Err_t) {
+	l, err := v.resolve(paths, cwd, cred, true)
+	if err != 0 {
+		return nil, err
+	}
+	defer l.done()
+	return l.m.fs.Fs_getxattr(l.p, name, l.c, cred)
+}
+
+func (v *Vfs_t) Fs_listxattr(paths ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t) ([]uint8, defs.Err_t) {
+	l, err := v.resolve(paths, cwd, cred, true)
+	if err != 0 {
+		return nil, err
+	}
+	defer l.done()
+	return l.m.fs.Fs_listxattr(l.p, l.c, cred)
+}
+
+func (v *Vfs_t) Fs_removexattr(paths, name ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	l, err := v.resolve(paths, cwd, cred, true)
+	if err != 0 {
+		return err
+	}
+	defer l.done()
+	return l.m.fs.Fs_removexattr(l.p, name, l.c, cred)
+}
+
+// implements chdir(2): makes the directory paths the cwd. the caller must hold
+// the cwd's lock.
+func (v *Vfs_t) Fs_chdir(paths ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	l, err := v.resolve(paths, cwd, cred, true)
+	if err != 0 {
+		return err
+	}
+	defer l.done()
+	// changing directory requires search, not read, permission
+	if err := l.m.fs.Fs_access(l.p, defs.X_OK, l.c, cred); err != 0 {
+		return err
+	}
+	dir, err := l.m.fs.Fs_open(l.p, defs.O_RDONLY|defs.O_DIRECTORY, 0, l.c, proc.Rootcred, 0, 0)
+	if err != 0 {
+		return err
+	}
+	fd.Close_panic(cwd.Fd)
+	cwd.Fd = dir
+	cwd.Path = cwd.Canonicalpath(paths)
+	cwd.Mnt = l.m
+	return 0
+}
+
+func (v *Vfs_t) Fs_execperm(f *fd.Fd_t, cred *proc.Cred_t) (int, int, defs.Err_t) {
+	x, ok := f.Fops.(Execperm_i)
+	if !ok {
+		return -1, -1, -defs.EACCES
+	}
+	return x.Execperm(cred)
+}
+
+// syncs every mounted file system
+func (v *Vfs_t) Fs_sync() defs.Err_t {
+	v.RLock()
+	defer v.RUnlock()
+	for _, m := range v.mnts {
+		if m.bind {
+			continue
+		}
+		if err := m.fs.Fs_sync(); err != 0 {
+			return err
+		}
+	}
+	return 0
+}
+
+// grows the file system on which paths lives to end at disk block nblocks
+func (v *Vfs_t) Fs_resize(paths ustr.Ustr, nblocks int, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	if !cred.Isroot() {
+		return -defs.EPERM
+	}
+	l, err := v.resolve(paths, cwd, cred, true)
+	if err != 0 {
+		return err
+	}
+	defer l.done()
+	var st stat.Stat_t
+	if err := l.m.fs.Fs_stat(l.p, &st, l.c, cred); err != 0 {
+		return err
+	}
+	return l.m.fs.Fs_resize(nblocks)
+}
+
+// implements mount(2). with MS_BIND, the directory source is attached at
+// target as well; otherwise a new instance of fstype is created from source
+// and data.
+func (v *Vfs_t) Mount(source, target, fstype ustr.Ustr, flags int, data ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	if !cred.Isroot() {
+		return -defs.EPERM
+	}
+	if flags&^defs.MS_BIND != 0 {
+		return -defs.EINVAL
+	}
+	if flags&defs.MS_BIND != 0 {
+		l, err := v.resolve(source, cwd, cred, true)
+		if err != 0 {
+			return err
+		}
+		defer l.done()
+		dir, err := l.m.fs.Fs_open(l.p, defs.O_RDONLY|defs.O_DIRECTORY, 0, l.c, cred, 0, 0)
+		if err != 0 {
+			return err
+		}
+		err = v._attach(l.m.fs, fd.MkRootCwd(dir), target, cwd, cred, true)
+		if err != 0 {
+			fd.Close_panic(dir)
+		}
+		return err
+	}
+	mk, ok := fstypes[fstype.String()]
+	if !ok {
+		return -defs.ENODEV
+	}
+	fs, err := mk(source, data)
+	if err != 0 {
+		return err
+	}
+	err = v.Mountfs(fs, target, cwd, cred)
+	if err != 0 {
+		if fs.Fs_umount() != 0 {
+			panic("must succeed")
+		}
+	}
+	return err
+}
+
+// attaches the root of fs at target, which must name a directory
+func (v *Vfs_t) Mountfs(fs Fs_i, target ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	return v._attach(fs, fs.MkRootCwd(), target, cwd, cred, false)
+}
+
+func (v *Vfs_t) _attach(fs Fs_i, root *fd.Cwd_t, target ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t, bind bool) defs.Err_t {
+	nm := &mount_t{fs: fs, root: root, bind: bind}
+	var st stat.Stat_t
+	if err := fs.Fs_stat(ustr.MkUstrDot(), &st, root, cred); err != 0 {
+		return err
+	}
+	nm.rdev, nm.rino = st.Dev(), st.Rino()
+
+	// the operation on the mount of target keeps it from being
+	// unmounted until nm is attached to it
+	l, err := v.resolve(target, cwd, cred, true)
+	if err != 0 {
+		return err
+	}
+	defer l.done()
+	dir, err := l.m.fs.Fs_open(l.p, defs.O_RDONLY|defs.O_DIRECTORY, 0, l.c, cred, 0, 0)
+	if err != 0 {
+		return err
+	}
+	mp := fd.MkRootCwd(dir)
+	if err := l.m.fs.Fs_stat(ustr.MkUstrDot(), &st, mp, cred); err != 0 {
+		fd.Close_panic(dir)
+		return err
+	}
+	nm.parent, nm.mp = l.m, mp
+	nm.dev, nm.ino = st.Dev(), st.Rino()
+
+	v.Lock()
+	v.mnts = append(v.mnts, nm)
+	v.Unlock()
+	return 0
+}
+
+// implements umount(2). detaches the most recent mount at target. the root
+// file system, mount points with mounts below them and mounts with operations
+// in progress cannot be unmounted.
+func (v *Vfs_t) Umount(target ustr.Ustr, cwd *fd.Cwd_t, cred *proc.Cred_t) defs.Err_t {
+	if !cred.Isroot() {
+		return -defs.EPERM
+	}
+	l, err := v.resolve(target, cwd, cred, true)
+	if err != 0 {
+		return err
+	}
+	var st stat.Stat_t
+	err = l.m.fs.Fs_stat(l.p, &st, l.c, cred)
+	l.done()
+	if err != 0 {
+		return err
+	}
+	m := l.m
+	if st.Dev() != m.rdev || st.Rino() != m.rino {
+		return -defs.EINVAL
+	}
+
+	v.Lock()
+	defer v.Unlock()
+
+	i := len(v.mnts) - 1
+	for ; i >= 0; i-- {
+		if v.mnts[i] == m {
+			break
+		}
+	}
+	if i < 0 {
+		return -defs.EINVAL
+	}
+	if i == 0 {
+		return -defs.EBUSY
+	}
+	// no operation begins on m while we hold the lock
+	if atomic.LoadInt32(&m.ops) != 0 {
+		return -defs.EBUSY
+	}
+	for _, o := range v.mnts[i+1:] {
+		if o.parent == m {
+			return -defs.EBUSY
+		}
+	}
+	if m.bind {
+		fd.Close_panic(m.root.Fd)
+	} else if err := l.m.fs.Fs_umount(); err != 0 {
+		return err
+	}
+	fd.Close_panic(m.mp.Fd)
+	copy(v.mnts[i:], v.mnts[i+1:])
+	v.mnts[len(v.mnts)-1] = nil
+	v.mnts = v.mnts[:len(v.mnts)-1]
+	return 0
+}
@@ -47,17 +47,30 @@ func (as *Vm_t) Lockassert_pmap() {
 }
 
 func (as *Vm_t) Userdmap8_inner(va int, k2u bool) ([]uint8, defs.Err_t) {
+	pa, err := as.userpa_inner(va, k2u)
+	if err != 0 {
+		return nil, err
+	}
+	voff := va & int(PGOFFSET)
+	pg := mem.Physmem.Dmap(pa)
+	bpg := mem.Pg2bytes(pg)
+	return bpg[voff:], 0
+}
+
+// returns the physical address of the page mapped at user address va,
+// faulting the page in if it isn't present, or if k2u and the page is
+// copy-on-write.
+func (as *Vm_t) userpa_inner(va int, k2u bool) (mem.Pa_t, defs.Err_t) {
 	as.Lockassert_pmap()
 
-	voff := va & int(PGOFFSET)
 	uva := uintptr(va)
 	vmi, ok := as.Vmregion.Lookup(uva)
 	if !ok {
-		return nil, -defs.EFAULT
+		return 0, -defs.EFAULT
 	}
 	pte, ok := vmi.Ptefor(as.Pmap, uva)
 	if !ok {
-		return nil, -defs.ENOMEM
+		return 0, -defs.ENOMEM
 	}
 	ecode := uintptr(PTE_U)
 	needfault := true
@@ -82,13 +95,10 @@ func (as *Vm_t) Userdmap8_inner(va int, k2u bool) ([]uint8, defs.Err_t) {
 
 	if needfault {
 		if err := Sys_pgfault(as, vmi, uva, ecode); err != 0 {
-			return nil, err
+			return 0, err
 		}
 	}
-
-	pg := mem.Physmem.Dmap(*pte & PTE_ADDR)
-	bpg := mem.Pg2bytes(pg)
-	return bpg[voff:], 0
+	return *pte & PTE_ADDR, 0
 }
 
 // _userdmap8 and userdmap8r functions must only be used if concurrent
@@ -7,6 +7,7 @@ import "unsafe"
 
 import "bounds"
 import "defs"
+import "mem"
 import "res"
 
 // a helper object for read/writing from userspace memory. virtual address
@@ -87,6 +88,28 @@ func (ub *Userbuf_t) _tx(buf []uint8, write bool) (int, defs.Err_t) {
 	return ret, 0
 }
 
+// returns the physical page of the user memory at the buffer's offset and its
+// kernel mapping, and advances the buffer past the page. the offset must be
+// page aligned and a whole page must remain. the page's reference count is
+// increased so that the page stays allocated while the disk transfers to or
+// from it; the caller decreases it with Physmem.Refdown(). k2u is true if the
+// disk writes to the page.
+func (ub *Userbuf_t) Userpage(k2u bool) (mem.Pa_t, *mem.Bytepg_t, defs.Err_t) {
+	va := ub.userva + ub.off
+	if va%mem.PGSIZE != 0 || ub.Remain() < mem.PGSIZE {
+		return 0, nil, -defs.EINVAL
+	}
+	ub.as.Lock_pmap()
+	defer ub.as.Unlock_pmap()
+	pa, err := ub.as.userpa_inner(va, k2u)
+	if err != 0 {
+		return 0, nil, err
+	}
+	mem.Physmem.Refup(pa)
+	ub.off += mem.PGSIZE
+	return pa, mem.Pg2bytes(mem.Physmem.Dmap(pa)), 0
+}
+
 type _iove_t struct {
 	uva uint
 	sz  int
@@ -227,6 +250,17 @@ func (fb *Fakeubuf_t) Uiowrite(src []uint8) (int, defs.Err_t) {
 	return fb._tx(src, true)
 }
 
+// the fake user memory isn't backed by physical pages; the returned address
+// is 0.
+func (fb *Fakeubuf_t) Userpage(k2u bool) (mem.Pa_t, *mem.Bytepg_t, defs.Err_t) {
+	if len(fb.fbuf) < mem.PGSIZE {
+		return 0, nil, -defs.EINVAL
+	}
+	pg := (*mem.Bytepg_t)(unsafe.Pointer(&fb.fbuf[0]))
+	fb.fbuf = fb.fbuf[mem.PGSIZE:]
+	return 0, pg, 0
+}
+
 var Ubpool = sync.Pool{New: func() interface{} { return new(Userbuf_t) }}
 
 func Mkfxbuf() *[64]uintptr {
@@ -86,6 +86,18 @@ func (vmi *Vminfo_t) Filepage(va uintptr) (*mem.Pg_t, mem.Pa_t, defs.Err_t) {
 	return mmapi[0].Pg, mmapi[0].Phys, 0
 }
 
+// returns the file offset and the inode number of the file of a file mapping
+// and whether the mapping is shared
+func (vmi *Vminfo_t) Fileinfo() (int, defs.Inum_t, bool) {
+	switch vmi.Mtype {
+	case VFILE:
+		return vmi.file.foff, vmi.file.mfile.mfops.Pathi(), vmi.file.shared
+	case VSANON:
+		return 0, 0, true
+	}
+	return 0, 0, false
+}
+
 func (vmi *Vminfo_t) Ptefor(pmap *mem.Pmap_t, va uintptr) (*mem.Pa_t, bool) {
 	if vmi.pch == nil {
 		bva := int(vmi.Pgn) << PGSHIFT
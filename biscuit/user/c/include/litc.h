@@ -20,6 +20,7 @@ extern "C" {
 #define		ESRCH		3
 #define		EINTR		4
 #define		EIO		5
+#define		ENXIO		6
 #define		E2BIG		7
 #define		EBADF		9
 #define		ECHILD		10
@@ -37,8 +38,11 @@ extern "C" {
 #define		EINVAL		22
 #define		ENFILE		23
 #define		EMFILE		24
+#define		EFBIG		27
 #define		ENOSPC		28
 #define		ESPIPE		29
+#define		EROFS		30
+#define		EMLINK		31
 #define		EPIPE		32
 #define		ERANGE		34
 #define		ENAMETOOLONG	36
@@ -51,6 +55,7 @@ extern "C" {
 #define		ENETDOWN	50
 #define		ENETUNREACH	51
 #define		ECONNABORTED	53
+#define		ENODATA		61
 #define		ELOOP		62
 #define		EHOSTDOWN	64
 #define		EHOSTUNREACH	65
@@ -296,6 +301,10 @@ void _exit(int)
 int execv(const char *, char * const[]);
 int execve(const char *, char * const[], char * const[]);
 int execvp(const char *, char * const[]);
+int fallocate(int, int, off_t, off_t);
+#define		FALLOC_FL_KEEP_SIZE	0x1
+#define		FALLOC_FL_PUNCH_HOLE	0x2
+#define		FALLOC_FL_ZERO_RANGE	0x10
 pid_t fork(void);
 int fstat(int, struct stat *);
 int ftruncate(int, off_t);
@@ -305,6 +314,7 @@ int futex(const int, void *, void *, int, const struct timespec *);
 #define		FUTEX_CNDGIVE	3
 
 char *getcwd(char *, size_t);
+ssize_t getdents64(int, void *, size_t);
 pid_t getpid(void);
 pid_t getppid(void);
 
@@ -320,6 +330,7 @@ int getsockopt(int, int, int, void *, socklen_t *);
 #define		SHUT_RD		(1 << 1)
 int shutdown(int, int);
 int gettimeofday(struct timeval *, struct timezone *);
+ssize_t getxattr(const char *, const char *, void *, size_t);
 long gettid(void);
 
 int fcntl(int, int, ...);
@@ -330,20 +341,62 @@ int fcntl(int, int, ...);
 #define		F_SETLK		5
 #define		F_SETLKW	6
 #define		F_SETOWN	7
+#define		F_GETLK		8
 
 #define		FD_CLOEXEC	0x4
 
+int flock(int, int);
+#define		LOCK_SH		1
+#define		LOCK_EX		2
+#define		LOCK_NB		4
+#define		LOCK_UN		8
+
+struct inotify_event {
+	int		wd;
+	uint32_t	mask;
+	uint32_t	cookie;
+	uint32_t	len;
+	char		name[];
+};
+int inotify_add_watch(int, const char *, uint32_t);
+int inotify_init(void);
+int inotify_init1(int);
+int inotify_rm_watch(int, int);
+#define		IN_NONBLOCK	O_NONBLOCK
+#define		IN_CLOEXEC	O_CLOEXEC
+#define		IN_MODIFY	0x2
+#define		IN_ATTRIB	0x4
+#define		IN_MOVED_FROM	0x40
+#define		IN_MOVED_TO	0x80
+#define		IN_MOVE		(IN_MOVED_FROM | IN_MOVED_TO)
+#define		IN_CREATE	0x100
+#define		IN_DELETE	0x200
+#define		IN_DELETE_SELF	0x400
+#define		IN_MOVE_SELF	0x800
+#define		IN_ALL_EVENTS	0xfc6
+#define		IN_Q_OVERFLOW	0x4000
+#define		IN_IGNORED	0x8000
+#define		IN_ONLYDIR	0x1000000
+#define		IN_MASK_ADD	0x20000000
+#define		IN_ISDIR	0x40000000
+
 int kill(int, int);
 int link(const char *, const char *);
 int listen(int, int);
+ssize_t listxattr(const char *, char *, size_t);
 off_t lseek(int, off_t, int);
 #define		SEEK_SET	1
 #define		SEEK_CUR	2
 #define		SEEK_END	4
+#define		SEEK_DATA	8
+#define		SEEK_HOLE	16
 
 int mkdir(const char *, long);
 int mknod(const char *, mode_t, dev_t);
 void *mmap(void *, size_t, int, int, int, long);
+int mount(const char *, const char *, const char *, unsigned long,
+    const void *);
+#define		MS_BIND		0x1000
 int munmap(void *, size_t);
 int nanosleep(const struct timespec *, struct timespec *);
 int open(const char *, int, ...);
@@ -355,7 +408,9 @@ int open(const char *, int, ...);
 #define		O_TRUNC		0x200
 #define		O_APPEND	0x400
 #define		O_NONBLOCK	0x800
+#define		O_DIRECT	0x4000
 #define		O_DIRECTORY	0x10000
+#define		O_NOFOLLOW	0x20000
 #define		O_CLOEXEC	0x80000
 
 int pause(void);
@@ -365,6 +420,7 @@ int poll(struct pollfd *, nfds_t, int);
 ssize_t pread(int, void *, size_t, off_t);
 ssize_t pwrite(int, const void *, size_t, off_t);
 ssize_t read(int, void*, size_t);
+ssize_t readlink(const char *, char *, size_t);
 ssize_t readv(int, const struct iovec *, int);
 int reboot(void);
 ssize_t recv(int, void *, size_t, int);
@@ -403,7 +459,10 @@ struct cmsghdr {
 #define		CMSG_SPACE(x)		CMSG_LEN(x)
 
 ssize_t recvmsg(int, struct msghdr *, int);
+int reflink(const char *, const char *);
+int removexattr(const char *, const char *);
 int rename(const char *, const char *);
+int resizefs(const char *, long);
 int rmdir(const char *);
 int select(int, fd_set*, fd_set*, fd_set*, struct timeval *);
 ssize_t send(int, const void *, size_t, int);
@@ -470,6 +529,7 @@ int socket(int, int, int);
 #define		SOCK_NONBLOCK	(1 << 5)
 
 int stat(const char *, struct stat *);
+int symlink(const char *, const char *);
 int sync(void);
 long sys_prof(long, long, long, long);
 #define		PROF_DISABLE   (1ul << 0)
@@ -514,7 +574,14 @@ long sys_info(long);
 #define		SINFO_PROCLIST				11l
 
 int truncate(const char *, off_t);
+int umount(const char *);
+int umount2(const char *, int);
 int unlink(const char *);
+int utimensat(int, const char *, const struct timespec[2], int);
+#define		AT_FDCWD		(-100)
+#define		AT_SYMLINK_NOFOLLOW	0x100
+#define		UTIME_NOW		((1l << 30) - 1)
+#define		UTIME_OMIT		((1l << 30) - 2)
 pid_t wait(int *);
 pid_t waitpid(pid_t, int *, int);
 pid_t wait3(int *, int, struct rusage *);
@@ -670,16 +737,27 @@ int posix_spawn_file_actions_init(posix_spawn_file_actions_t *);
 #define		atof(s)		strtod(s, NULL)
 
 #define		_POSIX_NAME_MAX	14
+#define		NAME_MAX	255
 struct dirent {
 	ino_t d_ino;
-	char d_name[_POSIX_NAME_MAX];
+	off_t d_off;
+	unsigned short d_reclen;
+	unsigned char d_type;
+	char d_name[NAME_MAX + 1];
 };
 
+#define		DT_UNKNOWN	0
+#define		DT_CHR		2
+#define		DT_DIR		4
+#define		DT_REG		8
+#define		DT_LNK		10
+#define		DT_SOCK		12
+
 typedef struct {
 	int fd;
-	uint cent;
-	uint nent;
-	struct dirent dents[];
+	uint bpos;
+	uint blen;
+	char buf[4096];
 } DIR;
 
 extern __thread int errno;
@@ -756,6 +834,7 @@ FILE *fdopen(int, const char *);
 FILE *fopen(const char *, const char *);
 int fprintf(FILE *, const char *, ...)
     __attribute__((format(printf, 2, 3)));
+int fdatasync(int);
 int fsync(int);
 //int fputs(const char *, FILE *); /*REDIS*/
 size_t fread(void *, size_t, size_t, FILE *);
@@ -959,6 +1038,7 @@ struct flock {
 	short	l_type;
 #define		F_WRLCK		1
 #define		F_UNLCK		2
+#define		F_RDLCK		3
 	short	l_whence;
 	off_t	l_start;
 	off_t	l_len;
@@ -978,10 +1058,19 @@ int sigsuspend(const sigset_t *);
 int setpriority(int, int, int);
 #define		PRIO_PROCESS	1
 
+int setxattr(const char *, const char *, const void *, size_t, int);
+#define		XATTR_CREATE	0x1
+#define		XATTR_REPLACE	0x2
+
+gid_t getegid(void);
+gid_t getgid(void);
+int getgroups(int, gid_t *);
 uid_t getuid(void);
-int setuid(uid_t);
 int setgid(gid_t);
+int setgroups(int, const gid_t *);
+int setuid(uid_t);
 int initgroups(const char *, gid_t);
+#define		NGROUPS_MAX	32
 
 #define		MSG_PEEK	1
 
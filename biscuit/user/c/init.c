@@ -28,25 +28,6 @@ int main(int argc, char **argv)
 {
 	printf("init starting...\n");
 
-	// create dev nodes
-	mkdir("/dev", 0);
-	int ret;
-	ret = mknod("/dev/console", 0, MKDEV(1, 0));
-	if (ret != 0 && errno != EEXIST)
-		err(-1, "mknod");
-	ret = mknod("/dev/null", 0, MKDEV(4, 0));
-	if (ret != 0 && errno != EEXIST)
-		err(-1, "mknod");
-	ret = mknod("/dev/rsd0c", 0, MKDEV(5, 0));
-	if (ret != 0 && errno != EEXIST)
-		err(-1, "mknod");
-	ret = mknod("/dev/stats", 0, MKDEV(6, 0));
-	if (ret != 0 && errno != EEXIST)
-		err(-1, "mknod");
-	ret = mknod("/dev/prof", 0, MKDEV(7, 0));
-	if (ret != 0 && errno != EEXIST)
-		err(-1, "mknod");
-
 	char * const largs [] = {"/bin/bmgc", "-l", "512", NULL};
 	fexec(largs);
 	char * const hargs [] = {"/bin/bmgc", "-h", "470", NULL};
@@ -38,6 +38,9 @@
 #define SYS_WAIT4        61
 #define SYS_KILL         62
 #define SYS_FCNTL        72
+#define SYS_FLOCK        73
+#define SYS_FSYNC        74
+#define SYS_FDATASYNC    75
 #define SYS_TRUNC        76
 #define SYS_FTRUNC       77
 #define SYS_GETCWD       79
@@ -46,15 +49,39 @@
 #define SYS_MKDIR        83
 #define SYS_LINK         86
 #define SYS_UNLINK       87
+#define SYS_SYMLINK      88
+#define SYS_READLINK     89
+#define SYS_CHMOD        90
+#define SYS_CHOWN        92
 #define SYS_GETTOD       96
 #define SYS_GETRLIMIT    97
 #define SYS_GETRUSAGE    98
+#define SYS_GETUID       102
+#define SYS_GETGID       104
+#define SYS_SETUID       105
+#define SYS_SETGID       106
+#define SYS_GETEUID      107
+#define SYS_GETEGID      108
+#define SYS_GETGROUPS    115
+#define SYS_SETGROUPS    116
 #define SYS_MKNOD        133
 #define SYS_SETRLIMIT    160
 #define SYS_SYNC         162
+#define SYS_MOUNT        165
+#define SYS_UMOUNT2      166
 #define SYS_REBOOT       169
+#define SYS_SETXATTR     188
+#define SYS_GETXATTR     191
+#define SYS_LISTXATTR    194
+#define SYS_REMOVEXATTR  197
+#define SYS_GETDENTS64   217
+#define SYS_INOTIFY_ADD_WATCH 254
+#define SYS_INOTIFY_RM_WATCH  255
 #define SYS_NANOSLEEP    230
+#define SYS_UTIMENSAT    280
+#define SYS_FALLOCATE    285
 #define SYS_PIPE2        293
+#define SYS_INOTIFY_INIT1 294
 #define SYS_PROF         31337
 #define SYS_THREXIT      31338
 #define SYS_INFO         31339
@@ -62,6 +89,8 @@
 #define SYS_PWRITE       31341
 #define SYS_FUTEX        31342
 #define SYS_GETTID       31343
+#define SYS_REFLINK      31344
+#define SYS_RESIZEFS     31345
 
 __thread int errno;
 
@@ -185,8 +214,17 @@ connect(int fd, const struct sockaddr *sa, socklen_t salen)
 int
 chmod(const char *path, mode_t mode)
 {
-	printf("warning: chmod is a no-op\n");
-	return 0;
+	int ret = syscall(SA(path), SA(mode), 0, 0, 0, SYS_CHMOD);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
+int
+chown(const char *path, uid_t uid, gid_t gid)
+{
+	int ret = syscall(SA(path), SA(uid), SA(gid), 0, 0, SYS_CHOWN);
+	ERRNO_NZ(ret);
+	return ret;
 }
 
 int
@@ -255,6 +293,15 @@ execvp(const char *path, char * const argv[])
 	return execv(p, argv);
 }
 
+int
+fallocate(int fd, int mode, off_t offset, off_t len)
+{
+	int ret = syscall(SA(fd), SA(mode), SA(offset), SA(len), 0,
+	    SYS_FALLOCATE);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
 int
 fcntl(int fd, int cmd, ...)
 {
@@ -275,6 +322,15 @@ fcntl(int fd, int cmd, ...)
 		ERRNO_NEG(ret);
 		break;
 	}
+	case F_GETLK:
+	case F_SETLK:
+	case F_SETLKW:
+	{
+		struct flock *fl = va_arg(ap, struct flock *);
+		ret = syscall(a1, a2, SA(fl), 0, 0, SYS_FCNTL);
+		ERRNO_NZ(ret);
+		break;
+	}
 	case F_SETOWN:
 	{
 		fprintf(stderr, "warning: F_SETOWN is no-op\n");
@@ -288,6 +344,14 @@ fcntl(int fd, int cmd, ...)
 	return ret;
 }
 
+int
+flock(int fd, int op)
+{
+	int ret = syscall(SA(fd), SA(op), 0, 0, 0, SYS_FLOCK);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
 pid_t
 fork(void)
 {
@@ -315,6 +379,40 @@ getcwd(char *buf, size_t sz)
 	return buf;
 }
 
+ssize_t
+getdents64(int fd, void *buf, size_t len)
+{
+	ssize_t ret = syscall(SA(fd), SA(buf), SA(len), 0, 0, SYS_GETDENTS64);
+	ERRNO_NEG(ret);
+	return ret;
+}
+
+gid_t
+getegid(void)
+{
+	return syscall(0, 0, 0, 0, 0, SYS_GETEGID);
+}
+
+uid_t
+geteuid(void)
+{
+	return syscall(0, 0, 0, 0, 0, SYS_GETEUID);
+}
+
+gid_t
+getgid(void)
+{
+	return syscall(0, 0, 0, 0, 0, SYS_GETGID);
+}
+
+int
+getgroups(int n, gid_t *list)
+{
+	int ret = syscall(SA(n), SA(list), 0, 0, 0, SYS_GETGROUPS);
+	ERRNO_NEG(ret);
+	return ret;
+}
+
 pid_t
 getpid(void)
 {
@@ -386,6 +484,52 @@ getrusage(int who, struct rusage *r)
 	return ret;
 }
 
+uid_t
+getuid(void)
+{
+	return syscall(0, 0, 0, 0, 0, SYS_GETUID);
+}
+
+ssize_t
+getxattr(const char *path, const char *name, void *value, size_t sz)
+{
+	ssize_t ret = syscall(SA(path), SA(name), SA(value), SA(sz), 0,
+	    SYS_GETXATTR);
+	ERRNO_NEG(ret);
+	return ret;
+}
+
+int
+inotify_add_watch(int fd, const char *path, uint32_t mask)
+{
+	int ret = syscall(SA(fd), SA(path), SA(mask), 0, 0,
+	    SYS_INOTIFY_ADD_WATCH);
+	ERRNO_NEG(ret);
+	return ret;
+}
+
+int
+inotify_init(void)
+{
+	return inotify_init1(0);
+}
+
+int
+inotify_init1(int flags)
+{
+	int ret = syscall(SA(flags), 0, 0, 0, 0, SYS_INOTIFY_INIT1);
+	ERRNO_NEG(ret);
+	return ret;
+}
+
+int
+inotify_rm_watch(int fd, int wd)
+{
+	int ret = syscall(SA(fd), SA(wd), 0, 0, 0, SYS_INOTIFY_RM_WATCH);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
 int
 kill(int pid, int sig)
 {
@@ -414,6 +558,14 @@ listen(int fd, int backlog)
 	return ret;
 }
 
+ssize_t
+listxattr(const char *path, char *list, size_t sz)
+{
+	ssize_t ret = syscall(SA(path), SA(list), SA(sz), 0, 0, SYS_LISTXATTR);
+	ERRNO_NEG(ret);
+	return ret;
+}
+
 off_t
 lseek(int fd, off_t off, int whence)
 {
@@ -455,6 +607,16 @@ mmap(void *addr, size_t len, int prot, int flags, int fd, long offset)
 	return (void *)ret;
 }
 
+int
+mount(const char *source, const char *target, const char *fstype,
+    unsigned long flags, const void *data)
+{
+	int ret = syscall(SA(source), SA(target), SA(fstype), SA(flags),
+	    SA(data), SYS_MOUNT);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
 int
 munmap(void *addr, size_t len)
 {
@@ -546,6 +708,14 @@ read(int fd, void *buf, size_t c)
 	return ret;
 }
 
+ssize_t
+readlink(const char *path, char *buf, size_t sz)
+{
+	ssize_t ret = syscall(SA(path), SA(buf), SA(sz), 0, 0, SYS_READLINK);
+	ERRNO_NEG(ret);
+	return ret;
+}
+
 int
 reboot(void)
 {
@@ -583,6 +753,22 @@ recvmsg(int fd, struct msghdr *msg, int flags)
 	return ret;
 }
 
+int
+reflink(const char *src, const char *dst)
+{
+	int ret = syscall(SA(src), SA(dst), 0, 0, 0, SYS_REFLINK);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
+int
+removexattr(const char *path, const char *name)
+{
+	int ret = syscall(SA(path), SA(name), 0, 0, 0, SYS_REMOVEXATTR);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
 int
 rename(const char *old, const char *new)
 {
@@ -591,6 +777,14 @@ rename(const char *old, const char *new)
 	return ret;
 }
 
+int
+resizefs(const char *path, long nblocks)
+{
+	int ret = syscall(SA(path), SA(nblocks), 0, 0, 0, SYS_RESIZEFS);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
 ssize_t
 send(int fd, const void *buf, size_t len, int flags)
 {
@@ -618,6 +812,22 @@ sendmsg(int fd, struct msghdr *msg, int flags)
 	return ret;
 }
 
+int
+setgid(gid_t gid)
+{
+	int ret = syscall(SA(gid), 0, 0, 0, 0, SYS_SETGID);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
+int
+setgroups(int n, const gid_t *list)
+{
+	int ret = syscall(SA(n), SA(list), 0, 0, 0, SYS_SETGROUPS);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
 int
 setrlimit(int res, const struct rlimit *rlp)
 {
@@ -626,6 +836,24 @@ setrlimit(int res, const struct rlimit *rlp)
 	return ret;
 }
 
+int
+setuid(uid_t uid)
+{
+	int ret = syscall(SA(uid), 0, 0, 0, 0, SYS_SETUID);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
+int
+setxattr(const char *path, const char *name, const void *value, size_t sz,
+    int flags)
+{
+	int ret = syscall(SA(path), SA(name), SA(value), SA(sz), SA(flags),
+	    SYS_SETXATTR);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
 pid_t
 setsid(void)
 {
@@ -729,6 +957,14 @@ sync(void)
 	return ret;
 }
 
+int
+symlink(const char *target, const char *path)
+{
+	int ret = syscall(SA(target), SA(path), 0, 0, 0, SYS_SYMLINK);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
 long
 sys_prof(long ptype, long events, long flags, long intperiod)
 {
@@ -753,6 +989,20 @@ truncate(const char *p, off_t newlen)
 	return ret;
 }
 
+int
+umount(const char *target)
+{
+	return umount2(target, 0);
+}
+
+int
+umount2(const char *target, int flags)
+{
+	int ret = syscall(SA(target), SA(flags), 0, 0, 0, SYS_UMOUNT2);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
 static int
 _unlink(const char *path, int wantdir)
 {
@@ -773,6 +1023,16 @@ rmdir(const char *path)
 	return _unlink(path, 1);
 }
 
+int
+utimensat(int dirfd, const char *path, const struct timespec times[2],
+    int flags)
+{
+	int ret = syscall(SA(dirfd), SA(path), SA(times), SA(flags), 0,
+	    SYS_UTIMENSAT);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
 pid_t
 wait(int *status)
 {
@@ -1870,11 +2130,20 @@ futex(const int op, void *fut, void *fut2, int aux, const struct timespec *ts)
 	return ret;
 }
 
+int
+fdatasync(int fd)
+{
+	int ret = syscall(SA(fd), 0, 0, 0, 0, SYS_FDATASYNC);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
 int
 fsync(int fd)
 {
-	sync();
-	return 0;
+	int ret = syscall(SA(fd), 0, 0, 0, 0, SYS_FSYNC);
+	ERRNO_NZ(ret);
+	return ret;
 }
 
 static void
@@ -2158,8 +2427,6 @@ inval:
 DIR *
 fdopendir(int fd)
 {
-        #define BSIZE 4096
-  
 	struct stat st;
 	if (fstat(fd, &st) == -1)
 		return NULL;
@@ -2167,59 +2434,14 @@ fdopendir(int fd)
 		errno = ENOTDIR;
 		return NULL;
 	}
-	// allocate enough space for all dirents; count them.
 	if (lseek(fd, 0, SEEK_SET) == -1)
 		return NULL;
-	// on disk format of directory entries
-	struct  __attribute__((packed)) _dirent_t {
-		char	name[_POSIX_NAME_MAX];
-		ulong	inum;
-	};
-	const int nde = BSIZE/sizeof(struct _dirent_t);
-	size_t c = 0;
-	char buf[BSIZE];
-	ssize_t r;
-	while ((r = read(fd, buf, sizeof(buf))) > 0) {
-		int i;
-		for (i = 0; i < nde; i++) {
-			struct _dirent_t *de = (struct _dirent_t *)buf + i;
-			if (de->name[0] != '\0')
-				c++;
-		}
-	}
-	if (r == -1)
-		return NULL;
-	if (c > (ULONG_MAX - sizeof(DIR))/sizeof(struct dirent))
-		errx(-1, "very fat dir");
-	DIR *ret = malloc(sizeof(DIR) + c*sizeof(struct dirent));
+	DIR *ret = malloc(sizeof(DIR));
 	if (!ret)
 		return NULL;
-
-	// copy dirents into ret
 	ret->fd = fd;
-	ret->nent = (int)c;
-	ret->cent = 0;
-	if (lseek(fd, 0, SEEK_SET) == -1)
-		goto out;
-	struct dirent *p = &ret->dents[0];
-	while ((r = read(fd, buf, sizeof(buf))) > 0) {
-		int i;
-		for (i = 0; i < nde; i++) {
-			struct _dirent_t *de = (struct _dirent_t *)buf + i;
-			if (de->name[0] != '\0') {
-				p->d_ino = de->inum;
-				strncpy(p->d_name, de->name,
-				    sizeof(p->d_name));
-				p++;
-			}
-		}
-	}
-	if (r == -1)
-		goto out;
+	ret->bpos = ret->blen = 0;
 	return ret;
-out:
-	free(ret);
-	return NULL;
 }
 
 DIR *
@@ -2244,7 +2466,8 @@ readdir(DIR *d)
 {
 	static struct dirent _ret;
 	struct dirent *ret;
-	readdir_r(d, &_ret, &ret);
+	if (readdir_r(d, &_ret, &ret))
+		return NULL;
 	return ret;
 }
 
@@ -2252,12 +2475,33 @@ readdir(DIR *d)
 int
 readdir_r(DIR *d, struct dirent *entry, struct dirent **ret)
 {
-	if (d->cent == d->nent) {
-		*ret = NULL;
-		return 0;
-	}
-	struct dirent *src = &d->dents[d->cent++];
-	*entry = *src;
+	// the kernel's record format
+	struct _dirent64_t {
+		ulong	d_ino;
+		long	d_off;
+		ushort	d_reclen;
+		uchar	d_type;
+		char	d_name[];
+	};
+	if (d->bpos == d->blen) {
+		ssize_t r = getdents64(d->fd, d->buf, sizeof(d->buf));
+		if (r == -1)
+			return errno;
+		if (r == 0) {
+			*ret = NULL;
+			return 0;
+		}
+		d->bpos = 0;
+		d->blen = r;
+	}
+	struct _dirent64_t *src = (struct _dirent64_t *)&d->buf[d->bpos];
+	d->bpos += src->d_reclen;
+	entry->d_ino = src->d_ino;
+	entry->d_off = src->d_off;
+	entry->d_reclen = sizeof(*entry);
+	entry->d_type = src->d_type;
+	strncpy(entry->d_name, src->d_name, sizeof(entry->d_name));
+	entry->d_name[sizeof(entry->d_name) - 1] = '\0';
 	*ret = entry;
 	return 0;
 }
@@ -2265,7 +2509,8 @@ readdir_r(DIR *d, struct dirent *entry, struct dirent **ret)
 void
 rewinddir(DIR *d)
 {
-	d->cent = 0;
+	lseek(d->fd, 0, SEEK_SET);
+	d->bpos = d->blen = 0;
 }
 
 struct {
@@ -3008,6 +3253,7 @@ static const char * const _errstr[] = {
 	[ESRCH] = "No such process",
 	[EINTR] = "Interrupted system call",
 	[EIO] = "Input/output error",
+	[ENXIO] = "No such device or address",
 	[E2BIG] = "Argument list too long",
 	[EBADF] = "Bad file descriptor",
 	[EAGAIN] = "Resource temporarily unavailable",
@@ -3024,8 +3270,11 @@ static const char * const _errstr[] = {
 	[EINVAL] = "Invalid argument",
 	[ENFILE] = "Too many open files in system",
 	[EMFILE] = "Too many open files",
+	[EFBIG] = "File too large",
 	[ENOSPC] = "No space left on device",
 	[ESPIPE] = "Illegal seek",
+	[EROFS] = "Read-only file system",
+	[EMLINK] = "Too many links",
 	[EPIPE] = "Broken pipe",
 	[ERANGE] = "Result too large",
 	[ENAMETOOLONG] = "File name too long",
@@ -3038,6 +3287,7 @@ static const char * const _errstr[] = {
 	[ENETDOWN] = "Network is down",
 	[ENETUNREACH] = "Network is unreachable",
 	[ECONNABORTED] = "Software caused connection abort",
+	[ENODATA] = "Attribute not found",
 	[ELOOP] = "Too many levels of symbolic links",
 	[EHOSTDOWN] = "Host is down",
 	[EHOSTUNREACH] = "No route to host",
@@ -3552,12 +3802,6 @@ getenv(char *name)
 	HACK(NULL);
 }
 
-uid_t
-geteuid(void)
-{
-	HACK(666);
-}
-
 struct passwd *
 getpwnam(const char *a)
 {
@@ -3585,15 +3829,6 @@ gethostbyname(const char *a)
 	FAIL;
 }
 
-int
-chown(const char *a, uid_t b, gid_t c)
-{
-	if (b != 666 || c != -1)
-		errx(-1, "unexpected chown");
-	errno = 0;
-	HACK(0);
-}
-
 time_t
 mktime(struct tm *a)
 {
@@ -3646,9 +3881,17 @@ gmtime(const time_t *a)
 }
 
 int
-utimes(const char *a, const struct timeval b[2])
+utimes(const char *path, const struct timeval tv[2])
 {
-	FAIL;
+	if (tv == NULL)
+		return utimensat(AT_FDCWD, path, NULL, 0);
+	struct timespec ts[2];
+	int i;
+	for (i = 0; i < 2; i++) {
+		ts[i].tv_sec = tv[i].tv_sec;
+		ts[i].tv_nsec = tv[i].tv_usec * 1000;
+	}
+	return utimensat(AT_FDCWD, path, ts, 0);
 }
 
 int
@@ -3714,28 +3957,11 @@ setpriority(int a, int b, int c)
 	FAIL;
 }
 
-uid_t
-getuid(void)
-{
-	FAIL;
-}
-
-int
-setuid(uid_t a)
-{
-	FAIL;
-}
-
-int
-setgid(gid_t a)
-{
-	FAIL;
-}
-
 int
 initgroups(const char *a, gid_t b)
 {
-	FAIL;
+	// there is no group database; b is the only supplementary group
+	return setgroups(1, &b);
 }
 
 char *
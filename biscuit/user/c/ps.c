@@ -0,0 +1,59 @@
+#include <litc.h>
+
+// copies the value of the "key:" line of a /proc/<pid>/status file to dst
+static void field(char *status, char *key, char *dst, size_t sz)
+{
+	snprintf(dst, sz, "?");
+	size_t kl = strlen(key);
+	char *p = status;
+	while (p && *p) {
+		if (strncmp(p, key, kl) == 0 && p[kl] == ':') {
+			p += kl + 1;
+			while (*p == '\t' || *p == ' ')
+				p++;
+			char *end = strchr(p, '\n');
+			size_t l = end ? end - p : strlen(p);
+			if (l >= sz)
+				l = sz - 1;
+			memcpy(dst, p, l);
+			dst[l] = '\0';
+			return;
+		}
+		p = strchr(p, '\n');
+		if (p)
+			p++;
+	}
+}
+
+int main(int argc, char **argv)
+{
+	DIR *dir = opendir("/proc");
+	if (!dir)
+		err(-1, "opendir");
+	printf("%6s %6s %4s %s\n", "PID", "PPID", "THR", "NAME");
+	struct dirent *de;
+	while ((de = readdir(dir)) != NULL) {
+		if (de->d_name[0] < '0' || de->d_name[0] > '9')
+			continue;
+		char fn[64];
+		snprintf(fn, sizeof(fn), "/proc/%s/status", de->d_name);
+		int fd = open(fn, O_RDONLY);
+		// the process may have exited
+		if (fd == -1)
+			continue;
+		char status[512];
+		ssize_t r = read(fd, status, sizeof(status) - 1);
+		close(fd);
+		if (r < 0)
+			continue;
+		status[r] = '\0';
+		char ppid[16], thr[16], name[64];
+		field(status, "PPid", ppid, sizeof(ppid));
+		field(status, "Threads", thr, sizeof(thr));
+		field(status, "Name", name, sizeof(name));
+		printf("%6s %6s %4s %s\n", de->d_name, ppid, thr, name);
+	}
+	if (closedir(dir) == -1)
+		err(-1, "closedir");
+	return 0;
+}
@@ -22,7 +22,12 @@ void dirrm(char *dir)
 		if (strncmp(de->d_name, ".", 2) == 0 ||
 		    strncmp(de->d_name, "..", 3) == 0)
 			continue;
-		rm(de->d_name);
+		// unlink entries without following them; the directory's
+		// cursor remains valid while entries are removed.
+		if (de->d_type == DT_DIR)
+			dirrm(de->d_name);
+		else if (unlink(de->d_name) == -1)
+			err(-1, "unlink");
 	}
 	if (chdir("..") == -1)
 		err(-1, "chdir");
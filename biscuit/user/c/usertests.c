@@ -2750,7 +2750,6 @@ void trunctest(void)
 
 void accesstest(void)
 {
-	// XXX write better test once we actually have permissions
 	printf("access test\n");
 
 	if (access("/", R_OK | X_OK | W_OK))
@@ -2767,13 +2766,48 @@ void accesstest(void)
 
 	char *f = "/tmp/accfile";
 	int fd;
-	if ((fd = open(f, O_CREAT | O_WRONLY)) < 0)
+	if ((fd = (open)(f, O_CREAT | O_WRONLY, 0755)) < 0)
 		err(-1, "creat");
 	close(fd);
 
 	if (access(f, R_OK | X_OK | W_OK))
 	       err(-1, "access");
 
+	// even the superuser cannot execute a file without execute bits
+	if (chmod(f, 0644))
+		err(-1, "chmod");
+	if (access(f, X_OK) == 0)
+		errx(-1, "access X_OK for non-executable");
+
+	pid_t c = fork();
+	if (c < 0)
+		err(-1, "fork");
+	if (!c) {
+		if (setuid(1000))
+			err(-1, "setuid");
+		if (getuid() != 1000 || geteuid() != 1000)
+			errx(-1, "uid not set");
+		if (access(f, R_OK))
+			err(-1, "access R_OK");
+		if (access(f, W_OK) == 0 || errno != EACCES)
+			errx(-1, "access W_OK by non-owner");
+		if (open(f, O_WRONLY) >= 0 || errno != EACCES)
+			errx(-1, "open for write by non-owner");
+		// EPERM if /tmp is sticky
+		if (unlink(f) == 0 || (errno != EACCES && errno != EPERM))
+			errx(-1, "unlink by non-owner");
+		if (setuid(0) == 0)
+			errx(-1, "setuid back to root");
+		exit(0);
+	}
+	int status;
+	if (wait(&status) != c)
+		err(-1, "wait");
+	if (status)
+		errx(-1, "child failed");
+	if (unlink(f))
+		err(-1, "unlink");
+
 	printf("access test OK\n");
 }
 